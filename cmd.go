@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/basic/models"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"github.com/golang-migrate/migrate/v4"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"dm-gitlab.bolo.me/hubpd/basic/logger"
+	topic_grpc_pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
+	"dm-gitlab.bolo.me/hubpd/topic/cron"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"dm-gitlab.bolo.me/hubpd/topic/service"
+)
+
+const (
+	cmdServe         = "serve"
+	cmdMigrate       = "migrate"
+	cmdAutoMigrate   = "automigrate"
+	cmdRebuildIndex  = "rebuild-index"
+	cmdRefreshStatus = "refresh-status"
+	cmdReindex       = "reindex"
+	cmdCacheEvict    = "cache-evict"
+	cmdBackfillUTC   = "backfill-utc"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		cmdServe:         {"启动grpc服务（默认）", serve},
+		cmdMigrate:       {"执行migration/sql：migrate up|down|status，up同时转换存量时间，down回滚最近一次migration，见README", migrateCmd},
+		cmdAutoMigrate:   {"按model.Tables自动建表", autoMigrateCmd},
+		cmdRebuildIndex:  {"重建缓存穿透过滤器（bitmap）", rebuildIndexCmd},
+		cmdRefreshStatus: {"全量修正话题状态并登记状态切换", refreshStatusCmd},
+		cmdReindex:       {"按范围发布话题事件，重建es索引：reindex [-ids] [-created-from] [-created-to] [-updated-from] [-updated-to] [-status]", reindexCmd},
+		cmdCacheEvict:    {"删除话题缓存：cache-evict [-ids 1,2,3]", cacheEvictCmd},
+		cmdBackfillUTC:   {"存量时间由旧版本偏移转换为UTC，全部副本升级后执行，可重复执行", backfillUTCCmd},
+	}
+}
+
+// splitCommand 子命令前为配置参数（-key=value或-key value，bool参数可省略值），由config包解析；无子命令时为serve
+func splitCommand(args []string) (string, []string) {
+	boolFlags := configBoolFlags()
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			if i+1 < len(args) {
+				return args[i+1], args[i+2:]
+			}
+			return cmdServe, nil
+		}
+		if !strings.HasPrefix(arg, "-") {
+			return arg, args[i+1:]
+		}
+		name := strings.TrimLeft(arg, "-")
+		if !strings.Contains(name, "=") && !boolFlags[name] {
+			// 跳过参数值
+			i++
+		}
+	}
+	return cmdServe, nil
+}
+
+// configBoolFlags config包生成的bool参数名：字段名小写，嵌套字段以-连接
+func configBoolFlags() map[string]bool {
+	flags := make(map[string]bool)
+	var walk func(t reflect.Type, prefix string)
+	walk = func(t reflect.Type, prefix string) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := prefix + strings.ToLower(field.Name)
+			switch field.Type.Kind() {
+			case reflect.Struct:
+				walk(field.Type, name+"-")
+			case reflect.Bool:
+				flags[name] = true
+			}
+		}
+	}
+	walk(reflect.TypeOf(config.Hubpd{}), "")
+	return flags
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "usage: %v [-config=value ...] <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, name := range []string{cmdServe, cmdMigrate, cmdAutoMigrate, cmdRebuildIndex, cmdRefreshStatus, cmdReindex, cmdCacheEvict, cmdBackfillUTC} {
+		fmt.Fprintf(os.Stderr, "  %-16v %v\n", name, commands[name].usage)
+	}
+}
+
+// legacyTimeMigration 新增utc列的最后一个migration
+const legacyTimeMigration = 26
+
+func migrateCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing migrate action: up|down|status")
+	}
+
+	if config.Cfg.IsMysql {
+		models.Tidb2mysqlSchema("migration/sql")
+	}
+	m, err := migrate.New("file://migration/sql", "mysql://"+config.Cfg.DBDsn)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	switch args[0] {
+	case "up":
+		// utc列在本次之前已存在时，旧版本副本均已退出，转换存量时间后才算完成；本次新增utc列时旧版本可能仍在写入，不转换
+		before, _, versionErr := m.Version()
+		if versionErr != nil && !errors.Is(versionErr, migrate.ErrNilVersion) {
+			return versionErr
+		}
+		if err = m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+			return err
+		}
+		if versionErr != nil {
+			// 新建的库没有存量数据
+			return nil
+		}
+		if before < legacyTimeMigration {
+			fmt.Printf("utc columns added, run migrate up again after all replicas are upgraded to convert legacy times\n")
+			return nil
+		}
+		return backfillUTCCmd(args[1:])
+	case "down":
+		// 每次只回滚最近一次migration，000019及之前的down为空，不支持回滚
+		version, dirty, err := m.Version()
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return fmt.Errorf("migration %v is dirty, fix it before rolling back", version)
+		}
+		downFiles, err := filepath.Glob(fmt.Sprintf("migration/sql/%06d_*.down.sql", version))
+		if err != nil {
+			return err
+		}
+		if len(downFiles) != 1 {
+			return fmt.Errorf("down migration of version %v not found", version)
+		}
+		if info, err := os.Stat(downFiles[0]); err != nil {
+			return err
+		} else if info.Size() == 0 {
+			return fmt.Errorf("migration %v has no down sql, rollback is not supported", version)
+		}
+		if err = m.Steps(-1); err != nil {
+			return err
+		}
+		after, _, err := m.Version()
+		if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+			return err
+		}
+		fmt.Printf("rolled back: %v, version: %v\n", filepath.Base(downFiles[0]), after)
+		return nil
+	case "status":
+		version, dirty, err := m.Version()
+		if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+			return err
+		}
+		fmt.Printf("version: %v, dirty: %v\n", version, dirty)
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate action: %v", args[0])
+	}
+}
+
+func autoMigrateCmd(args []string) error {
+	return model.GetInstance().AutoMigrate(model.Tables...)
+}
+
+// maintenanceFlags 运维命令公共参数
+func maintenanceFlags(name string) (*flag.FlagSet, *service.MaintenanceOptions) {
+	opts := &service.MaintenanceOptions{}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.IntVar(&opts.BatchSize, "batch-size", 0, "每批处理条数，0-使用配置BatchJobSize")
+	fs.IntVar(&opts.RatePerSec, "rate", 0, "每秒最多处理的话题数，0-使用配置")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "只统计不写入")
+	return fs, opts
+}
+
+// runMaintenance 初始化存储后持任务锁执行，避免多处同时执行同一命令
+// 运维命令只读写TiDB、redis，话题事件经发件箱由serve副本发布，不启动grpc服务、不连接kafka
+func runMaintenance(name string, f func(ctx context.Context) error) error {
+	if err := sentry.Init(sentry.ClientOptions{Dsn: config.Cfg.SentryDsn}); err != nil {
+		return err
+	}
+	defer sentry.Flush(2 * time.Second)
+
+	initStores()
+	logger.GetLogger().Infof("[main] run %v", name)
+
+	return cron.LockJob(context.Background(), name, f)
+}
+
+func rebuildIndexCmd(args []string) error {
+	fs, opts := maintenanceFlags(cmdRebuildIndex)
+	_ = fs.Parse(args)
+
+	return runMaintenance(cmdRebuildIndex, func(ctx context.Context) error {
+		return service.Instance.RebuildTopicBitMap(ctx, *opts)
+	})
+}
+
+func refreshStatusCmd(args []string) error {
+	fs, opts := maintenanceFlags(cmdRefreshStatus)
+	_ = fs.Parse(args)
+
+	return runMaintenance(cmdRefreshStatus, func(ctx context.Context) error {
+		return service.Instance.RefreshTopicStatus(ctx, *opts)
+	})
+}
+
+func reindexCmd(args []string) error {
+	fs, opts := maintenanceFlags(cmdReindex)
+	idsFlag := fs.String("ids", "", "逗号分隔的话题id")
+	createdFrom := fs.String("created-from", "", "创建时间下限（含），RFC3339或2006-01-02")
+	createdTo := fs.String("created-to", "", "创建时间上限（不含）")
+	updatedFrom := fs.String("updated-from", "", "更新时间下限（含）")
+	updatedTo := fs.String("updated-to", "", "更新时间上限（不含）")
+	statusFlag := fs.String("status", "", "逗号分隔的状态：1-进行中，2-未开始，3-已结束")
+	_ = fs.Parse(args)
+
+	reindexOpts := service.ReindexOptions{MaintenanceOptions: *opts}
+	var err error
+	if reindexOpts.Filter.Ids, err = parseIds(*idsFlag); err != nil {
+		return err
+	}
+	for flagValue, t := range map[*string]*time.Time{
+		createdFrom: &reindexOpts.Filter.CreatedFrom,
+		createdTo:   &reindexOpts.Filter.CreatedTo,
+		updatedFrom: &reindexOpts.Filter.UpdatedFrom,
+		updatedTo:   &reindexOpts.Filter.UpdatedTo,
+	} {
+		if *t, err = parseTime(*flagValue); err != nil {
+			return err
+		}
+	}
+	statuses, err := parseIds(*statusFlag)
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		reindexOpts.Filter.Statuses = append(reindexOpts.Filter.Statuses, topic_grpc_pb.TopicDetail_TopicStatus(status))
+	}
+
+	// 与ReindexTopics接口触发的任务共用任务锁
+	return runMaintenance(model.JobReindexTopics, func(ctx context.Context) error {
+		return service.Instance.ReindexTopics(ctx, reindexOpts)
+	})
+}
+
+func cacheEvictCmd(args []string) error {
+	fs, opts := maintenanceFlags(cmdCacheEvict)
+	idsFlag := fs.String("ids", "", "逗号分隔的话题id，为空时删除全部话题缓存")
+	_ = fs.Parse(args)
+
+	ids, err := parseIds(*idsFlag)
+	if err != nil {
+		return err
+	}
+
+	return runMaintenance(cmdCacheEvict, func(ctx context.Context) error {
+		return service.Instance.EvictTopicCache(ctx, ids, *opts)
+	})
+}
+
+func backfillUTCCmd(args []string) error {
+	fs, opts := maintenanceFlags(cmdBackfillUTC)
+	_ = fs.Parse(args)
+
+	return runMaintenance(cmdBackfillUTC, func(ctx context.Context) error {
+		return service.Instance.BackfillUTC(ctx, *opts)
+	})
+}
+
+// parseIds 解析逗号分隔的整数
+func parseIds(s string) ([]int64, error) {
+	ids := make([]int64, 0)
+	for _, v := range strings.Split(s, ",") {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id: %v", v)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseTime 空串为零值，日期按DefaultTimeZone解析
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	loc, err := time.LoadLocation(config.Cfg.DefaultTimeZone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, loc)
+	if err != nil {
+		return t, fmt.Errorf("invalid time: %v", s)
+	}
+	return t, nil
+}
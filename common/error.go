@@ -9,3 +9,8 @@ func (e *InternalError) Error() string {
 	return e.ErrMsg
 }
 
+// VersionConflictError 乐观锁冲突，Current为当前版本
+type VersionConflictError struct {
+	InternalError
+	Current int64
+}
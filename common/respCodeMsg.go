@@ -3,9 +3,13 @@ package common
 const (
 	Code_SvcOK            int32 = 200
 	Code_SvcInternalError       = 500
+	Code_SvcLocked              = 423
+	Code_SvcUnavailable         = 503
 )
 
 const (
 	Msg_SvcOK            string = "success"
 	Msg_SvcInternalError        = "server internal error"
+	Msg_SvcLocked               = "resource is being modified, please retry later"
+	Msg_SvcUnavailable          = "service unavailable, redis is down"
 )
@@ -2,13 +2,32 @@ package config
 
 import (
 	"github.com/koding/multiconfig"
+	"reflect"
 )
 
 type Hubpd struct {
 	GrpcServerAddress      string   `required:"true" default:"127.0.0.1:5000"`
+	GatewayAddress         string   // HTTP/JSON网关，为空时不启动
+	GatewayMethods         []string // 网关暴露的方法白名单
+	GatewayToken           string   // 网关Bearer token
 	SentryDsn              string   `required:"true" default:"https://6c4df933fae649f586f30cbab96dddd4@sentry-v.bolo.me/59"`
 	KafkaHosts             []string `required:"true" default:"127.0.0.1:9092"`
-	DBDsn                  string   `default:"root:pwd@tcp(127.0.0.1:3306)/topic_test?charset=utf8&parseTime=True&loc=Asia%2FShanghai&timeout=10s"`
+	EventsKafkaTopic       string   `default:"dm_topic_events"` // 话题领域事件
+	OutboxPollMs           int      `default:"200"`             // 发件箱relay轮询间隔
+	OutboxBatchSize        int      `default:"100"`
+	OutboxRelayLeaseSec    int      `default:"15"`   // 发件箱relay租约时长
+	OutboxRetentionHours   int      `default:"72"`   // 已发布事件保留时长
+	OutboxMaxRetryMin      int      `default:"60"`   // 首次发布失败后最多重试的时长，超过后转入死信
+	WebhookPollMs          int      `default:"1000"` // webhook投递轮询间隔
+	WebhookBatchSize       int      `default:"50"`
+	WebhookTimeoutSec      int      `default:"5"`    // 单次投递超时
+	WebhookMaxAttempts     int      `default:"8"`    // 投递失败次数达到该值后不再重试
+	WebhookRetryBaseSec    int      `default:"10"`   // 重试间隔，按失败次数指数增长
+	WebhookRetryMaxSec     int      `default:"3600"` // 重试间隔上限
+	WebhookWorkers         int      `default:"8"`    // 每个副本并发投递数
+	WebhookAllowedHosts    []string // 允许投递的域名，含其子域名；为空时不能创建订阅
+	WebhookSecretKey       string   // 加密保存签名密钥，hex编码的32字节AES密钥
+	DBDsn                  string   `default:"root:pwd@tcp(127.0.0.1:3306)/topic_test?charset=utf8&parseTime=True&loc=Asia%2FShanghai&timeout=10s"` // 会话时区由程序固定为UTC
 	DBMaxIdleConns         int      `default:"2"`
 	DBMaxOpenConns         int      `default:"4"`
 	Debug                  bool     `default:"true"`
@@ -16,11 +35,87 @@ type Hubpd struct {
 	ExecuteMigration       bool     `default:"false"`
 	GRPCClientAddressBI    string   `default:"127.0.0.1:8116"` // bi服务
 	EnableCron             bool     `default:"true"`
-	RedisDsn               []string `default:"0.0.0.0:7000,0.0.0.0:7001,0.0.0.0:7002"`
+	StatusQueuePollMs      int      `default:"500"` // 状态切换延时队列轮询间隔
+	StatusQueueBatchSize   int      `default:"100"`
+	CronLeaderLeaseSec     int      `default:"15"`                                     // 定时任务选主租约时长，leader宕机后最长该时间内完成切换
+	RedisMode              string   `default:"cluster"`                                // standalone、sentinel、cluster
+	RedisDsn               []string `default:"0.0.0.0:7000,0.0.0.0:7001,0.0.0.0:7002"` // 单机取第一个地址，哨兵模式为哨兵地址
 	RedisPassword          string   `default:""`
+	RedisMasterName        string   `default:""` // 哨兵模式master名
+	RedisSentinelPassword  string   `default:""`
+	RedisDB                int      `default:"0"` // 集群模式不支持
 	RedisPrefix            string   `default:"topicSvc"`
 	RedisLockExpirationSec int      `default:"120"`
+	RedisLockWaitMs        int      `default:"3000"`  // 锁被占用时最长等待时间
+	LockBackend            string   `default:"redis"` // 分布式锁后端：redis、tidb、failover
+	LockFailoverGraceSec   int      `default:"3"`     // failover切换后不发放锁的时长，不小于LockFailoverRefreshMs，各副本在此期间观察到切换
+	LockFailoverConfirms   int      `default:"3"`     // failover：redis降级后连续该次数刷新仍不可用才切换到TiDB
+	LockFailoverRefreshMs  int      `default:"1000"`  // failover：各副本刷新当前后端的间隔
+	LockFailbackSec        int      `default:"300"`   // failover切换到TiDB后，redis恢复且超过该时长才切回
+	RedisCompressThreshold int      `default:"1024"`  // 话题缓存超过该字节数时压缩，0-不压缩，仅msgpack格式生效
+	RedisCacheCodec        string   `default:"json"`  // 话题缓存写入格式：json、msgpack，全部副本可读msgpack后再切换
+	RedisProbeIntervalSec  int      `default:"5"`     // redis健康探测间隔
+	RedisProbeFailures     int      `default:"3"`     // 连续探测失败次数达到该值后降级
+	TiDBFallbackConcurrent int      `default:"16"`    // 降级读TiDB的并发上限
+	WarmUpSoonStartHours   int      `default:"24"`    // 预热：即将开始的话题范围
+	WarmUpRefreshAheadMin  int      `default:"120"`   // 预热：缓存剩余有效期低于该值时主动刷新
+	WarmUpBatchSize        int      `default:"100"`
+	WarmUpRatePerSec       int      `default:"200"`  // 预热：每秒最多回源的话题数
+	WarmUpMaxTopics        int      `default:"5000"` // 预热：单次最多处理的话题数，按开始时间升序截取
+	MetricsAddress         string   `default:"0.0.0.0:9100"`
+	CacheAuditFull         bool     `default:"false"` // 缓存巡检：true-全量，false-抽样
+	CacheAuditSampleRate   float64  `default:"0.05"`
+	CacheAuditRepair       string   `default:"none"` // 缓存巡检修复方式：none、evict、rewrite
+	BatchJobSize           int      `default:"500"`
+	BatchJobRatePerSec     int      `default:"0"`             // 批处理每秒最多处理的条目数，0-不限速
+	BatchJobMaxRetries     int      `default:"3"`             // 批处理单条目重试次数，仍失败时记入job_failures
+	BatchJobResume         bool     `default:"true"`          // 批处理从上次中断的断点续跑
+	ReindexRatePerSec      int      `default:"500"`           // 重建es索引每秒最多发布的话题数，0-不限速
+	DefaultTimeZone        string   `default:"Asia/Shanghai"` // 话题未指定时区时使用
+	LegacyTimeOffsetMin    int      `default:"480"`           // 旧版本存储时间相对UTC的偏移分钟数，旧版本按Asia/Shanghai存储
+	LegacyTimeCompat       bool     `default:"true"`          // 读写时换算utc=0的存量行，migrate up完成转换后的下个版本关闭
 	IsMysql                bool
+	Jobs                   Jobs // 定时任务，EnableCron为false时全部不执行
+}
+
+// Job 单个定时任务配置，Spec为空时使用Jobs字段的spec标签
+type Job struct {
+	Spec       string
+	Enabled    bool `default:"true"`
+	TimeoutSec int  `default:"0"` // 单次执行超时，0-不限时
+	JitterSec  int  `default:"0"` // 触发后随机延迟[0, JitterSec)秒再执行
+}
+
+// Jobs 字段名即任务名，spec标签为默认的秒级cron表达式；新增任务只需加字段
+type Jobs struct {
+	UpdateTopicStatistic Job `spec:"0 0 10 * * ?"`
+	UpdateTopicStatus    Job `spec:"0 0 0 * * ?"`
+	WarmUpTopicCache     Job `spec:"0 */30 * * * ?"`
+	AuditTopicCache      Job `spec:"0 15 * * * ?"`
+	EvaluateTopicAlerts  Job `spec:"0 */10 * * * ?"`
+}
+
+// DefaultJobSpecs 由Jobs的spec标签生成
+var DefaultJobSpecs = func() map[string]string {
+	specs := make(map[string]string)
+	t := reflect.TypeOf(Jobs{})
+	for i := 0; i < t.NumField(); i++ {
+		specs[t.Field(i).Name] = t.Field(i).Tag.Get("spec")
+	}
+	return specs
+}()
+
+// Get 按任务名取配置，未知任务返回false
+func (jobs Jobs) Get(name string) (Job, bool) {
+	field, ok := reflect.TypeOf(jobs).FieldByName(name)
+	if !ok {
+		return Job{}, false
+	}
+	job := reflect.ValueOf(jobs).FieldByIndex(field.Index).Interface().(Job)
+	if job.Spec == "" {
+		job.Spec = field.Tag.Get("spec")
+	}
+	return job, true
 }
 
 var Cfg = &Hubpd{}
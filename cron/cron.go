@@ -1,17 +1,50 @@
 package cron
 
 import (
+	"context"
 	"dm-gitlab.bolo.me/hubpd/basic/logger"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"fmt"
 	"github.com/robfig/cron/v3"
+	"sort"
+	"sync"
+	"time"
 )
 
 var log = logger.GetLogger()
 
+// 与cron.WithSeconds()一致
+var specParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+var Instance *Cron
+
 type Cron struct {
-	cron *cron.Cron
+	cron    *cron.Cron
+	elector *LeaderElector
+	cancel  context.CancelFunc
+	stopped chan struct{} // 选主退出后关闭
+
+	jobs    map[string]*job // 已注册任务，手动触发只能执行已注册任务
+	running sync.WaitGroup
+}
+
+type job struct {
+	name string
+	conf config.Job
+	f    func(ctx context.Context) error
+}
+
+// JobInfo 任务配置及触发时间
+type JobInfo struct {
+	Name string
+	Conf config.Job // 手动任务为零值
+	Prev time.Time  // 任一副本最近一次开始执行的时间，未执行为零值
+	Next time.Time  // 未开启cron、未启用或手动任务为零值
 }
 
-func NewCron() *Cron {
+func NewCron(elector *LeaderElector) *Cron {
 	cronLog := cron.VerbosePrintfLogger(log)
 	c := cron.New(
 		cron.WithLogger(cronLog),
@@ -21,21 +54,109 @@ func NewCron() *Cron {
 			cron.SkipIfStillRunning(cronLog)),
 	)
 	return &Cron{
-		cron: c,
+		cron:    c,
+		elector: elector,
+		jobs:    make(map[string]*job),
 	}
 }
 
-func (c *Cron) AddJob(spec string, cmd func()) {
-	_, err := c.cron.AddFunc(spec, cmd)
-	if err != nil {
+// ValidateJobs 启动时校验全部任务配置，含未启用的任务
+func ValidateJobs(names []string) error {
+	for _, name := range names {
+		conf, ok := config.Cfg.Jobs.Get(name)
+		if !ok {
+			return fmt.Errorf("job %v has no config", name)
+		}
+		if _, err := specParser.Parse(conf.Spec); err != nil {
+			return fmt.Errorf("job %v invalid spec %q: %v", name, conf.Spec, err)
+		}
+		if conf.TimeoutSec < 0 || conf.JitterSec < 0 {
+			return fmt.Errorf("job %v timeout and jitter must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// AddJob 注册任务，name取值见model.Jobs；未启用的任务不定时触发，但仍可手动触发
+func (c *Cron) AddJob(name string, f func(ctx context.Context) error) {
+	conf, ok := config.Cfg.Jobs.Get(name)
+	if !ok {
+		log.Fatalf("Add Job Fail; job %v has no config", name)
+	}
+	j := &job{name: name, conf: conf, f: f}
+	c.jobs[name] = j
+	if !conf.Enabled {
+		log.Infof("[cron] job %v disabled", name)
+		return
+	}
+
+	if _, err := c.cron.AddFunc(conf.Spec, func() {
+		c.runAsLeader(name)
+	}); err != nil {
 		log.Fatalf("Add Job Fail; Err: %v", err)
 	}
 }
 
+// AddManualJob 注册仅手动触发的任务，name取值见model.ManualJobs
+func (c *Cron) AddManualJob(name string, f func(ctx context.Context) error) {
+	c.jobs[name] = &job{name: name, f: f}
+}
+
+// ListJobs 按任务名排序返回全部定时及手动任务，上次执行时间取自job_runs，各副本结果一致
+func ListJobs(ctx context.Context) ([]*JobInfo, error) {
+	prevs, err := dao.TiDBInstance.LastJobRunStartAt(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	infos := make([]*JobInfo, 0, len(model.Jobs)+len(model.ManualJobs))
+	for _, name := range model.Jobs {
+		conf, _ := config.Cfg.Jobs.Get(name)
+		info := &JobInfo{Name: name, Conf: conf, Prev: prevs[name]}
+		if config.Cfg.EnableCron && conf.Enabled {
+			if schedule, err := specParser.Parse(conf.Spec); err == nil {
+				info.Next = schedule.Next(now)
+			}
+		}
+		infos = append(infos, info)
+	}
+	for _, name := range model.ManualJobs {
+		infos = append(infos, &JobInfo{Name: name, Prev: prevs[name]})
+	}
+	sort.Slice(infos, func(i, k int) bool { return infos[i].Name < infos[k].Name })
+	return infos, nil
+}
+
+// Start 开始选主，成为leader后才启动调度
 func (c *Cron) Start() {
-	c.cron.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.stopped = make(chan struct{})
+	c.elector.OnLeading = c.lead
+	go func() {
+		defer close(c.stopped)
+		c.elector.Run(ctx)
+	}()
 }
 
+// Stop 停止调度并取消执行中的任务，任务结束后释放租约；批处理任务下次从断点继续
 func (c *Cron) Stop() {
-	c.cron.Stop()
+	c.cancel()
+	<-c.stopped
+}
+
+// lead 担任leader期间调度定时任务、派发手动任务；失去leader身份时停止调度，等执行中的任务退出后返回
+func (c *Cron) lead(ctx context.Context) {
+	dispatchDone := make(chan struct{})
+	go func() {
+		defer close(dispatchDone)
+		c.dispatchManualRuns(ctx)
+	}()
+	c.cron.Start()
+
+	<-ctx.Done()
+	<-c.cron.Stop().Done()
+	<-dispatchDone
+	c.running.Wait()
 }
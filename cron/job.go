@@ -0,0 +1,233 @@
+package cron
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 手动触发任务及取消请求的轮询间隔
+const jobPollInterval = 2 * time.Second
+
+// 执行中的任务每个轮询间隔更新一次进度，超过该时长未更新视为执行副本已退出
+const jobRunLease = 30 * jobPollInterval
+
+var jobCanceledErr = errors.New("job run canceled")
+
+// legacyJobLockKeys 旧版本副本只在redis上加这些key，滚动发布期间新旧副本都可能执行定时任务，
+// 新版本同时持有新旧两个key保证互斥；全部副本升级到本版本后的下个版本删除
+var legacyJobLockKeys = map[string]string{
+	model.JobUpdateTopicStatistic: model.LegacyLockUpdateStatistic,
+	model.JobUpdateTopicStatus:    model.LegacyLockUpdateStatus,
+}
+
+// LockJob 持任务锁执行f，定时、手动触发与运维命令共用
+func LockJob(ctx context.Context, job string, f func(ctx context.Context) error) error {
+	legacyKey, ok := legacyJobLockKeys[job]
+	if !ok {
+		return dao.LockerInstance.LockWrap(ctx, model.GetKeyForLockJob(job), f)
+	}
+
+	return dao.LockerInstance.LockWrap(ctx, model.GetKeyForLockJob(job), func(ctx context.Context) error {
+		// 直接Acquire而不用LockWrap，ctx中的fence保持为新key的fence
+		h, err := dao.RedisInstance.Acquire(ctx, legacyKey, dao.DefaultLockOptions())
+		if err != nil {
+			if err == dao.LockNotAcquiredErr {
+				return &common.InternalError{
+					ErrCode: common.Code_SvcLocked,
+					ErrMsg:  common.Msg_SvcLocked,
+				}
+			}
+			return err
+		}
+		defer func() {
+			if err := dao.RedisInstance.Release(context.Background(), h); err != nil {
+				log.Warnf("[cron] release legacy job lock err: %v, key: %v", err, legacyKey)
+			}
+		}()
+
+		legacyCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-h.Lost():
+				cancel()
+			case <-legacyCtx.Done():
+			}
+		}()
+		if err := f(legacyCtx); err != nil {
+			return err
+		}
+		select {
+		case <-h.Lost():
+			return dao.LockLostErr
+		default:
+			return nil
+		}
+	})
+}
+
+// 随机延迟依赖全局随机数，不依赖其它包初始化
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// runAsLeader 定时触发，仅leader执行
+func (c *Cron) runAsLeader(name string) {
+	ctx, ok := c.elector.LeaderContext()
+	if !ok {
+		log.Debugf("[cron] %v skip, not leader", name)
+		return
+	}
+
+	// 随机延迟，错开同一时刻触发的任务
+	if j := c.jobs[name]; j != nil && j.conf.JitterSec > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(rand.Int63n(int64(j.conf.JitterSec) * int64(time.Second)))):
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	jobRun := &model.JobRun{
+		Job:     name,
+		Trigger: model.JobTriggerCron,
+		Status:  model.JobRunStatusRunning,
+		Host:    hostname,
+		StartAt: &now,
+	}
+	if err := dao.TiDBInstance.CreateJobRun(ctx, jobRun); err != nil {
+		// 记录失败不影响任务执行
+		log.Errorf("[cron] %v CreateJobRun err: %v", name, err)
+	}
+
+	c.running.Add(1)
+	defer c.running.Done()
+	c.execute(ctx, jobRun)
+}
+
+// dispatchManualRuns leader轮询手动触发的任务并执行，同时回收心跳过期的执行记录
+func (c *Cron) dispatchManualRuns(ctx context.Context) {
+	hostname, _ := os.Hostname()
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		leaderCtx, ok := c.elector.LeaderContext()
+		if !ok {
+			continue
+		}
+
+		if reaped, err := dao.TiDBInstance.ReapStaleJobRuns(leaderCtx, time.Now().Add(-jobRunLease)); err == nil && reaped != 0 {
+			log.Warnf("[cron] reaped stale job runs: %v", reaped)
+		}
+
+		jobRunArr, err := dao.TiDBInstance.PendingJobRuns(leaderCtx)
+		if err != nil {
+			continue
+		}
+		for _, jobRun := range jobRunArr {
+			started, err := dao.TiDBInstance.StartJobRun(leaderCtx, jobRun.ID, hostname)
+			if err != nil || !started {
+				continue
+			}
+
+			c.running.Add(1)
+			go func(jobRun *model.JobRun) {
+				defer c.running.Done()
+				c.execute(leaderCtx, jobRun)
+			}(jobRun)
+		}
+	}
+}
+
+// execute 持任务锁执行，避免定时与手动触发的同一任务并发，并记录执行结果
+func (c *Cron) execute(ctx context.Context, jobRun *model.JobRun) {
+	var processed, total int64
+	var status, errMsg string
+
+	j, ok := c.jobs[jobRun.Job]
+	if !ok {
+		status, errMsg = model.JobRunStatusFailed, fmt.Sprintf("job not registered: %v", jobRun.Job)
+	} else {
+		parentCtx := dao.WithJobParams(dao.WithJobTotal(dao.WithJobProcessed(ctx, &processed), &total), jobRun.Params)
+		if j.conf.TimeoutSec > 0 {
+			var cancelTimeout context.CancelFunc
+			parentCtx, cancelTimeout = context.WithTimeout(parentCtx, time.Duration(j.conf.TimeoutSec)*time.Second)
+			defer cancelTimeout()
+		}
+		runCtx, cancel := context.WithCancel(parentCtx)
+		canceled := int32(0)
+		if jobRun.ID != 0 {
+			go c.watchRun(runCtx, jobRun.ID, &processed, &total, func() {
+				atomic.StoreInt32(&canceled, 1)
+				cancel()
+			})
+		}
+
+		err := LockJob(runCtx, jobRun.Job, j.f)
+		cancel()
+
+		switch {
+		case err == nil:
+			status = model.JobRunStatusSucceeded
+		case atomic.LoadInt32(&canceled) == 1:
+			status, errMsg = model.JobRunStatusCanceled, jobCanceledErr.Error()
+		default:
+			status, errMsg = model.JobRunStatusFailed, err.Error()
+			currErr := fmt.Errorf("[cron] %v err: %v, run: %v", jobRun.Job, err, jobRun.ID)
+			log.Error(currErr)
+			sentry.CaptureException(currErr)
+		}
+	}
+
+	log.Infof("[cron] %v finished, run: %v, trigger: %v, status: %v, processed: %v",
+		jobRun.Job, jobRun.ID, jobRun.Trigger, status, atomic.LoadInt64(&processed))
+	if jobRun.ID == 0 {
+		return
+	}
+	// 失去leader身份时ctx已取消，结果仍需落库
+	if err := dao.TiDBInstance.FinishJobRun(context.Background(), jobRun.ID, status,
+		atomic.LoadInt64(&processed), atomic.LoadInt64(&total), errMsg); err != nil {
+		log.Errorf("[cron] %v FinishJobRun err: %v, run: %v", jobRun.Job, err, jobRun.ID)
+	}
+}
+
+// watchRun 落库执行进度并轮询取消请求，取消请求可能由任一副本写入
+func (c *Cron) watchRun(ctx context.Context, id int64, processed, total *int64, cancel func()) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_ = dao.TiDBInstance.UpdateJobRunProgress(ctx, id, atomic.LoadInt64(processed), atomic.LoadInt64(total))
+
+		requested, err := dao.TiDBInstance.JobRunCancelRequested(ctx, id)
+		if err == nil && requested {
+			log.Infof("[cron] job run cancel requested, run: %v", id)
+			cancel()
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package cron
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/metrics"
+	"os"
+	"sync"
+	"time"
+)
+
+// LeaderElector 多副本通过租约选主，只有leader执行定时任务
+// 租约由dao.Locker持有并续约，续约失败即失去leader身份
+// Locker必须是单一后端，failover切换期间两个副本可能同时认为自己是leader
+type LeaderElector struct {
+	Locker    dao.Locker
+	Key       string
+	TTL       time.Duration
+	OnLeading func(ctx context.Context) // 成为leader后调用，ctx随leader身份取消，返回后才释放租约
+
+	mu        sync.RWMutex
+	leaderCtx context.Context // 非leader时为nil，失去leader身份时被取消
+}
+
+func NewLeaderElector(locker dao.Locker, key string, ttl time.Duration) *LeaderElector {
+	if _, ok := locker.(*dao.FailoverLocker); ok {
+		log.Fatalf("[cron] LeaderElector requires a single lock backend, got failover, key: %v", key)
+	}
+	return &LeaderElector{
+		Locker: locker,
+		Key:    key,
+		TTL:    ttl,
+	}
+}
+
+// LeaderContext 当前为leader时返回随leader身份取消的ctx
+func (e *LeaderElector) LeaderContext() (context.Context, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.leaderCtx, e.leaderCtx != nil
+}
+
+// Run 持续竞选直到ctx取消
+func (e *LeaderElector) Run(ctx context.Context) {
+	hostname, _ := os.Hostname()
+	retry := time.NewTicker(e.TTL / 3)
+	defer retry.Stop()
+
+	for {
+		h, err := e.Locker.Acquire(ctx, e.Key, dao.LockOptions{TTL: e.TTL})
+		if err != nil && err != dao.LockNotAcquiredErr {
+			log.Warnf("[cron] LeaderElector acquire err: %v, key: %v", err, e.Key)
+		}
+		if h != nil {
+			e.lead(ctx, h, hostname)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-retry.C:
+		}
+	}
+}
+
+// lead 持有租约直到租约丢失或ctx取消
+func (e *LeaderElector) lead(ctx context.Context, h *dao.LockHandle, hostname string) {
+	leaderCtx, cancel := context.WithCancel(ctx)
+	e.setLeader(leaderCtx)
+	log.Infof("[cron] became leader, host: %v, key: %v, fence: %v", hostname, e.Key, h.Fence)
+
+	leading := make(chan struct{})
+	go func() {
+		defer close(leading)
+		if e.OnLeading != nil {
+			e.OnLeading(leaderCtx)
+		}
+	}()
+
+	select {
+	case <-h.Lost():
+		log.Warnf("[cron] lost leadership, host: %v, key: %v, fence: %v", hostname, e.Key, h.Fence)
+	case <-ctx.Done():
+		log.Infof("[cron] resign leadership, host: %v, key: %v", hostname, e.Key)
+	}
+
+	e.setLeader(nil)
+	cancel()
+	<-leading
+	if err := e.Locker.Release(context.Background(), h); err != nil {
+		log.Warnf("[cron] LeaderElector release err: %v, key: %v", err, e.Key)
+	}
+}
+
+func (e *LeaderElector) setLeader(leaderCtx context.Context) {
+	e.mu.Lock()
+	e.leaderCtx = leaderCtx
+	e.mu.Unlock()
+
+	if leaderCtx != nil {
+		metrics.CronIsLeader.Set(1)
+		metrics.CronLeaderTransitions.Add(1)
+	} else {
+		metrics.CronIsLeader.Set(0)
+	}
+}
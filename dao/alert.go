@@ -0,0 +1,235 @@
+package dao
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+func (dao *TiDB) CreateAlertRule(ctx context.Context, rule *model.AlertRule) error {
+	if err := dao.DB.WithContext(ctx).Create(rule).Error; err != nil {
+		dao.Log.Errorf("[dao] CreateAlertRule err: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func (dao *TiDB) UpdateAlertRule(ctx context.Context, rule *model.AlertRule) (int64, error) {
+	if rule.ID == 0 {
+		return 0, PrimaryKeyUnspecifiedErr
+	}
+
+	db := dao.DB.WithContext(ctx).Model(&model.AlertRule{}).Where("id = ?", rule.ID).
+		Updates(map[string]interface{}{
+			"topic_id":   rule.TopicID,
+			"metric":     rule.Metric,
+			"thresholds": rule.Thresholds,
+			"enabled":    rule.Enabled,
+			// 规则变化后重新记录基线
+			"baselined_at": nil,
+		})
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] UpdateAlertRule err: %v, id: %v", err, rule.ID)
+		return 0, err
+	}
+
+	return db.RowsAffected, nil
+}
+
+func (dao *TiDB) DelAlertRule(ctx context.Context, id int64) (int64, error) {
+	db := dao.DB.WithContext(ctx).Delete(&model.AlertRule{}, "id = ?", id)
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] DelAlertRule err: %v, id: %v", err, id)
+		return 0, err
+	}
+
+	return db.RowsAffected, nil
+}
+
+func (dao *TiDB) GetAlertRule(ctx context.Context, id int64) (*model.AlertRule, error) {
+	rule := &model.AlertRule{}
+	if err := dao.DB.WithContext(ctx).First(rule, "id = ?", id).Error; err != nil {
+		if !IsNotFound(err) {
+			dao.Log.Errorf("[dao] GetAlertRule err: %v, id: %v", err, id)
+		}
+		return rule, err
+	}
+
+	return rule, nil
+}
+
+// AlertRuleList enabledOnly为true时只返回启用的规则
+func (dao *TiDB) AlertRuleList(ctx context.Context, enabledOnly bool) ([]*model.AlertRule, error) {
+	ruleArr := make([]*model.AlertRule, 0)
+
+	db := dao.DB.WithContext(ctx).Model(&model.AlertRule{})
+	if enabledOnly {
+		db = db.Where("enabled = ?", true)
+	}
+	if err := db.Order("created_at asc").Find(&ruleArr).Error; err != nil {
+		dao.Log.Errorf("[dao] AlertRuleList err: %v", err)
+		return ruleArr, err
+	}
+
+	return ruleArr, nil
+}
+
+// TopicAlertKey 告警去重键
+type TopicAlertKey struct {
+	RuleID    int64
+	TopicID   int64
+	Threshold int64
+}
+
+// TopicAlertState 同一去重键最近一轮的告警
+type TopicAlertState struct {
+	ID     int64
+	Round  int64
+	Active bool // 未解除
+}
+
+// TopicAlertStates 话题各去重键最近一轮的告警
+func (dao *TiDB) TopicAlertStates(ctx context.Context, topicIDs []int64) (map[TopicAlertKey]*TopicAlertState, error) {
+	states := make(map[TopicAlertKey]*TopicAlertState)
+	if len(topicIDs) == 0 {
+		return states, nil
+	}
+
+	alertArr := make([]*model.TopicAlert, 0)
+	if err := dao.DB.WithContext(ctx).Select("id", "rule_id", "topic_id", "threshold", "round", "cleared_at").
+		Find(&alertArr, "topic_id in (?)", topicIDs).Error; err != nil {
+		dao.Log.Errorf("[dao] TopicAlertStates err: %v", err)
+		return states, err
+	}
+	for _, alert := range alertArr {
+		key := TopicAlertKey{RuleID: alert.RuleID, TopicID: alert.TopicID, Threshold: alert.Threshold}
+		if state, ok := states[key]; ok && state.Round > alert.Round {
+			continue
+		}
+		states[key] = &TopicAlertState{ID: alert.ID, Round: alert.Round, Active: alert.ClearedAt == nil}
+	}
+
+	return states, nil
+}
+
+// CreateTopicAlert 记录告警并在同一事务内登记事件，outboxEvent为nil时只记录基线；同一轮次已记录过时返回false
+func (dao *TiDB) CreateTopicAlert(ctx context.Context, alert *model.TopicAlert, outboxEvent *model.OutboxEvent) (bool, error) {
+	created := false
+	err := dao.DB.WithContext(ctx).Transaction(func(dbTrans *gorm.DB) error {
+		db := dbTrans.Clauses(clause.OnConflict{DoNothing: true}).Create(alert)
+		if err := db.Error; err != nil {
+			dao.Log.Errorf("[dao] CreateTopicAlert err: %v, rule: %v, topic: %v", err, alert.RuleID, alert.TopicID)
+			return err
+		}
+		if db.RowsAffected == 0 {
+			return nil
+		}
+
+		if outboxEvent != nil {
+			if err := insertOutboxEvents(dbTrans, []*model.OutboxEvent{outboxEvent}); err != nil {
+				dao.Log.Errorf("[dao] CreateTopicAlert outbox err: %v, rule: %v, topic: %v", err, alert.RuleID, alert.TopicID)
+				return err
+			}
+		}
+		created = true
+		return nil
+	})
+
+	return created, err
+}
+
+// ClearTopicAlerts 解除告警，之后再次越过阈值时重新告警
+func (dao *TiDB) ClearTopicAlerts(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := dao.DB.WithContext(ctx).Model(&model.TopicAlert{}).Where("id in (?) AND cleared_at IS NULL", ids).
+		Update("cleared_at", time.Now()).Error; err != nil {
+		dao.Log.Errorf("[dao] ClearTopicAlerts err: %v, count: %v", err, len(ids))
+		return err
+	}
+
+	return nil
+}
+
+// MarkAlertRuleBaselined 记录基线完成，检查期间规则被修改时不标记
+func (dao *TiDB) MarkAlertRuleBaselined(ctx context.Context, rule *model.AlertRule) error {
+	if err := dao.DB.WithContext(ctx).Model(&model.AlertRule{}).
+		Where("id = ? AND updated_at = ? AND baselined_at IS NULL", rule.ID, rule.UpdatedAt).
+		UpdateColumn("baselined_at", time.Now()).Error; err != nil {
+		dao.Log.Errorf("[dao] MarkAlertRuleBaselined err: %v, id: %v", err, rule.ID)
+		return err
+	}
+
+	return nil
+}
+
+// TopicAlertList topicID为0时返回所有话题的告警，含已解除的，按时间倒序
+func (dao *TiDB) TopicAlertList(ctx context.Context, topicID int64, offset, limit int64) ([]*model.TopicAlert, int64, error) {
+	var total int64
+	alertArr := make([]*model.TopicAlert, 0)
+
+	// 基线记录未告警，不返回
+	db := dao.DB.WithContext(ctx).Model(&model.TopicAlert{}).Where("baseline = ?", false)
+	if topicID != 0 {
+		db = db.Where("topic_id = ?", topicID)
+	}
+
+	if err := db.Count(&total).Error; err != nil {
+		dao.Log.Errorf("[dao] TopicAlertList Count err: %v", err)
+		return alertArr, total, err
+	}
+	if err := db.Order("created_at desc").Offset(int(offset)).Limit(int(limit)).Find(&alertArr).Error; err != nil {
+		dao.Log.Errorf("[dao] TopicAlertList Find err: %v", err)
+		return alertArr, total, err
+	}
+
+	return alertArr, total, nil
+}
+
+// InProcessTopics ids中进行中的话题
+func (dao *TiDB) InProcessTopics(ctx context.Context, ids []int64) ([]*model.TopicDetail, error) {
+	topicDetailArr := make([]*model.TopicDetail, 0)
+	if len(ids) == 0 {
+		return topicDetailArr, nil
+	}
+
+	if err := dao.DB.WithContext(ctx).Select("id", "start_at").
+		Where("id in (?) AND status = ?", ids, pb.TopicDetail_TopicStatus_InProcess).
+		Find(&topicDetailArr).Error; err != nil {
+		dao.Log.Errorf("[dao] InProcessTopics err: %v", err)
+		return topicDetailArr, err
+	}
+
+	return topicDetailArr, nil
+}
+
+// LatestTopicContentAt 各话题最近一条内容的发布时间，无内容的话题不返回
+func (dao *TiDB) LatestTopicContentAt(ctx context.Context, topicIDs []int64) (map[int64]time.Time, error) {
+	latestMap := make(map[int64]time.Time, len(topicIDs))
+	if len(topicIDs) == 0 {
+		return latestMap, nil
+	}
+
+	type row struct {
+		TopicID     int64
+		PublishedAt time.Time
+	}
+	rowArr := make([]*row, 0)
+	if err := dao.DB.WithContext(ctx).Model(&model.TopicContent{}).
+		Select("topic_id, MAX(published_at) AS published_at").
+		Where("topic_id in (?)", topicIDs).Group("topic_id").Scan(&rowArr).Error; err != nil {
+		dao.Log.Errorf("[dao] LatestTopicContentAt err: %v", err)
+		return latestMap, err
+	}
+	for _, r := range rowArr {
+		latestMap[r.TopicID] = r.PublishedAt
+	}
+
+	return latestMap, nil
+}
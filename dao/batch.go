@@ -0,0 +1,137 @@
+package dao
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// GetJobCheckpoint 无断点时返回空记录
+func (dao *TiDB) GetJobCheckpoint(ctx context.Context, job string) (*model.JobCheckpoint, error) {
+	checkpoint := &model.JobCheckpoint{Job: job}
+	if err := dao.DB.WithContext(ctx).First(checkpoint, "job = ?", job).Error; err != nil {
+		if IsNotFound(err) {
+			return &model.JobCheckpoint{Job: job, Finished: true}, nil
+		}
+		dao.Log.Errorf("[dao] GetJobCheckpoint err: %v, job: %v", err, job)
+		return checkpoint, err
+	}
+
+	return checkpoint, nil
+}
+
+func (dao *TiDB) SaveJobCheckpoint(ctx context.Context, job, scope string, lastID int64, finished bool) error {
+	if err := dao.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		UpdateAll: true,
+	}).Create(&model.JobCheckpoint{
+		Job:      job,
+		Scope:    scope,
+		LastID:   lastID,
+		Finished: finished,
+	}).Error; err != nil {
+		dao.Log.Errorf("[dao] SaveJobCheckpoint err: %v, job: %v, lastID: %v", err, job, lastID)
+		return err
+	}
+
+	return nil
+}
+
+// RecordJobFailures 批量记录失败条目，同一条目多次失败时累加尝试次数
+func (dao *TiDB) RecordJobFailures(ctx context.Context, job string, failed map[int64]error, attempts int) error {
+	if len(failed) == 0 {
+		return nil
+	}
+
+	jobFailureArr := make([]*model.JobFailure, 0, len(failed))
+	for itemID, err := range failed {
+		jobFailureArr = append(jobFailureArr, &model.JobFailure{
+			Job:      job,
+			ItemID:   itemID,
+			Attempts: attempts,
+			Err:      err.Error(),
+		})
+	}
+	if err := dao.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "job"}, {Name: "item_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"attempts":   gorm.Expr("attempts + VALUES(attempts)"),
+			"err":        gorm.Expr("VALUES(err)"),
+			"updated_at": time.Now(),
+		}),
+	}).Create(&jobFailureArr).Error; err != nil {
+		dao.Log.Errorf("[dao] RecordJobFailures err: %v, job: %v, count: %v", err, job, len(failed))
+		return err
+	}
+
+	return nil
+}
+
+// TopicFilter 批处理的话题范围，零值字段不过滤，时间范围左闭右开
+type TopicFilter struct {
+	Ids         []int64                      `json:"ids,omitempty"`
+	CreatedFrom time.Time                    `json:"createdFrom,omitempty"`
+	CreatedTo   time.Time                    `json:"createdTo,omitempty"`
+	UpdatedFrom time.Time                    `json:"updatedFrom,omitempty"`
+	UpdatedTo   time.Time                    `json:"updatedTo,omitempty"`
+	Statuses    []pb.TopicDetail_TopicStatus `json:"statuses,omitempty"`
+	// StatusStaleAt 非零时只取状态与该时刻按开始、结束时间计算的不一致的话题，口径同TopicDetail.StatusAt
+	StatusStaleAt time.Time `json:"statusStaleAt,omitempty"`
+}
+
+func (filter TopicFilter) apply(db *gorm.DB) *gorm.DB {
+	if len(filter.Ids) != 0 {
+		db = db.Where("id in (?)", filter.Ids)
+	}
+	if !filter.CreatedFrom.IsZero() {
+		db = db.Where("created_at >= ?", filter.CreatedFrom)
+	}
+	if !filter.CreatedTo.IsZero() {
+		db = db.Where("created_at < ?", filter.CreatedTo)
+	}
+	if !filter.UpdatedFrom.IsZero() {
+		db = db.Where("updated_at >= ?", filter.UpdatedFrom)
+	}
+	if !filter.UpdatedTo.IsZero() {
+		db = db.Where("updated_at < ?", filter.UpdatedTo)
+	}
+	if len(filter.Statuses) != 0 {
+		db = db.Where("status in (?)", filter.Statuses)
+	}
+	if !filter.StatusStaleAt.IsZero() {
+		at := filter.StatusStaleAt.Truncate(time.Second)
+		db = db.Where("((start_at > ? AND status != ?) OR (end_at < ? AND status != ?) OR (start_at <= ? AND end_at >= ? AND status != ?))",
+			at, pb.TopicDetail_TopicStatus_NotStarted,
+			at, pb.TopicDetail_TopicStatus_Ended,
+			at, at, pb.TopicDetail_TopicStatus_InProcess)
+	}
+	return db
+}
+
+// TopicIdsAfter 按id游标分页取filter范围内的话题
+func (dao *TiDB) TopicIdsAfter(ctx context.Context, lastID int64, limit int, filter TopicFilter) ([]int64, error) {
+	ids := make([]int64, 0)
+
+	db := filter.apply(dao.DB.WithContext(ctx).Model(&model.TopicDetail{}).Where("id > ?", lastID))
+	if err := db.Order("id asc").Limit(limit).Pluck("id", &ids).Error; err != nil {
+		dao.Log.Errorf("[dao] TopicIdsAfter err: %v, lastID: %v", err, lastID)
+		return ids, err
+	}
+
+	return ids, nil
+}
+
+// CountTopics filter范围内id大于lastID的话题数，用于进度
+func (dao *TiDB) CountTopics(ctx context.Context, lastID int64, filter TopicFilter) (int64, error) {
+	var count int64
+
+	db := filter.apply(dao.DB.WithContext(ctx).Model(&model.TopicDetail{}).Where("id > ?", lastID))
+	if err := db.Count(&count).Error; err != nil {
+		dao.Log.Errorf("[dao] CountTopics err: %v", err)
+		return count, err
+	}
+
+	return count, nil
+}
@@ -0,0 +1,49 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"gorm.io/gorm/clause"
+)
+
+// SavePendingCacheOps 登记待补做的缓存操作，重复登记的只保留一条
+func (dao *TiDB) SavePendingCacheOps(ctx context.Context, op string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	pendingCacheOps := make([]*model.PendingCacheOp, 0, len(keys))
+	for _, key := range keys {
+		pendingCacheOps = append(pendingCacheOps, &model.PendingCacheOp{Op: op, Key: key})
+	}
+	if err := dao.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&pendingCacheOps).Error; err != nil {
+		dao.Log.Errorf("[dao] SavePendingCacheOps err: %v, op: %v, count: %v", err, op, len(keys))
+		return err
+	}
+
+	return nil
+}
+
+// PendingCacheOps 按id升序取待补做的缓存操作
+func (dao *TiDB) PendingCacheOps(ctx context.Context, afterID int64, limit int) ([]*model.PendingCacheOp, error) {
+	pendingCacheOps := make([]*model.PendingCacheOp, 0)
+	if err := dao.DB.WithContext(ctx).Where("id > ?", afterID).Order("id asc").Limit(limit).Find(&pendingCacheOps).Error; err != nil {
+		dao.Log.Errorf("[dao] PendingCacheOps err: %v", err)
+		return pendingCacheOps, err
+	}
+
+	return pendingCacheOps, nil
+}
+
+func (dao *TiDB) DelPendingCacheOps(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := dao.DB.WithContext(ctx).Where("id in (?)", ids).Delete(&model.PendingCacheOp{}).Error; err != nil {
+		dao.Log.Errorf("[dao] DelPendingCacheOps err: %v, count: %v", err, len(ids))
+		return err
+	}
+
+	return nil
+}
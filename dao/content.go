@@ -0,0 +1,130 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// TopicContentCursor 列表游标，对应上一页最后一条的排序键
+type TopicContentCursor struct {
+	Pinned      bool      `json:"p"`
+	Sort        int32     `json:"s"`
+	PublishedAt time.Time `json:"t"`
+	ID          int64     `json:"i"`
+}
+
+// ExistingTopicIds 返回ids中未删除的话题id
+func (dao *TiDB) ExistingTopicIds(ctx context.Context, ids []int64) (map[int64]bool, error) {
+	existing := make(map[int64]bool, len(ids))
+	if len(ids) == 0 {
+		return existing, nil
+	}
+
+	idArr := make([]int64, 0, len(ids))
+	if err := dao.DB.WithContext(ctx).Model(&model.TopicDetail{}).
+		Where("id in (?)", ids).Pluck("id", &idArr).Error; err != nil {
+		dao.Log.Errorf("[dao] ExistingTopicIds err: %v", err)
+		return existing, err
+	}
+	for _, id := range idArr {
+		existing[id] = true
+	}
+
+	return existing, nil
+}
+
+// UpsertTopicContents 已关联的内容只更新发布时间，保留运营设置
+func (dao *TiDB) UpsertTopicContents(ctx context.Context, contentArr []*model.TopicContent) error {
+	if len(contentArr) == 0 {
+		return nil
+	}
+
+	if err := dao.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		DoUpdates: clause.AssignmentColumns([]string{"published_at", "updated_at"}),
+	}).Create(&contentArr).Error; err != nil {
+		dao.Log.Errorf("[dao] UpsertTopicContents err: %v, count: %v", err, len(contentArr))
+		return err
+	}
+
+	return nil
+}
+
+func (dao *TiDB) DelTopicContent(ctx context.Context, topicID int64, contentID string) (int64, error) {
+	db := dao.DB.WithContext(ctx).Delete(&model.TopicContent{}, "topic_id = ? AND content_id = ?", topicID, contentID)
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] DelTopicContent err: %v, topicID: %v, contentID: %v", err, topicID, contentID)
+		return 0, err
+	}
+
+	return db.RowsAffected, nil
+}
+
+func (dao *TiDB) GetTopicContent(ctx context.Context, topicID int64, contentID string) (*model.TopicContent, error) {
+	content := &model.TopicContent{}
+	if err := dao.DB.WithContext(ctx).First(content, "topic_id = ? AND content_id = ?", topicID, contentID).Error; err != nil {
+		if !IsNotFound(err) {
+			dao.Log.Errorf("[dao] GetTopicContent err: %v, topicID: %v, contentID: %v", err, topicID, contentID)
+		}
+		return content, err
+	}
+
+	return content, nil
+}
+
+// UpdateTopicContent 更新运营设置：置顶、精选、隐藏、排序，只更新fields指定的列，fields为空时更新全部
+func (dao *TiDB) UpdateTopicContent(ctx context.Context, content *model.TopicContent, fields []string) (int64, error) {
+	if content.TopicID == 0 || content.ContentID == "" {
+		return 0, PrimaryKeyUnspecifiedErr
+	}
+	if len(fields) == 0 {
+		fields = model.TopicContentUpdatableFields
+	}
+
+	values := map[string]interface{}{
+		"pinned":   content.Pinned,
+		"featured": content.Featured,
+		"hidden":   content.Hidden,
+		"sort":     content.Sort,
+	}
+	updates := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		updates[field] = values[field]
+	}
+	db := dao.DB.WithContext(ctx).Model(&model.TopicContent{}).
+		Where("topic_id = ? AND content_id = ?", content.TopicID, content.ContentID).
+		Updates(updates)
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] UpdateTopicContent err: %v, topicID: %v, contentID: %v",
+			err, content.TopicID, content.ContentID)
+		return 0, err
+	}
+
+	return db.RowsAffected, nil
+}
+
+// TopicContentList 按置顶、排序、发布时间倒序分页，cursor为nil时从头开始
+func (dao *TiDB) TopicContentList(ctx context.Context, topicID int64, cursor *TopicContentCursor,
+	limit int, featuredOnly, includeHidden bool) ([]*model.TopicContent, error) {
+	contentArr := make([]*model.TopicContent, 0)
+
+	db := dao.DB.WithContext(ctx).Where("topic_id = ?", topicID)
+	if featuredOnly {
+		db = db.Where("featured = ?", true)
+	}
+	if !includeHidden {
+		db = db.Where("hidden = ?", false)
+	}
+	if cursor != nil {
+		db = db.Where("(pinned, sort, published_at, id) < (?, ?, ?, ?)",
+			cursor.Pinned, cursor.Sort, cursor.PublishedAt, cursor.ID)
+	}
+	if err := db.Order("pinned desc, sort desc, published_at desc, id desc").
+		Limit(limit).Find(&contentArr).Error; err != nil {
+		dao.Log.Errorf("[dao] TopicContentList err: %v, topicID: %v", err, topicID)
+		return contentArr, err
+	}
+
+	return contentArr, nil
+}
@@ -0,0 +1,117 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// DeadLetterOutboxEvent 将发件箱事件转入死信，同一事务内从发件箱删除
+func (dao *TiDB) DeadLetterOutboxEvent(ctx context.Context, outboxEvent *model.OutboxEvent, reason string) error {
+	err := dao.DB.WithContext(ctx).Transaction(func(dbTrans *gorm.DB) error {
+		if err := dbTrans.Create(&model.DeadLetter{
+			EventID:  outboxEvent.EventID,
+			Kind:     outboxEvent.Kind,
+			TopicID:  outboxEvent.TopicID,
+			Seq:      outboxEvent.Seq,
+			Payload:  outboxEvent.Payload,
+			Reason:   reason,
+			Attempts: outboxEvent.Attempts,
+		}).Error; err != nil {
+			return err
+		}
+
+		return dbTrans.Where("id = ? AND sent_at IS NULL", outboxEvent.ID).Delete(&model.OutboxEvent{}).Error
+	})
+	if err != nil {
+		dao.Log.Errorf("[dao] DeadLetterOutboxEvent err: %v, eventId: %v", err, outboxEvent.EventID)
+		return err
+	}
+
+	return nil
+}
+
+// ReplayDeadLetter 以原EventID、Seq重新登记到发件箱并删除死信，返回false表示死信不存在
+// 死信存在期间该话题的后续事件不发布，重放的事件仍先于后续事件发布
+func (dao *TiDB) ReplayDeadLetter(ctx context.Context, id int64) (bool, error) {
+	found := false
+	err := dao.DB.WithContext(ctx).Transaction(func(dbTrans *gorm.DB) error {
+		deadLetter := &model.DeadLetter{}
+		if err := dbTrans.Clauses(clause.Locking{Strength: "UPDATE"}).First(deadLetter, "id = ?", id).Error; err != nil {
+			if IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+
+		if err := dbTrans.Create(&model.OutboxEvent{
+			EventID:       deadLetter.EventID,
+			Kind:          deadLetter.Kind,
+			TopicID:       deadLetter.TopicID,
+			Seq:           deadLetter.Seq,
+			Payload:       deadLetter.Payload,
+			NextAttemptAt: time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		if err := dbTrans.Delete(deadLetter).Error; err != nil {
+			return err
+		}
+		found = true
+		return nil
+	})
+	if err != nil {
+		dao.Log.Errorf("[dao] ReplayDeadLetter err: %v, id: %v", err, id)
+		return false, err
+	}
+
+	return found, nil
+}
+
+func (dao *TiDB) DelDeadLetter(ctx context.Context, id int64) (int64, error) {
+	db := dao.DB.WithContext(ctx).Delete(&model.DeadLetter{}, "id = ?", id)
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] DelDeadLetter err: %v, id: %v", err, id)
+		return 0, err
+	}
+
+	return db.RowsAffected, nil
+}
+
+func (dao *TiDB) CountDeadLetters(ctx context.Context) (int64, error) {
+	var total int64
+	if err := dao.DB.WithContext(ctx).Model(&model.DeadLetter{}).Count(&total).Error; err != nil {
+		dao.Log.Errorf("[dao] CountDeadLetters err: %v", err)
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// DeadLetterList topicID为0、kind为空时不过滤，按时间倒序
+func (dao *TiDB) DeadLetterList(ctx context.Context,
+	topicID int64, kind string, offset, limit int64) ([]*model.DeadLetter, int64, error) {
+	var total int64
+	deadLetterArr := make([]*model.DeadLetter, 0)
+
+	db := dao.DB.WithContext(ctx).Model(&model.DeadLetter{})
+	if topicID != 0 {
+		db = db.Where("topic_id = ?", topicID)
+	}
+	if kind != "" {
+		db = db.Where("kind = ?", kind)
+	}
+
+	if err := db.Count(&total).Error; err != nil {
+		dao.Log.Errorf("[dao] DeadLetterList Count err: %v", err)
+		return deadLetterArr, total, err
+	}
+	if err := db.Order("created_at desc").Offset(int(offset)).Limit(int(limit)).Find(&deadLetterArr).Error; err != nil {
+		dao.Log.Errorf("[dao] DeadLetterList Find err: %v", err)
+		return deadLetterArr, total, err
+	}
+
+	return deadLetterArr, total, nil
+}
@@ -0,0 +1,214 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type jobProcessedKey struct{}
+type jobTotalKey struct{}
+type jobParamsKey struct{}
+
+// WithJobProcessed 任务执行时携带处理数计数器
+func WithJobProcessed(ctx context.Context, processed *int64) context.Context {
+	return context.WithValue(ctx, jobProcessedKey{}, processed)
+}
+
+// AddJobProcessed 累加任务处理数，非任务调用时忽略
+func AddJobProcessed(ctx context.Context, n int) {
+	if processed, ok := ctx.Value(jobProcessedKey{}).(*int64); ok {
+		atomic.AddInt64(processed, int64(n))
+	}
+}
+
+// WithJobTotal 任务执行时携带待处理数，用于进度
+func WithJobTotal(ctx context.Context, total *int64) context.Context {
+	return context.WithValue(ctx, jobTotalKey{}, total)
+}
+
+// SetJobTotal 设置任务待处理数，非任务调用时忽略
+func SetJobTotal(ctx context.Context, n int64) {
+	if total, ok := ctx.Value(jobTotalKey{}).(*int64); ok {
+		atomic.StoreInt64(total, n)
+	}
+}
+
+// WithJobParams 任务执行时携带手动触发的参数
+func WithJobParams(ctx context.Context, params string) context.Context {
+	return context.WithValue(ctx, jobParamsKey{}, params)
+}
+
+// JobParams 手动触发的参数，无参数时为空
+func JobParams(ctx context.Context) string {
+	params, _ := ctx.Value(jobParamsKey{}).(string)
+	return params
+}
+
+func (dao *TiDB) CreateJobRun(ctx context.Context, jobRun *model.JobRun) error {
+	if err := dao.DB.WithContext(ctx).Create(jobRun).Error; err != nil {
+		dao.Log.Errorf("[dao] CreateJobRun err: %v, job: %v", err, jobRun.Job)
+		return err
+	}
+
+	return nil
+}
+
+// StartJobRun 抢占待执行的手动任务，返回false表示已被取消或已在执行
+func (dao *TiDB) StartJobRun(ctx context.Context, id int64, host string) (bool, error) {
+	db := dao.DB.WithContext(ctx).Model(&model.JobRun{}).
+		Where("id = ? AND status = ?", id, model.JobRunStatusPending).
+		Updates(map[string]interface{}{
+			"status":   model.JobRunStatusRunning,
+			"host":     host,
+			"start_at": time.Now(),
+		})
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] StartJobRun err: %v, id: %v", err, id)
+		return false, err
+	}
+
+	return db.RowsAffected != 0, nil
+}
+
+// UpdateJobRunProgress 执行中定期落库进度
+func (dao *TiDB) UpdateJobRunProgress(ctx context.Context, id int64, processed, total int64) error {
+	if err := dao.DB.WithContext(ctx).Model(&model.JobRun{}).
+		Where("id = ? AND status = ?", id, model.JobRunStatusRunning).
+		Updates(map[string]interface{}{
+			"processed": processed,
+			"total":     total,
+		}).Error; err != nil {
+		dao.Log.Errorf("[dao] UpdateJobRunProgress err: %v, id: %v", err, id)
+		return err
+	}
+
+	return nil
+}
+
+func (dao *TiDB) FinishJobRun(ctx context.Context, id int64, status string, processed, total int64, errMsg string) error {
+	if err := dao.DB.WithContext(ctx).Model(&model.JobRun{}).Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"status":    status,
+			"processed": processed,
+			"total":     total,
+			"err":       errMsg,
+			"end_at":    time.Now(),
+		}).Error; err != nil {
+		dao.Log.Errorf("[dao] FinishJobRun err: %v, id: %v", err, id)
+		return err
+	}
+
+	return nil
+}
+
+// ReapStaleJobRuns 执行副本宕机或失去leader后未能落库结果的任务，进度心跳超过before未更新即置为失败
+func (dao *TiDB) ReapStaleJobRuns(ctx context.Context, before time.Time) (int64, error) {
+	db := dao.DB.WithContext(ctx).Model(&model.JobRun{}).
+		Where("status = ? AND updated_at < ?", model.JobRunStatusRunning, before).
+		Updates(map[string]interface{}{
+			"status": model.JobRunStatusFailed,
+			"err":    "job run lease expired",
+			"end_at": time.Now(),
+		})
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] ReapStaleJobRuns err: %v", err)
+		return 0, err
+	}
+
+	return db.RowsAffected, nil
+}
+
+func (dao *TiDB) JobRunCancelRequested(ctx context.Context, id int64) (bool, error) {
+	jobRun := &model.JobRun{}
+	if err := dao.DB.WithContext(ctx).Select("cancel_requested").First(jobRun, "id = ?", id).Error; err != nil {
+		dao.Log.Errorf("[dao] JobRunCancelRequested err: %v, id: %v", err, id)
+		return false, err
+	}
+
+	return jobRun.CancelRequested, nil
+}
+
+// CancelJobRun 待执行的直接取消，执行中的标记取消由执行副本中断
+func (dao *TiDB) CancelJobRun(ctx context.Context, id int64) (rowsAffected int64, err error) {
+	db := dao.DB.WithContext(ctx).Model(&model.JobRun{}).
+		Where("id = ? AND status = ?", id, model.JobRunStatusPending).
+		Updates(map[string]interface{}{
+			"status": model.JobRunStatusCanceled,
+			"end_at": time.Now(),
+		})
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] CancelJobRun pending err: %v, id: %v", err, id)
+		return 0, err
+	}
+	if db.RowsAffected != 0 {
+		return db.RowsAffected, nil
+	}
+
+	db = dao.DB.WithContext(ctx).Model(&model.JobRun{}).
+		Where("id = ? AND status = ?", id, model.JobRunStatusRunning).
+		Update("cancel_requested", true)
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] CancelJobRun running err: %v, id: %v", err, id)
+		return 0, err
+	}
+
+	return db.RowsAffected, nil
+}
+
+func (dao *TiDB) PendingJobRuns(ctx context.Context) ([]*model.JobRun, error) {
+	jobRunArr := make([]*model.JobRun, 0)
+
+	if err := dao.DB.WithContext(ctx).Where("status = ?", model.JobRunStatusPending).
+		Order("created_at asc").Find(&jobRunArr).Error; err != nil {
+		dao.Log.Errorf("[dao] PendingJobRuns err: %v", err)
+		return jobRunArr, err
+	}
+
+	return jobRunArr, nil
+}
+
+// LastJobRunStartAt 各任务最近一次开始执行的时间，不区分执行副本
+func (dao *TiDB) LastJobRunStartAt(ctx context.Context) (map[string]time.Time, error) {
+	var rows []struct {
+		Job     string
+		StartAt time.Time
+	}
+	if err := dao.DB.WithContext(ctx).Model(&model.JobRun{}).Select("job, MAX(start_at) AS start_at").
+		Where("start_at IS NOT NULL").Group("job").Scan(&rows).Error; err != nil {
+		dao.Log.Errorf("[dao] LastJobRunStartAt err: %v", err)
+		return nil, err
+	}
+
+	startAts := make(map[string]time.Time, len(rows))
+	for _, row := range rows {
+		startAts[row.Job] = row.StartAt
+	}
+	return startAts, nil
+}
+
+func (dao *TiDB) JobRunList(ctx context.Context, job, status string, offset, limit int64) ([]*model.JobRun, int64, error) {
+	var total int64
+	jobRunArr := make([]*model.JobRun, 0)
+
+	db := dao.DB.WithContext(ctx).Model(&model.JobRun{})
+	if strings.TrimSpace(job) != "" {
+		db = db.Where("job = ?", strings.TrimSpace(job))
+	}
+	if status != "" {
+		db = db.Where("status = ?", status)
+	}
+
+	if err := db.Count(&total).Error; err != nil {
+		dao.Log.Errorf("[dao] JobRunList Count err: %v", err)
+		return jobRunArr, total, err
+	}
+	if err := db.Order("created_at desc").Offset(int(offset)).Limit(int(limit)).Find(&jobRunArr).Error; err != nil {
+		dao.Log.Errorf("[dao] JobRunList Find err: %v", err)
+		return jobRunArr, total, err
+	}
+
+	return jobRunArr, total, nil
+}
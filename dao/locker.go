@@ -0,0 +1,399 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	LockBackendRedis    = "redis"
+	LockBackendTiDB     = "tidb"
+	LockBackendFailover = "failover" // 优先redis，redis不可用时使用TiDB
+)
+
+// Locker 分布式锁，service层的写操作统一通过LockerInstance加锁
+type Locker interface {
+	Acquire(ctx context.Context, lockKey string, opts LockOptions) (*LockHandle, error)
+	Release(ctx context.Context, h *LockHandle) error
+	LockWrap(ctx context.Context, lockKey string, f func(ctx context.Context) error) error
+	Held(ctx context.Context, lockKey string) (bool, error) // 锁当前是否被持有且未过期
+}
+
+var LockerInstance Locker
+
+type LockOptions struct {
+	TTL  time.Duration // 租约时长，持有期间由watchdog按TTL/3续约
+	Wait time.Duration // 锁被占用时最长等待时间，0-不等待
+}
+
+func DefaultLockOptions() LockOptions {
+	return LockOptions{
+		TTL:  time.Duration(config.Cfg.RedisLockExpirationSec) * time.Second,
+		Wait: time.Duration(config.Cfg.RedisLockWaitMs) * time.Millisecond,
+	}
+}
+
+// LockHandle 一次加锁的凭证，Token每次加锁唯一，Fence按锁key单调递增
+type LockHandle struct {
+	Key   string
+	Token string
+	Fence int64
+
+	locker   Locker                                  // 实际加锁的后端
+	renew    func(ctx context.Context) (bool, error) // 续约，返回false表示锁已被他人持有
+	stop     chan struct{}
+	stopOnce sync.Once
+	lost     chan struct{} // 续约失败时关闭
+	lostOnce sync.Once
+}
+
+func newLockHandle(locker Locker, lockKey, token string, fence int64, renew func(ctx context.Context) (bool, error)) *LockHandle {
+	return &LockHandle{
+		Key:    lockKey,
+		Token:  token,
+		Fence:  fence,
+		locker: locker,
+		renew:  renew,
+		stop:   make(chan struct{}),
+		lost:   make(chan struct{}),
+	}
+}
+
+// Lost 续约失败、锁已被他人持有时关闭
+func (h *LockHandle) Lost() <-chan struct{} {
+	return h.lost
+}
+
+func (h *LockHandle) markLost() {
+	h.lostOnce.Do(func() { close(h.lost) })
+}
+
+func (h *LockHandle) stopWatchdog() {
+	h.stopOnce.Do(func() { close(h.stop) })
+}
+
+var (
+	LockNotAcquiredErr = errors.New("lock not acquired")
+	LockLostErr        = errors.New("lock lost")
+)
+
+// watchdog 持有期间按TTL/3续约，直到Release
+// 续约出错时无法确认租约是否仍有效，与续约失败一样视为锁已丢失
+func watchdog(log *logrus.Entry, h *LockHandle, ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ttl/3)
+		renewed, err := h.renew(ctx)
+		cancel()
+		if err != nil || !renewed {
+			lostErr := fmt.Errorf("[dao] lock lost, key: %v, token: %v, fence: %v, renew err: %v", h.Key, h.Token, h.Fence, err)
+			log.Error(lostErr)
+			sentry.CaptureException(lostErr)
+			h.markLost()
+			return
+		}
+	}
+}
+
+// acquireWithWait 锁被占用时退避重试直到opts.Wait，tryAcquire返回nil表示锁被占用
+func acquireWithWait(ctx context.Context, opts LockOptions, tryAcquire func() (*LockHandle, error)) (*LockHandle, error) {
+	deadline := time.Now().Add(opts.Wait)
+	backoff := 20 * time.Millisecond
+	for {
+		h, err := tryAcquire()
+		if err != nil || h != nil {
+			return h, err
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, LockNotAcquiredErr
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff < 200*time.Millisecond {
+			backoff *= 2
+		}
+	}
+}
+
+// lockWrap 持锁执行f，f的ctx携带fence，锁丢失时ctx被取消
+func lockWrap(ctx context.Context, locker Locker, log *logrus.Entry, lockKey string, f func(ctx context.Context) error) (err error) {
+	h, err := locker.Acquire(ctx, lockKey, DefaultLockOptions())
+	if err != nil {
+		if err == LockNotAcquiredErr {
+			return &common.InternalError{
+				ErrCode: common.Code_SvcLocked,
+				ErrMsg:  common.Msg_SvcLocked,
+			}
+		}
+		return err
+	}
+	defer func() {
+		if unLockErr := locker.Release(context.Background(), h); unLockErr != nil && err == nil {
+			err = unLockErr
+		}
+	}()
+
+	fCtx, cancel := context.WithCancel(WithFence(ctx, h.Fence))
+	defer cancel()
+	go func() {
+		select {
+		case <-h.Lost():
+			cancel()
+		case <-fCtx.Done():
+		}
+	}()
+
+	if err = f(fCtx); err != nil {
+		log.Errorf("[dao] LockWrap f() return err: %v, key: %v", err, lockKey)
+		return
+	}
+	select {
+	case <-h.Lost():
+		return LockLostErr
+	default:
+	}
+
+	return
+}
+
+type fenceKey struct{}
+
+func WithFence(ctx context.Context, fence int64) context.Context {
+	return context.WithValue(ctx, fenceKey{}, fence)
+}
+
+// FenceFromContext 未持锁时返回0
+func FenceFromContext(ctx context.Context) int64 {
+	fence, _ := ctx.Value(fenceKey{}).(int64)
+	return fence
+}
+
+// lockAlive 持锁写入前确认锁未丢失，锁丢失时lockWrap会取消ctx
+func lockAlive(ctx context.Context) error {
+	if FenceFromContext(ctx) != 0 && ctx.Err() != nil {
+		return LockLostErr
+	}
+	return nil
+}
+
+// FailoverLocker 优先使用Primary，Primary不可用时切换到Secondary
+// 当前后端记录在TiDB，所有副本共同遵守；各副本每Interval刷新一次到本地，加锁只读本地状态。
+// redis降级后连续Confirms次刷新仍不可用才切换到TiDB，redis恢复且切换超过FailbackAfter后切回。
+// 切换后Grace内不发放锁，各副本在此期间观察到切换；持有旧后端锁的副本视为锁丢失。
+// 本地状态超过3个Interval未刷新成功时加锁失败，不做本地判断
+type FailoverLocker struct {
+	Primary       *Redis
+	Secondary     *TiDBLocker
+	Grace         time.Duration
+	FailbackAfter time.Duration
+	Confirms      int
+	Interval      time.Duration
+
+	startOnce sync.Once
+	mu        sync.RWMutex
+	view      lockBackendView
+	failures  int // redis连续不可用的刷新次数，仅刷新协程读写
+}
+
+// lockBackendView 本地缓存的当前后端
+type lockBackendView struct {
+	backend     string
+	switchedAt  time.Time     // 按本地时钟换算的切换时间
+	refreshedAt time.Time     // 最近一次刷新成功的时间
+	changed     chan struct{} // 后端切换或状态过期时关闭
+}
+
+var LockBackendUnknownErr = errors.New("lock backend unknown")
+
+// start 首次使用时同步刷新一次，之后由后台协程按Interval刷新
+func (l *FailoverLocker) start() {
+	l.startOnce.Do(func() {
+		if l.Interval <= 0 {
+			l.Interval = time.Second
+		}
+		l.view.changed = make(chan struct{})
+		l.refresh(context.Background())
+		go func() {
+			ticker := time.NewTicker(l.Interval)
+			defer ticker.Stop()
+			for range ticker.C {
+				l.refresh(context.Background())
+			}
+		}()
+	})
+}
+
+// refresh 从TiDB读取当前后端，确认redis持续不可用或已恢复时切换
+func (l *FailoverLocker) refresh(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, l.Interval)
+	defer cancel()
+
+	backend, sinceSwitch, err := l.Secondary.TiDB.LockBackend(ctx)
+	if err == nil {
+		switch {
+		case backend == LockBackendRedis && !l.Primary.Healthy():
+			l.failures++
+			if l.failures >= l.Confirms {
+				l.failures = 0
+				backend, sinceSwitch, err = l.switchBackend(ctx, LockBackendRedis, LockBackendTiDB)
+			}
+		case backend == LockBackendTiDB && l.Primary.Healthy() && sinceSwitch >= l.FailbackAfter:
+			backend, sinceSwitch, err = l.switchBackend(ctx, LockBackendTiDB, LockBackendRedis)
+		default:
+			l.failures = 0
+		}
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		l.Primary.Log.Warnf("[dao] FailoverLocker refresh backend err: %v, last refreshed: %v", err, l.view.refreshedAt)
+		if now.Sub(l.view.refreshedAt) > l.staleAfter() && l.view.backend != "" {
+			// 无法确认当前后端，持有的锁视为丢失
+			l.view.backend = ""
+			close(l.view.changed)
+			l.view.changed = make(chan struct{})
+		}
+		return
+	}
+	if backend != l.view.backend {
+		close(l.view.changed)
+		l.view.changed = make(chan struct{})
+	}
+	l.view.backend = backend
+	l.view.switchedAt = now.Add(-sinceSwitch)
+	l.view.refreshedAt = now
+}
+
+func (l *FailoverLocker) staleAfter() time.Duration {
+	return 3 * l.Interval
+}
+
+// current 返回本地缓存的当前后端，过期时返回LockBackendUnknownErr
+func (l *FailoverLocker) current() (lockBackendView, error) {
+	l.start()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.view.backend == "" || time.Since(l.view.refreshedAt) > l.staleAfter() {
+		return lockBackendView{}, LockBackendUnknownErr
+	}
+	return l.view, nil
+}
+
+func (l *FailoverLocker) Acquire(ctx context.Context, lockKey string, opts LockOptions) (*LockHandle, error) {
+	view, err := l.current()
+	if err != nil {
+		l.Primary.Log.Errorf("[dao] FailoverLocker backend unknown, key: %v", lockKey)
+		return nil, err
+	}
+	if time.Since(view.switchedAt) < l.Grace {
+		l.Primary.Log.Infof("[dao] FailoverLocker waiting for other replicas to observe switch, backend: %v, key: %v", view.backend, lockKey)
+		return nil, LockNotAcquiredErr
+	}
+
+	var h *LockHandle
+	if view.backend == LockBackendRedis {
+		// redis出错时本次加锁失败，是否切换由刷新协程确认
+		h, err = l.Primary.Acquire(ctx, lockKey, opts)
+	} else {
+		h, err = l.Secondary.Acquire(ctx, lockKey, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	go l.watchBackend(h, view)
+	return h, nil
+}
+
+func (l *FailoverLocker) switchBackend(ctx context.Context, from, to string) (string, time.Duration, error) {
+	switched, err := l.Secondary.TiDB.SwitchLockBackend(ctx, from, to)
+	if err != nil {
+		return "", 0, err
+	}
+	if switched {
+		switchErr := fmt.Errorf("[dao] FailoverLocker switch backend, from: %v, to: %v", from, to)
+		l.Primary.Log.Warn(switchErr)
+		sentry.CaptureException(switchErr)
+	}
+	return l.Secondary.TiDB.LockBackend(ctx)
+}
+
+// watchBackend 持有期间后端发生切换或无法确认时视为锁丢失
+func (l *FailoverLocker) watchBackend(h *LockHandle, view lockBackendView) {
+	select {
+	case <-h.stop:
+	case <-h.lost:
+	case <-view.changed:
+		l.Primary.Log.Errorf("[dao] FailoverLocker backend switched, lock lost, key: %v, backend: %v", h.Key, view.backend)
+		h.markLost()
+	}
+}
+
+func (l *FailoverLocker) Release(ctx context.Context, h *LockHandle) error {
+	return h.locker.Release(ctx, h)
+}
+
+func (l *FailoverLocker) Held(ctx context.Context, lockKey string) (bool, error) {
+	view, err := l.current()
+	if err != nil {
+		return false, err
+	}
+	if view.backend == LockBackendRedis {
+		return l.Primary.Held(ctx, lockKey)
+	}
+	return l.Secondary.Held(ctx, lockKey)
+}
+
+func (l *FailoverLocker) LockWrap(ctx context.Context, lockKey string, f func(ctx context.Context) error) error {
+	return lockWrap(ctx, l, l.Primary.Log, lockKey, f)
+}
+
+// SingleBackendLocker failover时返回其TiDB后端，用于选主等不能容忍切换期间双持有的租约
+func SingleBackendLocker(locker Locker) Locker {
+	if l, ok := locker.(*FailoverLocker); ok {
+		return l.Secondary
+	}
+	return locker
+}
+
+func NewLocker(redis *Redis, tiDB *TiDB) Locker {
+	switch config.Cfg.LockBackend {
+	case LockBackendRedis:
+		return redis
+	case LockBackendTiDB:
+		return &TiDBLocker{TiDB: tiDB}
+	case LockBackendFailover:
+		return &FailoverLocker{
+			Primary:       redis,
+			Secondary:     &TiDBLocker{TiDB: tiDB},
+			Grace:         time.Duration(config.Cfg.LockFailoverGraceSec) * time.Second,
+			FailbackAfter: time.Duration(config.Cfg.LockFailbackSec) * time.Second,
+			Confirms:      config.Cfg.LockFailoverConfirms,
+			Interval:      time.Duration(config.Cfg.LockFailoverRefreshMs) * time.Millisecond,
+		}
+	default:
+		redis.Log.Fatalf("unknown LockBackend: %v, want redis, tidb or failover", config.Cfg.LockBackend)
+		return nil
+	}
+}
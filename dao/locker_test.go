@@ -0,0 +1,408 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/basic/logger"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	dbInstance := model.GetInstance()
+	_ = dbInstance.Migrator().DropTable(model.Tables...)
+	_ = dbInstance.AutoMigrate(model.Tables...)
+
+	log := logger.GetLogger()
+	TiDBInstance = &TiDB{
+		DB:  dbInstance,
+		Log: log,
+	}
+	RedisInstance = &Redis{
+		Log:         log,
+		RedisClient: model.GetRedisMock(),
+	}
+
+	os.Exit(m.Run())
+}
+
+func Test_TiDBLocker(t *testing.T) {
+	locker := &TiDBLocker{TiDB: TiDBInstance}
+	ctx := context.Background()
+	opts := LockOptions{TTL: 300 * time.Millisecond}
+
+	h, err := locker.Acquire(ctx, "test:tidb", opts)
+	if err != nil {
+		t.Fatalf("Acquire() err: %v", err)
+	}
+	if _, err := locker.Acquire(ctx, "test:tidb", opts); err != LockNotAcquiredErr {
+		t.Errorf("Acquire() held lock err: %v, want LockNotAcquiredErr", err)
+	}
+
+	// watchdog续约期间不会过期
+	time.Sleep(2 * opts.TTL)
+	if _, err := locker.Acquire(ctx, "test:tidb", opts); err != LockNotAcquiredErr {
+		t.Errorf("Acquire() renewed lock err: %v, want LockNotAcquiredErr", err)
+	}
+
+	// 停止续约模拟持有方卡住，租约过期后可被抢占，原持有方续约失败
+	h.stopWatchdog()
+	time.Sleep(2 * opts.TTL)
+	h2, err := locker.Acquire(ctx, "test:tidb", opts)
+	if err != nil {
+		t.Fatalf("Acquire() expired lock err: %v", err)
+	}
+	if renewed, err := h.renew(ctx); err != nil || renewed {
+		t.Errorf("renew() taken over lock renewed: %v, err: %v", renewed, err)
+	}
+	if held, err := locker.Held(ctx, "test:tidb"); err != nil || !held {
+		t.Errorf("Held() held: %v, err: %v, want true", held, err)
+	}
+	if err := locker.Release(ctx, h2); err != nil {
+		t.Errorf("Release() err: %v", err)
+	}
+	if held, err := locker.Held(ctx, "test:tidb"); err != nil || held {
+		t.Errorf("Held() released: %v, err: %v, want false", held, err)
+	}
+
+	// 过期租约清理后仍可加锁
+	if _, err := TiDBInstance.PurgeLockLeases(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("PurgeLockLeases() err: %v", err)
+	}
+	h3, err := locker.Acquire(ctx, "test:tidb", opts)
+	if err != nil {
+		t.Fatalf("Acquire() after purge err: %v", err)
+	}
+	_ = locker.Release(ctx, h3)
+}
+
+func Test_LockWrapFence(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		locker Locker
+		reset  func() error // 清理fence记录，之后的fence仍应递增
+	}{
+		{"tidb", &TiDBLocker{TiDB: TiDBInstance}, func() error {
+			_, err := TiDBInstance.PurgeLockLeases(ctx, time.Now().Add(time.Hour))
+			return err
+		}},
+		{"redis", RedisInstance, func() error {
+			return RedisInstance.RedisClient.Del(ctx, model.GetKeyForLockFence("test:fence:redis")).Err()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lockKey := "test:fence:" + tt.name
+			var fences []int64
+			for i := 0; i < 4; i++ {
+				if i == 2 {
+					if err := tt.reset(); err != nil {
+						t.Fatalf("reset() err: %v", err)
+					}
+				}
+				if err := tt.locker.LockWrap(ctx, lockKey, func(ctx context.Context) error {
+					fences = append(fences, FenceFromContext(ctx))
+					return nil
+				}); err != nil {
+					t.Fatalf("LockWrap() err: %v", err)
+				}
+			}
+			for i := 1; i < len(fences); i++ {
+				if fences[i] <= fences[i-1] {
+					t.Errorf("fence not increasing: %v", fences)
+				}
+			}
+		})
+	}
+
+	// fence key带过期时间，不会无限累积
+	if ttl, err := RedisInstance.RedisClient.PTTL(ctx, model.GetKeyForLockFence("test:fence:redis")).Result(); err != nil || ttl <= 0 {
+		t.Errorf("fence key ttl: %v, err: %v, want expiring", ttl, err)
+	}
+}
+
+// newFailoverReplica 模拟一个副本：共用redis与TiDB，redis健康状态各自独立；刷新由测试驱动
+func newFailoverReplica(confirms int) *FailoverLocker {
+	return &FailoverLocker{
+		Primary:   &Redis{Log: RedisInstance.Log, RedisClient: RedisInstance.RedisClient},
+		Secondary: &TiDBLocker{TiDB: TiDBInstance},
+		Confirms:  confirms,
+		Interval:  time.Hour,
+	}
+}
+
+func Test_FailoverLocker(t *testing.T) {
+	locker := newFailoverReplica(2)
+	ctx := context.Background()
+	opts := LockOptions{TTL: 300 * time.Millisecond}
+
+	h, err := locker.Acquire(ctx, "test:failover", opts)
+	if err != nil {
+		t.Fatalf("Acquire() err: %v", err)
+	}
+	if h.locker != locker.Primary {
+		t.Errorf("Acquire() backend: %T, want redis", h.locker)
+	}
+
+	// redis降级后连续Confirms次刷新仍不可用才切换到TiDB，持有redis锁的视为锁丢失
+	atomic.StoreInt32(&locker.Primary.unhealthy, 1)
+	locker.refresh(ctx)
+	if view, _ := locker.current(); view.backend != LockBackendRedis {
+		t.Errorf("backend after 1 failure: %v, want redis", view.backend)
+	}
+	locker.refresh(ctx)
+	h2, err := locker.Acquire(ctx, "test:failover", opts)
+	if err != nil {
+		t.Fatalf("Acquire() after failover err: %v", err)
+	}
+	if h2.locker != locker.Secondary {
+		t.Errorf("Acquire() backend: %T, want tidb", h2.locker)
+	}
+	select {
+	case <-h.Lost():
+	case <-time.After(time.Second):
+		t.Errorf("redis lock not lost after failover")
+	}
+	_ = locker.Release(ctx, h)
+
+	// 切换期间不发放锁
+	locker.Grace = time.Minute
+	atomic.StoreInt32(&locker.Primary.unhealthy, 0)
+	locker.refresh(ctx)
+	if _, err := locker.Acquire(ctx, "test:failover:grace", opts); err != LockNotAcquiredErr {
+		t.Errorf("Acquire() in grace err: %v, want LockNotAcquiredErr", err)
+	}
+
+	// redis恢复后切回
+	locker.Grace = 0
+	locker.refresh(ctx)
+	h3, err := locker.Acquire(ctx, "test:failover:back", opts)
+	if err != nil {
+		t.Fatalf("Acquire() after failback err: %v", err)
+	}
+	if h3.locker != locker.Primary {
+		t.Errorf("Acquire() backend: %T, want redis", h3.locker)
+	}
+	select {
+	case <-h2.Lost():
+	case <-time.After(time.Second):
+		t.Errorf("tidb lock not lost after failback")
+	}
+	_ = locker.Release(ctx, h2)
+	_ = locker.Release(ctx, h3)
+
+	// 本地状态过期时加锁失败
+	locker.mu.Lock()
+	locker.view.refreshedAt = time.Now().Add(-4 * locker.Interval)
+	locker.mu.Unlock()
+	if _, err := locker.Acquire(ctx, "test:failover:stale", opts); err != LockBackendUnknownErr {
+		t.Errorf("Acquire() stale backend err: %v, want LockBackendUnknownErr", err)
+	}
+}
+
+func Test_FailoverLockerReplicas(t *testing.T) {
+	ctx := context.Background()
+	opts := LockOptions{TTL: time.Second, Wait: 2 * time.Second}
+	replicas := []*FailoverLocker{newFailoverReplica(3), newFailoverReplica(3)}
+
+	// 多副本并发加同一个key，任一时刻只有一个持有者
+	var holders, maxHolders, total int32
+	run := func() {
+		var wg sync.WaitGroup
+		for _, replica := range replicas {
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func(locker *FailoverLocker) {
+					defer wg.Done()
+					if err := locker.LockWrap(ctx, "test:failover:replicas", func(ctx context.Context) error {
+						n := atomic.AddInt32(&holders, 1)
+						for {
+							m := atomic.LoadInt32(&maxHolders)
+							if n <= m || atomic.CompareAndSwapInt32(&maxHolders, m, n) {
+								break
+							}
+						}
+						time.Sleep(5 * time.Millisecond)
+						atomic.AddInt32(&holders, -1)
+						atomic.AddInt32(&total, 1)
+						return nil
+					}); err != nil {
+						t.Errorf("LockWrap() err: %v", err)
+					}
+				}(replica)
+			}
+		}
+		wg.Wait()
+	}
+	run()
+
+	// 单个副本短暂连不上redis不切换，其它副本照常使用redis
+	atomic.StoreInt32(&replicas[0].Primary.unhealthy, 1)
+	replicas[0].refresh(ctx)
+	replicas[0].refresh(ctx)
+	atomic.StoreInt32(&replicas[0].Primary.unhealthy, 0)
+	replicas[0].refresh(ctx)
+	atomic.StoreInt32(&replicas[0].Primary.unhealthy, 1)
+	replicas[0].refresh(ctx)
+	for i, replica := range replicas {
+		if view, _ := replica.current(); view.backend != LockBackendRedis {
+			t.Errorf("replica %v backend: %v, want redis", i, view.backend)
+		}
+	}
+
+	// 持续不可用后切换，其它副本刷新后跟随，持有redis锁的副本视为锁丢失
+	h, err := replicas[1].Acquire(ctx, "test:failover:held", opts)
+	if err != nil {
+		t.Fatalf("Acquire() err: %v", err)
+	}
+	replicas[0].refresh(ctx)
+	replicas[0].refresh(ctx)
+	if view, _ := replicas[0].current(); view.backend != LockBackendTiDB {
+		t.Errorf("replica 0 backend: %v, want tidb", view.backend)
+	}
+	replicas[1].refresh(ctx)
+	if view, _ := replicas[1].current(); view.backend != LockBackendTiDB {
+		t.Errorf("replica 1 backend: %v, want tidb", view.backend)
+	}
+	select {
+	case <-h.Lost():
+	case <-time.After(time.Second):
+		t.Errorf("redis lock on other replica not lost after failover")
+	}
+	_ = replicas[1].Release(ctx, h)
+	run()
+
+	if maxHolders != 1 {
+		t.Errorf("max concurrent holders: %v, want 1", maxHolders)
+	}
+	if total != 16 {
+		t.Errorf("total LockWrap: %v, want 16", total)
+	}
+
+	// 切回redis，不影响其它测试
+	atomic.StoreInt32(&replicas[0].Primary.unhealthy, 0)
+	replicas[0].refresh(ctx)
+}
+
+func Test_DelOrDefer(t *testing.T) {
+	ctx := context.Background()
+	defer atomic.StoreInt32(&RedisInstance.unhealthy, 0)
+
+	key := model.GetKeyForTopic(1)
+	if err := RedisInstance.RedisClient.Set(ctx, key, "1", time.Hour).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 降级期间登记到TiDB，恢复后补删、补写bitmap
+	atomic.StoreInt32(&RedisInstance.unhealthy, 1)
+	if err := RedisInstance.DelOrDefer(ctx, []string{key}); err != nil {
+		t.Fatalf("DelOrDefer() err: %v", err)
+	}
+	if err := RedisInstance.SetBitTopicsOrDefer(ctx, []int64{123456789}); err != nil {
+		t.Fatalf("SetBitTopicsOrDefer() err: %v", err)
+	}
+	atomic.StoreInt32(&RedisInstance.unhealthy, 0)
+	if err := RedisInstance.flushPending(ctx); err != nil {
+		t.Fatalf("flushPending() err: %v", err)
+	}
+
+	if n, _ := RedisInstance.RedisClient.Exists(ctx, key).Result(); n != 0 {
+		t.Errorf("deferred key not deleted: %v", key)
+	}
+	if ids, err := RedisInstance.GetBitTopics(ctx, []int64{123456789}); err != nil || len(ids) != 1 {
+		t.Errorf("deferred bit not set, ids: %v, err: %v", ids, err)
+	}
+	if pendingCacheOps, _ := TiDBInstance.PendingCacheOps(ctx, 0, 10); len(pendingCacheOps) != 0 {
+		t.Errorf("pending cache ops left: %v", len(pendingCacheOps))
+	}
+}
+
+// failDelHook fail为1时DEL所在的pipeline返回错误，ping不受影响
+type failDelHook struct {
+	fail int32
+}
+
+func (h *failDelHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *failDelHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h *failDelHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if atomic.LoadInt32(&h.fail) == 1 {
+		for _, cmd := range cmds {
+			if cmd.Name() == "del" {
+				return ctx, errors.New("del failed")
+			}
+		}
+	}
+	return ctx, nil
+}
+
+func (h *failDelHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func Test_ProbeFlushFailure(t *testing.T) {
+	ctx := context.Background()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	hook := &failDelHook{}
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	client.AddHook(hook)
+	r := &Redis{Log: RedisInstance.Log, RedisClient: client, unhealthy: 1}
+
+	key := model.GetKeyForTopic(2)
+	if err := client.Set(ctx, key, "1", time.Hour).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.DelOrDefer(ctx, []string{key}); err != nil {
+		t.Fatalf("DelOrDefer() err: %v", err)
+	}
+	if err := r.SetBitTopicsOrDefer(ctx, []int64{987654321}); err != nil {
+		t.Fatalf("SetBitTopicsOrDefer() err: %v", err)
+	}
+
+	// bitmap已补写、删除失败，保持降级，登记保留
+	atomic.StoreInt32(&hook.fail, 1)
+	failures := 0
+	r.probe(ctx, time.Second, false, &failures)
+	if r.Healthy() {
+		t.Fatal("healthy before pending ops flushed")
+	}
+	if n, _ := client.Exists(ctx, key).Result(); n != 1 {
+		t.Errorf("key deleted unexpectedly")
+	}
+	if pendingCacheOps, _ := TiDBInstance.PendingCacheOps(ctx, 0, 10); len(pendingCacheOps) != 2 {
+		t.Errorf("pending cache ops: %v, want 2", len(pendingCacheOps))
+	}
+
+	// 下次探测重试，全部补做后切回
+	atomic.StoreInt32(&hook.fail, 0)
+	r.probe(ctx, time.Second, false, &failures)
+	if !r.Healthy() {
+		t.Fatal("not healthy after pending ops flushed")
+	}
+	if n, _ := client.Exists(ctx, key).Result(); n != 0 {
+		t.Errorf("deferred key not deleted: %v", key)
+	}
+	if ids, err := r.GetBitTopics(ctx, []int64{987654321}); err != nil || len(ids) != 1 {
+		t.Errorf("deferred bit not set, ids: %v, err: %v", ids, err)
+	}
+	if pendingCacheOps, _ := TiDBInstance.PendingCacheOps(ctx, 0, 10); len(pendingCacheOps) != 0 {
+		t.Errorf("pending cache ops left: %v", len(pendingCacheOps))
+	}
+}
@@ -0,0 +1,172 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sort"
+	"time"
+)
+
+type outboxKey struct{}
+
+// OutboxBuilderMissingErr 话题写入必须登记事件，ctx未携带builder时写入失败，避免漏发
+var OutboxBuilderMissingErr = errors.New("outbox builder missing")
+
+// OutboxBuilder 在话题写入的事务内，按写入后的数据生成待发布事件
+// befores为事务内读取的完整变更前数据，创建、删除等不需要时为nil
+type OutboxBuilder func(befores map[int64]*model.TopicDetail, afters []*model.TopicDetail) ([]*model.OutboxEvent, error)
+
+// WithOutbox 话题写入时在同一事务内登记builder生成的事件
+func WithOutbox(ctx context.Context, builder OutboxBuilder) context.Context {
+	return context.WithValue(ctx, outboxKey{}, builder)
+}
+
+// writeOutbox 事务内登记事件，ids为本次写入的话题；afters含已删除的话题
+func (dao *TiDB) writeOutbox(ctx context.Context, dbTrans *gorm.DB, ids []int64, befores map[int64]*model.TopicDetail) error {
+	// 事务提交前最后一步，持锁写入时在此确认锁未丢失
+	if err := lockAlive(ctx); err != nil {
+		return err
+	}
+
+	builder, ok := ctx.Value(outboxKey{}).(OutboxBuilder)
+	if !ok {
+		dao.Log.Errorf("[dao] writeOutbox err: %v, count: %v", OutboxBuilderMissingErr, len(ids))
+		return OutboxBuilderMissingErr
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	afters := make([]*model.TopicDetail, 0, len(ids))
+	if err := dbTrans.Unscoped().Find(&afters, "id in (?)", ids).Error; err != nil {
+		dao.Log.Errorf("[dao] writeOutbox Find err: %v, count: %v", err, len(ids))
+		return err
+	}
+	outboxEvents, err := builder(befores, afters)
+	if err != nil {
+		dao.Log.Errorf("[dao] writeOutbox build err: %v, count: %v", err, len(ids))
+		return err
+	}
+	if len(outboxEvents) == 0 {
+		return nil
+	}
+
+	if err := insertOutboxEvents(dbTrans, outboxEvents); err != nil {
+		dao.Log.Errorf("[dao] writeOutbox insert err: %v, count: %v", err, len(outboxEvents))
+		return err
+	}
+	if err := dao.writeWebhookDeliveries(ctx, dbTrans, outboxEvents); err != nil {
+		dao.Log.Errorf("[dao] writeOutbox webhook deliveries err: %v, count: %v", err, len(outboxEvents))
+		return err
+	}
+	return nil
+}
+
+// insertOutboxEvents 事务内为每个话题分配连续的seq后写入，同一话题的事件按切片顺序排列
+// 序号行的锁持有至事务提交，同一话题并发登记时依次提交，seq顺序即提交顺序
+func insertOutboxEvents(dbTrans *gorm.DB, outboxEvents []*model.OutboxEvent) error {
+	counts := make(map[int64]int64)
+	topicIDs := make([]int64, 0)
+	for _, outboxEvent := range outboxEvents {
+		if counts[outboxEvent.TopicID] == 0 {
+			topicIDs = append(topicIDs, outboxEvent.TopicID)
+		}
+		counts[outboxEvent.TopicID]++
+	}
+	// 按话题id顺序加锁，避免并发登记时死锁
+	sort.Slice(topicIDs, func(i, k int) bool { return topicIDs[i] < topicIDs[k] })
+
+	nextSeqs := make(map[int64]int64, len(topicIDs))
+	for _, topicID := range topicIDs {
+		outboxSequence := &model.OutboxSequence{TopicID: topicID, Seq: counts[topicID]}
+		if err := dbTrans.Clauses(clause.OnConflict{
+			DoUpdates: clause.Assignments(map[string]interface{}{"seq": gorm.Expr("seq + ?", counts[topicID])}),
+		}).Create(outboxSequence).Error; err != nil {
+			return err
+		}
+		if err := dbTrans.First(outboxSequence, "topic_id = ?", topicID).Error; err != nil {
+			return err
+		}
+		nextSeqs[topicID] = outboxSequence.Seq - counts[topicID] + 1
+	}
+
+	now := time.Now()
+	for _, outboxEvent := range outboxEvents {
+		outboxEvent.Seq = nextSeqs[outboxEvent.TopicID]
+		nextSeqs[outboxEvent.TopicID]++
+		outboxEvent.NextAttemptAt = now
+	}
+	return dbTrans.Create(&outboxEvents).Error
+}
+
+// EnqueueTopicEvents 不修改话题，只按ctx中的builder为ids登记发件箱事件，如重建es索引
+func (dao *TiDB) EnqueueTopicEvents(ctx context.Context, ids []int64) error {
+	if err := dao.DB.WithContext(ctx).Transaction(func(dbTrans *gorm.DB) error {
+		return dao.writeOutbox(ctx, dbTrans, ids, nil)
+	}); err != nil {
+		dao.Log.Errorf("[dao] EnqueueTopicEvents err: %v, count: %v", err, len(ids))
+		return err
+	}
+
+	return nil
+}
+
+// PendingOutboxEvents 返回话题id大于afterTopicID的待发布事件，按话题、seq排序，同一话题的事件连续且从最早未发布的开始
+// 有事件未到重试时间或有死信的话题整体跳过，其余话题不受影响
+func (dao *TiDB) PendingOutboxEvents(ctx context.Context, afterTopicID int64, limit int) ([]*model.OutboxEvent, error) {
+	outboxEvents := make([]*model.OutboxEvent, 0)
+
+	db := dao.DB.WithContext(ctx)
+	blocked := db.Model(&model.OutboxEvent{}).Select("topic_id").Where("sent_at IS NULL AND next_attempt_at > ?", time.Now())
+	deadLettered := db.Model(&model.DeadLetter{}).Select("topic_id")
+	if err := db.Where("sent_at IS NULL AND topic_id > ? AND topic_id NOT IN (?) AND topic_id NOT IN (?)",
+		afterTopicID, blocked, deadLettered).
+		Order("topic_id asc, seq asc, id asc").Limit(limit).Find(&outboxEvents).Error; err != nil {
+		dao.Log.Errorf("[dao] PendingOutboxEvents err: %v", err)
+		return outboxEvents, err
+	}
+
+	return outboxEvents, nil
+}
+
+// MarkOutboxEventSent 仅标记未发布的事件，返回false表示已被标记
+func (dao *TiDB) MarkOutboxEventSent(ctx context.Context, id int64) (bool, error) {
+	db := dao.DB.WithContext(ctx).Model(&model.OutboxEvent{}).Where("id = ? AND sent_at IS NULL", id).
+		Update("sent_at", time.Now())
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] MarkOutboxEventSent err: %v, id: %v", err, id)
+		return false, err
+	}
+
+	return db.RowsAffected != 0, nil
+}
+
+// OutboxEventFailed 记录发布失败，nextAttemptAt前不再重试，首次失败时记录失败时间
+func (dao *TiDB) OutboxEventFailed(ctx context.Context, id int64, errMsg string, nextAttemptAt time.Time) error {
+	if err := dao.DB.WithContext(ctx).Model(&model.OutboxEvent{}).Where("id = ? AND sent_at IS NULL", id).
+		Updates(map[string]interface{}{
+			"attempts":        gorm.Expr("attempts + 1"),
+			"err":             errMsg,
+			"next_attempt_at": nextAttemptAt,
+			"first_failed_at": gorm.Expr("COALESCE(first_failed_at, ?)", time.Now()),
+		}).Error; err != nil {
+		dao.Log.Errorf("[dao] OutboxEventFailed err: %v, id: %v", err, id)
+		return err
+	}
+
+	return nil
+}
+
+// PurgeOutboxEvents 删除before前已发布的事件
+func (dao *TiDB) PurgeOutboxEvents(ctx context.Context, before time.Time) (int64, error) {
+	db := dao.DB.WithContext(ctx).Where("sent_at < ?", before).Delete(&model.OutboxEvent{})
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] PurgeOutboxEvents err: %v", err)
+		return 0, err
+	}
+
+	return db.RowsAffected, nil
+}
@@ -2,35 +2,55 @@ package dao
 
 import (
 	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
 	"dm-gitlab.bolo.me/hubpd/topic/config"
 	"dm-gitlab.bolo.me/hubpd/topic/model"
-	"encoding/json"
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"github.com/go-redis/redis/v8"
 	"github.com/sirupsen/logrus"
 	"math/rand"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 type Redis struct {
-	Log                *logrus.Entry
-	RedisClusterClient *redis.ClusterClient
+	Log         *logrus.Entry
+	RedisClient redis.UniversalClient
+
+	unhealthy int32 // 0-正常，1-降级；零值即正常，便于直接构造
 }
 
 var RedisInstance *Redis
 
+// redis降级期间，需要加锁的写操作直接失败
+var RedisUnavailableErr = &common.InternalError{
+	ErrCode: common.Code_SvcUnavailable,
+	ErrMsg:  common.Msg_SvcUnavailable,
+}
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
 func (r *Redis) SetTopics(ctx context.Context, topicInfos []*model.TopicInfo) error {
-	pipe := r.RedisClusterClient.Pipeline()
+	pipe := r.RedisClient.Pipeline()
 	for _, topicInfo := range topicInfos {
 		if topicInfo.TopicDetail != nil {
-			topicInfoJson, _ := json.Marshal(topicInfo)
+			var topicInfoBytes []byte
+			var err error
+			if config.Cfg.RedisCacheCodec == model.CacheCodecMsgpack {
+				topicInfoBytes, err = model.EncodeTopicInfo(topicInfo, config.Cfg.RedisCompressThreshold)
+			} else {
+				topicInfoBytes, err = model.EncodeTopicInfoJSON(topicInfo)
+			}
+			if err != nil {
+				r.Log.Errorf("[dao redis] SetTopics EncodeTopicInfo err: %v, id: %v", err, topicInfo.TopicDetail.ID)
+				continue
+			}
 			exp := time.Duration(10+rand.Intn(20)) * time.Hour // [10, 30)
-			pipe.Set(ctx, model.GetKeyForTopic(topicInfo.TopicDetail.ID), topicInfoJson, exp)
+			pipe.Set(ctx, model.GetKeyForTopic(topicInfo.TopicDetail.ID), topicInfoBytes, exp)
 		}
 	}
 	_, err := pipe.Exec(ctx)
@@ -48,7 +68,7 @@ func (r *Redis) SetTopics(ctx context.Context, topicInfos []*model.TopicInfo) er
 func (r *Redis) GetTopics(ctx context.Context, topicIds []int64) (map[int64]*model.TopicInfo, error) {
 	topicInfoMap := make(map[int64]*model.TopicInfo, 0)
 
-	pipe := r.RedisClusterClient.Pipeline()
+	pipe := r.RedisClient.Pipeline()
 	for _, topicId := range topicIds {
 		pipe.Get(ctx, model.GetKeyForTopic(topicId))
 	}
@@ -62,13 +82,18 @@ func (r *Redis) GetTopics(ctx context.Context, topicIds []int64) (map[int64]*mod
 	}
 
 	for _, resItem := range res {
-		topicInfo := &model.TopicInfo{}
+		var topicInfo *model.TopicInfo
 		if b, ok := resItem.(*redis.StringCmd); ok {
 			if b.Val() == "" {
 				continue
 			}
-			if err := json.Unmarshal([]byte(b.Val()), topicInfo); err != nil {
-				currErr := fmt.Errorf("[dao redis] GetTopics Unmarshal err: %v, topicIds: %v", err, topicIds)
+			var err error
+			if topicInfo, err = model.DecodeTopicInfo([]byte(b.Val())); err != nil {
+				// 旧版本缓存按未命中处理，回源后覆盖
+				if err == model.ErrCacheSchemaMismatch {
+					continue
+				}
+				currErr := fmt.Errorf("[dao redis] GetTopics DecodeTopicInfo err: %v, topicIds: %v", err, topicIds)
 				r.Log.Error(currErr)
 				sentry.CaptureException(currErr)
 				continue
@@ -84,78 +109,226 @@ func (r *Redis) GetTopics(ctx context.Context, topicIds []int64) (map[int64]*mod
 	return topicInfoMap, nil
 }
 
-func (r *Redis) Lock(ctx context.Context, lockKey string) error {
-	r.Log.Infof("[dao] redis lock, will setNX, key: %v, value: %v, expiration: %v",
-		lockKey, model.RedisLockSecret, time.Duration(config.Cfg.RedisLockExpirationSec)*time.Second)
+// TTLTopics 话题缓存剩余有效期，key不存在时为负数
+func (r *Redis) TTLTopics(ctx context.Context, topicIds []int64) (map[int64]time.Duration, error) {
+	ttlMap := make(map[int64]time.Duration, len(topicIds))
+
+	pipe := r.RedisClient.Pipeline()
+	cmds := make([]*redis.DurationCmd, 0, len(topicIds))
+	for _, topicId := range topicIds {
+		cmds = append(cmds, pipe.TTL(ctx, model.GetKeyForTopic(topicId)))
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		currErr := fmt.Errorf("[dao redis] TTLTopics pipe.TTL err: %v, topicIds: %v", err, topicIds)
+		r.Log.Error(currErr)
+		sentry.CaptureException(currErr)
+
+		return ttlMap, err
+	}
+
+	for i, cmd := range cmds {
+		ttlMap[topicIds[i]] = cmd.Val()
+	}
+
+	return ttlMap, nil
+}
+
+// ScanTopicIds 遍历所有话题缓存key，集群模式下逐个master扫描
+func (r *Redis) ScanTopicIds(ctx context.Context, f func(ids []int64) error) error {
+	match := model.Topic + ":*"
+
+	scan := func(ctx context.Context, client *redis.Client) error {
+		var cursor uint64
+		for {
+			keys, nextCursor, err := client.Scan(ctx, cursor, match, 500).Result()
+			if err != nil {
+				return err
+			}
+
+			ids := make([]int64, 0, len(keys))
+			for _, key := range keys {
+				if id, ok := model.ParseKeyForTopic(key); ok {
+					ids = append(ids, id)
+				}
+			}
+			if len(ids) != 0 {
+				if err := f(ids); err != nil {
+					return err
+				}
+			}
 
-	resp := r.RedisClusterClient.SetNX(
-		ctx, lockKey, model.RedisLockSecret, time.Duration(config.Cfg.RedisLockExpirationSec)*time.Second)
-	lockSuccess, err := resp.Result()
+			if nextCursor == 0 {
+				return nil
+			}
+			cursor = nextCursor
+		}
+	}
+
+	var err error
+	switch client := r.RedisClient.(type) {
+	case *redis.ClusterClient:
+		err = client.ForEachMaster(ctx, scan)
+	case *redis.Client:
+		err = scan(ctx, client)
+	default:
+		err = fmt.Errorf("unsupported redis client type: %T", r.RedisClient)
+	}
 	if err != nil {
-		lockFailErr := fmt.Errorf("[dao] redis lock SetNX fail, key: %v, err: %v", lockKey, err)
-		r.Log.Error(lockFailErr)
-		sentry.CaptureException(lockFailErr)
+		currErr := fmt.Errorf("[dao redis] ScanTopicIds err: %v", err)
+		r.Log.Error(currErr)
+		sentry.CaptureException(currErr)
 		return err
 	}
-	if !lockSuccess {
-		lockFailErr := fmt.Errorf("[dao] redis lock SetNX fail, key: %v, result: %v", lockKey, lockSuccess)
-		r.Log.Info(lockFailErr)
-		return lockFailErr
-	}
 
 	return nil
 }
 
-func (r *Redis) UnLock(ctx context.Context, lockKey string) error {
-	r.Log.Infof("[dao] redis unLock, will checkAndDel key, key: %v, value: %v", lockKey, model.RedisLockSecret)
+// DelOrDefer 降级期间不阻塞写操作，待删key登记到TiDB，恢复后补删；登记失败时返回错误
+func (r *Redis) DelOrDefer(ctx context.Context, keys []string) error {
+	if r.Healthy() {
+		return r.Del(ctx, keys)
+	}
 
-	script := redis.NewScript(`
-		if redis.call('get', KEYS[1]) == ARGV[1] 
-			then 
-				return redis.call('del', KEYS[1]) 
-			else 
-				return 0 
-			end
-		`)
-	scriptResp, err := script.Run(ctx, r.RedisClusterClient, []string{lockKey}, []interface{}{model.RedisLockSecret}).Int()
-	if err != nil {
-		unLockFailErr := fmt.Errorf("[dao] redis unLock checkAndDel key fail, key: %v, err: %v", lockKey, err)
-		r.Log.Error(unLockFailErr)
-		sentry.CaptureException(unLockFailErr)
+	if err := TiDBInstance.SavePendingCacheOps(ctx, model.PendingCacheOpDel, keys); err != nil {
 		return err
 	}
-	if scriptResp == 0 {
-		unLockFailErr := fmt.Errorf("[dao] redis unLock checkAndDel key fail, key: %v, result: %v", lockKey, scriptResp)
-		r.Log.Info(unLockFailErr)
-		//sentry.CaptureException(unLockFailErr)
-		//return unLockFailErr
+	r.Log.Warnf("[dao redis] DelOrDefer redis unavailable, deferred keys: %v", keys)
+
+	return nil
+}
+
+// SetBitTopicsOrDefer 降级期间待写入bitmap的id登记到TiDB，恢复后补写；登记失败时返回错误
+func (r *Redis) SetBitTopicsOrDefer(ctx context.Context, ids []int64) error {
+	if r.Healthy() {
+		return r.SetBitTopics(ctx, ids)
+	}
+
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, strconv.FormatInt(id, 10))
+	}
+	if err := TiDBInstance.SavePendingCacheOps(ctx, model.PendingCacheOpSetBit, keys); err != nil {
+		return err
 	}
+	r.Log.Warnf("[dao redis] SetBitTopicsOrDefer redis unavailable, deferred ids: %v", ids)
 
 	return nil
 }
 
-func (r *Redis) LockWrap(ctx context.Context, lockKey string, f func() error) (err error) {
-	// redis lock
-	if err = r.Lock(ctx, lockKey); err != nil {
-		return
+// flushPending redis可用时补做登记的缓存操作，成功后删除登记；各副本并发补做时操作幂等
+// 遇到错误即返回，剩余登记在下次探测时重试
+func (r *Redis) flushPending(ctx context.Context) error {
+	var afterID int64
+	var flushed int
+	for {
+		pendingCacheOps, err := TiDBInstance.PendingCacheOps(ctx, afterID, 500)
+		if err != nil {
+			return err
+		}
+		if len(pendingCacheOps) == 0 {
+			break
+		}
+		afterID = pendingCacheOps[len(pendingCacheOps)-1].ID
+
+		keys := make([]string, 0)
+		ids := make([]int64, 0)
+		for _, pendingCacheOp := range pendingCacheOps {
+			switch pendingCacheOp.Op {
+			case model.PendingCacheOpDel:
+				keys = append(keys, pendingCacheOp.Key)
+			case model.PendingCacheOpSetBit:
+				if id, err := strconv.ParseInt(pendingCacheOp.Key, 10, 64); err == nil {
+					ids = append(ids, id)
+				}
+			}
+		}
+		if len(ids) != 0 {
+			if err := r.SetBitTopics(ctx, ids); err != nil {
+				return err
+			}
+		}
+		if len(keys) != 0 {
+			if err := r.Del(ctx, keys); err != nil {
+				return err
+			}
+		}
+
+		doneIds := make([]int64, 0, len(pendingCacheOps))
+		for _, pendingCacheOp := range pendingCacheOps {
+			doneIds = append(doneIds, pendingCacheOp.ID)
+		}
+		if err := TiDBInstance.DelPendingCacheOps(ctx, doneIds); err != nil {
+			return err
+		}
+		flushed += len(doneIds)
+	}
+	if flushed != 0 {
+		r.Log.Infof("[dao redis] flushPending done, flushed: %v", flushed)
+	}
+	return nil
+}
+
+func (r *Redis) Healthy() bool {
+	return atomic.LoadInt32(&r.unhealthy) == 0
+}
+
+// Probe 周期性ping redis，连续失败达到阈值后切换到降级模式，恢复后切回
+func (r *Redis) Probe(ctx context.Context) {
+	interval := time.Duration(config.Cfg.RedisProbeIntervalSec) * time.Second
+	if interval <= 0 {
+		r.Log.Warnf("[dao redis] Probe invalid RedisProbeIntervalSec: %v, use default 5s", config.Cfg.RedisProbeIntervalSec)
+		interval = 5 * time.Second
 	}
-	// redis unLock
-	defer func() {
-		if unLockErr := r.UnLock(ctx, lockKey); unLockErr != nil {
-			err = unLockErr
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failures := 0
+	for first := true; ; first = false {
+		r.probe(ctx, interval, first, &failures)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-	}()
+	}
+}
+
+// probe 单次探测；可用时每次都补做登记的缓存操作，全部补做完才从降级切回，避免读到待删除的缓存
+func (r *Redis) probe(ctx context.Context, timeout time.Duration, first bool, failures *int) {
+	pingCtx, cancel := context.WithTimeout(ctx, timeout)
+	err := r.RedisClient.Ping(pingCtx).Err()
+	cancel()
 
-	if err = f(); err != nil {
-		r.Log.Errorf("[redis] LockWrap f() return err: %v", err)
+	if err != nil {
+		*failures++
+		r.Log.Warnf("[dao redis] Probe ping fail, failures: %v, err: %v", *failures, err)
+		// 启动时首次探测失败直接降级
+		if (first || *failures >= config.Cfg.RedisProbeFailures) && atomic.CompareAndSwapInt32(&r.unhealthy, 0, 1) {
+			currErr := fmt.Errorf("[dao redis] Probe redis unavailable, switch to degraded mode, err: %v", err)
+			r.Log.Error(currErr)
+			sentry.CaptureException(currErr)
+		}
 		return
 	}
+	*failures = 0
 
-	return
+	if err := r.flushPending(ctx); err != nil {
+		r.Log.Warnf("[dao redis] Probe flushPending err: %v, healthy: %v", err, r.Healthy())
+		return
+	}
+	if atomic.CompareAndSwapInt32(&r.unhealthy, 1, 0) {
+		r.Log.Infof("[dao redis] Probe redis recovered, switch back to normal mode")
+		// 补做切回前最后一次读取后登记的操作
+		if err := r.flushPending(ctx); err != nil {
+			r.Log.Warnf("[dao redis] Probe flushPending err: %v", err)
+		}
+	}
 }
 
 func (r *Redis) Del(ctx context.Context, keys []string) error {
-	pipe := r.RedisClusterClient.Pipeline()
+	pipe := r.RedisClient.Pipeline()
 	for _, key := range keys {
 		pipe.Del(ctx, key)
 	}
@@ -172,7 +345,7 @@ func (r *Redis) Del(ctx context.Context, keys []string) error {
 
 // 注意 bitmap只增勿删
 func (r *Redis) SetBitTopics(ctx context.Context, ids []int64) error {
-	pipe := r.RedisClusterClient.Pipeline()
+	pipe := r.RedisClient.Pipeline()
 	for _, id := range ids {
 		if id == 0 {
 			return fmt.Errorf("[dao redis] SetBitTopics id == 0, ids: %v", ids)
@@ -195,7 +368,7 @@ func (r *Redis) SetBitTopics(ctx context.Context, ids []int64) error {
 func (r *Redis) GetBitTopics(ctx context.Context, ids []int64) ([]int64, error) {
 	resIDs := make([]int64, 0)
 
-	pipe := r.RedisClusterClient.Pipeline()
+	pipe := r.RedisClient.Pipeline()
 	for _, id := range ids {
 		if id == 0 {
 			return resIDs, fmt.Errorf("[dao redis] GetBitTopics id == 0, ids: %v", ids)
@@ -0,0 +1,137 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"time"
+)
+
+// 认领到期成员：score改为认领截止时间，处理副本宕机时到期后被重新认领，多副本同时消费不会重复
+var delayClaimScript = redis.NewScript(`
+local ids = redis.call('zrangebyscore', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(ids) do
+	redis.call('zadd', KEYS[1], 'XX', ARGV[3], id)
+end
+return ids
+`)
+
+// 确认处理完成：score仍为认领截止时间才删除，处理期间已重新登记的切换时间保留
+var delayAckScript = redis.NewScript(`
+local acked = 0
+for i = 2, #ARGV do
+	local score = redis.call('zscore', KEYS[1], ARGV[i])
+	if score and tonumber(score) == tonumber(ARGV[1]) then
+		acked = acked + redis.call('zrem', KEYS[1], ARGV[i])
+	end
+end
+return acked
+`)
+
+const keyDelayTopicStatusBackfilled = ":backfilled"
+
+// ScheduleTopicStatus 每个话题只保留下一次状态切换，重复调用覆盖切换时间
+func (r *Redis) ScheduleTopicStatus(ctx context.Context, id int64, at time.Time) error {
+	return r.ScheduleTopicsStatus(ctx, map[int64]time.Time{id: at})
+}
+
+func (r *Redis) ScheduleTopicsStatus(ctx context.Context, schedule map[int64]time.Time) error {
+	if len(schedule) == 0 {
+		return nil
+	}
+
+	members := make([]*redis.Z, 0, len(schedule))
+	for id, at := range schedule {
+		members = append(members, &redis.Z{
+			Score:  float64(at.UnixNano() / int64(time.Millisecond)),
+			Member: id,
+		})
+	}
+	if err := r.RedisClient.ZAdd(ctx, model.KeyDelayTopicStatus, members...).Err(); err != nil {
+		currErr := fmt.Errorf("[dao redis] ScheduleTopicsStatus ZAdd err: %v, count: %v", err, len(schedule))
+		r.Log.Error(currErr)
+		sentry.CaptureException(currErr)
+		return err
+	}
+
+	return nil
+}
+
+func (r *Redis) UnscheduleTopicStatus(ctx context.Context, ids []int64) error {
+	members := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		members = append(members, id)
+	}
+	if err := r.RedisClient.ZRem(ctx, model.KeyDelayTopicStatus, members...).Err(); err != nil {
+		currErr := fmt.Errorf("[dao redis] UnscheduleTopicStatus ZRem err: %v, ids: %v", err, ids)
+		r.Log.Error(currErr)
+		sentry.CaptureException(currErr)
+		return err
+	}
+
+	return nil
+}
+
+// ClaimDueTopicStatus 认领now前到期的话题，最多limit个，返回的deadline用于AckTopicStatus
+// 未确认的话题在deadline后重新到期
+func (r *Redis) ClaimDueTopicStatus(ctx context.Context, now time.Time, visibility time.Duration, limit int) ([]int64, int64, error) {
+	deadline := now.Add(visibility).UnixNano() / int64(time.Millisecond)
+	res, err := delayClaimScript.Run(ctx, r.RedisClient, []string{model.KeyDelayTopicStatus},
+		now.UnixNano()/int64(time.Millisecond), limit, deadline).Result()
+	if err != nil && err != redis.Nil {
+		r.Log.Errorf("[dao redis] ClaimDueTopicStatus err: %v", err)
+		return nil, 0, err
+	}
+
+	members, _ := res.([]interface{})
+	ids := make([]int64, 0, len(members))
+	for _, member := range members {
+		id, err := strconv.ParseInt(fmt.Sprint(member), 10, 64)
+		if err != nil {
+			r.Log.Errorf("[dao redis] ClaimDueTopicStatus invalid member: %v", member)
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, deadline, nil
+}
+
+func (r *Redis) AckTopicStatus(ctx context.Context, ids []int64, deadline int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, deadline)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	if err := delayAckScript.Run(ctx, r.RedisClient, []string{model.KeyDelayTopicStatus}, args...).Err(); err != nil && err != redis.Nil {
+		r.Log.Errorf("[dao redis] AckTopicStatus err: %v, ids: %v", err, ids)
+		return err
+	}
+
+	return nil
+}
+
+// TopicStatusBackfilled 延时队列是否已补登记存量话题，redis数据丢失时标记随队列一起丢失
+func (r *Redis) TopicStatusBackfilled(ctx context.Context) (bool, error) {
+	n, err := r.RedisClient.Exists(ctx, model.KeyDelayTopicStatus+keyDelayTopicStatusBackfilled).Result()
+	if err != nil {
+		r.Log.Errorf("[dao redis] TopicStatusBackfilled err: %v", err)
+		return false, err
+	}
+	return n != 0, nil
+}
+
+func (r *Redis) MarkTopicStatusBackfilled(ctx context.Context) error {
+	if err := r.RedisClient.Set(ctx, model.KeyDelayTopicStatus+keyDelayTopicStatusBackfilled, time.Now().Unix(), 0).Err(); err != nil {
+		r.Log.Errorf("[dao redis] MarkTopicStatusBackfilled err: %v", err)
+		return err
+	}
+	return nil
+}
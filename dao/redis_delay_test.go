@@ -0,0 +1,47 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"testing"
+	"time"
+)
+
+func Test_ClaimAckTopicStatus(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	defer RedisInstance.RedisClient.Del(ctx, model.KeyDelayTopicStatus)
+
+	if err := RedisInstance.ScheduleTopicsStatus(ctx, map[int64]time.Time{
+		1: now.Add(-time.Second),
+		2: now.Add(-time.Second),
+		3: now.Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, deadline, err := RedisInstance.ClaimDueTopicStatus(ctx, now, time.Minute, 10)
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("ClaimDueTopicStatus() ids: %v, err: %v", ids, err)
+	}
+	// 认领期间不会被其它副本重复取出
+	if ids, _, _ := RedisInstance.ClaimDueTopicStatus(ctx, now, time.Minute, 10); len(ids) != 0 {
+		t.Errorf("ClaimDueTopicStatus() claimed twice: %v", ids)
+	}
+	// 未确认的话题在认领超时后重新到期
+	if ids, _, _ := RedisInstance.ClaimDueTopicStatus(ctx, now.Add(2*time.Minute), time.Minute, 10); len(ids) != 2 {
+		t.Errorf("ClaimDueTopicStatus() after timeout: %v, want 2", ids)
+	}
+
+	// 处理期间重新登记的切换时间不会被确认删除
+	ids, deadline, _ = RedisInstance.ClaimDueTopicStatus(ctx, now.Add(4*time.Minute), time.Minute, 10)
+	if err := RedisInstance.ScheduleTopicStatus(ctx, 2, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := RedisInstance.AckTopicStatus(ctx, ids, deadline); err != nil {
+		t.Fatalf("AckTopicStatus() err: %v", err)
+	}
+	if n, _ := RedisInstance.RedisClient.ZCard(ctx, model.KeyDelayTopicStatus).Result(); n != 2 {
+		t.Errorf("queue size after ack: %v, want 2", n)
+	}
+}
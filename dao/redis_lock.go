@@ -0,0 +1,117 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"github.com/go-redis/redis/v8"
+	uuid "github.com/satori/go.uuid"
+	"time"
+)
+
+var (
+	// 加锁成功时推进fence：max(fence+1, redis当前微秒时间)，与TiDB租约锁的fence可比较，后端切换后仍单调
+	// fence key与锁key同hash tag；fence不低于当前时间，fence key过期后重建也不会回退，过期时间只用于回收
+	lockAcquireScript = redis.NewScript(`
+		if redis.call('set', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2])
+			then
+				local fence = redis.call('incr', KEYS[2])
+				local t = redis.call('time')
+				local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+				if fence < now then
+					redis.call('set', KEYS[2], string.format('%d', now))
+					fence = now
+				end
+				redis.call('pexpire', KEYS[2], ARGV[3])
+				return fence
+			else
+				return 0
+			end
+		`)
+	lockRenewScript = redis.NewScript(`
+		if redis.call('get', KEYS[1]) == ARGV[1]
+			then
+				return redis.call('pexpire', KEYS[1], ARGV[2])
+			else
+				return 0
+			end
+		`)
+	lockReleaseScript = redis.NewScript(`
+		if redis.call('get', KEYS[1]) == ARGV[1]
+			then
+				return redis.call('del', KEYS[1])
+			else
+				return 0
+			end
+		`)
+)
+
+// lockFenceTTL fence key的回收时间
+const lockFenceTTL = 24 * time.Hour
+
+func (r *Redis) Acquire(ctx context.Context, lockKey string, opts LockOptions) (*LockHandle, error) {
+	if !r.Healthy() {
+		r.Log.Warnf("[dao] redis lock fail fast in degraded mode, key: %v", lockKey)
+		return nil, RedisUnavailableErr
+	}
+
+	token := uuid.NewV4().String()
+	h, err := acquireWithWait(ctx, opts, func() (*LockHandle, error) {
+		fence, err := lockAcquireScript.Run(ctx, r.RedisClient, []string{lockKey, model.GetKeyForLockFence(lockKey)},
+			token, opts.TTL.Milliseconds(), lockFenceTTL.Milliseconds()).Int64()
+		if err != nil {
+			lockFailErr := fmt.Errorf("[dao] redis lock acquire fail, key: %v, err: %v", lockKey, err)
+			r.Log.Error(lockFailErr)
+			sentry.CaptureException(lockFailErr)
+			return nil, err
+		}
+		if fence == 0 {
+			return nil, nil
+		}
+		return newLockHandle(r, lockKey, token, fence, func(ctx context.Context) (bool, error) {
+			renewed, err := lockRenewScript.Run(ctx, r.RedisClient, []string{lockKey}, token, opts.TTL.Milliseconds()).Int()
+			return renewed != 0, err
+		}), nil
+	})
+	if err != nil {
+		r.Log.Infof("[dao] redis lock not acquired, key: %v, wait: %v, err: %v", lockKey, opts.Wait, err)
+		return nil, err
+	}
+
+	r.Log.Infof("[dao] redis lock acquired, key: %v, token: %v, fence: %v, ttl: %v", lockKey, token, h.Fence, opts.TTL)
+	go watchdog(r.Log, h, opts.TTL)
+
+	return h, nil
+}
+
+func (r *Redis) Release(ctx context.Context, h *LockHandle) error {
+	h.stopWatchdog()
+
+	r.Log.Infof("[dao] redis unLock, key: %v, token: %v", h.Key, h.Token)
+	released, err := lockReleaseScript.Run(ctx, r.RedisClient, []string{h.Key}, h.Token).Int()
+	if err != nil {
+		unLockFailErr := fmt.Errorf("[dao] redis unLock fail, key: %v, err: %v", h.Key, err)
+		r.Log.Error(unLockFailErr)
+		sentry.CaptureException(unLockFailErr)
+		return err
+	}
+	if released == 0 {
+		r.Log.Infof("[dao] redis unLock, lock already expired or taken over, key: %v, token: %v", h.Key, h.Token)
+	}
+
+	return nil
+}
+
+func (r *Redis) Held(ctx context.Context, lockKey string) (bool, error) {
+	n, err := r.RedisClient.Exists(ctx, lockKey).Result()
+	if err != nil {
+		r.Log.Errorf("[dao] redis lock Held err: %v, key: %v", err, lockKey)
+		return false, err
+	}
+	return n != 0, nil
+}
+
+func (r *Redis) LockWrap(ctx context.Context, lockKey string, f func(ctx context.Context) error) error {
+	return lockWrap(ctx, r, r.Log, lockKey, f)
+}
@@ -0,0 +1,55 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strconv"
+)
+
+// TopicStatisticsByTopicIds 已落库的统计数据
+func (dao *TiDB) TopicStatisticsByTopicIds(ctx context.Context, topicIDs []int64) (map[int64]*model.TopicStatistic, error) {
+	topicStatisticMap := make(map[int64]*model.TopicStatistic, len(topicIDs))
+	if len(topicIDs) == 0 {
+		return topicStatisticMap, nil
+	}
+
+	topicStatisticArr := make([]*model.TopicStatistic, 0)
+	if err := dao.DB.WithContext(ctx).Find(&topicStatisticArr, "topic_id in (?)", topicIDs).Error; err != nil {
+		dao.Log.Errorf("[dao] TopicStatisticsByTopicIds err: %v", err)
+		return topicStatisticMap, err
+	}
+	for _, topicStatistic := range topicStatisticArr {
+		topicStatisticMap[topicStatistic.TopicID] = topicStatistic
+	}
+
+	return topicStatisticMap, nil
+}
+
+// SaveTopicStatistics 按话题写入统计数据，并在同一事务内登记事件
+func (dao *TiDB) SaveTopicStatistics(ctx context.Context, topicStatisticArr []*model.TopicStatistic) error {
+	if len(topicStatisticArr) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(topicStatisticArr))
+	for _, topicStatistic := range topicStatisticArr {
+		topicStatistic.Uniq = strconv.FormatInt(topicStatistic.TopicID, 10)
+		ids = append(ids, topicStatistic.TopicID)
+	}
+
+	return dao.DB.WithContext(ctx).Transaction(func(dbTrans *gorm.DB) error {
+		if err := dbTrans.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "uniq"}},
+			// 已有行为存量格式时一并转换时间列
+			DoUpdates: append(clause.AssignmentColumns([]string{"content_num", "mp_num", "content_exposure_num", "updated_at"}),
+				model.LegacyTimeAssignments("created_at", "deleted_at")...),
+		}).Create(&topicStatisticArr).Error; err != nil {
+			dao.Log.Errorf("[dao] SaveTopicStatistics err: %v, count: %v", err, len(topicStatisticArr))
+			return err
+		}
+
+		return dao.writeOutbox(ctx, dbTrans, ids, nil)
+	})
+}
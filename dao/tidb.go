@@ -12,6 +12,7 @@ import (
 	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"strings"
 	"time"
 )
@@ -26,6 +27,7 @@ var TiDBInstance *TiDB
 var (
 	PrimaryKeyUnspecifiedErr  = errors.New("primary key unspecified")
 	PrimaryKeysUnspecifiedErr = errors.New("primary key unspecified exists in primary key list")
+	StaleFenceErr             = errors.New("write rejected, lock fence is stale")
 )
 
 func IsDuplicated(err error) bool {
@@ -39,30 +41,73 @@ func IsNotFound(err error) bool {
 	return errors.Is(err, gorm.ErrRecordNotFound)
 }
 
+// withFence 持锁写入单个话题时，仅允许不小于已记录fence的锁写入，并记录本次fence
+func withFence(ctx context.Context, db *gorm.DB, updates map[string]interface{}) *gorm.DB {
+	if err := lockAlive(ctx); err != nil {
+		_ = db.AddError(err)
+		return db
+	}
+	if fence := FenceFromContext(ctx); fence != 0 {
+		updates["fence"] = fence
+		return db.Where("fence <= ?", fence)
+	}
+	return db
+}
+
+// checkFence 条件更新未命中时区分是记录不存在还是fence过期
+func (dao *TiDB) checkFence(ctx context.Context, db *gorm.DB, id int64) error {
+	fence := FenceFromContext(ctx)
+	if fence == 0 {
+		return nil
+	}
+
+	var count int64
+	if err := db.Model(&model.TopicDetail{}).Where("id = ? AND fence > ?", id, fence).Count(&count).Error; err != nil {
+		return err
+	}
+	if count != 0 {
+		dao.Log.Errorf("[dao] write rejected by fence, id: %v, fence: %v", id, fence)
+		return StaleFenceErr
+	}
+	return nil
+}
+
 func (dao *TiDB) CreateTopic(ctx context.Context, topicDetail *model.TopicDetail) error {
 	topicDetail.Uniq = topicDetail.Title
-	if err := dao.DB.Create(topicDetail).Error; err != nil {
-		dao.Log.Errorf("[dao] Create(topicDetail) err: %v", err)
-		if IsDuplicated(err) {
-			return &common.InternalError{
-				ErrCode: int32(pb.CreateTopicResp_NAME_DUP),
-				ErrMsg:  "name dup",
+	return dao.DB.Transaction(func(dbTrans *gorm.DB) error {
+		if err := dbTrans.Create(topicDetail).Error; err != nil {
+			dao.Log.Errorf("[dao] Create(topicDetail) err: %v", err)
+			if IsDuplicated(err) {
+				return &common.InternalError{
+					ErrCode: int32(pb.CreateTopicResp_NAME_DUP),
+					ErrMsg:  "name dup",
+				}
+			} else {
+				return err
 			}
-		} else {
-			return err
 		}
-	}
 
-	return nil
+		return dao.writeOutbox(ctx, dbTrans, []int64{topicDetail.ID}, nil)
+	})
 }
 
-func (dao *TiDB) UpdateTopicWithoutUserBehavior(ctx context.Context, topicDetail *model.TopicDetail) (rowsAffected int64, err error) {
+// UpdateTopicWithoutUserBehavior 只更新columns指定的列，为空时更新全部列
+// expectedVersion非0时仅在版本一致时更新，否则返回VersionConflictError；话题不存在时返回gorm.ErrRecordNotFound
+func (dao *TiDB) UpdateTopicWithoutUserBehavior(ctx context.Context,
+	topicDetail *model.TopicDetail, columns []string, expectedVersion int64) (rowsAffected int64, err error) {
 	if topicDetail.ID == 0 {
 		return rowsAffected, PrimaryKeyUnspecifiedErr
 	}
 
 	return rowsAffected, dao.DB.Transaction(func(dbTrans *gorm.DB) error {
-		db := dbTrans.Model(&model.TopicDetail{}).Where("id = ?", topicDetail.ID).Limit(1).Updates(map[string]interface{}{
+		// 事务内锁定变更前数据，领域事件的before、after均取自本事务
+		before := &model.TopicDetail{}
+		if err := dbTrans.Clauses(clause.Locking{Strength: "UPDATE"}).First(before, "id = ?", topicDetail.ID).Error; err != nil {
+			dao.Log.Errorf("[dao] UpdateTopicWithoutUserBehavior First err: %v, id: %v", err, topicDetail.ID)
+			return err
+		}
+
+		all := map[string]interface{}{
 			"title":        topicDetail.Title,
 			"uniq":         topicDetail.Title,
 			"bg_pic":       topicDetail.BGPic,
@@ -72,39 +117,30 @@ func (dao *TiDB) UpdateTopicWithoutUserBehavior(ctx context.Context, topicDetail
 			"catalogue":    topicDetail.Catalogue,
 			"start_at":     topicDetail.StartAt,
 			"end_at":       topicDetail.EndAt,
+			"time_zone":    topicDetail.TimeZone,
 			"status":       topicDetail.Status,
 			"manual_audit": topicDetail.ManualAudit,
-		})
-		if db.Error != nil {
-			dao.Log.Errorf("[dao] db.Update(TopicDetail) err: %v", db.Error)
-			if IsDuplicated(db.Error) {
-				return &common.InternalError{
-					ErrCode: int32(pb.UpdateTopicResp_NAME_DUP),
-					ErrMsg:  "name dup",
+		}
+		updates := all
+		if len(columns) != 0 {
+			updates = make(map[string]interface{}, len(columns))
+			for _, column := range columns {
+				if v, ok := all[column]; ok {
+					updates[column] = v
 				}
-			} else {
-				return db.Error
 			}
 		}
+		if BumpsVersion(columns) {
+			updates["version"] = gorm.Expr("version + 1")
+		}
 
-		rowsAffected = db.RowsAffected
-		return nil
-	})
-}
-
-func (dao *TiDB) UpdateTopic(ctx context.Context, topicDetail *model.TopicDetail) (rowsAffected int64, err error) {
-	if topicDetail.ID == 0 {
-		return rowsAffected, PrimaryKeyUnspecifiedErr
-	}
-
-	return rowsAffected, dao.DB.Transaction(func(dbTrans *gorm.DB) error {
-		// update title field
-		db := dbTrans.Model(&model.TopicDetail{}).Where("id = ?", topicDetail.ID).Limit(1).Updates(map[string]interface{}{
-			"title": topicDetail.Title,
-			"uniq":  topicDetail.Title,
-		})
+		db := withFence(ctx, dbTrans.Model(&model.TopicDetail{}).Where("id = ?", topicDetail.ID), updates)
+		if expectedVersion != 0 {
+			db = db.Where("version = ?", expectedVersion)
+		}
+		db = db.Limit(1).Updates(updates)
 		if db.Error != nil {
-			dao.Log.Errorf("[dao] db.Update(TopicDetail.title) err: %v", db.Error)
+			dao.Log.Errorf("[dao] db.Update(TopicDetail) err: %v", db.Error)
 			if IsDuplicated(db.Error) {
 				return &common.InternalError{
 					ErrCode: int32(pb.UpdateTopicResp_NAME_DUP),
@@ -115,74 +151,40 @@ func (dao *TiDB) UpdateTopic(ctx context.Context, topicDetail *model.TopicDetail
 			}
 		}
 
-		// del userBehavior
-		if db.RowsAffected != 0 {
-			delNow := time.Now()
-
-			err = dbTrans.Model(&model.TopicUserBehavior{}).Where("topic_id = ?", topicDetail.ID).Limit(1).Updates(map[string]interface{}{
-				"deleted_at": delNow,
-				"uniq":       gorm.Expr("CONCAT_WS('-', topic_id, user_id, ?)", delNow.Unix()),
-			}).Error
-			if err != nil {
-				dao.Log.Errorf("[dao] db.Del(TopicUserBehavior.topicID) err: %v", err)
+		// updated_at每次更新，行已锁定时未命中只可能是fence或版本不一致
+		if db.RowsAffected == 0 {
+			if err := dao.checkFence(ctx, dbTrans, topicDetail.ID); err != nil {
+				return err
 			}
+			return dao.checkVersion(dbTrans, topicDetail.ID)
 		}
 
 		rowsAffected = db.RowsAffected
-
-		// update other field
-		db = dbTrans.Model(&model.TopicDetail{}).Where("id = ?", topicDetail.ID).Limit(1).Updates(map[string]interface{}{
-			"bg_pic":       topicDetail.BGPic,
-			"avatar":       topicDetail.Avatar,
-			"sort":         topicDetail.Sort,
-			"desc":         topicDetail.Desc,
-			"catalogue":    topicDetail.Catalogue,
-			"start_at":     topicDetail.StartAt,
-			"end_at":       topicDetail.EndAt,
-			"manual_audit": topicDetail.ManualAudit,
-			"status":       topicDetail.Status,
-		})
-		if db.Error != nil {
-			dao.Log.Errorf("[dao] db.Update(TopicDetail.otherField) err: %v", db.Error)
-			return db.Error
-		}
-
-		if rowsAffected == 0 {
-			rowsAffected = db.RowsAffected
-		}
-
-		return nil
+		return dao.writeOutbox(ctx, dbTrans, []int64{topicDetail.ID}, map[int64]*model.TopicDetail{before.ID: before})
 	})
 }
 
-func (dao *TiDB) DelTopicByIdsWithoutUserBehavior(ctx context.Context, ids []int64) (rowsAffected int64, err error) {
-	if len(ids) == 0 {
-		return rowsAffected, nil
+// BumpsVersion 只按时间切换status时不递增version，status由开始、结束时间推导，不算内容变更，调用方按切换前读到的version提交时不冲突
+func BumpsVersion(columns []string) bool {
+	return !(len(columns) == 1 && columns[0] == "status")
+}
+
+// checkVersion 条件更新未命中时区分是记录不存在还是版本不一致，返回gorm.ErrRecordNotFound或VersionConflictError
+func (dao *TiDB) checkVersion(db *gorm.DB, id int64) error {
+	topicDetail := &model.TopicDetail{}
+	if err := db.Select("id", "version").First(topicDetail, "id = ?", id).Error; err != nil {
+		return err
 	}
-	for _, id := range ids {
-		if id == 0 {
-			return rowsAffected, PrimaryKeysUnspecifiedErr
-		}
+	return &common.VersionConflictError{
+		InternalError: common.InternalError{
+			ErrCode: int32(pb.UpdateTopicResp_VERSION_CONFLICT),
+			ErrMsg:  fmt.Sprintf("version conflict, current version: %v", topicDetail.Version),
+		},
+		Current: topicDetail.Version,
 	}
-
-	return rowsAffected, dao.DB.Transaction(func(dbTrans *gorm.DB) error {
-		delNow := time.Now()
-
-		db := dbTrans.Model(&model.TopicDetail{}).Where("id IN (?)", ids).Updates(map[string]interface{}{
-			"deleted_at": delNow,
-			"uniq":       gorm.Expr("CONCAT_WS('-', title, ?)", delNow.Unix()),
-		})
-		if err = db.Error; err != nil {
-			dao.Log.Errorf("[dao] db.Del(TopicDetail.ID) err: %v", err)
-			return db.Error
-		}
-
-		rowsAffected = db.RowsAffected
-		return nil
-	})
 }
 
-func (dao *TiDB) DelTopicByIds(ctx context.Context, ids []int64) (rowsAffected int64, err error) {
+func (dao *TiDB) DelTopicByIdsWithoutUserBehavior(ctx context.Context, ids []int64) (rowsAffected int64, err error) {
 	if len(ids) == 0 {
 		return rowsAffected, nil
 	}
@@ -195,27 +197,29 @@ func (dao *TiDB) DelTopicByIds(ctx context.Context, ids []int64) (rowsAffected i
 	return rowsAffected, dao.DB.Transaction(func(dbTrans *gorm.DB) error {
 		delNow := time.Now()
 
-		db := dbTrans.Model(&model.TopicDetail{}).Where("id IN (?)", ids).Updates(map[string]interface{}{
+		updates := map[string]interface{}{
 			"deleted_at": delNow,
 			"uniq":       gorm.Expr("CONCAT_WS('-', title, ?)", delNow.Unix()),
-		})
+		}
+		db := dbTrans.Model(&model.TopicDetail{}).Where("id IN (?)", ids)
+		// fence来自单个话题的锁，批量删除时不适用
+		if len(ids) == 1 {
+			db = withFence(ctx, db, updates)
+		}
+		db = db.Updates(updates)
 		if err = db.Error; err != nil {
 			dao.Log.Errorf("[dao] db.Del(TopicDetail.ID) err: %v", err)
+			return db.Error
 		}
-		rowsAffected = db.RowsAffected
-
-		// del userBehavior
-		if db.RowsAffected != 0 {
-			err = dbTrans.Model(&model.TopicUserBehavior{}).Where("topic_id IN (?)", ids).Updates(map[string]interface{}{
-				"deleted_at": delNow,
-				"uniq":       gorm.Expr("CONCAT_WS('-', topic_id, user_id, ?)", delNow.Unix()),
-			}).Error
-			if err != nil {
-				dao.Log.Errorf("[dao] db.Del(TopicUserBehavior.topicID) err: %v", err)
+		if db.RowsAffected == 0 {
+			if len(ids) == 1 {
+				return dao.checkFence(ctx, dbTrans, ids[0])
 			}
+			return nil
 		}
 
-		return nil
+		rowsAffected = db.RowsAffected
+		return dao.writeOutbox(ctx, dbTrans, ids, nil)
 	})
 }
 
@@ -422,23 +426,25 @@ func (dao *TiDB) CreateTopicFollowing(ctx context.Context, topicID int64, userID
 		return PrimaryKeyUnspecifiedErr
 	}
 
-	if err := dao.DB.Create(&model.TopicUserBehavior{
-		TopicID: topicID,
-		UserID:  userID,
-		Uniq:    fmt.Sprintf("%v-%v", topicID, userID),
-	}).Error; err != nil {
-		if IsDuplicated(err) {
-			return &common.InternalError{
-				ErrCode: int32(pb.TopicFollowingResp_STATUS_ERR),
-				ErrMsg:  "只有未关注，才可关注",
+	return dao.DB.Transaction(func(dbTrans *gorm.DB) error {
+		if err := dbTrans.Create(&model.TopicUserBehavior{
+			TopicID: topicID,
+			UserID:  userID,
+			Uniq:    fmt.Sprintf("%v-%v", topicID, userID),
+		}).Error; err != nil {
+			if IsDuplicated(err) {
+				return &common.InternalError{
+					ErrCode: int32(pb.TopicFollowingResp_STATUS_ERR),
+					ErrMsg:  "只有未关注，才可关注",
+				}
+			} else {
+				dao.Log.Errorf("[dao] Create(TopicUserBehavior) err: %v", err)
+				return err
 			}
-		} else {
-			dao.Log.Errorf("[dao] Create(TopicUserBehavior) err: %v", err)
-			return err
 		}
-	}
 
-	return nil
+		return dao.writeOutbox(ctx, dbTrans, []int64{topicID}, nil)
+	})
 }
 
 func (dao *TiDB) DelTopicFollowing(ctx context.Context, topicID int64, userID string) error {
@@ -446,23 +452,25 @@ func (dao *TiDB) DelTopicFollowing(ctx context.Context, topicID int64, userID st
 		return PrimaryKeyUnspecifiedErr
 	}
 
-	delNow := time.Now()
-	db := dao.DB.Model(&model.TopicUserBehavior{}).Where("topic_id = ? AND user_id = ?", topicID, userID).Limit(1).Updates(map[string]interface{}{
-		"deleted_at": delNow,
-		"uniq":       gorm.Expr("CONCAT_WS('-', topic_id, user_id, ?)", delNow.Unix()),
-	})
-	if err := db.Error; err != nil {
-		dao.Log.Errorf("[dao] db.Del(TopicUserBehavior) err: %v", err)
-		return err
-	}
-	if db.RowsAffected == 0 {
-		return &common.InternalError{
-			ErrCode: int32(pb.TopicFollowingResp_STATUS_ERR),
-			ErrMsg:  "只有已关注，才取消关注",
+	return dao.DB.Transaction(func(dbTrans *gorm.DB) error {
+		delNow := time.Now()
+		db := dbTrans.Model(&model.TopicUserBehavior{}).Where("topic_id = ? AND user_id = ?", topicID, userID).Limit(1).Updates(map[string]interface{}{
+			"deleted_at": delNow,
+			"uniq":       gorm.Expr("CONCAT_WS('-', topic_id, user_id, ?)", delNow.Unix()),
+		})
+		if err := db.Error; err != nil {
+			dao.Log.Errorf("[dao] db.Del(TopicUserBehavior) err: %v", err)
+			return err
+		}
+		if db.RowsAffected == 0 {
+			return &common.InternalError{
+				ErrCode: int32(pb.TopicFollowingResp_STATUS_ERR),
+				ErrMsg:  "只有已关注，才取消关注",
+			}
 		}
-	}
 
-	return nil
+		return dao.writeOutbox(ctx, dbTrans, []int64{topicID}, nil)
+	})
 }
 
 func (dao *TiDB) MustManualAudit(ctx context.Context, topics []string) ([]string, error) {
@@ -479,30 +487,89 @@ func (dao *TiDB) MustManualAudit(ctx context.Context, topics []string) ([]string
 	return manualAuditTopics, err
 }
 
-func (dao *TiDB) TopicDetailListForUpdateStatus(ctx context.Context) ([]*model.TopicDetail, error) {
-	topicDetailArr := make([]*model.TopicDetail, 0)
+// RefreshTopicStatus 按开始、结束时间修正一批话题的状态，返回状态有变化的话题（只含id和变更前status）
+// 条件与model.TopicDetail.StatusAt一致，每种状态一次加锁查询加一次条件更新，变更事件同事务写入发件箱
+func (dao *TiDB) RefreshTopicStatus(ctx context.Context, ids []int64, now time.Time) ([]*model.TopicDetail, error) {
+	changed := make([]*model.TopicDetail, 0)
+	if len(ids) == 0 {
+		return changed, nil
+	}
 
-	now := time.Now()
-	db := dao.DB.Model(&model.TopicDetail{}).Debug()
+	now = now.Truncate(time.Second)
+	conds := []struct {
+		status pb.TopicDetail_TopicStatus
+		query  string
+		args   []interface{}
+	}{
+		{pb.TopicDetail_TopicStatus_NotStarted, "start_at > ?", []interface{}{now}},
+		{pb.TopicDetail_TopicStatus_Ended, "end_at < ?", []interface{}{now}},
+		{pb.TopicDetail_TopicStatus_InProcess, "start_at <= ? AND end_at >= ?", []interface{}{now, now}},
+	}
+
+	for _, cond := range conds {
+		if err := dao.DB.WithContext(ctx).Transaction(func(dbTrans *gorm.DB) error {
+			topicDetailArr := make([]*model.TopicDetail, 0)
+			if err := dbTrans.Model(&model.TopicDetail{}).Clauses(clause.Locking{Strength: "UPDATE"}).
+				Select("id", "status").Where("id in (?)", ids).Where(cond.query, cond.args...).
+				Where("status != ?", cond.status).Find(&topicDetailArr).Error; err != nil {
+				return err
+			}
+			if len(topicDetailArr) == 0 {
+				return nil
+			}
+
+			changedIds := make([]int64, 0, len(topicDetailArr))
+			befores := make(map[int64]*model.TopicDetail, len(topicDetailArr))
+			for _, topicDetail := range topicDetailArr {
+				changedIds = append(changedIds, topicDetail.ID)
+				befores[topicDetail.ID] = topicDetail
+			}
+			if err := dbTrans.Model(&model.TopicDetail{}).Where("id in (?)", changedIds).
+				Where("status != ?", cond.status).
+				Update("status", cond.status).Error; err != nil {
+				return err
+			}
+			if err := dao.writeOutbox(ctx, dbTrans, changedIds, befores); err != nil {
+				return err
+			}
+			changed = append(changed, topicDetailArr...)
+			return nil
+		}); err != nil {
+			dao.Log.Errorf("[dao] RefreshTopicStatus err: %v, status: %v, ids: %v", err, cond.status, ids)
+			return changed, err
+		}
+	}
 
-	db = db.Where("end_at < ? and status != ?", now, pb.TopicDetail_TopicStatus_Ended).
-		Or("start_at > ? and status != ?", now, pb.TopicDetail_TopicStatus_NotStarted).
-		Or("start_at <= ? and end_at >= ? and status != ?", now, now, pb.TopicDetail_TopicStatus_InProcess)
+	return changed, nil
+}
 
+// TopicDetailListNotEnded 按id分页取未结束的话题，只取状态切换需要的字段
+func (dao *TiDB) TopicDetailListNotEnded(ctx context.Context, afterID int64, limit int) ([]*model.TopicDetail, error) {
+	topicDetailArr := make([]*model.TopicDetail, 0)
+
+	db := dao.DB.WithContext(ctx).Model(&model.TopicDetail{}).Select("id", "start_at", "end_at").
+		Where("end_at >= ? AND id > ?", time.Now(), afterID).Order("id asc").Limit(limit)
 	if err := db.Find(&topicDetailArr).Error; err != nil {
-		dao.Log.Errorf("[dao] TopicDetailListForUpdateStatus Find err: %v", err)
+		dao.Log.Errorf("[dao] TopicDetailListNotEnded Find err: %v", err)
 		return topicDetailArr, err
 	}
 
 	return topicDetailArr, nil
 }
 
-func (dao *TiDB) TopicDetailListForFullUpdateStatus(ctx context.Context) ([]*model.TopicDetail, error) {
+// TopicDetailListForWarmUp 进行中以及soonStartAt前即将开始的话题
+// limit>0时最多返回limit个，按开始时间升序截取
+func (dao *TiDB) TopicDetailListForWarmUp(ctx context.Context, soonStartAt time.Time, limit int) ([]*model.TopicDetail, error) {
 	topicDetailArr := make([]*model.TopicDetail, 0)
 
-	db := dao.DB.Model(&model.TopicDetail{})
+	now := time.Now()
+	db := dao.DB.Model(&model.TopicDetail{}).Select("id").
+		Where("end_at >= ? and start_at <= ?", now, soonStartAt).Order("start_at asc")
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
 	if err := db.Find(&topicDetailArr).Error; err != nil {
-		dao.Log.Errorf("[dao] TopicDetailListForUpdateStatus Find err: %v", err)
+		dao.Log.Errorf("[dao] TopicDetailListForWarmUp Find err: %v", err)
 		return topicDetailArr, err
 	}
 
@@ -0,0 +1,175 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// TiDBLocker 基于lock_leases表的租约锁，redis不可用时也能保证写操作互斥
+type TiDBLocker struct {
+	TiDB *TiDB
+}
+
+// 租约统一使用TiDB时间，避免各节点时钟不一致
+func leaseExpireAt(ttl time.Duration) clause.Expr {
+	return gorm.Expr("DATE_ADD(NOW(3), INTERVAL ? MICROSECOND)", ttl.Microseconds())
+}
+
+func (l *TiDBLocker) Acquire(ctx context.Context, lockKey string, opts LockOptions) (*LockHandle, error) {
+	db := l.TiDB.DB.WithContext(ctx)
+
+	// 首次使用该key时插入空租约
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.LockLease{
+		LockKey:  lockKey,
+		ExpireAt: time.Unix(0, 0),
+	}).Error; err != nil {
+		lockFailErr := fmt.Errorf("[dao] tidb lock init lease fail, key: %v, err: %v", lockKey, err)
+		l.TiDB.Log.Error(lockFailErr)
+		sentry.CaptureException(lockFailErr)
+		return nil, err
+	}
+
+	token := uuid.NewV4().String()
+	h, err := acquireWithWait(ctx, opts, func() (*LockHandle, error) {
+		var h *LockHandle
+		err := db.Transaction(func(dbTrans *gorm.DB) error {
+			// fence推进规则与redis锁一致：max(fence+1, 当前微秒时间)，与授予租约在同一条UPDATE
+			res := dbTrans.Model(&model.LockLease{}).
+				Where("lock_key = ? AND (token = '' OR expire_at < NOW(3))", lockKey).
+				Updates(map[string]interface{}{
+					"token":     token,
+					"fence":     gorm.Expr("GREATEST(fence + 1, CAST(UNIX_TIMESTAMP(NOW(6)) * 1000000 AS SIGNED))"),
+					"expire_at": leaseExpireAt(opts.TTL),
+				})
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+
+			lease := &model.LockLease{}
+			if err := dbTrans.Select("fence").First(lease, "lock_key = ?", lockKey).Error; err != nil {
+				return err
+			}
+			h = newLockHandle(l, lockKey, token, lease.Fence, func(ctx context.Context) (bool, error) {
+				res := l.TiDB.DB.WithContext(ctx).Model(&model.LockLease{}).
+					Where("lock_key = ? AND token = ?", lockKey, token).
+					Update("expire_at", leaseExpireAt(opts.TTL))
+				return res.RowsAffected != 0, res.Error
+			})
+			return nil
+		})
+		if err != nil {
+			lockFailErr := fmt.Errorf("[dao] tidb lock acquire fail, key: %v, err: %v", lockKey, err)
+			l.TiDB.Log.Error(lockFailErr)
+			sentry.CaptureException(lockFailErr)
+			return nil, err
+		}
+		return h, nil
+	})
+	if err != nil {
+		l.TiDB.Log.Infof("[dao] tidb lock not acquired, key: %v, wait: %v, err: %v", lockKey, opts.Wait, err)
+		return nil, err
+	}
+
+	l.TiDB.Log.Infof("[dao] tidb lock acquired, key: %v, token: %v, fence: %v, ttl: %v", lockKey, token, h.Fence, opts.TTL)
+	go watchdog(l.TiDB.Log, h, opts.TTL)
+
+	return h, nil
+}
+
+func (l *TiDBLocker) Release(ctx context.Context, h *LockHandle) error {
+	h.stopWatchdog()
+
+	l.TiDB.Log.Infof("[dao] tidb unLock, key: %v, token: %v", h.Key, h.Token)
+	res := l.TiDB.DB.WithContext(ctx).Model(&model.LockLease{}).
+		Where("lock_key = ? AND token = ?", h.Key, h.Token).
+		Updates(map[string]interface{}{
+			"token":     "",
+			"expire_at": gorm.Expr("NOW(3)"),
+		})
+	if res.Error != nil {
+		unLockFailErr := fmt.Errorf("[dao] tidb unLock fail, key: %v, err: %v", h.Key, res.Error)
+		l.TiDB.Log.Error(unLockFailErr)
+		sentry.CaptureException(unLockFailErr)
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		l.TiDB.Log.Infof("[dao] tidb unLock, lease already expired or taken over, key: %v, token: %v", h.Key, h.Token)
+	}
+
+	return nil
+}
+
+func (l *TiDBLocker) Held(ctx context.Context, lockKey string) (bool, error) {
+	var count int64
+	if err := l.TiDB.DB.WithContext(ctx).Model(&model.LockLease{}).
+		Where("lock_key = ? AND token != '' AND expire_at > NOW(3)", lockKey).
+		Count(&count).Error; err != nil {
+		l.TiDB.Log.Errorf("[dao] tidb lock Held err: %v, key: %v", err, lockKey)
+		return false, err
+	}
+	return count != 0, nil
+}
+
+func (l *TiDBLocker) LockWrap(ctx context.Context, lockKey string, f func(ctx context.Context) error) error {
+	return lockWrap(ctx, l, l.TiDB.Log, lockKey, f)
+}
+
+// LockBackend failover锁当前后端及距上次切换的时长，均按TiDB时间计算；首次使用时初始化为redis
+func (dao *TiDB) LockBackend(ctx context.Context) (string, time.Duration, error) {
+	var state struct {
+		Backend       string
+		SinceSwitchUs int64
+	}
+	query := "SELECT backend, TIMESTAMPDIFF(MICROSECOND, switched_at, NOW(3)) AS since_switch_us FROM lock_backend_states WHERE id = 1"
+	db := dao.DB.WithContext(ctx).Raw(query).Scan(&state)
+	if db.Error == nil && db.RowsAffected == 0 {
+		if err := dao.DB.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&model.LockBackendState{
+			ID:         1,
+			Backend:    LockBackendRedis,
+			SwitchedAt: time.Unix(0, 0),
+		}).Error; err != nil {
+			dao.Log.Errorf("[dao] LockBackend init err: %v", err)
+			return "", 0, err
+		}
+		db = dao.DB.WithContext(ctx).Raw(query).Scan(&state)
+	}
+	if db.Error != nil {
+		dao.Log.Errorf("[dao] LockBackend err: %v", db.Error)
+		return "", 0, db.Error
+	}
+
+	return state.Backend, time.Duration(state.SinceSwitchUs) * time.Microsecond, nil
+}
+
+// SwitchLockBackend 当前后端为from时切换为to，返回false表示已被其他副本切换
+func (dao *TiDB) SwitchLockBackend(ctx context.Context, from, to string) (bool, error) {
+	db := dao.DB.WithContext(ctx).Model(&model.LockBackendState{}).
+		Where("id = 1 AND backend = ?", from).
+		Updates(map[string]interface{}{
+			"backend":     to,
+			"switched_at": gorm.Expr("NOW(3)"),
+		})
+	if db.Error != nil {
+		dao.Log.Errorf("[dao] SwitchLockBackend err: %v, from: %v, to: %v", db.Error, from, to)
+		return false, db.Error
+	}
+
+	return db.RowsAffected != 0, nil
+}
+
+// PurgeLockLeases 删除before前已过期的租约，再次加锁时会重新插入
+func (dao *TiDB) PurgeLockLeases(ctx context.Context, before time.Time) (int64, error) {
+	db := dao.DB.WithContext(ctx).Where("expire_at < ?", before).Delete(&model.LockLease{})
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] PurgeLockLeases err: %v", err)
+		return 0, err
+	}
+
+	return db.RowsAffected, nil
+}
@@ -0,0 +1,39 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+)
+
+// BackfillUTC 按id游标转换一批utc=0的存量行，已转换的行不受影响，可重复执行；返回本批最大id，没有更多行时为0
+// 不经过模型，避免读写时的存量格式换算
+func (dao *TiDB) BackfillUTC(ctx context.Context, table model.LegacyTimeTable, afterID int64, limit int, dryRun bool) (int64, int64, error) {
+	ids := make([]int64, 0)
+	if err := dao.DB.WithContext(ctx).Table(table.Table).Where("id > ?", afterID).
+		Order("id asc").Limit(limit).Pluck("id", &ids).Error; err != nil {
+		dao.Log.Errorf("[dao] BackfillUTC Pluck err: %v, table: %v, afterID: %v", err, table.Table, afterID)
+		return 0, 0, err
+	}
+	if len(ids) == 0 {
+		return 0, 0, nil
+	}
+	lastID := ids[len(ids)-1]
+
+	db := dao.DB.WithContext(ctx).Table(table.Table).Where("id > ? AND id <= ? AND utc = ?", afterID, lastID, false)
+	if dryRun {
+		var count int64
+		if err := db.Count(&count).Error; err != nil {
+			dao.Log.Errorf("[dao] BackfillUTC Count err: %v, table: %v, afterID: %v", err, table.Table, afterID)
+			return 0, 0, err
+		}
+		return lastID, count, nil
+	}
+
+	db = db.Updates(model.LegacyTimeBackfill(table.Columns...))
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] BackfillUTC Updates err: %v, table: %v, afterID: %v", err, table.Table, afterID)
+		return 0, 0, err
+	}
+
+	return lastID, db.RowsAffected, nil
+}
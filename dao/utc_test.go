@@ -0,0 +1,76 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"testing"
+	"time"
+)
+
+// insertLegacyTopic 以旧版本格式（utc=0，Asia/Shanghai墙上时间）插入话题
+func insertLegacyTopic(t *testing.T, uniq string, wall time.Time) int64 {
+	db := TiDBInstance.DB
+	if err := db.Exec("INSERT INTO topic_details (created_at, updated_at, title, bg_pic, avatar, sort, `desc`, catalogue, start_at, end_at, manual_audit, status, time_zone, uniq, utc) "+
+		"VALUES (?, ?, ?, '', '', 0, '', '', ?, ?, false, 0, '', ?, false)", wall, wall, uniq, wall, wall.Add(24*time.Hour), uniq).Error; err != nil {
+		t.Fatalf("insert legacy topic err: %v", err)
+	}
+	var id int64
+	if err := db.Raw("SELECT id FROM topic_details WHERE uniq = ?", uniq).Scan(&id).Error; err != nil || id == 0 {
+		t.Fatalf("select legacy topic id: %v, err: %v", id, err)
+	}
+	return id
+}
+
+type legacyTopicRow struct {
+	Title   string
+	StartAt time.Time
+	EndAt   time.Time
+	UTC     bool
+}
+
+func selectLegacyTopic(t *testing.T, id int64) legacyTopicRow {
+	var row legacyTopicRow
+	if err := TiDBInstance.DB.Raw("SELECT title, start_at, end_at, utc FROM topic_details WHERE id = ?", id).Scan(&row).Error; err != nil {
+		t.Fatalf("select legacy topic err: %v", err)
+	}
+	return row
+}
+
+func Test_UpdateLegacyTime(t *testing.T) {
+	wall := time.Date(2021, 3, 1, 8, 0, 0, 0, time.UTC)
+	want := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	// 按模型更新utc=0的行：未更新的时间列一并转换，utc显式写入1
+	id := insertLegacyTopic(t, "legacy-update", wall)
+	if err := TiDBInstance.DB.Model(&model.TopicDetail{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"title": "legacy-updated"}).Error; err != nil {
+		t.Fatalf("Updates() err: %v", err)
+	}
+	row := selectLegacyTopic(t, id)
+	if row.Title != "legacy-updated" || !row.UTC || !row.StartAt.Equal(want) || !row.EndAt.Equal(want.Add(24*time.Hour)) {
+		t.Errorf("updated legacy row: %+v, want start_at %v, utc true", row, want)
+	}
+
+	// 已转换的行再次更新不重复转换
+	if err := TiDBInstance.DB.Model(&model.TopicDetail{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"title": "legacy-updated-again"}).Error; err != nil {
+		t.Fatalf("Updates() again err: %v", err)
+	}
+	if row := selectLegacyTopic(t, id); !row.StartAt.Equal(want) {
+		t.Errorf("updated utc row start_at: %v, want %v", row.StartAt, want)
+	}
+
+	// backfill只转换utc=0的行，可重复执行
+	backfillID := insertLegacyTopic(t, "legacy-backfill", wall)
+	for i := 0; i < 2; i++ {
+		if _, _, err := TiDBInstance.BackfillUTC(context.Background(), model.LegacyTimeTables[0], 0, 100, false); err != nil {
+			t.Fatalf("BackfillUTC() err: %v", err)
+		}
+	}
+	if row := selectLegacyTopic(t, backfillID); !row.UTC || !row.StartAt.Equal(want) {
+		t.Errorf("backfilled row: %+v, want start_at %v, utc true", row, want)
+	}
+	if row := selectLegacyTopic(t, id); !row.StartAt.Equal(want) {
+		t.Errorf("utc row start_at after backfill: %v, want %v", row.StartAt, want)
+	}
+}
@@ -0,0 +1,203 @@
+package dao
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+type webhookKey struct{}
+
+// WebhookBuilder 在登记发件箱事件的同一事务内，按事件和启用的订阅生成投递记录
+type WebhookBuilder func(outboxEvents []*model.OutboxEvent, subscriptions []*model.WebhookSubscription) ([]*model.WebhookDelivery, error)
+
+// WithWebhooks 话题写入时在同一事务内登记builder生成的webhook投递，与发件箱事件同时提交
+func WithWebhooks(ctx context.Context, builder WebhookBuilder) context.Context {
+	return context.WithValue(ctx, webhookKey{}, builder)
+}
+
+// writeWebhookDeliveries 事务内登记投递，同一订阅同一事件已登记时忽略
+func (dao *TiDB) writeWebhookDeliveries(ctx context.Context, dbTrans *gorm.DB, outboxEvents []*model.OutboxEvent) error {
+	builder, ok := ctx.Value(webhookKey{}).(WebhookBuilder)
+	if !ok {
+		return nil
+	}
+	hasDomain := false
+	for _, outboxEvent := range outboxEvents {
+		if outboxEvent.Kind == model.OutboxKindDomain {
+			hasDomain = true
+			break
+		}
+	}
+	if !hasDomain {
+		return nil
+	}
+
+	subscriptionArr := make([]*model.WebhookSubscription, 0)
+	if err := dbTrans.Where("enabled = ?", true).Find(&subscriptionArr).Error; err != nil {
+		return err
+	}
+	if len(subscriptionArr) == 0 {
+		return nil
+	}
+	deliveryArr, err := builder(outboxEvents, subscriptionArr)
+	if err != nil || len(deliveryArr) == 0 {
+		return err
+	}
+	return dbTrans.Clauses(clause.OnConflict{DoNothing: true}).Create(&deliveryArr).Error
+}
+
+func (dao *TiDB) CreateWebhookSubscription(ctx context.Context, subscription *model.WebhookSubscription) error {
+	if err := dao.DB.WithContext(ctx).Create(subscription).Error; err != nil {
+		dao.Log.Errorf("[dao] CreateWebhookSubscription err: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func (dao *TiDB) UpdateWebhookSubscription(ctx context.Context, subscription *model.WebhookSubscription) (int64, error) {
+	if subscription.ID == 0 {
+		return 0, PrimaryKeyUnspecifiedErr
+	}
+
+	db := dao.DB.WithContext(ctx).Model(&model.WebhookSubscription{}).Where("id = ?", subscription.ID).
+		Updates(map[string]interface{}{
+			"url":         subscription.URL,
+			"event_types": subscription.EventTypes,
+			"secret":      subscription.Secret,
+			"enabled":     subscription.Enabled,
+		})
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] UpdateWebhookSubscription err: %v, id: %v", err, subscription.ID)
+		return 0, err
+	}
+
+	return db.RowsAffected, nil
+}
+
+func (dao *TiDB) DelWebhookSubscription(ctx context.Context, id int64) (int64, error) {
+	db := dao.DB.WithContext(ctx).Delete(&model.WebhookSubscription{}, "id = ?", id)
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] DelWebhookSubscription err: %v, id: %v", err, id)
+		return 0, err
+	}
+
+	return db.RowsAffected, nil
+}
+
+func (dao *TiDB) GetWebhookSubscription(ctx context.Context, id int64) (*model.WebhookSubscription, error) {
+	subscription := &model.WebhookSubscription{}
+	if err := dao.DB.WithContext(ctx).First(subscription, "id = ?", id).Error; err != nil {
+		if !IsNotFound(err) {
+			dao.Log.Errorf("[dao] GetWebhookSubscription err: %v, id: %v", err, id)
+		}
+		return subscription, err
+	}
+
+	return subscription, nil
+}
+
+// WebhookSubscriptionList enabledOnly为true时只返回启用的订阅
+func (dao *TiDB) WebhookSubscriptionList(ctx context.Context, enabledOnly bool) ([]*model.WebhookSubscription, error) {
+	subscriptionArr := make([]*model.WebhookSubscription, 0)
+
+	db := dao.DB.WithContext(ctx).Model(&model.WebhookSubscription{})
+	if enabledOnly {
+		db = db.Where("enabled = ?", true)
+	}
+	if err := db.Order("created_at asc").Find(&subscriptionArr).Error; err != nil {
+		dao.Log.Errorf("[dao] WebhookSubscriptionList err: %v", err)
+		return subscriptionArr, err
+	}
+
+	return subscriptionArr, nil
+}
+
+// DueWebhookDeliveries 到达投递时间的待投递记录
+func (dao *TiDB) DueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]*model.WebhookDelivery, error) {
+	deliveryArr := make([]*model.WebhookDelivery, 0)
+
+	if err := dao.DB.WithContext(ctx).
+		Where("status = ? AND next_attempt_at <= ?", model.WebhookDeliveryStatusPending, now).
+		Order("next_attempt_at asc").Limit(limit).Find(&deliveryArr).Error; err != nil {
+		dao.Log.Errorf("[dao] DueWebhookDeliveries err: %v", err)
+		return deliveryArr, err
+	}
+
+	return deliveryArr, nil
+}
+
+// ClaimWebhookDelivery 推迟下次投递时间以占用记录，返回false表示已被其他副本占用
+func (dao *TiDB) ClaimWebhookDelivery(ctx context.Context, delivery *model.WebhookDelivery, leaseUntil time.Time) (bool, error) {
+	db := dao.DB.WithContext(ctx).Model(&model.WebhookDelivery{}).
+		Where("id = ? AND status = ? AND next_attempt_at = ?", delivery.ID, model.WebhookDeliveryStatusPending, delivery.NextAttemptAt).
+		Update("next_attempt_at", leaseUntil)
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] ClaimWebhookDelivery err: %v, id: %v", err, delivery.ID)
+		return false, err
+	}
+
+	return db.RowsAffected != 0, nil
+}
+
+// FinishWebhookDeliveryAttempt 记录一次投递结果
+func (dao *TiDB) FinishWebhookDeliveryAttempt(ctx context.Context, delivery *model.WebhookDelivery) error {
+	if err := dao.DB.WithContext(ctx).Model(&model.WebhookDelivery{}).Where("id = ?", delivery.ID).
+		Updates(map[string]interface{}{
+			"status":          delivery.Status,
+			"attempts":        delivery.Attempts,
+			"response_code":   delivery.ResponseCode,
+			"err":             delivery.Err,
+			"next_attempt_at": delivery.NextAttemptAt,
+			"delivered_at":    delivery.DeliveredAt,
+		}).Error; err != nil {
+		dao.Log.Errorf("[dao] FinishWebhookDeliveryAttempt err: %v, id: %v", err, delivery.ID)
+		return err
+	}
+
+	return nil
+}
+
+// RedeliverWebhookDelivery 重置为待投递，重新计算重试次数
+func (dao *TiDB) RedeliverWebhookDelivery(ctx context.Context, id int64) (int64, error) {
+	db := dao.DB.WithContext(ctx).Model(&model.WebhookDelivery{}).Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"status":          model.WebhookDeliveryStatusPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now(),
+		})
+	if err := db.Error; err != nil {
+		dao.Log.Errorf("[dao] RedeliverWebhookDelivery err: %v, id: %v", err, id)
+		return 0, err
+	}
+
+	return db.RowsAffected, nil
+}
+
+func (dao *TiDB) WebhookDeliveryList(ctx context.Context,
+	subscriptionID int64, status string, offset, limit int64) ([]*model.WebhookDelivery, int64, error) {
+	var total int64
+	deliveryArr := make([]*model.WebhookDelivery, 0)
+
+	db := dao.DB.WithContext(ctx).Model(&model.WebhookDelivery{})
+	if subscriptionID != 0 {
+		db = db.Where("subscription_id = ?", subscriptionID)
+	}
+	if status != "" {
+		db = db.Where("status = ?", status)
+	}
+
+	if err := db.Count(&total).Error; err != nil {
+		dao.Log.Errorf("[dao] WebhookDeliveryList Count err: %v", err)
+		return deliveryArr, total, err
+	}
+	if err := db.Order("created_at desc").Offset(int(offset)).Limit(int(limit)).Find(&deliveryArr).Error; err != nil {
+		dao.Log.Errorf("[dao] WebhookDeliveryList Find err: %v", err)
+		return deliveryArr, total, err
+	}
+
+	return deliveryArr, total, nil
+}
@@ -0,0 +1,149 @@
+package events
+
+import (
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"encoding/json"
+	uuid "github.com/satori/go.uuid"
+	"time"
+)
+
+// SchemaVersion 事件结构有不兼容变更时递增，消费方据此区分
+const SchemaVersion = 1
+
+const (
+	TypeTopicCreated          = "TopicCreated"
+	TypeTopicUpdated          = "TopicUpdated"
+	TypeTopicDeleted          = "TopicDeleted"
+	TypeTopicStatusChanged    = "TopicStatusChanged"
+	TypeTopicFollowed         = "TopicFollowed"
+	TypeTopicUnfollowed       = "TopicUnfollowed"
+	TypeTopicThresholdCrossed = "TopicThresholdCrossed"
+)
+
+// TopicEvent 话题领域事件，按TopicID分区保证同一话题有序
+type TopicEvent struct {
+	EventID       string         `json:"eventId"`
+	Type          string         `json:"type"`
+	SchemaVersion int            `json:"schemaVersion"`
+	OccurredAt    time.Time      `json:"occurredAt"`
+	TopicID       int64          `json:"topicId"`
+	Before        *TopicSnapshot `json:"before,omitempty"`        // 变更前，创建事件为空
+	After         *TopicSnapshot `json:"after,omitempty"`         // 变更后，删除事件为空
+	ChangedFields []string       `json:"changedFields,omitempty"` // 仅TopicUpdated
+	UserID        string         `json:"userId,omitempty"`        // 仅关注、取消关注
+	Alert         *AlertSnapshot `json:"alert,omitempty"`         // 仅TopicThresholdCrossed
+}
+
+// AlertSnapshot 越过的阈值
+type AlertSnapshot struct {
+	RuleID    int64  `json:"ruleId"`
+	Metric    string `json:"metric"`
+	Threshold int64  `json:"threshold"`
+	Value     int64  `json:"value"`
+}
+
+// TopicSnapshot 事件中的话题完整数据
+type TopicSnapshot struct {
+	ID          int64           `json:"id"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+	Title       string          `json:"title"`
+	BGPic       string          `json:"bgPic"`
+	Avatar      string          `json:"avatar"`
+	Sort        int32           `json:"sort"`
+	Desc        string          `json:"desc"`
+	Catalogue   json.RawMessage `json:"catalogue,omitempty"`
+	StartAt     time.Time       `json:"startAt"`
+	EndAt       time.Time       `json:"endAt"`
+	TimeZone    string          `json:"timeZone"`
+	ManualAudit bool            `json:"manualAudit"`
+	Status      int32           `json:"status"`
+	Version     int64           `json:"version"`
+}
+
+func Snapshot(topicDetail *model.TopicDetail) *TopicSnapshot {
+	if topicDetail == nil {
+		return nil
+	}
+
+	snapshot := &TopicSnapshot{
+		ID:          topicDetail.ID,
+		CreatedAt:   topicDetail.CreatedAt,
+		UpdatedAt:   topicDetail.UpdatedAt,
+		Title:       topicDetail.Title,
+		BGPic:       topicDetail.BGPic,
+		Avatar:      topicDetail.Avatar,
+		Sort:        topicDetail.Sort,
+		Desc:        topicDetail.Desc,
+		StartAt:     topicDetail.StartAt,
+		EndAt:       topicDetail.EndAt,
+		TimeZone:    topicDetail.TimeZone,
+		ManualAudit: topicDetail.ManualAudit,
+		Status:      int32(topicDetail.Status),
+		Version:     topicDetail.Version,
+	}
+	if json.Valid([]byte(topicDetail.Catalogue)) {
+		snapshot.Catalogue = json.RawMessage(topicDetail.Catalogue)
+	}
+	return snapshot
+}
+
+func newTopicEvent(typ string, topicID int64) *TopicEvent {
+	return &TopicEvent{
+		EventID:       uuid.NewV4().String(),
+		Type:          typ,
+		SchemaVersion: SchemaVersion,
+		OccurredAt:    time.Now().UTC(),
+		TopicID:       topicID,
+	}
+}
+
+func TopicCreated(after *model.TopicDetail) *TopicEvent {
+	ev := newTopicEvent(TypeTopicCreated, after.ID)
+	ev.After = Snapshot(after)
+	return ev
+}
+
+func TopicUpdated(before, after *model.TopicDetail) *TopicEvent {
+	ev := newTopicEvent(TypeTopicUpdated, after.ID)
+	ev.Before, ev.After = Snapshot(before), Snapshot(after)
+	if before != nil {
+		ev.ChangedFields = before.Diff(after)
+	}
+	return ev
+}
+
+func TopicDeleted(before *model.TopicDetail) *TopicEvent {
+	ev := newTopicEvent(TypeTopicDeleted, before.ID)
+	ev.Before = Snapshot(before)
+	return ev
+}
+
+func TopicStatusChanged(before, after *model.TopicDetail) *TopicEvent {
+	ev := newTopicEvent(TypeTopicStatusChanged, after.ID)
+	ev.Before, ev.After = Snapshot(before), Snapshot(after)
+	return ev
+}
+
+func TopicFollowed(topicID int64, userID string) *TopicEvent {
+	ev := newTopicEvent(TypeTopicFollowed, topicID)
+	ev.UserID = userID
+	return ev
+}
+
+func TopicUnfollowed(topicID int64, userID string) *TopicEvent {
+	ev := newTopicEvent(TypeTopicUnfollowed, topicID)
+	ev.UserID = userID
+	return ev
+}
+
+func TopicThresholdCrossed(alert *model.TopicAlert) *TopicEvent {
+	ev := newTopicEvent(TypeTopicThresholdCrossed, alert.TopicID)
+	ev.Alert = &AlertSnapshot{
+		RuleID:    alert.RuleID,
+		Metric:    alert.Metric,
+		Threshold: alert.Threshold,
+		Value:     alert.Value,
+	}
+	return ev
+}
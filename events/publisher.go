@@ -0,0 +1,98 @@
+package events
+
+import (
+	"dm-gitlab.bolo.me/hubpd/proto/event"
+	"dm-gitlab.bolo.me/hubpd/proto/topic"
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"google.golang.org/protobuf/proto"
+	"strconv"
+)
+
+// Publisher 发布话题领域事件
+type Publisher interface {
+	Publish(evs ...*TopicEvent) error
+}
+
+var Instance Publisher
+
+// IndexPublisher 发布es索引事件，返回nil时已得到kafka确认
+type IndexPublisher interface {
+	PublishIndex(topicID int64, deleted bool) error
+}
+
+var Index IndexPublisher
+
+// KafkaPublisher 同步发送，等待所有副本确认
+type KafkaPublisher struct {
+	Producer sarama.SyncProducer
+	Topic    string
+}
+
+func NewKafkaPublisher(hosts []string, topic string) (*KafkaPublisher, error) {
+	cfg := sarama.NewConfig()
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.Partitioner = sarama.NewHashPartitioner
+
+	producer, err := sarama.NewSyncProducer(hosts, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaPublisher{Producer: producer, Topic: topic}, nil
+}
+
+func (p *KafkaPublisher) Publish(evs ...*TopicEvent) error {
+	if len(evs) == 0 {
+		return nil
+	}
+
+	msgs := make([]*sarama.ProducerMessage, 0, len(evs))
+	for _, ev := range evs {
+		msg, err := p.Message(ev)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+	}
+	return p.Producer.SendMessages(msgs)
+}
+
+// Message 以话题id为key，保证同一话题的事件落在同一分区
+func (p *KafkaPublisher) Message(ev *TopicEvent) (*sarama.ProducerMessage, error) {
+	value, err := json.Marshal(ev)
+	if err != nil {
+		return nil, fmt.Errorf("marshal event %v err: %v", ev.EventID, err)
+	}
+
+	return &sarama.ProducerMessage{
+		Topic: p.Topic,
+		Key:   sarama.StringEncoder(strconv.FormatInt(ev.TopicID, 10)),
+		Value: sarama.ByteEncoder(value),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("event-id"), Value: []byte(ev.EventID)},
+			{Key: []byte("event-type"), Value: []byte(ev.Type)},
+			{Key: []byte("schema-version"), Value: []byte(strconv.Itoa(ev.SchemaVersion))},
+		},
+	}, nil
+}
+
+// PublishIndex 按话题id分区同步发送EV_DM_TOPIC的DataEventUint64消息，与领域事件共用producer
+func (p *KafkaPublisher) PublishIndex(topicID int64, deleted bool) error {
+	typ := event.DataEventUint64_NEW
+	if deleted {
+		typ = event.DataEventUint64_DELETE
+	}
+	value, err := proto.Marshal(&event.DataEventUint64{Type: typ, Id: uint64(topicID)})
+	if err != nil {
+		return fmt.Errorf("marshal index event %v err: %v", topicID, err)
+	}
+
+	_, _, err = p.Producer.SendMessage(&sarama.ProducerMessage{
+		Topic: topic.EV_DM_TOPIC,
+		Key:   sarama.StringEncoder(strconv.FormatInt(topicID, 10)),
+		Value: sarama.ByteEncoder(value),
+	})
+	return err
+}
@@ -0,0 +1,255 @@
+package gateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"dm-gitlab.bolo.me/hubpd/basic/logger"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// 请求体上限
+const maxBodyBytes = 4 << 20
+
+var (
+	contextType    = reflect.TypeOf((*context.Context)(nil)).Elem()
+	messageType    = reflect.TypeOf((*proto.Message)(nil)).Elem()
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+	callOptionType = reflect.TypeOf([]grpc.CallOption(nil))
+)
+
+var (
+	unmarshalOptions = protojson.UnmarshalOptions{}
+	marshalOptions   = protojson.MarshalOptions{EmitUnpopulated: true}
+)
+
+// method TopicClient的一个方法
+type method struct {
+	name     string
+	reqType  reflect.Type
+	respType reflect.Type
+	call     reflect.Value
+}
+
+// Gateway 以HTTP/JSON暴露TopicServer：POST /v1/{方法名}，字段按protojson映射（lowerCamelCase）
+// 经gRPC客户端调用本服务，与gRPC请求走相同的拦截器；只暴露白名单内的方法，需带Bearer token
+type Gateway struct {
+	methods map[string]*method
+	token   string
+	openAPI []byte
+}
+
+func New(client pb.TopicClient, allowed []string, token string) (*Gateway, error) {
+	if token == "" {
+		return nil, fmt.Errorf("gateway token is empty")
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("gateway methods is empty")
+	}
+
+	g := &Gateway{methods: make(map[string]*method), token: token}
+
+	clientValue := reflect.ValueOf(client)
+	clientType := reflect.TypeOf((*pb.TopicClient)(nil)).Elem()
+	for _, name := range allowed {
+		m, ok := clientType.MethodByName(name)
+		// 只暴露 func(context.Context, *Req, ...grpc.CallOption) (*Resp, error)
+		if !ok || m.Type.NumIn() != 3 || m.Type.NumOut() != 2 || !m.Type.IsVariadic() ||
+			m.Type.In(0) != contextType || !m.Type.In(1).Implements(messageType) || m.Type.In(2) != callOptionType ||
+			!m.Type.Out(0).Implements(messageType) || m.Type.Out(1) != errorType {
+			return nil, fmt.Errorf("gateway method %v not found", name)
+		}
+		g.methods[m.Name] = &method{
+			name:     m.Name,
+			reqType:  m.Type.In(1).Elem(),
+			respType: m.Type.Out(0).Elem(),
+			call:     clientValue.MethodByName(m.Name),
+		}
+	}
+
+	openAPI, err := g.buildOpenAPI()
+	if err != nil {
+		return nil, err
+	}
+	g.openAPI = openAPI
+
+	return g, nil
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !g.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, codes.Unauthenticated, "unauthenticated")
+		return
+	}
+
+	if r.URL.Path == "/openapi.json" {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(g.openAPI)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/v1/")
+	m, ok := g.methods[name]
+	if !ok || name == r.URL.Path {
+		writeError(w, http.StatusNotFound, codes.Unimplemented, "unknown method")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, codes.Unimplemented, "method not allowed")
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, codes.InvalidArgument, err.Error())
+		return
+	}
+	req := reflect.New(m.reqType).Interface().(proto.Message)
+	if len(body) != 0 {
+		if err := unmarshalOptions.Unmarshal(body, req); err != nil {
+			writeError(w, http.StatusBadRequest, codes.InvalidArgument, err.Error())
+			return
+		}
+	}
+
+	resp, err := m.invoke(r.Context(), req)
+	if err != nil {
+		st := status.Convert(err)
+		writeError(w, grpcCodeStatus(st.Code()), st.Code(), st.Message())
+		return
+	}
+
+	out, err := marshalOptions.Marshal(resp)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codes.Internal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(respStatus(resp))
+	_, _ = w.Write(out)
+}
+
+// authorized 校验 Authorization: Bearer <token>
+func (g *Gateway) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), []byte(g.token)) == 1
+}
+
+func (m *method) invoke(ctx context.Context, req proto.Message) (proto.Message, error) {
+	out := m.call.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(req)})
+	if e, _ := out[1].Interface().(error); e != nil {
+		return nil, e
+	}
+	return out[0].Interface().(proto.Message), nil
+}
+
+// respStatus 按响应中ErrCode的枚举名换算HTTP状态码，未设置时为200
+func respStatus(resp proto.Message) int {
+	msg := resp.ProtoReflect()
+	fd := msg.Descriptor().Fields().ByName("err_code")
+	if fd == nil || fd.Enum() == nil {
+		return http.StatusOK
+	}
+	num := msg.Get(fd).Enum()
+	if num == 0 {
+		return http.StatusOK
+	}
+	name := fmt.Sprint(num)
+	if v := fd.Enum().Values().ByNumber(num); v != nil {
+		name = string(v.Name())
+	}
+	return errCodeStatus(name)
+}
+
+func errCodeStatus(name string) int {
+	switch {
+	case strings.HasSuffix(name, "NOT_FOUND"):
+		return http.StatusNotFound
+	case strings.HasSuffix(name, "INVALID_ARGUMENT"):
+		return http.StatusBadRequest
+	case strings.HasSuffix(name, "_DUP"), strings.HasSuffix(name, "CONFLICT"), strings.HasSuffix(name, "STATUS_ERR"):
+		return http.StatusConflict
+	case strings.HasSuffix(name, "NO_LEADER"):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
+
+func grpcCodeStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Canceled:
+		return 499
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError handler返回error时的响应体，与gRPC status一致
+func writeError(w http.ResponseWriter, httpStatus int, code codes.Code, msg string) {
+	out, _ := marshalOptions.Marshal(status.New(code, msg).Proto())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	_, _ = w.Write(out)
+}
+
+// Serve 启动网关，addr为空时不启动并返回nil；调用方退出时Shutdown
+func Serve(addr string, client pb.TopicClient, allowed []string, token string) (*http.Server, error) {
+	if addr == "" {
+		return nil, nil
+	}
+
+	g, err := New(client, allowed, token)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           g,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.GetLogger().Errorf("[gateway] ListenAndServe err: %v, addr: %v", err, addr)
+		}
+	}()
+	return srv, nil
+}
@@ -0,0 +1,148 @@
+package gateway
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeClient 只实现GetTopicByIds
+type fakeClient struct {
+	pb.TopicClient
+}
+
+func (c *fakeClient) GetTopicByIds(ctx context.Context, in *pb.GetTopicByIdsReq, opts ...grpc.CallOption) (*pb.GetTopicByIdsResp, error) {
+	resp := &pb.GetTopicByIdsResp{Data: make(map[int64]*pb.TopicInfo)}
+	for _, id := range in.Ids {
+		switch id {
+		case 0:
+			return nil, status.Error(codes.InvalidArgument, "invalid id")
+		case 404:
+			resp.ErrCode = pb.GetTopicByIdsResp_NOT_FOUND
+			resp.ErrMsg = "not found"
+		default:
+			resp.Data[id] = &pb.TopicInfo{Detail: &pb.TopicDetail{Id: id, Title: "topic"}}
+		}
+	}
+	return resp, nil
+}
+
+func TestGateway_ServeHTTP(t *testing.T) {
+	g, err := New(&fakeClient{}, []string{"GetTopicByIds"}, "secret")
+	if err != nil {
+		t.Fatalf("New() err: %v", err)
+	}
+
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+		want       *pb.GetTopicByIdsResp
+	}{
+		{
+			name: "ok", method: http.MethodPost, path: "/v1/GetTopicByIds", token: "secret",
+			body:       `{"ids":["1"],"withStatistics":true}`,
+			wantStatus: http.StatusOK,
+			want: &pb.GetTopicByIdsResp{Data: map[int64]*pb.TopicInfo{
+				1: {Detail: &pb.TopicDetail{Id: 1, Title: "topic"}},
+			}},
+		},
+		{
+			name: "err code", method: http.MethodPost, path: "/v1/GetTopicByIds", token: "secret",
+			body:       `{"ids":["404"]}`,
+			wantStatus: http.StatusNotFound,
+			want:       &pb.GetTopicByIdsResp{ErrCode: pb.GetTopicByIdsResp_NOT_FOUND, ErrMsg: "not found", Data: map[int64]*pb.TopicInfo{}},
+		},
+		{name: "grpc err", method: http.MethodPost, path: "/v1/GetTopicByIds", token: "secret", body: `{"ids":["0"]}`, wantStatus: http.StatusBadRequest},
+		{name: "bad json", method: http.MethodPost, path: "/v1/GetTopicByIds", token: "secret", body: `{"ids":`, wantStatus: http.StatusBadRequest},
+		{name: "no token", method: http.MethodPost, path: "/v1/GetTopicByIds", body: `{}`, wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodPost, path: "/v1/GetTopicByIds", token: "other", body: `{}`, wantStatus: http.StatusUnauthorized},
+		{name: "not allowed", method: http.MethodPost, path: "/v1/DelTopicByIds", token: "secret", body: `{}`, wantStatus: http.StatusNotFound},
+		{name: "get", method: http.MethodGet, path: "/v1/GetTopicByIds", token: "secret", wantStatus: http.StatusMethodNotAllowed},
+		{name: "openapi", method: http.MethodGet, path: "/openapi.json", token: "secret", wantStatus: http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+			if c.token != "" {
+				r.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			w := httptest.NewRecorder()
+			g.ServeHTTP(w, r)
+
+			if w.Code != c.wantStatus {
+				t.Fatalf("status = %v, want %v, body: %s", w.Code, c.wantStatus, w.Body.String())
+			}
+			if c.want == nil {
+				return
+			}
+			got := &pb.GetTopicByIdsResp{}
+			if err := protojson.Unmarshal(w.Body.Bytes(), got); err != nil {
+				t.Fatalf("protojson.Unmarshal() err: %v", err)
+			}
+			if !proto.Equal(got, c.want) {
+				t.Errorf("resp = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(&fakeClient{}, []string{"GetTopicByIds"}, ""); err == nil {
+		t.Errorf("New() without token err = nil")
+	}
+	if _, err := New(&fakeClient{}, nil, "secret"); err == nil {
+		t.Errorf("New() without methods err = nil")
+	}
+	if _, err := New(&fakeClient{}, []string{"NoSuchMethod"}, "secret"); err == nil {
+		t.Errorf("New() with unknown method err = nil")
+	}
+}
+
+func Test_errCodeStatus(t *testing.T) {
+	cases := []struct {
+		name string
+		want int
+	}{
+		{"NOT_FOUND", http.StatusNotFound},
+		{"JOB_NOT_FOUND", http.StatusNotFound},
+		{"INVALID_ARGUMENT", http.StatusBadRequest},
+		{"NAME_DUP", http.StatusConflict},
+		{"STATUS_ERR", http.StatusConflict},
+		{"UNKNOWN", http.StatusUnprocessableEntity},
+	}
+	for _, c := range cases {
+		if got := errCodeStatus(c.name); got != c.want {
+			t.Errorf("errCodeStatus(%v) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func Test_grpcCodeStatus(t *testing.T) {
+	cases := []struct {
+		code codes.Code
+		want int
+	}{
+		{codes.OK, http.StatusOK},
+		{codes.InvalidArgument, http.StatusBadRequest},
+		{codes.NotFound, http.StatusNotFound},
+		{codes.Unavailable, http.StatusServiceUnavailable},
+		{codes.Unknown, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		if got := grpcCodeStatus(c.code); got != c.want {
+			t.Errorf("grpcCodeStatus(%v) = %v, want %v", c.code, got, c.want)
+		}
+	}
+}
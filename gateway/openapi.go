@@ -0,0 +1,163 @@
+package gateway
+
+import (
+	"encoding/json"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"reflect"
+	"sort"
+)
+
+type schema = map[string]interface{}
+
+// wellKnownSchemas protojson对常用内置类型的特殊映射
+var wellKnownSchemas = map[protoreflect.FullName]schema{
+	"google.protobuf.Timestamp": {"type": "string", "format": "date-time"},
+	"google.protobuf.Duration":  {"type": "string", "example": "1.5s"},
+	"google.protobuf.FieldMask": {"type": "string", "example": "title,startAt"},
+	"google.protobuf.Struct":    {"type": "object"},
+	"google.protobuf.Value":     {},
+	"google.protobuf.Any":       {"type": "object"},
+}
+
+const statusSchemaName = "google.rpc.Status"
+
+// buildOpenAPI 由proto描述生成OpenAPI 3文档
+func (g *Gateway) buildOpenAPI() ([]byte, error) {
+	names := make([]string, 0, len(g.methods))
+	for name := range g.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	schemas := schema{
+		statusSchemaName: schema{
+			"type": "object",
+			"properties": schema{
+				"code":    schema{"type": "integer", "format": "int32", "description": "gRPC状态码"},
+				"message": schema{"type": "string"},
+				"details": schema{"type": "array", "items": schema{"type": "object"}},
+			},
+		},
+	}
+	paths := schema{}
+	for _, name := range names {
+		m := g.methods[name]
+		reqDesc := newMessage(m.reqType).ProtoReflect().Descriptor()
+		respDesc := newMessage(m.respType).ProtoReflect().Descriptor()
+		addMessageSchema(schemas, reqDesc)
+		addMessageSchema(schemas, respDesc)
+
+		paths["/v1/"+name] = schema{
+			"post": schema{
+				"operationId": name,
+				"requestBody": schema{
+					"required": true,
+					"content":  schema{"application/json": schema{"schema": ref(reqDesc.FullName())}},
+				},
+				"responses": schema{
+					"200": schema{
+						"description": "成功",
+						"content":     schema{"application/json": schema{"schema": ref(respDesc.FullName())}},
+					},
+					"4XX": schema{
+						"description": "errCode非0时按枚举换算：NOT_FOUND-404，INVALID_ARGUMENT-400，冲突-409，其余-422；响应体同200",
+						"content":     schema{"application/json": schema{"schema": ref(respDesc.FullName())}},
+					},
+					"default": schema{
+						"description": "gRPC错误",
+						"content":     schema{"application/json": schema{"schema": ref(statusSchemaName)}},
+					},
+				},
+			},
+		}
+	}
+
+	return json.MarshalIndent(schema{
+		"openapi": "3.0.3",
+		"info":    schema{"title": "topic", "version": "v1"},
+		"paths":   paths,
+		"components": schema{
+			"schemas": schemas,
+		},
+	}, "", "  ")
+}
+
+func newMessage(t reflect.Type) proto.Message {
+	return reflect.New(t).Interface().(proto.Message)
+}
+
+func ref(name protoreflect.FullName) schema {
+	return schema{"$ref": "#/components/schemas/" + string(name)}
+}
+
+// addMessageSchema 递归登记消息及其引用的消息
+func addMessageSchema(schemas schema, md protoreflect.MessageDescriptor) {
+	if _, ok := schemas[string(md.FullName())]; ok {
+		return
+	}
+	if _, ok := wellKnownSchemas[md.FullName()]; ok {
+		return
+	}
+
+	properties := schema{}
+	s := schema{"type": "object", "properties": properties}
+	// 先占位，避免循环引用时无限递归
+	schemas[string(md.FullName())] = s
+
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		properties[fd.JSONName()] = fieldSchema(schemas, fd)
+	}
+}
+
+func fieldSchema(schemas schema, fd protoreflect.FieldDescriptor) schema {
+	if fd.IsMap() {
+		return schema{"type": "object", "additionalProperties": singularSchema(schemas, fd.MapValue())}
+	}
+	if fd.IsList() {
+		return schema{"type": "array", "items": singularSchema(schemas, fd)}
+	}
+	return singularSchema(schemas, fd)
+}
+
+func singularSchema(schemas schema, fd protoreflect.FieldDescriptor) schema {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return schema{"type": "boolean"}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return schema{"type": "integer", "format": "int32"}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return schema{"type": "integer", "format": "int64", "minimum": 0}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		// protojson将64位整数编码为字符串
+		return schema{"type": "string", "format": "int64"}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return schema{"type": "string", "format": "uint64"}
+	case protoreflect.FloatKind:
+		return schema{"type": "number", "format": "float"}
+	case protoreflect.DoubleKind:
+		return schema{"type": "number", "format": "double"}
+	case protoreflect.StringKind:
+		return schema{"type": "string"}
+	case protoreflect.BytesKind:
+		return schema{"type": "string", "format": "byte"}
+	case protoreflect.EnumKind:
+		values := fd.Enum().Values()
+		names := make([]string, 0, values.Len())
+		for i := 0; i < values.Len(); i++ {
+			names = append(names, string(values.Get(i).Name()))
+		}
+		return schema{"type": "string", "enum": names}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		md := fd.Message()
+		if s, ok := wellKnownSchemas[md.FullName()]; ok {
+			return s
+		}
+		addMessageSchema(schemas, md)
+		return ref(md.FullName())
+	default:
+		return schema{}
+	}
+}
@@ -19,6 +19,7 @@ require (
 	github.com/robfig/cron/v3 v3.0.1
 	github.com/satori/go.uuid v1.2.0
 	github.com/sirupsen/logrus v1.7.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	google.golang.org/protobuf v1.25.0
 	gorm.io/driver/mysql v1.0.2
 	gorm.io/gorm v1.20.5
@@ -3,6 +3,7 @@ package grpcClient
 import (
 	"dm-gitlab.bolo.me/hubpd/basic/grpc"
 	"dm-gitlab.bolo.me/hubpd/proto/bi"
+	"dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
 	"dm-gitlab.bolo.me/hubpd/topic/config"
 )
 
@@ -14,3 +15,12 @@ func NewBIChartDataClient() (bi.ChartDataClient, error) {
 	}
 	return bi.NewChartDataClient(conn), nil
 }
+
+// 本服务，HTTP网关经此调用以复用gRPC拦截器
+func NewTopicClient() (topic_grpc.TopicClient, error) {
+	conn, err := grpc.DefaultConn(config.Cfg.GrpcServerAddress)
+	if err != nil {
+		return nil, err
+	}
+	return topic_grpc.NewTopicClient(conn), nil
+}
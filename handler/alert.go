@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"dm-gitlab.bolo.me/hubpd/topic/service"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"strings"
+)
+
+func (handler *Handler) CreateAlertRule(ctx context.Context, req *pb.CreateAlertRuleReq) (*pb.CreateAlertRuleResp, error) {
+	rule := &model.AlertRule{
+		TopicID: req.GetTopicId(),
+		Metric:  strings.TrimSpace(req.GetMetric()),
+		Enabled: req.GetEnabled(),
+	}
+	if err := service.Instance.CreateAlertRule(ctx, rule, req.GetThresholds()); err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.CreateAlertRuleResp{
+				ErrCode: pb.CreateAlertRuleResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.CreateAlertRuleResp{}, err
+	}
+
+	return &pb.CreateAlertRuleResp{Data: alertRuleToPb(rule)}, nil
+}
+
+func (handler *Handler) UpdateAlertRule(ctx context.Context, req *pb.UpdateAlertRuleReq) (*pb.UpdateAlertRuleResp, error) {
+	rule := &model.AlertRule{
+		Base:    model.Base{ID: req.GetId()},
+		TopicID: req.GetTopicId(),
+		Metric:  strings.TrimSpace(req.GetMetric()),
+		Enabled: req.GetEnabled(),
+	}
+	if err := service.Instance.UpdateAlertRule(ctx, rule, req.GetThresholds()); err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.UpdateAlertRuleResp{
+				ErrCode: pb.UpdateAlertRuleResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.UpdateAlertRuleResp{}, err
+	}
+
+	return &pb.UpdateAlertRuleResp{}, nil
+}
+
+func (handler *Handler) DelAlertRule(ctx context.Context, req *pb.DelAlertRuleReq) (*pb.DelAlertRuleResp, error) {
+	if err := service.Instance.DelAlertRule(ctx, req.GetId()); err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.DelAlertRuleResp{
+				ErrCode: pb.DelAlertRuleResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.DelAlertRuleResp{}, err
+	}
+
+	return &pb.DelAlertRuleResp{}, nil
+}
+
+func (handler *Handler) ListAlertRules(ctx context.Context, req *pb.ListAlertRulesReq) (*pb.ListAlertRulesResp, error) {
+	ruleArr, err := service.Instance.ListAlertRules(ctx)
+	if err != nil {
+		return &pb.ListAlertRulesResp{}, err
+	}
+
+	ruleArrPb := make([]*pb.AlertRule, 0, len(ruleArr))
+	for _, v := range ruleArr {
+		ruleArrPb = append(ruleArrPb, alertRuleToPb(v))
+	}
+
+	return &pb.ListAlertRulesResp{Data: ruleArrPb}, nil
+}
+
+func (handler *Handler) ListTopicAlerts(ctx context.Context, req *pb.ListTopicAlertsReq) (*pb.ListTopicAlertsResp, error) {
+	alertArr, total, err := service.Instance.ListTopicAlerts(ctx, req.GetTopicId(), req.GetOffset(), req.GetLimit())
+	if err != nil {
+		return &pb.ListTopicAlertsResp{}, err
+	}
+
+	alertArrPb := make([]*pb.TopicAlert, 0, len(alertArr))
+	for _, v := range alertArr {
+		alertArrPb = append(alertArrPb, &pb.TopicAlert{
+			Id:        v.ID,
+			RuleId:    v.RuleID,
+			TopicId:   v.TopicID,
+			Metric:    v.Metric,
+			Threshold: v.Threshold,
+			Value:     v.Value,
+			EventId:   v.EventID,
+			CreatedAt: timestamppb.New(v.CreatedAt),
+		})
+	}
+
+	return &pb.ListTopicAlertsResp{Data: alertArrPb, Total: total}, nil
+}
+
+func alertRuleToPb(rule *model.AlertRule) *pb.AlertRule {
+	return &pb.AlertRule{
+		Id:         rule.ID,
+		TopicId:    rule.TopicID,
+		Metric:     rule.Metric,
+		Thresholds: rule.ThresholdList(),
+		Enabled:    rule.Enabled,
+		CreatedAt:  timestamppb.New(rule.CreatedAt),
+	}
+}
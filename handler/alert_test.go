@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"dm-gitlab.bolo.me/hubpd/topic/service"
+	"testing"
+)
+
+func Test_CreateAlertRule(t *testing.T) {
+	prepareTestDatabase()
+
+	type args struct {
+		req *pb.CreateAlertRuleReq
+	}
+	tests := []struct {
+		name    string
+		args    args
+		check   func(t *testing.T, resp *pb.CreateAlertRuleResp)
+		wantErr bool
+	}{
+		{
+			name: "unknown metric",
+			args: args{
+				req: &pb.CreateAlertRuleReq{Metric: "follower_num", Thresholds: []int64{10}, Enabled: true},
+			},
+			check: func(t *testing.T, resp *pb.CreateAlertRuleResp) {
+				if resp.ErrCode != pb.CreateAlertRuleResp_INVALID_ARGUMENT {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "topic not found",
+			args: args{
+				req: &pb.CreateAlertRuleReq{TopicId: 100, Metric: model.AlertMetricMpNum, Thresholds: []int64{10}},
+			},
+			check: func(t *testing.T, resp *pb.CreateAlertRuleResp) {
+				if resp.ErrCode != pb.CreateAlertRuleResp_INVALID_ARGUMENT {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "ok",
+			args: args{
+				req: &pb.CreateAlertRuleReq{TopicId: 1, Metric: model.AlertMetricMpNum, Thresholds: []int64{100, 10, 10}, Enabled: true},
+			},
+			check: func(t *testing.T, resp *pb.CreateAlertRuleResp) {
+				if resp.ErrCode != pb.CreateAlertRuleResp_NONE {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+					return
+				}
+				// 阈值去重后升序保存
+				if thresholds := resp.GetData().GetThresholds(); len(thresholds) != 2 || thresholds[0] != 10 || thresholds[1] != 100 {
+					t.Errorf("thresholds: %v", thresholds)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.CreateAlertRule(context.Background(), tt.args.req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CreateAlertRule() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func Test_UpdateAlertRule(t *testing.T) {
+	prepareTestDatabase()
+
+	tests := []struct {
+		name     string
+		req      *pb.UpdateAlertRuleReq
+		wantCode pb.UpdateAlertRuleResp_ErrCode
+	}{
+		{
+			name:     "not found",
+			req:      &pb.UpdateAlertRuleReq{Id: 100, Metric: model.AlertMetricContentNum, Thresholds: []int64{10}},
+			wantCode: pb.UpdateAlertRuleResp_NOT_FOUND,
+		},
+		{
+			name:     "invalid threshold",
+			req:      &pb.UpdateAlertRuleReq{Id: 1, Metric: model.AlertMetricContentNum, Thresholds: []int64{0}},
+			wantCode: pb.UpdateAlertRuleResp_INVALID_ARGUMENT,
+		},
+		{
+			name:     "ok",
+			req:      &pb.UpdateAlertRuleReq{Id: 1, Metric: model.AlertMetricContentNum, Thresholds: []int64{20}, Enabled: true},
+			wantCode: pb.UpdateAlertRuleResp_NONE,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.UpdateAlertRule(context.Background(), tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ErrCode != tt.wantCode {
+				t.Errorf("errCode: %d, errMsg: %s", got.ErrCode, got.ErrMsg)
+			}
+		})
+	}
+
+	list, err := Instance.ListAlertRules(context.Background(), &pb.ListAlertRulesReq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.GetData()) != 1 || len(list.GetData()[0].GetThresholds()) != 1 || list.GetData()[0].GetThresholds()[0] != 20 {
+		t.Errorf("rules: %v", list.GetData())
+	}
+}
+
+func Test_DelAlertRule(t *testing.T) {
+	prepareTestDatabase()
+
+	tests := []struct {
+		name     string
+		id       int64
+		wantCode pb.DelAlertRuleResp_ErrCode
+	}{
+		{name: "ok", id: 1, wantCode: pb.DelAlertRuleResp_NONE},
+		{name: "not found", id: 1, wantCode: pb.DelAlertRuleResp_NOT_FOUND},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.DelAlertRule(context.Background(), &pb.DelAlertRuleReq{Id: tt.id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ErrCode != tt.wantCode {
+				t.Errorf("errCode: %d, errMsg: %s", got.ErrCode, got.ErrMsg)
+			}
+		})
+	}
+}
+
+func Test_ListTopicAlerts(t *testing.T) {
+	prepareTestDatabase()
+
+	tests := []struct {
+		name    string
+		topicID int64
+		want    int64
+	}{
+		{name: "all", topicID: 0, want: 1},
+		{name: "topic", topicID: 1, want: 1},
+		{name: "no alert", topicID: 2, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.ListTopicAlerts(context.Background(), &pb.ListTopicAlertsReq{TopicId: tt.topicID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.GetTotal() != tt.want || int64(len(got.GetData())) != tt.want {
+				t.Errorf("total: %v, data: %v, want: %v", got.GetTotal(), len(got.GetData()), tt.want)
+			}
+		})
+	}
+}
+
+func Test_EvaluateTopicAlerts(t *testing.T) {
+	prepareTestDatabase()
+
+	ctx := context.Background()
+	alert := func(round int64) *model.TopicAlert {
+		alert := &model.TopicAlert{}
+		if err := dao.TiDBInstance.DB.First(alert, "rule_id = ? AND topic_id = ? AND threshold = ? AND round = ?",
+			1, 1, 10, round).Error; err != nil {
+			t.Fatal(err)
+		}
+		return alert
+	}
+
+	// 话题1的content_num为1，低于阈值，已有告警解除
+	if err := service.Instance.EvaluateTopicAlerts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if alert(1).ClearedAt == nil {
+		t.Fatalf("alert not cleared")
+	}
+
+	// 再次越过时以下一轮次重新告警并登记事件
+	if err := dao.TiDBInstance.DB.Model(&model.TopicStatistic{}).Where("topic_id = ?", 1).
+		Update("content_num", 12).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Instance.EvaluateTopicAlerts(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rearmed := alert(2)
+	if rearmed.ClearedAt != nil || rearmed.Baseline || rearmed.EventID == "" {
+		t.Errorf("alert: %+v", rearmed)
+	}
+	var count int64
+	if err := dao.TiDBInstance.DB.Model(&model.OutboxEvent{}).Where("event_id = ?", rearmed.EventID).
+		Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("outbox events: %v, want: 1", count)
+	}
+}
+
+func Test_EvaluateTopicAlertsBaseline(t *testing.T) {
+	prepareTestDatabase()
+
+	ctx := context.Background()
+	resp, err := Instance.CreateAlertRule(ctx, &pb.CreateAlertRuleReq{
+		TopicId: 1, Metric: model.AlertMetricMpNum, Thresholds: []int64{1}, Enabled: true,
+	})
+	if err != nil || resp.ErrCode != pb.CreateAlertRuleResp_NONE {
+		t.Fatalf("err: %v, resp: %v", err, resp)
+	}
+	ruleID := resp.GetData().GetId()
+
+	if err := service.Instance.EvaluateTopicAlerts(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 新规则创建前已越过的阈值只记录基线，不告警
+	alert := &model.TopicAlert{}
+	if err := dao.TiDBInstance.DB.First(alert, "rule_id = ? AND topic_id = ?", ruleID, 1).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !alert.Baseline || alert.EventID != "" {
+		t.Errorf("alert: %+v", alert)
+	}
+	rule, err := dao.TiDBInstance.GetAlertRule(ctx, ruleID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.BaselinedAt == nil {
+		t.Errorf("rule not baselined")
+	}
+	list, err := Instance.ListTopicAlerts(ctx, &pb.ListTopicAlertsReq{TopicId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range list.GetData() {
+		if v.GetRuleId() == ruleID {
+			t.Errorf("baseline alert listed: %v", v)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"dm-gitlab.bolo.me/hubpd/topic/service"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"strings"
+	"time"
+)
+
+func (handler *Handler) IngestTopicContents(ctx context.Context,
+	req *pb.IngestTopicContentsReq) (*pb.IngestTopicContentsResp, error) {
+	items := make([]*service.TopicContentItem, 0, len(req.GetItems()))
+	for _, v := range req.GetItems() {
+		var publishedAt time.Time
+		if v.GetPublishedAt() != nil {
+			publishedAt = v.GetPublishedAt().AsTime()
+		}
+		items = append(items, &service.TopicContentItem{
+			TopicID:     v.GetTopicId(),
+			ContentID:   strings.TrimSpace(v.GetContentId()),
+			PublishedAt: publishedAt,
+			Removed:     v.GetRemoved(),
+		})
+	}
+
+	accepted, unknownTopicIds, err := service.Instance.IngestTopicContents(ctx, items)
+	if err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.IngestTopicContentsResp{
+				ErrCode: pb.IngestTopicContentsResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.IngestTopicContentsResp{}, err
+	}
+
+	return &pb.IngestTopicContentsResp{Accepted: int32(accepted), UnknownTopicIds: unknownTopicIds}, nil
+}
+
+func (handler *Handler) UpdateTopicContent(ctx context.Context,
+	req *pb.UpdateTopicContentReq) (*pb.UpdateTopicContentResp, error) {
+	// 未指定update_mask时更新全部字段
+	fields := req.GetUpdateMask().GetPaths()
+	if err := model.ValidateTopicContentUpdateMask(fields); err != nil {
+		return &pb.UpdateTopicContentResp{
+			ErrCode: pb.UpdateTopicContentResp_INVALID_ARGUMENT,
+			ErrMsg:  err.Error(),
+		}, nil
+	}
+	content := &model.TopicContent{
+		TopicID:   req.GetTopicId(),
+		ContentID: strings.TrimSpace(req.GetContentId()),
+		Pinned:    req.GetPinned(),
+		Featured:  req.GetFeatured(),
+		Hidden:    req.GetHidden(),
+		Sort:      req.GetSort(),
+	}
+	if err := service.Instance.UpdateTopicContent(ctx, content, fields); err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.UpdateTopicContentResp{
+				ErrCode: pb.UpdateTopicContentResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.UpdateTopicContentResp{}, err
+	}
+
+	return &pb.UpdateTopicContentResp{}, nil
+}
+
+func (handler *Handler) ListTopicContents(ctx context.Context,
+	req *pb.ListTopicContentsReq) (*pb.ListTopicContentsResp, error) {
+	contentArr, nextCursor, err := service.Instance.ListTopicContents(ctx, req.GetTopicId(), req.GetCursor(),
+		int(req.GetLimit()), req.GetFeaturedOnly(), req.GetIncludeHidden())
+	if err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.ListTopicContentsResp{
+				ErrCode: pb.ListTopicContentsResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.ListTopicContentsResp{}, err
+	}
+
+	contentArrPb := make([]*pb.TopicContent, 0, len(contentArr))
+	for _, v := range contentArr {
+		contentArrPb = append(contentArrPb, &pb.TopicContent{
+			TopicId:     v.TopicID,
+			ContentId:   v.ContentID,
+			PublishedAt: timestamppb.New(v.PublishedAt),
+			Pinned:      v.Pinned,
+			Featured:    v.Featured,
+			Hidden:      v.Hidden,
+			Sort:        v.Sort,
+		})
+	}
+
+	return &pb.ListTopicContentsResp{Data: contentArrPb, NextCursor: nextCursor}, nil
+}
@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+	"time"
+)
+
+func Test_IngestTopicContents(t *testing.T) {
+	prepareTestDatabase()
+
+	publishedAt := timestamppb.New(time.Date(2020, 9, 15, 4, 0, 0, 0, time.UTC))
+	type args struct {
+		req *pb.IngestTopicContentsReq
+	}
+	tests := []struct {
+		name    string
+		args    args
+		check   func(t *testing.T, resp *pb.IngestTopicContentsResp)
+		wantErr bool
+	}{
+		{
+			name: "missing publishedAt",
+			args: args{
+				req: &pb.IngestTopicContentsReq{
+					Items: []*pb.TopicContentItem{{TopicId: 1, ContentId: "content_004"}},
+				},
+			},
+			check: func(t *testing.T, resp *pb.IngestTopicContentsResp) {
+				if resp.ErrCode != pb.IngestTopicContentsResp_INVALID_ARGUMENT {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "ok",
+			args: args{
+				req: &pb.IngestTopicContentsReq{
+					Items: []*pb.TopicContentItem{
+						{TopicId: 1, ContentId: "content_004", PublishedAt: publishedAt},
+						{TopicId: 1, ContentId: "content_001", Removed: true},
+						{TopicId: 100, ContentId: "content_005", PublishedAt: publishedAt},
+					},
+				},
+			},
+			check: func(t *testing.T, resp *pb.IngestTopicContentsResp) {
+				if resp.ErrCode != pb.IngestTopicContentsResp_NONE {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+					return
+				}
+				if resp.GetAccepted() != 2 || len(resp.GetUnknownTopicIds()) != 1 || resp.GetUnknownTopicIds()[0] != 100 {
+					t.Errorf("accepted: %v, unknownTopicIds: %v", resp.GetAccepted(), resp.GetUnknownTopicIds())
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.IngestTopicContents(context.Background(), tt.args.req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("IngestTopicContents() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func Test_UpdateTopicContent(t *testing.T) {
+	prepareTestDatabase()
+
+	type args struct {
+		req *pb.UpdateTopicContentReq
+	}
+	tests := []struct {
+		name    string
+		args    args
+		check   func(t *testing.T, resp *pb.UpdateTopicContentResp)
+		wantErr bool
+	}{
+		{
+			name: "not found",
+			args: args{
+				req: &pb.UpdateTopicContentReq{TopicId: 1, ContentId: "content_100", Pinned: true},
+			},
+			check: func(t *testing.T, resp *pb.UpdateTopicContentResp) {
+				if resp.ErrCode != pb.UpdateTopicContentResp_NOT_FOUND {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "ok",
+			args: args{
+				req: &pb.UpdateTopicContentReq{TopicId: 1, ContentId: "content_001", Pinned: true},
+			},
+			check: func(t *testing.T, resp *pb.UpdateTopicContentResp) {
+				if resp.ErrCode != pb.UpdateTopicContentResp_NONE {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "invalid mask",
+			args: args{
+				req: &pb.UpdateTopicContentReq{
+					TopicId:    1,
+					ContentId:  "content_002",
+					UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"published_at"}},
+				},
+			},
+			check: func(t *testing.T, resp *pb.UpdateTopicContentResp) {
+				if resp.ErrCode != pb.UpdateTopicContentResp_INVALID_ARGUMENT {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "pin only",
+			args: args{
+				req: &pb.UpdateTopicContentReq{
+					TopicId:    1,
+					ContentId:  "content_002",
+					Pinned:     true,
+					UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"pinned"}},
+				},
+			},
+			check: func(t *testing.T, resp *pb.UpdateTopicContentResp) {
+				if resp.ErrCode != pb.UpdateTopicContentResp_NONE {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+					return
+				}
+				// 未在mask中的精选保持不变
+				content, err := dao.TiDBInstance.GetTopicContent(context.Background(), 1, "content_002")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !content.Pinned || !content.Featured {
+					t.Errorf("pinned: %v, featured: %v", content.Pinned, content.Featured)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.UpdateTopicContent(context.Background(), tt.args.req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UpdateTopicContent() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func Test_ListTopicContents(t *testing.T) {
+	prepareTestDatabase()
+
+	contentIds := func(data []*pb.TopicContent) []string {
+		ids := make([]string, 0, len(data))
+		for _, v := range data {
+			ids = append(ids, v.GetContentId())
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name string
+		req  *pb.ListTopicContentsReq
+		want []string
+	}{
+		{
+			name: "default",
+			req:  &pb.ListTopicContentsReq{TopicId: 1},
+			want: []string{"content_002", "content_001"},
+		},
+		{
+			name: "include hidden",
+			req:  &pb.ListTopicContentsReq{TopicId: 1, IncludeHidden: true},
+			want: []string{"content_003", "content_002", "content_001"},
+		},
+		{
+			name: "featured only",
+			req:  &pb.ListTopicContentsReq{TopicId: 1, FeaturedOnly: true},
+			want: []string{"content_002"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.ListTopicContents(context.Background(), tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ErrCode != pb.ListTopicContentsResp_NONE {
+				t.Fatalf("errCode: %d, errMsg: %s", got.ErrCode, got.ErrMsg)
+			}
+			if ids := contentIds(got.GetData()); len(ids) != len(tt.want) {
+				t.Errorf("contents: %v, want: %v", ids, tt.want)
+			} else {
+				for i := range ids {
+					if ids[i] != tt.want[i] {
+						t.Errorf("contents: %v, want: %v", ids, tt.want)
+						break
+					}
+				}
+			}
+		})
+	}
+
+	// 按游标翻页，两页合起来与不分页一致
+	first, err := Instance.ListTopicContents(context.Background(), &pb.ListTopicContentsReq{TopicId: 1, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.GetNextCursor() == "" {
+		t.Fatal("nextCursor empty")
+	}
+	second, err := Instance.ListTopicContents(context.Background(),
+		&pb.ListTopicContentsReq{TopicId: 1, Limit: 1, Cursor: first.GetNextCursor()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := append(contentIds(first.GetData()), contentIds(second.GetData())...); len(ids) != 2 ||
+		ids[0] != "content_002" || ids[1] != "content_001" {
+		t.Errorf("pages: %v", ids)
+	}
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/service"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (handler *Handler) ListDeadLetters(ctx context.Context, req *pb.ListDeadLettersReq) (*pb.ListDeadLettersResp, error) {
+	deadLetterArr, total, err := service.Instance.ListDeadLetters(ctx,
+		req.GetTopicId(), req.GetKind(), req.GetOffset(), req.GetLimit())
+	if err != nil {
+		return &pb.ListDeadLettersResp{}, err
+	}
+
+	deadLetterArrPb := make([]*pb.DeadLetter, 0, len(deadLetterArr))
+	for _, v := range deadLetterArr {
+		deadLetterArrPb = append(deadLetterArrPb, &pb.DeadLetter{
+			Id:        v.ID,
+			EventId:   v.EventID,
+			Kind:      v.Kind,
+			TopicId:   v.TopicID,
+			Payload:   v.Payload,
+			Reason:    v.Reason,
+			Attempts:  int32(v.Attempts),
+			CreatedAt: timestamppb.New(v.CreatedAt),
+		})
+	}
+
+	return &pb.ListDeadLettersResp{Data: deadLetterArrPb, Total: total}, nil
+}
+
+func (handler *Handler) ReplayDeadLetter(ctx context.Context, req *pb.ReplayDeadLetterReq) (*pb.ReplayDeadLetterResp, error) {
+	if err := service.Instance.ReplayDeadLetter(ctx, req.GetId()); err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.ReplayDeadLetterResp{
+				ErrCode: pb.ReplayDeadLetterResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.ReplayDeadLetterResp{}, err
+	}
+
+	return &pb.ReplayDeadLetterResp{}, nil
+}
+
+func (handler *Handler) DiscardDeadLetter(ctx context.Context, req *pb.DiscardDeadLetterReq) (*pb.DiscardDeadLetterResp, error) {
+	if err := service.Instance.DiscardDeadLetter(ctx, req.GetId()); err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.DiscardDeadLetterResp{
+				ErrCode: pb.DiscardDeadLetterResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.DiscardDeadLetterResp{}, err
+	}
+
+	return &pb.DiscardDeadLetterResp{}, nil
+}
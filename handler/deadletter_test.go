@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"testing"
+	"time"
+)
+
+func Test_ListDeadLetters(t *testing.T) {
+	prepareTestDatabase()
+
+	tests := []struct {
+		name string
+		req  *pb.ListDeadLettersReq
+		want int64
+	}{
+		{name: "all", req: &pb.ListDeadLettersReq{}, want: 2},
+		{name: "topic", req: &pb.ListDeadLettersReq{TopicId: 2}, want: 1},
+		{name: "kind", req: &pb.ListDeadLettersReq{Kind: model.OutboxKindDomain}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.ListDeadLetters(context.Background(), tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.GetTotal() != tt.want {
+				t.Errorf("total: %v, want: %v", got.GetTotal(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_ReplayDeadLetter(t *testing.T) {
+	prepareTestDatabase()
+
+	tests := []struct {
+		name     string
+		id       int64
+		wantCode pb.ReplayDeadLetterResp_ErrCode
+	}{
+		{name: "ok", id: 1, wantCode: pb.ReplayDeadLetterResp_NONE},
+		{name: "not found", id: 1, wantCode: pb.ReplayDeadLetterResp_NOT_FOUND},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.ReplayDeadLetter(context.Background(), &pb.ReplayDeadLetterReq{Id: tt.id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ErrCode != tt.wantCode {
+				t.Errorf("errCode: %d, errMsg: %s", got.ErrCode, got.ErrMsg)
+			}
+		})
+	}
+
+	// 以原eventId、seq重新登记到发件箱
+	outboxEvent := &model.OutboxEvent{}
+	if err := dao.TiDBInstance.DB.First(outboxEvent, "event_id = ?", "00000000-0000-0000-0000-000000000003").Error; err != nil {
+		t.Fatal(err)
+	}
+	if outboxEvent.TopicID != 2 || outboxEvent.Seq != 1 || outboxEvent.SentAt != nil {
+		t.Errorf("outbox event: %+v", outboxEvent)
+	}
+}
+
+func Test_DeadLetterBlocksTopic(t *testing.T) {
+	prepareTestDatabase()
+
+	ctx := context.Background()
+	if err := dao.TiDBInstance.DB.Create(&model.OutboxEvent{
+		EventID:       "00000000-0000-0000-0000-000000000005",
+		Kind:          model.OutboxKindIndex,
+		TopicID:       3,
+		Seq:           2,
+		Payload:       "new",
+		NextAttemptAt: time.Now(),
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	pending := func() bool {
+		outboxEvents, err := dao.TiDBInstance.PendingOutboxEvents(ctx, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, outboxEvent := range outboxEvents {
+			if outboxEvent.TopicID == 3 {
+				return true
+			}
+		}
+		return false
+	}
+
+	// 话题3有死信，后续事件不发布
+	if pending() {
+		t.Fatalf("topic with dead letter not blocked")
+	}
+	got, err := Instance.DiscardDeadLetter(ctx, &pb.DiscardDeadLetterReq{Id: 2})
+	if err != nil || got.ErrCode != pb.DiscardDeadLetterResp_NONE {
+		t.Fatalf("err: %v, resp: %v", err, got)
+	}
+	if !pending() {
+		t.Errorf("topic not unblocked after discard")
+	}
+}
+
+func Test_DiscardDeadLetter(t *testing.T) {
+	prepareTestDatabase()
+
+	tests := []struct {
+		name     string
+		id       int64
+		wantCode pb.DiscardDeadLetterResp_ErrCode
+	}{
+		{name: "ok", id: 2, wantCode: pb.DiscardDeadLetterResp_NONE},
+		{name: "not found", id: 2, wantCode: pb.DiscardDeadLetterResp_NOT_FOUND},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.DiscardDeadLetter(context.Background(), &pb.DiscardDeadLetterReq{Id: tt.id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ErrCode != tt.wantCode {
+				t.Errorf("errCode: %d, errMsg: %s", got.ErrCode, got.ErrMsg)
+			}
+		})
+	}
+}
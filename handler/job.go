@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/cron"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"dm-gitlab.bolo.me/hubpd/topic/service"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+)
+
+func (handler *Handler) ListJobRuns(ctx context.Context, req *pb.ListJobRunsReq) (*pb.ListJobRunsResp, error) {
+	jobRunArr, total, err := service.Instance.ListJobRuns(ctx, req.GetJob(), req.GetStatus(), req.GetOffset(), req.GetLimit())
+	if err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.ListJobRunsResp{
+				ErrCode: pb.ListJobRunsResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.ListJobRunsResp{}, err
+	}
+
+	jobRunArrPb := make([]*pb.JobRun, 0, len(jobRunArr))
+	for _, v := range jobRunArr {
+		jobRunArrPb = append(jobRunArrPb, jobRunToPb(v))
+	}
+
+	return &pb.ListJobRunsResp{Data: jobRunArrPb, Total: total}, nil
+}
+
+func (handler *Handler) TriggerJob(ctx context.Context, req *pb.TriggerJobReq) (*pb.TriggerJobResp, error) {
+	runID, err := service.Instance.TriggerJob(ctx, req.GetJob(), "")
+	if err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.TriggerJobResp{
+				ErrCode: pb.TriggerJobResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.TriggerJobResp{}, err
+	}
+
+	return &pb.TriggerJobResp{RunId: runID}, nil
+}
+
+// ReindexTopics 登记重建es索引的手动任务，进度见ListJobRuns
+func (handler *Handler) ReindexTopics(ctx context.Context, req *pb.ReindexTopicsReq) (*pb.ReindexTopicsResp, error) {
+	pbToTime := func(t *timestamppb.Timestamp) time.Time {
+		if t == nil {
+			return time.Time{}
+		}
+		return t.AsTime()
+	}
+
+	runID, err := service.Instance.TriggerReindex(ctx, service.ReindexOptions{
+		MaintenanceOptions: service.MaintenanceOptions{
+			RatePerSec: int(req.GetRatePerSec()),
+			DryRun:     req.GetDryRun(),
+		},
+		Filter: dao.TopicFilter{
+			Ids:         req.GetIds(),
+			CreatedFrom: pbToTime(req.GetCreatedFrom()),
+			CreatedTo:   pbToTime(req.GetCreatedTo()),
+			UpdatedFrom: pbToTime(req.GetUpdatedFrom()),
+			UpdatedTo:   pbToTime(req.GetUpdatedTo()),
+			Statuses:    req.GetStatuses(),
+		},
+	})
+	if err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.ReindexTopicsResp{
+				ErrCode: pb.ReindexTopicsResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.ReindexTopicsResp{}, err
+	}
+
+	return &pb.ReindexTopicsResp{RunId: runID}, nil
+}
+
+func (handler *Handler) CancelJobRun(ctx context.Context, req *pb.CancelJobRunReq) (*pb.CancelJobRunResp, error) {
+	if err := service.Instance.CancelJobRun(ctx, req.GetRunId()); err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.CancelJobRunResp{
+				ErrCode: pb.CancelJobRunResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.CancelJobRunResp{}, err
+	}
+
+	return &pb.CancelJobRunResp{}, nil
+}
+
+// ListJobs 列出全部任务，任一副本返回结果一致
+func (handler *Handler) ListJobs(ctx context.Context, req *pb.ListJobsReq) (*pb.ListJobsResp, error) {
+	jobArrPb := make([]*pb.Job, 0)
+
+	jobs, err := cron.ListJobs(ctx)
+	if err != nil {
+		return &pb.ListJobsResp{Data: jobArrPb}, err
+	}
+	for _, v := range jobs {
+		jobArrPb = append(jobArrPb, &pb.Job{
+			Name:       v.Name,
+			Spec:       v.Conf.Spec,
+			Enabled:    v.Conf.Enabled,
+			TimeoutSec: int32(v.Conf.TimeoutSec),
+			JitterSec:  int32(v.Conf.JitterSec),
+			PrevFireAt: func() *timestamppb.Timestamp {
+				if v.Prev.IsZero() {
+					return nil
+				}
+				return timestamppb.New(v.Prev)
+			}(),
+			NextFireAt: func() *timestamppb.Timestamp {
+				if v.Next.IsZero() {
+					return nil
+				}
+				return timestamppb.New(v.Next)
+			}(),
+		})
+	}
+
+	return &pb.ListJobsResp{Data: jobArrPb}, nil
+}
+
+func jobRunToPb(v *model.JobRun) *pb.JobRun {
+	timeToPb := func(t *time.Time) *timestamppb.Timestamp {
+		if t == nil {
+			return nil
+		}
+		return timestamppb.New(*t)
+	}
+
+	return &pb.JobRun{
+		Id:              v.ID,
+		Job:             v.Job,
+		Trigger:         v.Trigger,
+		Status:          v.Status,
+		Host:            v.Host,
+		Processed:       v.Processed,
+		Err:             v.Err,
+		CancelRequested: v.CancelRequested,
+		Total:           v.Total,
+		Params:          v.Params,
+		CreatedAt:       timestamppb.New(v.CreatedAt),
+		StartAt:         timeToPb(v.StartAt),
+		EndAt:           timeToPb(v.EndAt),
+	}
+}
@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"dm-gitlab.bolo.me/hubpd/topic/service"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+	"time"
+)
+
+// holdCronLeader 模拟leader副本持有选主锁
+func holdCronLeader(t *testing.T) {
+	ctx := context.Background()
+	if err := dao.RedisInstance.RedisClient.Set(ctx, model.CronLeader, "test", time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dao.RedisInstance.RedisClient.Del(ctx, model.CronLeader)
+	})
+}
+
+func Test_TriggerJob(t *testing.T) {
+	prepareTestDatabase()
+
+	type args struct {
+		req *pb.TriggerJobReq
+	}
+	tests := []struct {
+		name    string
+		args    args
+		leader  bool
+		check   func(t *testing.T, resp *pb.TriggerJobResp)
+		wantErr bool
+	}{
+		{
+			name: "job not found",
+			args: args{
+				req: &pb.TriggerJobReq{Job: "NotExist"},
+			},
+			leader: true,
+			check: func(t *testing.T, resp *pb.TriggerJobResp) {
+				if resp.ErrCode != pb.TriggerJobResp_JOB_NOT_FOUND {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "no leader",
+			args: args{
+				req: &pb.TriggerJobReq{Job: model.JobWarmUpTopicCache},
+			},
+			check: func(t *testing.T, resp *pb.TriggerJobResp) {
+				if resp.ErrCode != pb.TriggerJobResp_NO_LEADER {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "ok",
+			args: args{
+				req: &pb.TriggerJobReq{Job: model.JobWarmUpTopicCache},
+			},
+			leader: true,
+			check: func(t *testing.T, resp *pb.TriggerJobResp) {
+				if resp.ErrCode != pb.TriggerJobResp_NONE {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+					return
+				}
+				jobRun := &model.JobRun{}
+				if err := dao.TiDBInstance.DB.First(jobRun, "id = ?", resp.GetRunId()).Error; err != nil {
+					t.Fatal(err)
+				}
+				if jobRun.Status != model.JobRunStatusPending || jobRun.Trigger != model.JobTriggerManual {
+					t.Errorf("status: %v, trigger: %v", jobRun.Status, jobRun.Trigger)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.leader {
+				holdCronLeader(t)
+			}
+			got, err := Instance.TriggerJob(context.Background(), tt.args.req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("TriggerJob() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func Test_ListJobs(t *testing.T) {
+	prepareTestDatabase()
+
+	got, err := Instance.ListJobs(context.Background(), &pb.ListJobsReq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.GetData()) != len(model.Jobs)+len(model.ManualJobs) {
+		t.Fatalf("jobs: %v", len(got.GetData()))
+	}
+
+	for _, job := range got.GetData() {
+		switch job.GetName() {
+		case model.JobUpdateTopicStatistic:
+			// 取自job_runs，与执行副本无关
+			want := time.Date(2020, 9, 15, 10, 0, 0, 0, time.UTC)
+			if !job.GetPrevFireAt().AsTime().Equal(want) {
+				t.Errorf("prevFireAt: %v, want: %v", job.GetPrevFireAt().AsTime(), want)
+			}
+			if job.GetSpec() == "" || job.GetNextFireAt() == nil {
+				t.Errorf("spec: %q, nextFireAt: %v", job.GetSpec(), job.GetNextFireAt())
+			}
+		case model.JobReindexTopics:
+			if job.GetSpec() != "" || job.GetNextFireAt() != nil {
+				t.Errorf("manual job spec: %q, nextFireAt: %v", job.GetSpec(), job.GetNextFireAt())
+			}
+		}
+	}
+}
+
+func Test_ReindexTopics(t *testing.T) {
+	prepareTestDatabase()
+
+	type args struct {
+		req *pb.ReindexTopicsReq
+	}
+	tests := []struct {
+		name    string
+		args    args
+		leader  bool
+		check   func(t *testing.T, resp *pb.ReindexTopicsResp)
+		wantErr bool
+	}{
+		{
+			name: "invalid range",
+			args: args{
+				req: &pb.ReindexTopicsReq{
+					CreatedFrom: timestamppb.New(time.Date(2020, 9, 16, 0, 0, 0, 0, time.UTC)),
+					CreatedTo:   timestamppb.New(time.Date(2020, 9, 15, 0, 0, 0, 0, time.UTC)),
+				},
+			},
+			leader: true,
+			check: func(t *testing.T, resp *pb.ReindexTopicsResp) {
+				if resp.ErrCode != pb.ReindexTopicsResp_INVALID_ARGUMENT {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "no leader",
+			args: args{
+				req: &pb.ReindexTopicsReq{Ids: []int64{1, 2}},
+			},
+			check: func(t *testing.T, resp *pb.ReindexTopicsResp) {
+				if resp.ErrCode != pb.ReindexTopicsResp_NO_LEADER {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "ok",
+			args: args{
+				req: &pb.ReindexTopicsReq{Ids: []int64{1, 2}},
+			},
+			leader: true,
+			check: func(t *testing.T, resp *pb.ReindexTopicsResp) {
+				if resp.ErrCode != pb.ReindexTopicsResp_NONE || resp.GetRunId() == 0 {
+					t.Errorf("errCode: %d, errMsg: %s, runId: %v", resp.ErrCode, resp.ErrMsg, resp.GetRunId())
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.leader {
+				holdCronLeader(t)
+			}
+			got, err := Instance.ReindexTopics(context.Background(), tt.args.req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ReindexTopics() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func Test_ReindexTopicsJob(t *testing.T) {
+	prepareTestDatabase()
+
+	ctx := context.Background()
+	opts := service.ReindexOptions{}
+	opts.Filter.Ids = []int64{1, 2}
+	if err := service.Instance.ReindexTopics(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// 经发件箱登记，每个话题一条es索引事件，序号在话题内递增
+	outboxEvents := make([]*model.OutboxEvent, 0)
+	if err := dao.TiDBInstance.DB.Where("topic_id IN (?) AND kind = ? AND sent_at IS NULL", opts.Filter.Ids, model.OutboxKindIndex).
+		Order("topic_id asc, seq asc").Find(&outboxEvents).Error; err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int64]bool)
+	for _, outboxEvent := range outboxEvents {
+		if outboxEvent.Seq == 0 {
+			t.Errorf("topic %v seq not assigned", outboxEvent.TopicID)
+		}
+		seen[outboxEvent.TopicID] = true
+	}
+	for _, id := range opts.Filter.Ids {
+		if !seen[id] {
+			t.Errorf("topic %v not enqueued", id)
+		}
+	}
+}
@@ -30,28 +30,20 @@ func (handler *Handler) CreateTopic(ctx context.Context, req *pb.CreateTopicReq)
 			catalogueJson, _ := json.Marshal(req.GetData().GetCatalogue())
 			return string(catalogueJson)
 		}(),
-		StartAt: func() time.Time {
-			todayZeroTime, _ := time.ParseInLocation(
-				"2006-01-02", req.GetData().GetStartAt().AsTime().Local().Format("2006-01-02"), time.Local)
-			return todayZeroTime
-		}(),
-		EndAt: func() time.Time {
-			todayZeroTime, _ := time.ParseInLocation(
-				"2006-01-02", req.GetData().GetEndAt().AsTime().Local().Format("2006-01-02"), time.Local)
-			return todayZeroTime.AddDate(0, 0, 1).Add(-1 * time.Second)
-		}(),
-		Status: func() pb.TopicDetail_TopicStatus {
-			if time.Now().Unix() < req.GetData().GetStartAt().GetSeconds() {
-				return pb.TopicDetail_TopicStatus_NotStarted
-			} else if time.Now().Unix() > req.GetData().GetEndAt().GetSeconds() {
-				return pb.TopicDetail_TopicStatus_Ended
-			} else {
-				return pb.TopicDetail_TopicStatus_InProcess
-			}
-		}(),
+		// 精确到分钟，统一按UTC存储
+		StartAt: req.GetData().GetStartAt().AsTime().Truncate(time.Minute),
+		EndAt:   req.GetData().GetEndAt().AsTime().Truncate(time.Minute),
 	}
-	err := service.Instance.CreateTopic(ctx, topicDetail)
+	timeZone, err := model.NormalizeTimeZone(req.GetData().GetTimeZone())
 	if err != nil {
+		return &pb.CreateTopicResp{
+			ErrCode: pb.CreateTopicResp_INVALID_ARGUMENT,
+			ErrMsg:  err.Error(),
+		}, nil
+	}
+	topicDetail.TimeZone = timeZone
+	topicDetail.Status = topicDetail.StatusAt(time.Now())
+	if err := service.Instance.CreateTopic(ctx, topicDetail); err != nil {
 		if internalErr, ok := err.(*common.InternalError); ok {
 			return &pb.CreateTopicResp{
 				ErrCode: pb.CreateTopicResp_ErrCode(internalErr.ErrCode),
@@ -80,28 +72,36 @@ func (handler *Handler) UpdateTopic(ctx context.Context, req *pb.UpdateTopicReq)
 			catalogueJson, _ := json.Marshal(req.GetData().GetCatalogue())
 			return string(catalogueJson)
 		}(),
-		StartAt: func() time.Time {
-			todayZeroTime, _ := time.ParseInLocation(
-				"2006-01-02", req.GetData().GetStartAt().AsTime().Local().Format("2006-01-02"), time.Local)
-			return todayZeroTime
-		}(),
-		EndAt: func() time.Time {
-			todayZeroTime, _ := time.ParseInLocation(
-				"2006-01-02", req.GetData().GetEndAt().AsTime().Local().Format("2006-01-02"), time.Local)
-			return todayZeroTime.AddDate(0, 0, 1).Add(-1 * time.Second)
-		}(),
-		Status: func() pb.TopicDetail_TopicStatus {
-			if time.Now().Unix() < req.GetData().GetStartAt().GetSeconds() {
-				return pb.TopicDetail_TopicStatus_NotStarted
-			} else if time.Now().Unix() > req.GetData().GetEndAt().GetSeconds() {
-				return pb.TopicDetail_TopicStatus_Ended
-			} else {
-				return pb.TopicDetail_TopicStatus_InProcess
-			}
-		}(),
+		// 精确到分钟，统一按UTC存储
+		StartAt: req.GetData().GetStartAt().AsTime().Truncate(time.Minute),
+		EndAt:   req.GetData().GetEndAt().AsTime().Truncate(time.Minute),
+		// 为0时不校验版本
+		Version: req.GetData().GetVersion(),
 	}
-	_, err := service.Instance.UpdateTopic(ctx, topicDetail)
+	// 未指定update_mask时更新全部字段
+	fields := req.GetUpdateMask().GetPaths()
+	if err := model.ValidateTopicUpdateMask(fields); err != nil {
+		return &pb.UpdateTopicResp{
+			ErrCode: pb.UpdateTopicResp_INVALID_ARGUMENT,
+			ErrMsg:  err.Error(),
+		}, nil
+	}
+	timeZone, err := model.NormalizeTimeZone(req.GetData().GetTimeZone())
 	if err != nil {
+		return &pb.UpdateTopicResp{
+			ErrCode: pb.UpdateTopicResp_INVALID_ARGUMENT,
+			ErrMsg:  err.Error(),
+		}, nil
+	}
+	topicDetail.TimeZone = timeZone
+	if _, err := service.Instance.UpdateTopic(ctx, topicDetail, fields); err != nil {
+		if conflictErr, ok := err.(*common.VersionConflictError); ok {
+			return &pb.UpdateTopicResp{
+				ErrCode:        pb.UpdateTopicResp_VERSION_CONFLICT,
+				ErrMsg:         conflictErr.ErrMsg,
+				CurrentVersion: conflictErr.Current,
+			}, nil
+		}
 		if internalErr, ok := err.(*common.InternalError); ok {
 			return &pb.UpdateTopicResp{
 				ErrCode: pb.UpdateTopicResp_ErrCode(internalErr.ErrCode),
@@ -178,9 +178,11 @@ func (handler *Handler) GetTopicByIds(ctx context.Context, req *pb.GetTopicByIds
 					}
 					return topicDetailCatalogueItemArr
 				}(v),
-				StartAt: timestamppb.New(v.TopicDetail.StartAt),
-				EndAt:   timestamppb.New(v.TopicDetail.EndAt),
-				Status:  v.TopicDetail.Status,
+				StartAt:  timestamppb.New(v.TopicDetail.StartAt),
+				EndAt:    timestamppb.New(v.TopicDetail.EndAt),
+				Status:   v.TopicDetail.Status,
+				TimeZone: v.TopicDetail.TimeZone,
+				Version:  v.TopicDetail.Version,
 			},
 			Statistic: func(innerV *model.TopicInfo) *pb.TopicStatistic {
 				if topicStatisticMapItem, ok := topicStatisticMap[innerV.TopicDetail.ID]; ok {
@@ -245,9 +247,11 @@ func (handler *Handler) TopicList(ctx context.Context, req *pb.TopicListReq) (*p
 					}
 					return topicDetailCatalogueItemArr
 				}(v),
-				StartAt: timestamppb.New(v.TopicDetail.StartAt),
-				EndAt:   timestamppb.New(v.TopicDetail.EndAt),
-				Status:  v.TopicDetail.Status,
+				StartAt:  timestamppb.New(v.TopicDetail.StartAt),
+				EndAt:    timestamppb.New(v.TopicDetail.EndAt),
+				Status:   v.TopicDetail.Status,
+				TimeZone: v.TopicDetail.TimeZone,
+				Version:  v.TopicDetail.Version,
 			},
 			Statistic: func(innerV *model.TopicInfo) *pb.TopicStatistic {
 				if topicStatisticMapItem, ok := topicStatisticMap[innerV.TopicDetail.ID]; ok {
@@ -334,9 +338,11 @@ func (handler *Handler) HitTopicByTag(ctx context.Context, req *pb.HitTopicByTag
 					}
 					return topicDetailCatalogueItemArr
 				}(v),
-				StartAt: timestamppb.New(v.TopicDetail.StartAt),
-				EndAt:   timestamppb.New(v.TopicDetail.EndAt),
-				Status:  v.TopicDetail.Status,
+				StartAt:  timestamppb.New(v.TopicDetail.StartAt),
+				EndAt:    timestamppb.New(v.TopicDetail.EndAt),
+				Status:   v.TopicDetail.Status,
+				TimeZone: v.TopicDetail.TimeZone,
+				Version:  v.TopicDetail.Version,
 			},
 			Statistic: func(innerV *model.TopicInfo) *pb.TopicStatistic {
 				if topicStatisticMapItem, ok := topicStatisticMap[innerV.TopicDetail.ID]; ok {
@@ -2,20 +2,20 @@ package handler
 
 import (
 	"context"
-	core "dm-gitlab.bolo.me/hubpd/basic/grpc"
 	"dm-gitlab.bolo.me/hubpd/basic/logger"
 	"dm-gitlab.bolo.me/hubpd/proto/bi"
 	mockBI "dm-gitlab.bolo.me/hubpd/proto/bi/mock"
 	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
 	"dm-gitlab.bolo.me/hubpd/topic/dao"
 	"dm-gitlab.bolo.me/hubpd/topic/model"
 	"dm-gitlab.bolo.me/hubpd/topic/service"
-	"github.com/Shopify/sarama/mocks"
 	"github.com/go-redis/redis/v8"
 	"github.com/go-testfixtures/testfixtures/v3"
 	"github.com/golang/mock/gomock"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/any"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"os"
 	"testing"
@@ -44,13 +44,12 @@ func TestMain(m *testing.M) {
 		Log: log,
 	}
 
-	loc, _ := time.LoadLocation("Asia/Shanghai")
 	ddb, _ := dbInstance.DB()
 	fixtures, err = testfixtures.New(
 		testfixtures.Database(ddb),
 		testfixtures.Dialect("mysql"),
 		testfixtures.Directory("../fixtures"),
-		testfixtures.Location(loc),
+		testfixtures.Location(time.UTC),
 	)
 	if err != nil {
 		log.Fatal(err)
@@ -59,13 +58,18 @@ func TestMain(m *testing.M) {
 	// redisInstance
 	dao.RedisInstance = &dao.Redis{
 		Log: logger.GetLogger(),
-		RedisClusterClient: func() *redis.ClusterClient {
+		RedisClient: func() redis.UniversalClient {
 			if os.Getenv("REDIS_MODE") == "local" {
 				return model.GetRedis()
 			}
 			return model.GetRedisMock()
 		}(),
 	}
+	dao.LockerInstance = dao.RedisInstance
+
+	// fixtures/webhook_subscriptions.yaml的secret以该密钥加密
+	config.Cfg.WebhookSecretKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	config.Cfg.WebhookAllowedHosts = []string{"hooks.example.com"}
 
 	os.Exit(m.Run())
 }
@@ -79,9 +83,6 @@ func prepareTestDatabase() {
 func Test_CreateTopic(t *testing.T) {
 	prepareTestDatabase()
 
-	mockPub := core.NewMockPublisher(t)
-	service.Instance.Pub = mockPub
-
 	type args struct {
 		req *pb.CreateTopicReq
 	}
@@ -96,9 +97,11 @@ func Test_CreateTopic(t *testing.T) {
 			args: args{
 				req: &pb.CreateTopicReq{
 					Data: &pb.TopicDetail{
-						Title: "test_title_001",
-						BgPic: "test_BgPic_002",
-						Sort:  2,
+						Title:   "test_title_001",
+						BgPic:   "test_BgPic_002",
+						Sort:    2,
+						StartAt: timestamppb.New(time.Date(2020, 9, 15, 0, 0, 0, 0, time.UTC)),
+						EndAt:   timestamppb.New(time.Date(2020, 9, 16, 0, 0, 0, 0, time.UTC)),
 						Catalogue: []*pb.TopicDetailCatalogueItem{
 							{
 								Key:   "k1",
@@ -126,10 +129,12 @@ func Test_CreateTopic(t *testing.T) {
 			args: args{
 				req: &pb.CreateTopicReq{
 					Data: &pb.TopicDetail{
-						Title: "test_title_0013",
-						BgPic: "test_BgPic_003",
-						Sort:  3,
-						Desc:  "test",
+						Title:   "test_title_0013",
+						BgPic:   "test_BgPic_003",
+						Sort:    3,
+						Desc:    "test",
+						StartAt: timestamppb.New(time.Date(2020, 9, 15, 0, 0, 0, 0, time.UTC)),
+						EndAt:   timestamppb.New(time.Date(2020, 9, 16, 0, 0, 0, 0, time.UTC)),
 						Catalogue: []*pb.TopicDetailCatalogueItem{
 							{
 								Key:   "k1",
@@ -152,10 +157,26 @@ func Test_CreateTopic(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "start not before end",
+			args: args{
+				req: &pb.CreateTopicReq{
+					Data: &pb.TopicDetail{
+						Title:   "test_title_0014",
+						StartAt: timestamppb.New(time.Date(2020, 9, 16, 0, 0, 0, 0, time.UTC)),
+						EndAt:   timestamppb.New(time.Date(2020, 9, 16, 0, 0, 0, 0, time.UTC)),
+					},
+				},
+			},
+			check: func(t *testing.T, resp *pb.CreateTopicResp) {
+				if resp.ErrCode != pb.CreateTopicResp_INVALID_ARGUMENT {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockPub.GetProducer().(*mocks.AsyncProducer).ExpectInputAndSucceed()
 			got, err := Instance.CreateTopic(context.Background(), tt.args.req)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CreateTopic() error = %v, wantErr %v", err, tt.wantErr)
@@ -169,9 +190,6 @@ func Test_CreateTopic(t *testing.T) {
 func Test_UpdateTopic(t *testing.T) {
 	prepareTestDatabase()
 
-	mockPub := core.NewMockPublisher(t)
-	service.Instance.Pub = mockPub
-
 	type args struct {
 		req *pb.UpdateTopicReq
 	}
@@ -182,7 +200,7 @@ func Test_UpdateTopic(t *testing.T) {
 		wantErr bool
 	}{
 		{
-			name: "name dup",
+			name: "name dup without time range",
 			args: args{
 				req: &pb.UpdateTopicReq{
 					Data: &pb.TopicDetail{
@@ -206,12 +224,62 @@ func Test_UpdateTopic(t *testing.T) {
 					},
 				},
 			},
+			check: func(t *testing.T, resp *pb.UpdateTopicResp) {
+				// 全量更新时开始、结束时间均为空，先于名称重复校验失败
+				if resp.ErrCode != pb.UpdateTopicResp_INVALID_ARGUMENT {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "name dup with valid time range",
+			args: args{
+				req: &pb.UpdateTopicReq{
+					Data: &pb.TopicDetail{
+						Id:     1,
+						Title:  "test_title_002",
+						BgPic:  "test_BgPic_002",
+						Avatar: "",
+						Sort:   2,
+						Catalogue: []*pb.TopicDetailCatalogueItem{
+							{
+								Key:   "k1",
+								Value: "v1",
+							},
+							{
+								Key:   "k2",
+								Value: "v2",
+							},
+						},
+						StartAt: timestamppb.New(time.Date(2020, 9, 15, 0, 0, 0, 0, time.UTC)),
+						EndAt:   timestamppb.New(time.Date(2020, 9, 16, 0, 0, 0, 0, time.UTC)),
+					},
+				},
+			},
 			check: func(t *testing.T, resp *pb.UpdateTopicResp) {
 				if resp.ErrCode != pb.UpdateTopicResp_NAME_DUP {
 					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
 				}
 			},
 		},
+		{
+			name: "start not before end",
+			args: args{
+				req: &pb.UpdateTopicReq{
+					Data: &pb.TopicDetail{
+						Id:      1,
+						Title:   "test_title_0015",
+						StartAt: timestamppb.New(time.Date(2020, 9, 16, 0, 0, 0, 0, time.UTC)),
+						EndAt:   timestamppb.New(time.Date(2020, 9, 15, 0, 0, 0, 0, time.UTC)),
+					},
+				},
+			},
+			check: func(t *testing.T, resp *pb.UpdateTopicResp) {
+				if resp.ErrCode != pb.UpdateTopicResp_INVALID_ARGUMENT {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
 		{
 			name: "ok",
 			args: args{
@@ -254,7 +322,6 @@ func Test_UpdateTopic(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockPub.GetProducer().(*mocks.AsyncProducer).ExpectInputAndSucceed()
 			got, err := Instance.UpdateTopic(context.Background(), tt.args.req)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("UpdateTopic() error = %v, wantErr %v", err, tt.wantErr)
@@ -265,11 +332,177 @@ func Test_UpdateTopic(t *testing.T) {
 	}
 }
 
-func Test_DelTopicByIds(t *testing.T) {
+func Test_UpdateTopicPartial(t *testing.T) {
 	prepareTestDatabase()
 
-	mockPub := core.NewMockPublisher(t)
-	service.Instance.Pub = mockPub
+	ctx := context.Background()
+	startAt := time.Date(2020, 12, 15, 0, 0, 0, 0, time.UTC)
+	endAt := time.Date(2020, 12, 16, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		req   *pb.UpdateTopicReq
+		want  pb.UpdateTopicResp_ErrCode
+		check func(t *testing.T, topicDetail *model.TopicDetail)
+	}{
+		{
+			name: "sort only",
+			req: &pb.UpdateTopicReq{
+				Data:       &pb.TopicDetail{Id: 2, Sort: 9},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"sort"}},
+			},
+			want: pb.UpdateTopicResp_NONE,
+			check: func(t *testing.T, topicDetail *model.TopicDetail) {
+				if topicDetail.Sort != 9 {
+					t.Errorf("sort: %v, want 9", topicDetail.Sort)
+				}
+				if topicDetail.Title != "test_title_002" || topicDetail.Desc != "test_desc_002" || topicDetail.BGPic != "test_bgPic_001" {
+					t.Errorf("unmasked fields changed: %+v", topicDetail)
+				}
+				if !topicDetail.StartAt.Equal(startAt) || !topicDetail.EndAt.Equal(endAt) {
+					t.Errorf("start_at: %v, end_at: %v", topicDetail.StartAt, topicDetail.EndAt)
+				}
+			},
+		},
+		{
+			name: "end_at before stored start_at",
+			req: &pb.UpdateTopicReq{
+				Data:       &pb.TopicDetail{Id: 2, EndAt: timestamppb.New(startAt.Add(-time.Hour))},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"end_at"}},
+			},
+			want: pb.UpdateTopicResp_INVALID_ARGUMENT,
+			check: func(t *testing.T, topicDetail *model.TopicDetail) {
+				if !topicDetail.EndAt.Equal(endAt) {
+					t.Errorf("end_at: %v, want %v", topicDetail.EndAt, endAt)
+				}
+			},
+		},
+		{
+			name: "start_at only",
+			req: &pb.UpdateTopicReq{
+				Data:       &pb.TopicDetail{Id: 2, StartAt: timestamppb.New(startAt.Add(12 * time.Hour))},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"start_at"}},
+			},
+			want: pb.UpdateTopicResp_NONE,
+			check: func(t *testing.T, topicDetail *model.TopicDetail) {
+				if !topicDetail.StartAt.Equal(startAt.Add(12*time.Hour)) || !topicDetail.EndAt.Equal(endAt) {
+					t.Errorf("start_at: %v, end_at: %v", topicDetail.StartAt, topicDetail.EndAt)
+				}
+				if topicDetail.Sort != 9 {
+					t.Errorf("sort: %v, want 9", topicDetail.Sort)
+				}
+			},
+		},
+		{
+			name: "status not updatable",
+			req: &pb.UpdateTopicReq{
+				Data:       &pb.TopicDetail{Id: 2},
+				UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"status"}},
+			},
+			want: pb.UpdateTopicResp_INVALID_ARGUMENT,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.UpdateTopic(ctx, tt.req)
+			if err != nil {
+				t.Fatalf("UpdateTopic() err: %v", err)
+			}
+			if got.ErrCode != tt.want {
+				t.Fatalf("errCode: %v, want %v, errMsg: %v", got.ErrCode, tt.want, got.ErrMsg)
+			}
+			if tt.check == nil {
+				return
+			}
+			topicDetail, err := dao.TiDBInstance.GetTopicDetail(ctx, 2)
+			if err != nil {
+				t.Fatalf("GetTopicDetail() err: %v", err)
+			}
+			tt.check(t, topicDetail)
+		})
+	}
+}
+
+func Test_UpdateTopicVersion(t *testing.T) {
+	prepareTestDatabase()
+
+	ctx := context.Background()
+	if err := service.Instance.RebuildTopicBitMap(ctx, service.MaintenanceOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 缓存中为更新前的数据，更新时删除
+	stale, err := dao.TiDBInstance.GetTopicDetail(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dao.RedisInstance.SetTopics(ctx, []*model.TopicInfo{{TopicDetail: stale}}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := Instance.UpdateTopic(ctx, &pb.UpdateTopicReq{
+		Data:       &pb.TopicDetail{Id: 3, Sort: 5, Version: 1},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"sort"}},
+	})
+	if err != nil || resp.ErrCode != pb.UpdateTopicResp_NONE {
+		t.Fatalf("err: %v, resp: %v", err, resp)
+	}
+
+	// 以旧版本提交
+	resp, err = Instance.UpdateTopic(ctx, &pb.UpdateTopicReq{
+		Data:       &pb.TopicDetail{Id: 3, Sort: 6, Version: 1},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"sort"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ErrCode != pb.UpdateTopicResp_VERSION_CONFLICT || resp.CurrentVersion != 2 {
+		t.Errorf("errCode: %v, currentVersion: %v, want VERSION_CONFLICT, 2", resp.ErrCode, resp.CurrentVersion)
+	}
+	topicDetail, err := dao.TiDBInstance.GetTopicDetail(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topicDetail.Sort != 5 || topicDetail.Version != 2 {
+		t.Errorf("sort: %v, version: %v, want 5, 2", topicDetail.Sort, topicDetail.Version)
+	}
+
+	// 不存在的话题
+	resp, err = Instance.UpdateTopic(ctx, &pb.UpdateTopicReq{
+		Data:       &pb.TopicDetail{Id: 999, Sort: 1},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"sort"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ErrCode != pb.UpdateTopicResp_NOT_FOUND {
+		t.Errorf("errCode: %v, want NOT_FOUND", resp.ErrCode)
+	}
+
+	// 更新后读到的是TiDB中的数据
+	getResp, err := Instance.GetTopicByIds(ctx, &pb.GetTopicByIdsReq{Ids: []int64{3}})
+	if err != nil || getResp.ErrCode != pb.GetTopicByIdsResp_NONE {
+		t.Fatalf("err: %v, resp: %v", err, getResp)
+	}
+	if got := getResp.Data[3].GetDetail(); got.GetVersion() != 2 || got.GetSort() != 5 {
+		t.Errorf("version: %v, sort: %v, want 2, 5", got.GetVersion(), got.GetSort())
+	}
+
+	// 按时间切换状态不递增version，以切换前读到的version提交不冲突
+	if _, err := service.Instance.UpdateTopicWithoutLock(ctx, topicDetail, []string{"status"}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = Instance.UpdateTopic(ctx, &pb.UpdateTopicReq{
+		Data:       &pb.TopicDetail{Id: 3, Sort: 7, Version: 2},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"sort"}},
+	})
+	if err != nil || resp.ErrCode != pb.UpdateTopicResp_NONE {
+		t.Fatalf("err: %v, resp: %v", err, resp)
+	}
+}
+
+func Test_DelTopicByIds(t *testing.T) {
+	prepareTestDatabase()
 
 	type args struct {
 		req *pb.DelTopicByIdsReq
@@ -296,8 +529,6 @@ func Test_DelTopicByIds(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockPub.GetProducer().(*mocks.AsyncProducer).ExpectInputAndSucceed()
-			mockPub.GetProducer().(*mocks.AsyncProducer).ExpectInputAndSucceed()
 			got, err := Instance.DelTopicByIds(context.Background(), tt.args.req)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("DelTopicByIds() error = %v, wantErr %v", err, tt.wantErr)
@@ -311,7 +542,7 @@ func Test_DelTopicByIds(t *testing.T) {
 func Test_GetTopicByIds(t *testing.T) {
 	prepareTestDatabase()
 
-	if err := service.Instance.InitTopicBitMap(context.Background()); err != nil {
+	if err := service.Instance.RebuildTopicBitMap(context.Background(), service.MaintenanceOptions{}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -720,10 +951,7 @@ func Test_MustManualAudit(t *testing.T) {
 
 //func Test_UpdateTopicStatus(t *testing.T) {
 //	prepareTestDatabase()
-//	mockPub := core.NewMockPublisher(t)
-//	service.Instance.Pub = mockPub
 //	for sb := 0; sb < 10000; sb++ {
-//		mockPub.GetProducer().(*mocks.AsyncProducer).ExpectInputAndSucceed()
 //	}
 //
 //	if err := service.Instance.UpdateTopicStatus(context.Background()); err != nil {
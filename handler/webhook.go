@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"dm-gitlab.bolo.me/hubpd/topic/service"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"strings"
+)
+
+func (handler *Handler) CreateWebhookSubscription(ctx context.Context,
+	req *pb.CreateWebhookSubscriptionReq) (*pb.CreateWebhookSubscriptionResp, error) {
+	subscription := &model.WebhookSubscription{
+		URL:        strings.TrimSpace(req.GetUrl()),
+		EventTypes: strings.Join(req.GetEventTypes(), ","),
+		Secret:     req.GetSecret(),
+		Enabled:    req.GetEnabled(),
+	}
+	secret, err := service.Instance.CreateWebhookSubscription(ctx, subscription)
+	if err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.CreateWebhookSubscriptionResp{
+				ErrCode: pb.CreateWebhookSubscriptionResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.CreateWebhookSubscriptionResp{}, err
+	}
+
+	// 仅创建时返回secret
+	data := webhookSubscriptionToPb(subscription)
+	data.Secret = secret
+	return &pb.CreateWebhookSubscriptionResp{Data: data}, nil
+}
+
+func (handler *Handler) UpdateWebhookSubscription(ctx context.Context,
+	req *pb.UpdateWebhookSubscriptionReq) (*pb.UpdateWebhookSubscriptionResp, error) {
+	// 未指定update_mask时更新全部字段
+	fields := req.GetUpdateMask().GetPaths()
+	if err := model.ValidateWebhookSubscriptionUpdateMask(fields); err != nil {
+		return &pb.UpdateWebhookSubscriptionResp{
+			ErrCode: pb.UpdateWebhookSubscriptionResp_INVALID_ARGUMENT,
+			ErrMsg:  err.Error(),
+		}, nil
+	}
+	subscription := &model.WebhookSubscription{
+		Base:       model.Base{ID: req.GetId()},
+		URL:        strings.TrimSpace(req.GetUrl()),
+		EventTypes: strings.Join(req.GetEventTypes(), ","),
+		Secret:     req.GetSecret(),
+		Enabled:    req.GetEnabled(),
+	}
+	if err := service.Instance.UpdateWebhookSubscription(ctx, subscription, fields); err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.UpdateWebhookSubscriptionResp{
+				ErrCode: pb.UpdateWebhookSubscriptionResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.UpdateWebhookSubscriptionResp{}, err
+	}
+
+	return &pb.UpdateWebhookSubscriptionResp{}, nil
+}
+
+func (handler *Handler) DelWebhookSubscription(ctx context.Context,
+	req *pb.DelWebhookSubscriptionReq) (*pb.DelWebhookSubscriptionResp, error) {
+	if err := service.Instance.DelWebhookSubscription(ctx, req.GetId()); err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.DelWebhookSubscriptionResp{
+				ErrCode: pb.DelWebhookSubscriptionResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.DelWebhookSubscriptionResp{}, err
+	}
+
+	return &pb.DelWebhookSubscriptionResp{}, nil
+}
+
+func (handler *Handler) ListWebhookSubscriptions(ctx context.Context,
+	req *pb.ListWebhookSubscriptionsReq) (*pb.ListWebhookSubscriptionsResp, error) {
+	subscriptionArr, err := service.Instance.ListWebhookSubscriptions(ctx)
+	if err != nil {
+		return &pb.ListWebhookSubscriptionsResp{}, err
+	}
+
+	subscriptionArrPb := make([]*pb.WebhookSubscription, 0, len(subscriptionArr))
+	for _, v := range subscriptionArr {
+		subscriptionArrPb = append(subscriptionArrPb, webhookSubscriptionToPb(v))
+	}
+
+	return &pb.ListWebhookSubscriptionsResp{Data: subscriptionArrPb}, nil
+}
+
+func (handler *Handler) ListWebhookDeliveries(ctx context.Context,
+	req *pb.ListWebhookDeliveriesReq) (*pb.ListWebhookDeliveriesResp, error) {
+	deliveryArr, total, err := service.Instance.ListWebhookDeliveries(ctx,
+		req.GetSubscriptionId(), req.GetStatus(), req.GetOffset(), req.GetLimit())
+	if err != nil {
+		return &pb.ListWebhookDeliveriesResp{}, err
+	}
+
+	deliveryArrPb := make([]*pb.WebhookDelivery, 0, len(deliveryArr))
+	for _, v := range deliveryArr {
+		deliveryArrPb = append(deliveryArrPb, &pb.WebhookDelivery{
+			Id:             v.ID,
+			SubscriptionId: v.SubscriptionID,
+			EventId:        v.EventID,
+			EventType:      v.EventType,
+			TopicId:        v.TopicID,
+			Payload:        v.Payload,
+			Status:         v.Status,
+			Attempts:       int32(v.Attempts),
+			ResponseCode:   int32(v.ResponseCode),
+			Err:            v.Err,
+			CreatedAt:      timestamppb.New(v.CreatedAt),
+			NextAttemptAt:  timestamppb.New(v.NextAttemptAt),
+			DeliveredAt: func() *timestamppb.Timestamp {
+				if v.DeliveredAt == nil {
+					return nil
+				}
+				return timestamppb.New(*v.DeliveredAt)
+			}(),
+		})
+	}
+
+	return &pb.ListWebhookDeliveriesResp{Data: deliveryArrPb, Total: total}, nil
+}
+
+func (handler *Handler) RedeliverWebhook(ctx context.Context, req *pb.RedeliverWebhookReq) (*pb.RedeliverWebhookResp, error) {
+	if err := service.Instance.RedeliverWebhook(ctx, req.GetDeliveryId()); err != nil {
+		if internalErr, ok := err.(*common.InternalError); ok {
+			return &pb.RedeliverWebhookResp{
+				ErrCode: pb.RedeliverWebhookResp_ErrCode(internalErr.ErrCode),
+				ErrMsg:  internalErr.ErrMsg,
+			}, nil
+		}
+
+		return &pb.RedeliverWebhookResp{}, err
+	}
+
+	return &pb.RedeliverWebhookResp{}, nil
+}
+
+// webhookSubscriptionToPb 不返回secret
+func webhookSubscriptionToPb(v *model.WebhookSubscription) *pb.WebhookSubscription {
+	return &pb.WebhookSubscription{
+		Id:         v.ID,
+		Url:        v.URL,
+		EventTypes: strings.Split(v.EventTypes, ","),
+		Enabled:    v.Enabled,
+		CreatedAt:  timestamppb.New(v.CreatedAt),
+		UpdatedAt:  timestamppb.New(v.UpdatedAt),
+	}
+}
@@ -0,0 +1,305 @@
+package handler
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"testing"
+)
+
+func Test_CreateWebhookSubscription(t *testing.T) {
+	prepareTestDatabase()
+
+	type args struct {
+		req *pb.CreateWebhookSubscriptionReq
+	}
+	tests := []struct {
+		name    string
+		args    args
+		check   func(t *testing.T, resp *pb.CreateWebhookSubscriptionResp)
+		wantErr bool
+	}{
+		{
+			name: "invalid url",
+			args: args{
+				req: &pb.CreateWebhookSubscriptionReq{
+					Url:        "ftp://hooks.example.com/topic",
+					EventTypes: []string{model.WebhookEventTopicStarted},
+					Enabled:    true,
+				},
+			},
+			check: func(t *testing.T, resp *pb.CreateWebhookSubscriptionResp) {
+				if resp.ErrCode != pb.CreateWebhookSubscriptionResp_INVALID_ARGUMENT {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "host not allowed",
+			args: args{
+				req: &pb.CreateWebhookSubscriptionReq{
+					Url:        "http://169.254.169.254/latest/meta-data",
+					EventTypes: []string{model.WebhookEventTopicStarted},
+					Enabled:    true,
+				},
+			},
+			check: func(t *testing.T, resp *pb.CreateWebhookSubscriptionResp) {
+				if resp.ErrCode != pb.CreateWebhookSubscriptionResp_INVALID_ARGUMENT {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "unknown event type",
+			args: args{
+				req: &pb.CreateWebhookSubscriptionReq{
+					Url:        "https://hooks.example.com/topic",
+					EventTypes: []string{"TopicFollowed"},
+					Enabled:    true,
+				},
+			},
+			check: func(t *testing.T, resp *pb.CreateWebhookSubscriptionResp) {
+				if resp.ErrCode != pb.CreateWebhookSubscriptionResp_INVALID_ARGUMENT {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "ok",
+			args: args{
+				req: &pb.CreateWebhookSubscriptionReq{
+					Url:        "https://hooks.example.com/topic",
+					EventTypes: []string{model.WebhookEventTopicUpdated},
+					Enabled:    true,
+				},
+			},
+			check: func(t *testing.T, resp *pb.CreateWebhookSubscriptionResp) {
+				if resp.ErrCode != pb.CreateWebhookSubscriptionResp_NONE {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+					return
+				}
+				// 未指定secret时生成，仅创建时返回
+				if resp.GetData().GetId() == 0 || resp.GetData().GetSecret() == "" {
+					t.Errorf("data: %v", resp.GetData())
+					return
+				}
+				// 加密保存
+				subscription, err := dao.TiDBInstance.GetWebhookSubscription(context.Background(), resp.GetData().GetId())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if subscription.Secret == resp.GetData().GetSecret() {
+					t.Errorf("secret stored in plaintext")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.CreateWebhookSubscription(context.Background(), tt.args.req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CreateWebhookSubscription() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func Test_UpdateWebhookSubscription(t *testing.T) {
+	prepareTestDatabase()
+
+	type args struct {
+		req *pb.UpdateWebhookSubscriptionReq
+	}
+	tests := []struct {
+		name    string
+		args    args
+		check   func(t *testing.T, resp *pb.UpdateWebhookSubscriptionResp)
+		wantErr bool
+	}{
+		{
+			name: "not found",
+			args: args{
+				req: &pb.UpdateWebhookSubscriptionReq{
+					Id:         100,
+					Url:        "https://hooks.example.com/topic",
+					EventTypes: []string{model.WebhookEventTopicStarted},
+				},
+			},
+			check: func(t *testing.T, resp *pb.UpdateWebhookSubscriptionResp) {
+				if resp.ErrCode != pb.UpdateWebhookSubscriptionResp_NOT_FOUND {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "ok",
+			args: args{
+				req: &pb.UpdateWebhookSubscriptionReq{
+					Id:         1,
+					Url:        "https://hooks.example.com/topic/v2",
+					EventTypes: []string{model.WebhookEventTopicStarted},
+					Enabled:    true,
+				},
+			},
+			check: func(t *testing.T, resp *pb.UpdateWebhookSubscriptionResp) {
+				if resp.ErrCode != pb.UpdateWebhookSubscriptionResp_NONE {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+					return
+				}
+				list, err := Instance.ListWebhookSubscriptions(context.Background(), &pb.ListWebhookSubscriptionsReq{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(list.GetData()) != 1 || list.GetData()[0].GetUrl() != "https://hooks.example.com/topic/v2" {
+					t.Errorf("data: %v", list.GetData())
+				}
+				// 列表不返回secret
+				if list.GetData()[0].GetSecret() != "" {
+					t.Errorf("secret returned")
+				}
+			},
+		},
+		{
+			name: "invalid mask",
+			args: args{
+				req: &pb.UpdateWebhookSubscriptionReq{
+					Id:         1,
+					UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"id"}},
+				},
+			},
+			check: func(t *testing.T, resp *pb.UpdateWebhookSubscriptionResp) {
+				if resp.ErrCode != pb.UpdateWebhookSubscriptionResp_INVALID_ARGUMENT {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+				}
+			},
+		},
+		{
+			name: "disable only",
+			args: args{
+				req: &pb.UpdateWebhookSubscriptionReq{
+					Id:         1,
+					UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"enabled"}},
+				},
+			},
+			check: func(t *testing.T, resp *pb.UpdateWebhookSubscriptionResp) {
+				if resp.ErrCode != pb.UpdateWebhookSubscriptionResp_NONE {
+					t.Errorf("errCode: %d, errMsg: %s", resp.ErrCode, resp.ErrMsg)
+					return
+				}
+				// 未在mask中的字段保持不变
+				subscription, err := dao.TiDBInstance.GetWebhookSubscription(context.Background(), 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if subscription.Enabled || subscription.URL != "https://hooks.example.com/topic/v2" ||
+					subscription.EventTypes != model.WebhookEventTopicStarted {
+					t.Errorf("subscription: %+v", subscription)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.UpdateWebhookSubscription(context.Background(), tt.args.req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UpdateWebhookSubscription() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func Test_DelWebhookSubscription(t *testing.T) {
+	prepareTestDatabase()
+
+	tests := []struct {
+		name     string
+		id       int64
+		wantCode pb.DelWebhookSubscriptionResp_ErrCode
+	}{
+		{name: "ok", id: 1, wantCode: pb.DelWebhookSubscriptionResp_NONE},
+		{name: "not found", id: 1, wantCode: pb.DelWebhookSubscriptionResp_NOT_FOUND},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.DelWebhookSubscription(context.Background(), &pb.DelWebhookSubscriptionReq{Id: tt.id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ErrCode != tt.wantCode {
+				t.Errorf("errCode: %d, errMsg: %s", got.ErrCode, got.ErrMsg)
+			}
+		})
+	}
+}
+
+func Test_RedeliverWebhook(t *testing.T) {
+	prepareTestDatabase()
+
+	tests := []struct {
+		name     string
+		id       int64
+		wantCode pb.RedeliverWebhookResp_ErrCode
+	}{
+		{name: "not found", id: 100, wantCode: pb.RedeliverWebhookResp_NOT_FOUND},
+		{name: "ok", id: 1, wantCode: pb.RedeliverWebhookResp_NONE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Instance.RedeliverWebhook(context.Background(), &pb.RedeliverWebhookReq{DeliveryId: tt.id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ErrCode != tt.wantCode {
+				t.Errorf("errCode: %d, errMsg: %s", got.ErrCode, got.ErrMsg)
+			}
+		})
+	}
+
+	// 重新投递后回到pending
+	list, err := Instance.ListWebhookDeliveries(context.Background(), &pb.ListWebhookDeliveriesReq{SubscriptionId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.GetTotal() != 1 || list.GetData()[0].GetStatus() != model.WebhookDeliveryStatusPending {
+		t.Errorf("total: %v, data: %v", list.GetTotal(), list.GetData())
+	}
+}
+
+func Test_UpdateTopicWebhookDeliveries(t *testing.T) {
+	prepareTestDatabase()
+
+	ctx := context.Background()
+	resp, err := Instance.UpdateWebhookSubscription(ctx, &pb.UpdateWebhookSubscriptionReq{
+		Id:         1,
+		EventTypes: []string{model.WebhookEventTopicUpdated},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"event_types"}},
+	})
+	if err != nil || resp.ErrCode != pb.UpdateWebhookSubscriptionResp_NONE {
+		t.Fatalf("err: %v, resp: %v", err, resp)
+	}
+
+	updateResp, err := Instance.UpdateTopic(ctx, &pb.UpdateTopicReq{
+		Data:       &pb.TopicDetail{Id: 1, Title: "test_title_webhook"},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"title"}},
+	})
+	if err != nil || updateResp.ErrCode != pb.UpdateTopicResp_NONE {
+		t.Fatalf("err: %v, resp: %v", err, updateResp)
+	}
+
+	// 与话题写入同一事务登记，不依赖kafka发布
+	var count int64
+	if err := dao.TiDBInstance.DB.Model(&model.WebhookDelivery{}).
+		Where("subscription_id = ? AND topic_id = ? AND event_type = ?", 1, 1, model.WebhookEventTopicUpdated).
+		Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("deliveries: %v, want: 1", count)
+	}
+}
@@ -2,57 +2,138 @@ package main
 
 import (
 	"context"
-	"dm-gitlab.bolo.me/hubpd/basic/models"
 	"dm-gitlab.bolo.me/hubpd/topic/cron"
 	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/events"
+	"dm-gitlab.bolo.me/hubpd/topic/gateway"
 	"dm-gitlab.bolo.me/hubpd/topic/grpcClient"
-	"errors"
-	"github.com/golang-migrate/migrate/v4"
+	"os"
+	"time"
 
 	core "dm-gitlab.bolo.me/hubpd/basic/grpc"
 	"dm-gitlab.bolo.me/hubpd/basic/logger"
 	topic_grpc_pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
 	"dm-gitlab.bolo.me/hubpd/topic/config"
 	"dm-gitlab.bolo.me/hubpd/topic/handler"
+	"dm-gitlab.bolo.me/hubpd/topic/metrics"
 	"dm-gitlab.bolo.me/hubpd/topic/model"
 	"dm-gitlab.bolo.me/hubpd/topic/service"
+	"dm-gitlab.bolo.me/hubpd/topic/webhook"
 )
 
 func main() {
 	log := logger.GetLogger()
 
-	// init redis client
-	redisClusterClient := model.GetRedis()
+	name, args := splitCommand(os.Args[1:])
 
-	/*------------------------------------------------ DB start ------------------------------------------------*/
+	// 兼容旧的ExecuteMigration、Migrate开关
+	if name == cmdServe && config.Cfg.ExecuteMigration {
+		name, args = cmdMigrate, []string{"up"}
+	} else if name == cmdServe && config.Cfg.Migrate {
+		name, args = cmdAutoMigrate, nil
+	}
 
-	dbInstance := model.GetInstance()
+	cmd, ok := commands[name]
+	if !ok {
+		printUsage()
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil {
+		log.Fatalf("[main] %v err: %v", name, err)
+	}
+}
 
-	if config.Cfg.ExecuteMigration {
-		if config.Cfg.IsMysql {
-			models.Tidb2mysqlSchema("migration/sql")
-		}
+func serve(args []string) error {
+	log := logger.GetLogger()
+
+	if err := cron.ValidateJobs(model.Jobs); err != nil {
+		return err
+	}
 
-		m, err := migrate.New("file://migration/sql", "mysql://"+config.Cfg.DBDsn)
+	// new service node
+	node, err := core.NewDefaultRunner(config.Cfg.GrpcServerAddress,
+		core.WithServiceName("topic"),
+		core.WithSentry(config.Cfg.SentryDsn),
+	)
+	if err != nil {
+		log.Fatalf("new node err: %v", err)
+	}
+	defer node.Close()
+
+	initInstances()
+
+	topic_grpc_pb.RegisterTopicServer(node.GrpcServer, handler.Instance)
+
+	// HTTP/JSON网关，经gRPC客户端调用本服务
+	if config.Cfg.GatewayAddress != "" {
+		topicClient, err := grpcClient.NewTopicClient()
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("new topic client err: %v", err)
 		}
-		if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
-			log.Fatal(err)
+		gatewayServer, err := gateway.Serve(config.Cfg.GatewayAddress, topicClient, config.Cfg.GatewayMethods, config.Cfg.GatewayToken)
+		if err != nil {
+			log.Fatalf("gateway serve err: %v", err)
 		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := gatewayServer.Shutdown(ctx); err != nil {
+				log.Errorf("[main] gateway Shutdown err: %v", err)
+			}
+		}()
+	}
+
+	// redis健康探测，不可用时读降级到TiDB
+	go dao.RedisInstance.Probe(context.Background())
+
+	// 到点切换话题状态
+	go service.Instance.RunTopicStatusQueue(context.Background())
 
-		return
+	// 发布发件箱事件
+	go service.Instance.RunOutboxRelay(context.Background())
+
+	// 投递webhook
+	go service.Instance.RunWebhookDelivery(context.Background())
+
+	// metrics
+	go metrics.Serve(config.Cfg.MetricsAddress)
+
+	// cron
+	if config.Cfg.EnableCron {
+		// 多副本选主，只有leader执行定时任务
+		elector := cron.NewLeaderElector(dao.SingleBackendLocker(dao.LockerInstance), model.CronLeader,
+			time.Duration(config.Cfg.CronLeaderLeaseSec)*time.Second)
+		cron.Instance = cron.NewCron(elector)
+		cron.Instance.AddJob(model.JobUpdateTopicStatistic, service.Instance.UpdateTopicStatistic)
+		cron.Instance.AddJob(model.JobUpdateTopicStatus, service.Instance.UpdateTopicStatus)
+		cron.Instance.AddJob(model.JobWarmUpTopicCache, service.Instance.WarmUpTopicCache)
+		cron.Instance.AddJob(model.JobAuditTopicCache, service.Instance.AuditTopicCache)
+		cron.Instance.AddJob(model.JobEvaluateTopicAlerts, service.Instance.EvaluateTopicAlerts)
+		cron.Instance.AddManualJob(model.JobReindexTopics, service.Instance.ReindexTopicsJob)
+		cron.Instance.Start()
+		defer cron.Instance.Stop()
 	}
 
-	if config.Cfg.Migrate {
-		if err := dbInstance.AutoMigrate(model.Tables...); err != nil {
-			log.Fatal(err)
+	// 启动时异步预热缓存，不阻塞服务就绪
+	go func() {
+		ctx := context.Background()
+		f := func(ctx context.Context) error {
+			return service.Instance.WarmUpTopicCache(ctx)
+		}
+		if err := cron.LockJob(ctx, model.JobWarmUpTopicCache, f); err != nil {
+			log.Errorf("[main] WarmUpTopicCache cron.LockJob err: %v", err)
 		}
+	}()
 
-		return
-	}
+	// run node
+	return node.Run()
+}
+
+// initInstances 初始化serve所需实例
+func initInstances() {
+	log := logger.GetLogger()
 
-	/*------------------------------------------------ DB end -------------------------------------------------*/
+	initStores()
 
 	// init bi-chartData client
 	biChartDataClient, err := grpcClient.NewBIChartDataClient()
@@ -60,54 +141,36 @@ func main() {
 		log.Fatalf("new bi-chartData client: %s", err)
 	}
 
-	// new service node
-	node, err := core.NewDefaultRunner(config.Cfg.GrpcServerAddress,
-		core.WithServiceName("topic"),
-		core.WithSentry(config.Cfg.SentryDsn),
-		core.WithPub(config.Cfg.KafkaHosts),
-	)
-	if err != nil {
-		log.Fatalf("new node err: %v", err)
-	}
-	defer node.Close()
-
 	// init instance
 	handler.Instance = &handler.Handler{
 		Log: log,
 	}
+	service.Instance.BIChartDataClient = biChartDataClient
+	service.Instance.Webhook = webhook.NewClient(time.Duration(config.Cfg.WebhookTimeoutSec) * time.Second)
+
+	// init domain and index events publisher
+	eventsPublisher, err := events.NewKafkaPublisher(config.Cfg.KafkaHosts, config.Cfg.EventsKafkaTopic)
+	if err != nil {
+		log.Fatalf("new events publisher: %s", err)
+	}
+	events.Instance = eventsPublisher
+	events.Index = eventsPublisher
+}
+
+// initStores 初始化service、TiDB、redis及锁，运维命令与serve共用
+func initStores() {
+	log := logger.GetLogger()
+
 	service.Instance = &service.Service{
-		Log:               log,
-		BIChartDataClient: biChartDataClient,
-		Pub:               node.Pub,
+		Log: log,
 	}
 	dao.TiDBInstance = &dao.TiDB{
-		DB:  dbInstance,
+		DB:  model.GetInstance(),
 		Log: log,
 	}
 	dao.RedisInstance = &dao.Redis{
-		Log:                log,
-		RedisClusterClient: redisClusterClient,
-	}
-
-	topic_grpc_pb.RegisterTopicServer(node.GrpcServer, handler.Instance)
-
-	// cron
-	if config.Cfg.EnableCron {
-		cronInstance := cron.NewCron()
-		cronInstance.AddJob("0 0 10 * * ?", cronInstance.UpdateTopicStatistic)
-		cronInstance.AddJob("0 0 0 * * ?", cronInstance.UpdateTopicStatus)
-		cronInstance.Start()
-		defer cronInstance.Stop()
-	}
-
-	// TODO 只针对存量数据，等线上存量数据都进bitmap后就可以去掉该方法
-	_ = service.Instance.InitTopicBitMap(context.Background())
-
-	// TODO 暂时先启动时全量刷新话题状态
-	_ = service.Instance.FullUpdateTopicStatus(context.Background())
-
-	// run node
-	if err := node.Run(); err != nil {
-		log.Fatalf("run node err: %v", err)
+		Log:         log,
+		RedisClient: model.GetRedis(),
 	}
+	dao.LockerInstance = dao.NewLocker(dao.RedisInstance, dao.TiDBInstance)
 }
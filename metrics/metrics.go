@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+
+	"dm-gitlab.bolo.me/hubpd/basic/logger"
+)
+
+// 统一在此声明，expvar同名重复注册会panic
+var (
+	CacheAuditScanned  = expvar.NewInt("topic_cache_audit_scanned_total")
+	CacheAuditChecked  = expvar.NewInt("topic_cache_audit_checked_total")
+	CacheAuditRepaired = expvar.NewInt("topic_cache_audit_repaired_total")
+	CacheAuditMismatch = expvar.NewMap("topic_cache_audit_mismatch_total") // key: 字段名
+
+	CronIsLeader          = expvar.NewInt("topic_cron_is_leader") // 1-当前副本为leader
+	CronLeaderTransitions = expvar.NewInt("topic_cron_leader_transitions_total")
+
+	DeadLetters       = expvar.NewInt("topic_dead_letters_total")  // 转入死信的事件数
+	DeadLetterBacklog = expvar.NewInt("topic_dead_letter_backlog") // 待处理死信数，各副本定时从TiDB读取
+)
+
+// Serve 以/debug/vars暴露指标
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.GetLogger().Errorf("[metrics] ListenAndServe err: %v, addr: %v", err, addr)
+	}
+}
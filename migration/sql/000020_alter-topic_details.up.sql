@@ -0,0 +1,2 @@
+ALTER TABLE `topic_details`
+ADD `fence` bigint(20) NOT NULL DEFAULT 0;
\ No newline at end of file
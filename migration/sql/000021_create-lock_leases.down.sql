@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `lock_leases`;
\ No newline at end of file
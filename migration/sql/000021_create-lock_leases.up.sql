@@ -0,0 +1,7 @@
+CREATE TABLE `lock_leases` (
+  `lock_key` varchar(255) NOT NULL,
+  `token` varchar(64) NOT NULL,
+  `expire_at` datetime(3) NOT NULL,
+  `updated_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`lock_key`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
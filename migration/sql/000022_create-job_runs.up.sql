@@ -0,0 +1,20 @@
+CREATE TABLE `job_runs` (
+  `id` bigint(20) NOT NULL /*T![auto_rand] AUTO_RANDOM(5) */,
+  `created_at` datetime(3) DEFAULT NULL,
+  `updated_at` datetime(3) DEFAULT NULL,
+  `deleted_at` datetime(3) DEFAULT NULL,
+  `job` varchar(64) NOT NULL,
+  `trigger` varchar(16) NOT NULL,
+  `status` varchar(16) NOT NULL,
+  `host` varchar(255) NOT NULL,
+  `processed` bigint(20) NOT NULL,
+  `err` text NOT NULL,
+  `cancel_requested` tinyint(1) NOT NULL,
+  `start_at` datetime(3) DEFAULT NULL,
+  `end_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_job_runs_created_at` (`created_at`),
+  KEY `idx_job_runs_deleted_at` (`deleted_at`),
+  KEY `idx_job_runs_job` (`job`),
+  KEY `idx_job_runs_status` (`status`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
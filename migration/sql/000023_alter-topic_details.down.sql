@@ -0,0 +1,2 @@
+ALTER TABLE `topic_details`
+DROP COLUMN `time_zone`;
\ No newline at end of file
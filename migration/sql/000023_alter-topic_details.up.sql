@@ -0,0 +1,2 @@
+ALTER TABLE `topic_details`
+ADD `time_zone` varchar(64) NOT NULL DEFAULT 'Asia/Shanghai';
\ No newline at end of file
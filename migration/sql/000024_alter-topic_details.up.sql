@@ -0,0 +1,3 @@
+-- 存量数据按Asia/Shanghai存储，标记为utc=0，由backfill-utc转换；列默认值保持0，滚动发布期间旧版本写入的行同样待转换，新版本写入时显式置1
+ALTER TABLE `topic_details`
+ADD `utc` tinyint(1) NOT NULL DEFAULT 0;
\ No newline at end of file
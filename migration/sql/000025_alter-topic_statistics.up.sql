@@ -0,0 +1,2 @@
+ALTER TABLE `topic_statistics`
+ADD `utc` tinyint(1) NOT NULL DEFAULT 0;
\ No newline at end of file
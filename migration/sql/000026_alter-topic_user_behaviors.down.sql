@@ -0,0 +1,2 @@
+ALTER TABLE `topic_user_behaviors`
+DROP COLUMN `utc`;
\ No newline at end of file
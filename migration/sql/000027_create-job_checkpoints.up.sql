@@ -0,0 +1,8 @@
+CREATE TABLE `job_checkpoints` (
+  `job` varchar(64) NOT NULL,
+  `scope` varchar(64) NOT NULL DEFAULT '',
+  `last_id` bigint(20) NOT NULL,
+  `finished` tinyint(1) NOT NULL,
+  `updated_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`job`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
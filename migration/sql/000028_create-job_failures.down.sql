@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `job_failures`;
\ No newline at end of file
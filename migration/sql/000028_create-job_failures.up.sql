@@ -0,0 +1,11 @@
+CREATE TABLE `job_failures` (
+  `id` bigint(20) NOT NULL /*T![auto_rand] AUTO_RANDOM(5) */,
+  `created_at` datetime(3) DEFAULT NULL,
+  `updated_at` datetime(3) DEFAULT NULL,
+  `job` varchar(64) NOT NULL,
+  `item_id` bigint(20) NOT NULL,
+  `attempts` bigint(20) NOT NULL,
+  `err` text NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_job_failures_job_item_id` (`job`, `item_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `outbox_events`;
\ No newline at end of file
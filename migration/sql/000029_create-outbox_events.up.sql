@@ -0,0 +1,16 @@
+CREATE TABLE `outbox_events` (
+  `id` bigint(20) NOT NULL AUTO_INCREMENT,
+  `created_at` datetime(3) DEFAULT NULL,
+  `updated_at` datetime(3) DEFAULT NULL,
+  `event_id` varchar(64) NOT NULL,
+  `kind` varchar(16) NOT NULL,
+  `topic_id` bigint(20) NOT NULL,
+  `payload` text NOT NULL,
+  `attempts` bigint(20) NOT NULL,
+  `err` text NOT NULL,
+  `next_attempt_at` datetime(3) NOT NULL,
+  `sent_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_outbox_events_event_id` (`event_id`),
+  KEY `idx_outbox_events_sent_at` (`sent_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE `job_runs`
+DROP COLUMN `total`;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE `job_runs`
+ADD `total` bigint(20) NOT NULL DEFAULT 0;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE `job_runs`
+DROP COLUMN `params`;
\ No newline at end of file
@@ -0,0 +1,3 @@
+-- TEXT列不能设置默认值，允许NULL，滚动发布期间旧版本插入时不带params；按model读取时NULL为空串
+ALTER TABLE `job_runs`
+ADD `params` text;
\ No newline at end of file
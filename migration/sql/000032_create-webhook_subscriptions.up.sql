@@ -0,0 +1,13 @@
+CREATE TABLE `webhook_subscriptions` (
+  `id` bigint(20) NOT NULL /*T![auto_rand] AUTO_RANDOM(5) */,
+  `created_at` datetime(3) DEFAULT NULL,
+  `updated_at` datetime(3) DEFAULT NULL,
+  `deleted_at` datetime(3) DEFAULT NULL,
+  `url` varchar(1024) NOT NULL,
+  `event_types` varchar(255) NOT NULL,
+  `secret` varchar(255) NOT NULL,
+  `enabled` tinyint(1) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_webhook_subscriptions_created_at` (`created_at`),
+  KEY `idx_webhook_subscriptions_deleted_at` (`deleted_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
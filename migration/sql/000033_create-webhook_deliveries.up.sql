@@ -0,0 +1,19 @@
+CREATE TABLE `webhook_deliveries` (
+  `id` bigint(20) NOT NULL /*T![auto_rand] AUTO_RANDOM(5) */,
+  `created_at` datetime(3) DEFAULT NULL,
+  `updated_at` datetime(3) DEFAULT NULL,
+  `subscription_id` bigint(20) NOT NULL,
+  `event_id` varchar(64) NOT NULL,
+  `event_type` varchar(64) NOT NULL,
+  `topic_id` bigint(20) NOT NULL,
+  `payload` text NOT NULL,
+  `status` varchar(16) NOT NULL,
+  `attempts` bigint(20) NOT NULL,
+  `response_code` bigint(20) NOT NULL,
+  `err` text NOT NULL,
+  `next_attempt_at` datetime(3) NOT NULL,
+  `delivered_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_webhook_deliveries_subscription_id_event_id` (`subscription_id`, `event_id`),
+  KEY `idx_webhook_deliveries_status_next_attempt_at` (`status`, `next_attempt_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `topic_contents`;
\ No newline at end of file
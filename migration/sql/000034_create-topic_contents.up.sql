@@ -0,0 +1,15 @@
+CREATE TABLE `topic_contents` (
+  `id` bigint(20) NOT NULL /*T![auto_rand] AUTO_RANDOM(5) */,
+  `created_at` datetime(3) DEFAULT NULL,
+  `updated_at` datetime(3) DEFAULT NULL,
+  `topic_id` bigint(20) NOT NULL,
+  `content_id` varchar(64) NOT NULL,
+  `published_at` datetime(3) NOT NULL,
+  `pinned` tinyint(1) NOT NULL,
+  `featured` tinyint(1) NOT NULL,
+  `hidden` tinyint(1) NOT NULL,
+  `sort` int(11) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_topic_contents_topic_id_content_id` (`topic_id`, `content_id`),
+  KEY `idx_topic_contents_list` (`topic_id`, `pinned`, `sort`, `published_at`, `id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
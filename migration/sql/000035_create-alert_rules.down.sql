@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `alert_rules`;
\ No newline at end of file
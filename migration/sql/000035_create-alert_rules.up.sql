@@ -0,0 +1,15 @@
+CREATE TABLE `alert_rules` (
+  `id` bigint(20) NOT NULL /*T![auto_rand] AUTO_RANDOM(5) */,
+  `created_at` datetime(3) DEFAULT NULL,
+  `updated_at` datetime(3) DEFAULT NULL,
+  `deleted_at` datetime(3) DEFAULT NULL,
+  `topic_id` bigint(20) NOT NULL,
+  `metric` varchar(64) NOT NULL,
+  `thresholds` varchar(255) NOT NULL,
+  `enabled` tinyint(1) NOT NULL,
+  `baselined_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_alert_rules_created_at` (`created_at`),
+  KEY `idx_alert_rules_deleted_at` (`deleted_at`),
+  KEY `idx_alert_rules_topic_id` (`topic_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
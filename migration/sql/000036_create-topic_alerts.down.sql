@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `topic_alerts`;
\ No newline at end of file
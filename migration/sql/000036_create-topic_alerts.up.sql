@@ -0,0 +1,17 @@
+CREATE TABLE `topic_alerts` (
+  `id` bigint(20) NOT NULL /*T![auto_rand] AUTO_RANDOM(5) */,
+  `created_at` datetime(3) DEFAULT NULL,
+  `rule_id` bigint(20) NOT NULL,
+  `topic_id` bigint(20) NOT NULL,
+  `threshold` bigint(20) NOT NULL,
+  `round` bigint(20) NOT NULL,
+  `metric` varchar(64) NOT NULL,
+  `value` bigint(20) NOT NULL,
+  `event_id` varchar(64) NOT NULL,
+  `baseline` tinyint(1) NOT NULL,
+  `cleared_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_topic_alerts_rule_id_topic_id_threshold_round` (`rule_id`, `topic_id`, `threshold`, `round`),
+  KEY `idx_topic_alerts_created_at` (`created_at`),
+  KEY `idx_topic_alerts_topic_id` (`topic_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `dead_letters`;
\ No newline at end of file
@@ -0,0 +1,16 @@
+CREATE TABLE `dead_letters` (
+  `id` bigint(20) NOT NULL /*T![auto_rand] AUTO_RANDOM(5) */,
+  `created_at` datetime(3) DEFAULT NULL,
+  `updated_at` datetime(3) DEFAULT NULL,
+  `event_id` varchar(64) NOT NULL,
+  `kind` varchar(16) NOT NULL,
+  `topic_id` bigint(20) NOT NULL,
+  `seq` bigint(20) NOT NULL,
+  `payload` text NOT NULL,
+  `reason` text NOT NULL,
+  `attempts` bigint(20) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_dead_letters_event_id` (`event_id`),
+  KEY `idx_dead_letters_created_at` (`created_at`),
+  KEY `idx_dead_letters_topic_id` (`topic_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
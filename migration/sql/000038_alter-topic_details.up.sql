@@ -0,0 +1,2 @@
+ALTER TABLE `topic_details`
+ADD `version` bigint(20) NOT NULL DEFAULT 1;
\ No newline at end of file
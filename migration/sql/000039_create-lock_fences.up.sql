@@ -0,0 +1,5 @@
+CREATE TABLE `lock_fences` (
+  `id` bigint(20) NOT NULL,
+  `fence` bigint(20) NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
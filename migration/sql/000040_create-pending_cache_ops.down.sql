@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `pending_cache_ops`;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `lock_backend_states`;
\ No newline at end of file
@@ -0,0 +1,6 @@
+CREATE TABLE `lock_backend_states` (
+  `id` bigint(20) NOT NULL,
+  `backend` varchar(16) NOT NULL,
+  `switched_at` datetime(3) NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
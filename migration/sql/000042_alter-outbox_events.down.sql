@@ -0,0 +1,2 @@
+ALTER TABLE `outbox_events`
+DROP COLUMN `seq`;
\ No newline at end of file
@@ -0,0 +1,3 @@
+-- 同一话题的事件按seq顺序发布，存量未发布的事件seq为0，排在其后登记的事件之前
+ALTER TABLE `outbox_events`
+ADD `seq` bigint(20) NOT NULL DEFAULT 0;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE `outbox_events`
+DROP KEY `idx_outbox_events_topic_seq`;
\ No newline at end of file
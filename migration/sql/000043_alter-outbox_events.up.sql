@@ -0,0 +1,2 @@
+ALTER TABLE `outbox_events`
+ADD KEY `idx_outbox_events_topic_seq` (`topic_id`, `seq`);
\ No newline at end of file
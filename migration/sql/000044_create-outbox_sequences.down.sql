@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `outbox_sequences`;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE `outbox_events`
+DROP COLUMN `first_failed_at`;
\ No newline at end of file
@@ -0,0 +1,3 @@
+-- 首次发布失败时间，超过OutboxMaxRetryMin仍未发布时转入死信
+ALTER TABLE `outbox_events`
+ADD `first_failed_at` datetime(3) DEFAULT NULL;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE `lock_leases`
+DROP COLUMN `fence`;
\ No newline at end of file
@@ -0,0 +1,3 @@
+-- 每个锁key独立推进fence，替代全局的lock_fences计数器
+ALTER TABLE `lock_leases`
+ADD `fence` bigint(20) NOT NULL DEFAULT 0;
\ No newline at end of file
@@ -0,0 +1,6 @@
+-- lock_fences仅在000039至000046之间使用，回滚时重建空表
+CREATE TABLE `lock_fences` (
+  `id` bigint(20) NOT NULL,
+  `fence` bigint(20) NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
\ No newline at end of file
@@ -0,0 +1,79 @@
+package model
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 阈值规则的指标，idle_hours为进行中话题距最近一条内容的小时数
+const (
+	AlertMetricContentNum         = "content_num"
+	AlertMetricMpNum              = "mp_num"
+	AlertMetricContentExposureNum = "content_exposure_num"
+	AlertMetricIdleHours          = "idle_hours"
+)
+
+var AlertMetrics = []string{
+	AlertMetricContentNum,
+	AlertMetricMpNum,
+	AlertMetricContentExposureNum,
+	AlertMetricIdleHours,
+}
+
+// AlertRule 话题统计阈值规则，TopicID为0时对所有话题生效
+// 新建或修改后首次检查只记录基线，已越过阈值的话题不告警
+type AlertRule struct {
+	Base
+
+	TopicID     int64      `gorm:"not null;index"`
+	Metric      string     `gorm:"size:64;not null"`
+	Thresholds  string     `gorm:"size:255;not null"` // 逗号分隔，升序
+	Enabled     bool       `gorm:"not null"`
+	BaselinedAt *time.Time // 基线记录完成时间，为空时需记录基线
+}
+
+func (*AlertRule) Description() string {
+	return "话题统计阈值规则表"
+}
+
+// ThresholdList 解析Thresholds，忽略无效值
+func (r *AlertRule) ThresholdList() []int64 {
+	thresholds := make([]int64, 0)
+	for _, v := range strings.Split(r.Thresholds, ",") {
+		threshold, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil || threshold <= 0 {
+			continue
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] < thresholds[j] })
+	return thresholds
+}
+
+// AppliesTo 规则是否对话题生效
+func (r *AlertRule) AppliesTo(topicID int64) bool {
+	return r.TopicID == 0 || r.TopicID == topicID
+}
+
+// TopicAlert 话题越过阈值的记录，同一规则、话题、阈值同时只有一条未解除的记录
+// 指标回落到阈值以下时解除，再次越过时以下一轮次重新告警
+type TopicAlert struct {
+	ID        int64     `gorm:"primarykey;<-:false"`
+	CreatedAt time.Time `gorm:"index"`
+
+	RuleID    int64      `gorm:"not null;uniqueIndex:idx_topic_alerts_rule_id_topic_id_threshold_round"`
+	TopicID   int64      `gorm:"not null;uniqueIndex:idx_topic_alerts_rule_id_topic_id_threshold_round;index"`
+	Threshold int64      `gorm:"not null;uniqueIndex:idx_topic_alerts_rule_id_topic_id_threshold_round"`
+	Round     int64      `gorm:"not null;uniqueIndex:idx_topic_alerts_rule_id_topic_id_threshold_round"` // 第几次越过，从1开始
+	Metric    string     `gorm:"size:64;not null"`
+	Value     int64      `gorm:"not null"`         // 触发时的指标值
+	EventID   string     `gorm:"size:64;not null"` // 基线记录为空
+	Baseline  bool       `gorm:"not null"`         // 规则记录基线时已越过，不告警
+	ClearedAt *time.Time // 指标回落到阈值以下的时间
+}
+
+func (*TopicAlert) Description() string {
+	return "话题阈值告警表"
+}
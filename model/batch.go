@@ -0,0 +1,32 @@
+package model
+
+import "time"
+
+// JobCheckpoint 批处理任务断点，记录最后处理的话题id
+type JobCheckpoint struct {
+	Job       string `gorm:"primarykey;size:64"`
+	Scope     string `gorm:"size:64;not null;default:''"` // 断点所属范围，如统计任务的统计日期，范围不同时不续跑
+	LastID    int64  `gorm:"not null"`
+	Finished  bool   `gorm:"not null"` // true-上次已完整执行，续跑时从头开始
+	UpdatedAt time.Time
+}
+
+func (*JobCheckpoint) Description() string {
+	return "批处理任务断点表"
+}
+
+// JobFailure 批处理任务重试后仍失败的条目
+type JobFailure struct {
+	ID        int64 `gorm:"primarykey;<-:false"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Job      string `gorm:"size:64;not null;uniqueIndex:idx_job_failures_job_item_id"`
+	ItemID   int64  `gorm:"not null;uniqueIndex:idx_job_failures_job_item_id"`
+	Attempts int    `gorm:"not null"` // 累计尝试次数
+	Err      string `gorm:"type:text;not null"`
+}
+
+func (*JobFailure) Description() string {
+	return "批处理任务失败记录表"
+}
@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+const (
+	PendingCacheOpDel    = "del"    // 删除缓存，Key为缓存key
+	PendingCacheOpSetBit = "setBit" // 写入缓存穿透过滤器，Key为话题id
+)
+
+// PendingCacheOp redis降级期间无法执行的缓存操作，redis恢复后补做
+// 持久化到TiDB，副本重启后不丢失
+type PendingCacheOp struct {
+	ID        int64 `gorm:"primarykey;<-:false"`
+	CreatedAt time.Time
+
+	Op  string `gorm:"size:16;not null;uniqueIndex:idx_pending_cache_ops_op_key"`
+	Key string `gorm:"size:255;not null;uniqueIndex:idx_pending_cache_ops_op_key"`
+}
+
+func (*PendingCacheOp) Description() string {
+	return "待补做缓存操作表"
+}
@@ -0,0 +1,106 @@
+package model
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// 缓存写入格式，读取时两种格式都支持
+// 滚动发布时先以json发布，全部副本升级后再切换为msgpack，避免旧副本读不懂新格式
+const (
+	CacheCodecJSON    = "json"
+	CacheCodecMsgpack = "msgpack"
+)
+
+// 缓存编码格式：magic(1B) + schema版本(1B) + flags(1B) + msgpack(TopicInfo)
+// TopicInfo及其字段有增删时必须递增TopicInfoSchemaVersion，旧版本缓存按未命中处理
+const (
+	topicInfoMagic         byte = 0xA7
+	TopicInfoSchemaVersion byte = 3
+
+	flagCompressed byte = 1 << 0
+	headerLen           = 3
+)
+
+var ErrCacheSchemaMismatch = errors.New("cache schema version mismatch")
+
+// EncodeTopicInfo payload超过compressThreshold字节时压缩，compressThreshold<=0不压缩
+func EncodeTopicInfo(topicInfo *TopicInfo, compressThreshold int) ([]byte, error) {
+	payload, err := msgpack.Marshal(topicInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	var flags byte
+	if compressThreshold > 0 && len(payload) > compressThreshold {
+		buf := &bytes.Buffer{}
+		w, _ := flate.NewWriter(buf, flate.BestSpeed)
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		// 压缩无收益时保留原文
+		if buf.Len() < len(payload) {
+			payload = buf.Bytes()
+			flags |= flagCompressed
+		}
+	}
+
+	b := make([]byte, 0, headerLen+len(payload))
+	b = append(b, topicInfoMagic, TopicInfoSchemaVersion, flags)
+	return append(b, payload...), nil
+}
+
+// topicInfoJSON json格式在TopicInfo的字段旁附带schema版本，旧副本解析时忽略该字段
+type topicInfoJSON struct {
+	Schema byte `json:"_schema"`
+	*TopicInfo
+}
+
+// EncodeTopicInfoJSON json格式，与msgpack共用TopicInfoSchemaVersion
+func EncodeTopicInfoJSON(topicInfo *TopicInfo) ([]byte, error) {
+	return json.Marshal(&topicInfoJSON{Schema: TopicInfoSchemaVersion, TopicInfo: topicInfo})
+}
+
+// DecodeTopicInfo 旧版本或旧json格式返回ErrCacheSchemaMismatch
+// json格式没有或不是当前schema版本的按未命中处理
+func DecodeTopicInfo(b []byte) (*TopicInfo, error) {
+	if len(b) > 0 && b[0] == '{' {
+		v := &topicInfoJSON{TopicInfo: &TopicInfo{}}
+		if err := json.Unmarshal(b, v); err != nil {
+			return nil, err
+		}
+		if v.Schema != TopicInfoSchemaVersion || v.TopicDetail == nil {
+			return nil, ErrCacheSchemaMismatch
+		}
+		return v.TopicInfo, nil
+	}
+
+	if len(b) < headerLen || b[0] != topicInfoMagic || b[1] != TopicInfoSchemaVersion {
+		return nil, ErrCacheSchemaMismatch
+	}
+
+	payload := b[headerLen:]
+	if b[2]&flagCompressed != 0 {
+		r := flate.NewReader(bytes.NewReader(payload))
+		defer r.Close()
+		var err error
+		if payload, err = ioutil.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("decompress err: %v", err)
+		}
+	}
+
+	topicInfo := &TopicInfo{}
+	if err := msgpack.Unmarshal(payload, topicInfo); err != nil {
+		return nil, err
+	}
+	return topicInfo, nil
+}
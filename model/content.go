@@ -0,0 +1,31 @@
+package model
+
+import "time"
+
+// TopicContent 话题与内容的关联，内容本身在内容服务
+// 列表按置顶、人工排序、发布时间、id倒序，idx_topic_contents_list与游标的列一致
+type TopicContent struct {
+	ID        int64 `gorm:"primarykey;<-:false;index:idx_topic_contents_list,priority:5"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	TopicID     int64     `gorm:"not null;uniqueIndex:idx_topic_contents_topic_id_content_id;index:idx_topic_contents_list,priority:1"`
+	ContentID   string    `gorm:"size:64;not null;uniqueIndex:idx_topic_contents_topic_id_content_id"`
+	PublishedAt time.Time `gorm:"not null;index:idx_topic_contents_list,priority:4"` // 内容发布时间
+	Pinned      bool      `gorm:"not null;index:idx_topic_contents_list,priority:2"` // 置顶
+	Featured    bool      `gorm:"not null"`                                          // 精选
+	Hidden      bool      `gorm:"not null"`                                          // 隐藏，默认不出现在列表中
+	Sort        int32     `gorm:"not null;index:idx_topic_contents_list,priority:3"` // 人工排序，越大越靠前
+}
+
+func (*TopicContent) Description() string {
+	return "话题内容关联表"
+}
+
+// TopicContentUpdatableFields UpdateTopicContent可按FieldMask更新的字段
+var TopicContentUpdatableFields = []string{"pinned", "featured", "hidden", "sort"}
+
+// ValidateTopicContentUpdateMask 校验FieldMask的path
+func ValidateTopicContentUpdateMask(paths []string) error {
+	return validateUpdateMask(paths, TopicContentUpdatableFields)
+}
@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// DeadLetter 无法发布的发件箱事件，重放或丢弃前阻塞该话题的后续事件
+// 重放时以原EventID、Seq重新登记到发件箱，仍排在该话题后续事件之前
+type DeadLetter struct {
+	ID        int64     `gorm:"primarykey;<-:false"`
+	CreatedAt time.Time `gorm:"index"`
+	UpdatedAt time.Time
+
+	EventID  string `gorm:"size:64;not null;uniqueIndex"`
+	Kind     string `gorm:"size:16;not null"`
+	TopicID  int64  `gorm:"not null;index"`
+	Seq      int64  `gorm:"not null"` // 原发件箱事件的话题内序号
+	Payload  string `gorm:"type:text;not null"`
+	Reason   string `gorm:"type:text;not null"` // 最后一次发布失败的原因
+	Attempts int    `gorm:"not null"`
+}
+
+func (*DeadLetter) Description() string {
+	return "死信表"
+}
@@ -0,0 +1,75 @@
+package model
+
+import "time"
+
+// 定时任务名，cron注册与手动触发共用
+const (
+	JobUpdateTopicStatistic = "UpdateTopicStatistic"
+	JobUpdateTopicStatus    = "UpdateTopicStatus"
+	JobWarmUpTopicCache     = "WarmUpTopicCache"
+	JobAuditTopicCache      = "AuditTopicCache"
+	JobEvaluateTopicAlerts  = "EvaluateTopicAlerts"
+)
+
+var Jobs = []string{
+	JobUpdateTopicStatistic,
+	JobUpdateTopicStatus,
+	JobWarmUpTopicCache,
+	JobAuditTopicCache,
+	JobEvaluateTopicAlerts,
+}
+
+// 仅手动触发的任务，无定时配置，参数见JobRun.Params
+const (
+	JobReindexTopics = "ReindexTopics"
+)
+
+var ManualJobs = []string{
+	JobReindexTopics,
+}
+
+// IsJob 是否为已定义的定时或手动任务
+func IsJob(name string) bool {
+	for _, jobs := range [][]string{Jobs, ManualJobs} {
+		for _, v := range jobs {
+			if v == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const (
+	JobTriggerCron   = "cron"
+	JobTriggerManual = "manual"
+)
+
+const (
+	JobRunStatusPending   = "pending" // 手动触发，等待leader执行
+	JobRunStatusRunning   = "running"
+	JobRunStatusSucceeded = "succeeded"
+	JobRunStatusFailed    = "failed"
+	JobRunStatusCanceled  = "canceled"
+)
+
+// JobRun 定时任务执行记录
+type JobRun struct {
+	Base
+
+	Job             string `gorm:"size:64;not null;index"`
+	Trigger         string `gorm:"size:16;not null"`       // cron、manual
+	Status          string `gorm:"size:16;not null;index"` // pending、running、succeeded、failed、canceled
+	Host            string `gorm:"size:255;not null"`      // 执行副本
+	Processed       int64  `gorm:"not null"`               // 处理的话题数
+	Total           int64  `gorm:"not null"`               // 待处理的话题数，0-未知
+	Params          string `gorm:"type:text"`              // 手动任务参数，JSON，旧版本写入的行为NULL
+	Err             string `gorm:"type:text;not null"`
+	CancelRequested bool   `gorm:"not null"` // 执行中被请求取消，由执行副本轮询后取消ctx
+	StartAt         *time.Time
+	EndAt           *time.Time
+}
+
+func (*JobRun) Description() string {
+	return "定时任务执行记录表"
+}
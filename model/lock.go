@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+// LockLease TiDB租约锁，每个锁key一行，token为空或expire_at已过期时可抢占，每次抢占推进fence
+type LockLease struct {
+	LockKey   string    `gorm:"primarykey;size:255"`
+	Token     string    `gorm:"size:64;not null"`
+	Fence     int64     `gorm:"not null;default:0"`
+	ExpireAt  time.Time `gorm:"not null"`
+	UpdatedAt time.Time
+}
+
+func (*LockLease) Description() string {
+	return "分布式锁租约表"
+}
+
+// LockBackendState failover锁当前使用的后端，只有一行，各副本共同遵守
+type LockBackendState struct {
+	ID         int64     `gorm:"primarykey;autoIncrement:false"`
+	Backend    string    `gorm:"size:16;not null"`
+	SwitchedAt time.Time `gorm:"not null"`
+}
+
+func (*LockBackendState) Description() string {
+	return "分布式锁failover后端状态表"
+}
@@ -1,6 +1,17 @@
 package model
 
-import "testing"
+import (
+	"bytes"
+	"dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
+	"encoding/json"
+	"fmt"
+	driver "github.com/go-sql-driver/mysql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
 
 func Test_GetKeyForTopicsBitMap(t *testing.T) {
 	var key string
@@ -14,3 +25,213 @@ func Test_GetKeyForTopicsBitMap(t *testing.T) {
 
 	println(key, offset)
 }
+
+func Test_TopicDetailDiff(t *testing.T) {
+	now := time.Now()
+	cached := &TopicDetail{Title: "t1", Sort: 1, StartAt: now, EndAt: now.Add(time.Hour), Status: 1}
+
+	same := *cached
+	same.StartAt = now.UTC() // 时区不同但时间点一致
+	if fields := cached.Diff(&same); len(fields) != 0 {
+		t.Errorf("Diff() = %v, want empty", fields)
+	}
+
+	changed := *cached
+	changed.Title = "t2"
+	changed.Status = 2
+	if fields := cached.Diff(&changed); !reflect.DeepEqual(fields, []string{"title", "status"}) {
+		t.Errorf("Diff() = %v, want [title status]", fields)
+	}
+
+	bumped := *cached
+	bumped.Version = cached.Version + 1
+	if fields := cached.Diff(&bumped); !reflect.DeepEqual(fields, []string{"version"}) {
+		t.Errorf("Diff() = %v, want [version]", fields)
+	}
+}
+
+func Test_TopicInfoCodec(t *testing.T) {
+	topicInfo := &TopicInfo{TopicDetail: &TopicDetail{
+		Base:      Base{ID: 1, CreatedAt: time.Now().Truncate(time.Millisecond)},
+		Title:     "t1",
+		Catalogue: strings.Repeat(`{"key":"k","value":"v"},`, 100),
+		Status:    1,
+	}}
+
+	for _, threshold := range []int{0, 64} {
+		b, err := EncodeTopicInfo(topicInfo, threshold)
+		if err != nil {
+			t.Fatalf("EncodeTopicInfo() err: %v", err)
+		}
+		if compressed := b[2]&flagCompressed != 0; compressed != (threshold > 0) {
+			t.Errorf("threshold: %v, compressed: %v", threshold, compressed)
+		}
+		got, err := DecodeTopicInfo(b)
+		if err != nil {
+			t.Fatalf("DecodeTopicInfo() err: %v", err)
+		}
+		if fields := got.TopicDetail.Diff(topicInfo.TopicDetail); len(fields) != 0 || got.TopicDetail.ID != 1 {
+			t.Errorf("DecodeTopicInfo() diff: %v, id: %v", fields, got.TopicDetail.ID)
+		}
+	}
+
+	// 旧json缓存、旧版本缓存按未命中处理，version为0的话题不受影响
+	oldJson, _ := json.Marshal(topicInfo)
+	if _, err := DecodeTopicInfo(oldJson); err != ErrCacheSchemaMismatch {
+		t.Errorf("DecodeTopicInfo(json) err: %v, want ErrCacheSchemaMismatch", err)
+	}
+	topicInfo.TopicDetail.Version = 2
+	oldJson, _ = json.Marshal(topicInfo)
+	if _, err := DecodeTopicInfo(oldJson); err != ErrCacheSchemaMismatch {
+		t.Errorf("DecodeTopicInfo(json with version) err: %v, want ErrCacheSchemaMismatch", err)
+	}
+	newJson, _ := EncodeTopicInfoJSON(topicInfo)
+	if got, err := DecodeTopicInfo(newJson); err != nil || got.TopicDetail.Version != 2 {
+		t.Errorf("DecodeTopicInfo(new json) err: %v, got: %+v", err, got)
+	}
+	// 旧副本仍能按TopicInfo解析
+	legacy := &TopicInfo{}
+	if err := json.Unmarshal(newJson, legacy); err != nil || legacy.TopicDetail.Title != "t1" {
+		t.Errorf("json.Unmarshal(new json) err: %v, got: %+v", err, legacy)
+	}
+	staleJson := bytes.Replace(newJson, []byte(fmt.Sprintf(`"_schema":%d`, TopicInfoSchemaVersion)), []byte(`"_schema":1`), 1)
+	if _, err := DecodeTopicInfo(staleJson); err != ErrCacheSchemaMismatch {
+		t.Errorf("DecodeTopicInfo(stale json) err: %v, want ErrCacheSchemaMismatch", err)
+	}
+	b, _ := EncodeTopicInfo(topicInfo, 0)
+	b[1] = TopicInfoSchemaVersion - 1
+	if _, err := DecodeTopicInfo(b); err != ErrCacheSchemaMismatch {
+		t.Errorf("DecodeTopicInfo(old version) err: %v, want ErrCacheSchemaMismatch", err)
+	}
+}
+
+func Test_TopicDetailStatusTransition(t *testing.T) {
+	startAt := time.Date(2021, 3, 1, 12, 30, 0, 0, time.UTC)
+	topicDetail := &TopicDetail{StartAt: startAt, EndAt: startAt.Add(2 * time.Hour)}
+
+	cases := []struct {
+		now    time.Time
+		status topic_grpc.TopicDetail_TopicStatus
+		next   time.Time
+		ok     bool
+	}{
+		{startAt.Add(-time.Second), topic_grpc.TopicDetail_TopicStatus_NotStarted, startAt, true},
+		{startAt, topic_grpc.TopicDetail_TopicStatus_InProcess, startAt.Add(2*time.Hour + time.Second), true},
+		{startAt.Add(2 * time.Hour), topic_grpc.TopicDetail_TopicStatus_InProcess, startAt.Add(2*time.Hour + time.Second), true},
+		{startAt.Add(2*time.Hour + time.Second), topic_grpc.TopicDetail_TopicStatus_Ended, time.Time{}, false},
+	}
+	for _, c := range cases {
+		if status := topicDetail.StatusAt(c.now); status != c.status {
+			t.Errorf("StatusAt(%v) = %v, want %v", c.now, status, c.status)
+		}
+		if next, ok := topicDetail.NextStatusTransitionAt(c.now); ok != c.ok || !next.Equal(c.next) {
+			t.Errorf("NextStatusTransitionAt(%v) = %v, %v, want %v, %v", c.now, next, ok, c.next, c.ok)
+		}
+	}
+}
+
+func Test_AlertRuleThresholdList(t *testing.T) {
+	cases := []struct {
+		thresholds string
+		want       []int64
+	}{
+		{"1000,10000", []int64{1000, 10000}},
+		{"10000, 1000", []int64{1000, 10000}},
+		{"24,x,0,-1", []int64{24}},
+		{"", []int64{}},
+	}
+	for _, c := range cases {
+		rule := &AlertRule{Thresholds: c.thresholds}
+		if got := rule.ThresholdList(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("ThresholdList(%q) = %v, want %v", c.thresholds, got, c.want)
+		}
+	}
+}
+
+func Test_TopicDetailWithFields(t *testing.T) {
+	now := time.Now()
+	stored := &TopicDetail{Title: "t1", Sort: 1, Catalogue: `[{"key":"k1"}]`, ManualAudit: true, StartAt: now, EndAt: now.Add(time.Hour)}
+	req := &TopicDetail{Sort: 2}
+
+	merged := stored.WithFields(req, []string{"sort"})
+	if merged.Sort != 2 || merged.Title != "t1" || merged.Catalogue != stored.Catalogue || !merged.ManualAudit {
+		t.Errorf("WithFields(sort) = %+v", merged)
+	}
+	if stored.Sort != 1 {
+		t.Errorf("WithFields modified receiver")
+	}
+
+	// 未指定时为全量更新
+	if merged := stored.WithFields(req, nil); merged.Title != "" || merged.ManualAudit {
+		t.Errorf("WithFields(nil) = %+v", merged)
+	}
+
+	if err := ValidateTopicUpdateMask([]string{"sort", "start_at"}); err != nil {
+		t.Errorf("ValidateTopicUpdateMask() err = %v", err)
+	}
+	for _, paths := range [][]string{{"status"}, {"uniq"}, {"startAt"}} {
+		if err := ValidateTopicUpdateMask(paths); err == nil {
+			t.Errorf("ValidateTopicUpdateMask(%v) want err", paths)
+		}
+	}
+}
+
+func Test_ShiftLegacyTimes(t *testing.T) {
+	defer func(offset int) { config.Cfg.LegacyTimeOffsetMin = offset }(config.Cfg.LegacyTimeOffsetMin)
+	config.Cfg.LegacyTimeOffsetMin = 480
+
+	// 存量行按Asia/Shanghai存储，按UTC读出的墙上时间需减去8小时
+	wall := time.Date(2021, 3, 1, 8, 0, 0, 0, time.UTC)
+	legacy := &TopicDetail{StartAt: wall, EndAt: wall}
+	legacy.shiftLegacyTimes()
+	if want := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC); !legacy.StartAt.Equal(want) || !legacy.EndAt.Equal(want) || !legacy.UTC {
+		t.Errorf("shiftLegacyTimes() legacy: %v, %v, utc: %v, want %v", legacy.StartAt, legacy.EndAt, legacy.UTC, want)
+	}
+	if !legacy.DeletedAt.Time.IsZero() {
+		t.Errorf("shiftLegacyTimes() zero deletedAt shifted: %v", legacy.DeletedAt.Time)
+	}
+
+	// 已转换的行不变，重复换算不会多减
+	legacy.shiftLegacyTimes()
+	utc := &TopicDetail{StartAt: wall, UTC: true}
+	utc.shiftLegacyTimes()
+	if !utc.StartAt.Equal(wall) || !legacy.StartAt.Equal(wall.Add(-legacyTimeOffset())) {
+		t.Errorf("shiftLegacyTimes() utc: %v, legacy: %v", utc.StartAt, legacy.StartAt)
+	}
+}
+
+func Test_UTCDSN(t *testing.T) {
+	dsn, err := utcDSN("root:pwd@tcp(127.0.0.1:3306)/topic?parseTime=True&loc=Asia%2FShanghai&time_zone=%27%2B08%3A00%27&timeout=10s")
+	if err != nil {
+		t.Fatalf("utcDSN() err: %v", err)
+	}
+	cfg, err := driver.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("ParseDSN(%v) err: %v", dsn, err)
+	}
+	if cfg.Loc != time.UTC || !cfg.ParseTime || cfg.Params["time_zone"] != "'+00:00'" || cfg.Timeout != 10*time.Second {
+		t.Errorf("utcDSN() = %v, loc: %v, parseTime: %v, params: %v", dsn, cfg.Loc, cfg.ParseTime, cfg.Params)
+	}
+}
+
+// redis集群计算slot时使用的部分：第一个{到其后第一个}之间非空时取该部分，否则取整个key
+func slotKey(key string) string {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			return key[s+1 : s+1+e]
+		}
+	}
+	return key
+}
+
+func Test_GetKeyForLockFence(t *testing.T) {
+	for _, lockKey := range []string{GetKeyForLockTopic(123), GetKeyForLockJob("statistic"), CronLeader, OutboxRelay} {
+		fenceKey := GetKeyForLockFence(lockKey)
+		if fenceKey == lockKey {
+			t.Errorf("fence key same as lock key: %v", lockKey)
+		}
+		if slotKey(fenceKey) != slotKey(lockKey) {
+			t.Errorf("fence key slot mismatch, lockKey: %v, fenceKey: %v", lockKey, fenceKey)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package model
+
+import "time"
+
+const (
+	OutboxKindIndex  = "index"  // es索引事件，发布到EV_DM_TOPIC，Payload为new、delete
+	OutboxKindDomain = "domain" // 话题领域事件，Payload为events.TopicEvent JSON
+)
+
+// OutboxEvent 与话题写入同一事务登记的待发布事件，由relay按话题内的Seq顺序发布
+// TiDB的AUTO_INCREMENT由各节点分段分配，id不代表登记顺序，不能用于排序
+type OutboxEvent struct {
+	ID        int64 `gorm:"primarykey;<-:false"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	EventID       string     `gorm:"size:64;not null;uniqueIndex"`
+	Kind          string     `gorm:"size:16;not null"`
+	TopicID       int64      `gorm:"not null;index:idx_outbox_events_topic_seq,priority:1"`
+	Seq           int64      `gorm:"not null;index:idx_outbox_events_topic_seq,priority:2"` // 话题内登记顺序，见OutboxSequence
+	Payload       string     `gorm:"type:text;not null"`
+	Attempts      int        `gorm:"not null"` // 已失败次数
+	Err           string     `gorm:"type:text;not null"`
+	NextAttemptAt time.Time  `gorm:"not null"` // 失败后按退避时间重试
+	FirstFailedAt *time.Time // 首次发布失败时间，据此判断是否转入死信
+	SentAt        *time.Time `gorm:"index"` // 为空表示待发布
+}
+
+func (*OutboxEvent) Description() string {
+	return "事件发件箱表"
+}
+
+// OutboxSequence 每个话题一行，登记事件时在同一事务内递增并持有行锁至提交，同一话题的事件按Seq顺序提交
+type OutboxSequence struct {
+	TopicID int64 `gorm:"primarykey;autoIncrement:false"`
+	Seq     int64 `gorm:"not null"`
+}
+
+func (*OutboxSequence) Description() string {
+	return "事件发件箱序号表"
+}
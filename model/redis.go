@@ -8,48 +8,81 @@ import (
 	"github.com/alicebob/miniredis/v2"
 	"github.com/getsentry/sentry-go"
 	"github.com/go-redis/redis/v8"
-	uuid "github.com/satori/go.uuid"
+	"strconv"
+	"strings"
 	"time"
 )
 
-var RedisLockSecret string
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+)
 
-func init() {
-	RedisLockSecret = uuid.NewV1().String()
-	logger.GetLogger().Infof("RedisLockSecret: %v", RedisLockSecret)
-}
+// GetRedis 按config.Cfg.RedisMode创建单机、哨兵或集群客户端
+func GetRedis() (rdb redis.UniversalClient) {
+	if len(config.Cfg.RedisDsn) == 0 {
+		logger.GetLogger().Fatalf("empty RedisDsn, mode: %v", config.Cfg.RedisMode)
+	}
 
-func GetRedis() (clusterRdb *redis.ClusterClient) {
-	clusterRdb = redis.NewClusterClient(&redis.ClusterOptions{
-		Addrs:              config.Cfg.RedisDsn,
-		PoolSize:           10,
-		IdleTimeout:        5 * time.Minute,
-		Password:           config.Cfg.RedisPassword,
-		MaxRetries:         3,
-		IdleCheckFrequency: time.Minute,
-	})
-	statusRes, err := clusterRdb.Ping(context.Background()).Result()
+	switch config.Cfg.RedisMode {
+	case RedisModeStandalone:
+		rdb = redis.NewClient(&redis.Options{
+			Addr:               config.Cfg.RedisDsn[0],
+			DB:                 config.Cfg.RedisDB,
+			PoolSize:           10,
+			IdleTimeout:        5 * time.Minute,
+			Password:           config.Cfg.RedisPassword,
+			MaxRetries:         3,
+			IdleCheckFrequency: time.Minute,
+		})
+	case RedisModeSentinel:
+		rdb = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:         config.Cfg.RedisMasterName,
+			SentinelAddrs:      config.Cfg.RedisDsn,
+			SentinelPassword:   config.Cfg.RedisSentinelPassword,
+			DB:                 config.Cfg.RedisDB,
+			PoolSize:           10,
+			IdleTimeout:        5 * time.Minute,
+			Password:           config.Cfg.RedisPassword,
+			MaxRetries:         3,
+			IdleCheckFrequency: time.Minute,
+		})
+	case RedisModeCluster:
+		rdb = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:              config.Cfg.RedisDsn,
+			PoolSize:           10,
+			IdleTimeout:        5 * time.Minute,
+			Password:           config.Cfg.RedisPassword,
+			MaxRetries:         3,
+			IdleCheckFrequency: time.Minute,
+		})
+	default:
+		logger.GetLogger().Fatalf("unknown RedisMode: %v, want standalone, sentinel or cluster", config.Cfg.RedisMode)
+	}
+
+	// 启动时redis不可用不再退出，由dao层健康探测切换到降级模式
+	statusRes, err := rdb.Ping(context.Background()).Result()
 	if err != nil {
-		pingErr := fmt.Errorf("clusterRdb.Ping fail, err: %v", err)
+		pingErr := fmt.Errorf("rdb.Ping fail, will start in degraded mode, mode: %v, err: %v", config.Cfg.RedisMode, err)
 		sentry.CaptureException(pingErr)
-		logger.GetLogger().Fatal(pingErr)
-	}
-	if statusRes != "PONG" {
-		pingErr := fmt.Errorf("clusterRdb.Ping fail, result: %v != PONG", statusRes)
+		logger.GetLogger().Error(pingErr)
+	} else if statusRes != "PONG" {
+		pingErr := fmt.Errorf("rdb.Ping fail, will start in degraded mode, mode: %v, result: %v != PONG", config.Cfg.RedisMode, statusRes)
 		sentry.CaptureException(pingErr)
-		logger.GetLogger().Fatal(pingErr)
+		logger.GetLogger().Error(pingErr)
 	}
 
 	return
 }
 
-func GetRedisMock() (clusterRdb *redis.ClusterClient) {
+func GetRedisMock() (rdb redis.UniversalClient) {
 	mock, err := miniredis.Run()
 	if err != nil {
 		panic(err)
 	}
-	clusterRdb = redis.NewClusterClient(&redis.ClusterOptions{
-		Addrs:        []string{mock.Addr()},
+	rdb = redis.NewClient(&redis.Options{
+		Addr:         mock.Addr(),
 		PoolSize:     100,
 		ReadTimeout:  1 * time.Second,
 		WriteTimeout: 1 * time.Second,
@@ -59,24 +92,60 @@ func GetRedisMock() (clusterRdb *redis.ClusterClient) {
 	return
 }
 
+// hashTag 集群模式下同一hash tag的key落在同一slot，多key脚本/事务需要
+func hashTag(s string) string {
+	return "{" + s + "}"
+}
+
 // redis key
 var (
-	UpdateTopicStatistic      = config.Cfg.RedisPrefix + ":lock" + ":updateTopicStatistic"
-	UpdateTopicStatus         = config.Cfg.RedisPrefix + ":lock" + ":updateTopicStatus"
+	CronLeader                = config.Cfg.RedisPrefix + ":lock:" + hashTag("cronLeader")  // 定时任务选主租约
+	OutboxRelay               = config.Cfg.RedisPrefix + ":lock:" + hashTag("outboxRelay") // 发件箱relay租约，同时只有一个副本发布
+	KeyLockJob                = config.Cfg.RedisPrefix + ":lock:job"                       // 任务锁：定时与手动触发互斥
+	LegacyLockUpdateStatistic = config.Cfg.RedisPrefix + ":lock:updateTopicStatistic"      // 旧版本的任务锁，滚动发布期间与新key一起加锁，下个版本删除
+	LegacyLockUpdateStatus    = config.Cfg.RedisPrefix + ":lock:updateTopicStatus"         // 同上
+	KeyLockStatusBackfill     = config.Cfg.RedisPrefix + ":lock:statusBackfill"            // 延时队列补登记，同时只有一个副本执行
 	Topic                     = config.Cfg.RedisPrefix + ":topic"
 	KeyLockTopic              = config.Cfg.RedisPrefix + ":lock" + ":topic"           // 分布式锁：控制台修改
 	KeyLockTopicForGetsByTiDB = config.Cfg.RedisPrefix + ":lockGetsByTiDB" + ":topic" // 缓存击穿锁
 	KeyBitMapTopic            = config.Cfg.RedisPrefix + ":bitMap" + ":topic"         // 缓存穿透过滤器
+	KeyDelayTopicStatus       = config.Cfg.RedisPrefix + ":delay:topicStatus"         // 状态切换延时队列，score为切换时间毫秒
 )
 
+func GetKeyForLockJob(job string) string {
+	return KeyLockJob + ":" + hashTag(job)
+}
+
+// GetKeyForTopic 话题缓存只做单key读写（pipeline按slot拆分），不加hash tag以兼容已有缓存
 func GetKeyForTopic(id int64) string {
 	return Topic + fmt.Sprintf(":%v", id)
 }
 
+func ParseKeyForTopic(key string) (int64, bool) {
+	if !strings.HasPrefix(key, Topic+":") {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(key[len(Topic)+1:], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// GetKeyForLockTopic 保持原格式，滚动发布期间新旧副本互斥同一个key
 func GetKeyForLockTopic(id int64) string {
 	return KeyLockTopic + fmt.Sprintf(":%v", id)
 }
 
+// GetKeyForLockFence fence计数器与锁key落在同一slot：
+// 锁key带hash tag时直接追加后缀，否则以整个锁key作为hash tag，slot与锁key相同
+func GetKeyForLockFence(lockKey string) string {
+	if strings.Contains(lockKey, "{") {
+		return lockKey + ":fence"
+	}
+	return hashTag(lockKey) + ":fence"
+}
+
 func GetKeyForLockTopicForGetsByTiDB(id int64) string {
 	return KeyLockTopicForGetsByTiDB + fmt.Sprintf(":%v", id)
 }
@@ -3,7 +3,7 @@ package model
 import (
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	driver "github.com/go-sql-driver/mysql"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 
@@ -16,6 +16,35 @@ var Tables = []interface{}{
 	&TopicDetail{},
 	&TopicUserBehavior{},
 	&TopicStatistic{},
+	&LockLease{},
+	&LockBackendState{},
+	&JobRun{},
+	&JobCheckpoint{},
+	&JobFailure{},
+	&OutboxEvent{},
+	&OutboxSequence{},
+	&WebhookSubscription{},
+	&WebhookDelivery{},
+	&TopicContent{},
+	&AlertRule{},
+	&TopicAlert{},
+	&DeadLetter{},
+	&PendingCacheOp{},
+}
+
+// utcDSN 时间统一按UTC读写：驱动按UTC解析，会话时区为+00:00，保证SQL中的NOW()同为UTC，不依赖DSN配置
+func utcDSN(dsn string) (string, error) {
+	cfg, err := driver.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	cfg.Params["time_zone"] = "'+00:00'"
+	return cfg.FormatDSN(), nil
 }
 
 func GetInstance() *gorm.DB {
@@ -26,7 +55,11 @@ func GetInstance() *gorm.DB {
 	if len(dsn) == 0 {
 		log.Fatal("[model] dsn is null")
 	}
-	instance, err := gorm.Open(mysql.Open(dsn), &gorm.Config{
+	dsn, err := utcDSN(dsn)
+	if err != nil {
+		log.Fatalf("[model] parse dsn err: %v", err)
+	}
+	instance, err = gorm.Open(mysql.Open(dsn), &gorm.Config{
 		SkipDefaultTransaction: true,
 	})
 	if err != nil {
@@ -34,6 +67,9 @@ func GetInstance() *gorm.DB {
 	}
 
 	models.DBTracing(instance)
+	if config.Cfg.LegacyTimeCompat {
+		registerLegacyTimeCallbacks(instance)
+	}
 
 	if config.Cfg.Debug {
 		instance = instance.Debug()
@@ -2,6 +2,8 @@ package model
 
 import (
 	"dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
+	"fmt"
 	"gorm.io/gorm"
 	"time"
 )
@@ -24,8 +26,12 @@ type TopicDetail struct {
 	Catalogue   string                             `json:"catalogue" gorm:"not null"`
 	StartAt     time.Time                          `json:"startAt" gorm:"not null"`
 	EndAt       time.Time                          `json:"endAt" gorm:"not null"`
-	ManualAudit bool                               `json:"manualAudit" gorm:"not null"` // 是否必须人工审核：true-必，false-不必
-	Status      topic_grpc.TopicDetail_TopicStatus `json:"status" gorm:"not null"`      // 状态
+	ManualAudit bool                               `json:"manualAudit" gorm:"not null"`                           // 是否必须人工审核：true-必，false-不必
+	Status      topic_grpc.TopicDetail_TopicStatus `json:"status" gorm:"not null"`                                // 状态
+	Fence       int64                              `json:"-" msgpack:"-" gorm:"not null;default:0"`               // 最近一次写入时持有的锁fence，拒绝过期锁的写入
+	TimeZone    string                             `json:"timeZone" gorm:"size:64;not null"`                      // IANA时区，开始、结束时间按UTC存储，展示时按该时区换算
+	Version     int64                              `json:"version" gorm:"not null;default:1"`                     // 每次更新递增，用于乐观锁
+	UTC         bool                               `json:"-" msgpack:"-" gorm:"column:utc;not null;default:true"` // 时间是否按UTC存储，见utc.go
 
 	Uniq string `gorm:"size:255;not null;unique" remark:"Title-DeletedAt"`
 }
@@ -34,6 +40,150 @@ func (*TopicDetail) Description() string {
 	return "话题表"
 }
 
+// StatusAt 按开始、结束时间计算now时刻的状态，精确到秒，所有状态计算统一走这里
+func (t *TopicDetail) StatusAt(now time.Time) topic_grpc.TopicDetail_TopicStatus {
+	if now.Unix() < t.StartAt.Unix() {
+		return topic_grpc.TopicDetail_TopicStatus_NotStarted
+	} else if now.Unix() > t.EndAt.Unix() {
+		return topic_grpc.TopicDetail_TopicStatus_Ended
+	} else {
+		return topic_grpc.TopicDetail_TopicStatus_InProcess
+	}
+}
+
+// NextStatusTransitionAt now之后下一次状态切换的时间，已结束返回false
+func (t *TopicDetail) NextStatusTransitionAt(now time.Time) (time.Time, bool) {
+	if now.Unix() < t.StartAt.Unix() {
+		return time.Unix(t.StartAt.Unix(), 0), true
+	} else if now.Unix() <= t.EndAt.Unix() {
+		return time.Unix(t.EndAt.Unix()+1, 0), true
+	}
+	return time.Time{}, false
+}
+
+// TopicUpdatableFields UpdateTopic可按FieldMask更新的字段，path与列名一致
+// uniq随title、status随start_at、end_at重新计算，不可直接指定
+var TopicUpdatableFields = []string{
+	"title", "bg_pic", "avatar", "sort", "desc", "catalogue", "start_at", "end_at", "time_zone", "manual_audit",
+}
+
+// ValidateTimeRange 开始时间须早于结束时间
+func (t *TopicDetail) ValidateTimeRange() error {
+	if !t.StartAt.Before(t.EndAt) {
+		return fmt.Errorf("start_at must be before end_at")
+	}
+	return nil
+}
+
+// ValidateTopicUpdateMask 校验FieldMask的path
+func ValidateTopicUpdateMask(paths []string) error {
+	return validateUpdateMask(paths, TopicUpdatableFields)
+}
+
+// validateUpdateMask paths须为updatable中的字段
+func validateUpdateMask(paths []string, updatable []string) error {
+	for _, path := range paths {
+		known := false
+		for _, field := range updatable {
+			if path == field {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("invalid update mask path: %v", path)
+		}
+	}
+	return nil
+}
+
+// WithFields 以t为基础，取src中fields指定的字段，fields为空时取全部可更新字段
+func (t *TopicDetail) WithFields(src *TopicDetail, fields []string) *TopicDetail {
+	if len(fields) == 0 {
+		fields = TopicUpdatableFields
+	}
+
+	merged := *t
+	for _, field := range fields {
+		switch field {
+		case "title":
+			merged.Title = src.Title
+		case "bg_pic":
+			merged.BGPic = src.BGPic
+		case "avatar":
+			merged.Avatar = src.Avatar
+		case "sort":
+			merged.Sort = src.Sort
+		case "desc":
+			merged.Desc = src.Desc
+		case "catalogue":
+			merged.Catalogue = src.Catalogue
+		case "start_at":
+			merged.StartAt = src.StartAt
+		case "end_at":
+			merged.EndAt = src.EndAt
+		case "time_zone":
+			merged.TimeZone = src.TimeZone
+		case "manual_audit":
+			merged.ManualAudit = src.ManualAudit
+		}
+	}
+	return &merged
+}
+
+// Diff 返回与other不一致的字段名，用于缓存与TiDB比对
+func (t *TopicDetail) Diff(other *TopicDetail) []string {
+	fields := make([]string, 0)
+	if t.Title != other.Title {
+		fields = append(fields, "title")
+	}
+	if t.BGPic != other.BGPic {
+		fields = append(fields, "bgPic")
+	}
+	if t.Avatar != other.Avatar {
+		fields = append(fields, "avatar")
+	}
+	if t.Sort != other.Sort {
+		fields = append(fields, "sort")
+	}
+	if t.Desc != other.Desc {
+		fields = append(fields, "desc")
+	}
+	if t.Catalogue != other.Catalogue {
+		fields = append(fields, "catalogue")
+	}
+	if !t.StartAt.Equal(other.StartAt) {
+		fields = append(fields, "startAt")
+	}
+	if !t.EndAt.Equal(other.EndAt) {
+		fields = append(fields, "endAt")
+	}
+	if t.ManualAudit != other.ManualAudit {
+		fields = append(fields, "manualAudit")
+	}
+	if t.Status != other.Status {
+		fields = append(fields, "status")
+	}
+	if t.TimeZone != other.TimeZone {
+		fields = append(fields, "timeZone")
+	}
+	if t.Version != other.Version {
+		fields = append(fields, "version")
+	}
+	return fields
+}
+
+// NormalizeTimeZone 校验IANA时区，为空时使用默认时区
+func NormalizeTimeZone(timeZone string) (string, error) {
+	if timeZone == "" {
+		return config.Cfg.DefaultTimeZone, nil
+	}
+	if _, err := time.LoadLocation(timeZone); err != nil {
+		return "", fmt.Errorf("invalid time zone: %v", timeZone)
+	}
+	return timeZone, nil
+}
+
 type TopicStatistic struct {
 	Base
 
@@ -41,6 +191,7 @@ type TopicStatistic struct {
 	ContentNum         int64 `json:"contentNum" gorm:"not null"`
 	MpNum              int64 `json:"mpNum" gorm:"not null"`
 	ContentExposureNum int64 `json:"contentExposureNum" gorm:"not null"`
+	UTC                bool  `json:"-" msgpack:"-" gorm:"column:utc;not null;default:true"`
 
 	Uniq string `gorm:"size:255;not null;unique" remark:"TopicID-DeletedAt"`
 }
@@ -54,6 +205,7 @@ type TopicUserBehavior struct {
 
 	TopicID int64  `json:"topicId" gorm:"index:topicIdUserID"`
 	UserID  string `json:"userId" gorm:"size:255;index:topicIdUserID;index"`
+	UTC     bool   `json:"-" msgpack:"-" gorm:"column:utc;not null;default:true"`
 
 	Uniq string `gorm:"size:255;not null;unique" remark:"TopicID-UserID-DeletedAt"`
 }
@@ -0,0 +1,223 @@
+package model
+
+import (
+	"dm-gitlab.bolo.me/hubpd/topic/config"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"reflect"
+	"time"
+)
+
+// 话题相关表的存量数据按旧版本时区存储（utc=0），新写入按UTC存储（utc=1），migrate up、backfill-utc逐行转换并置utc=1。
+// 转换完成前（LegacyTimeCompat）：按模型读取时换算utc=0的行；按模型更新时先整行转换再更新，保证同一行格式一致
+const columnUTC = "utc"
+
+// legacyTimeOffset 旧版本存储时间相对UTC的偏移，默认Asia/Shanghai（无夏令时，固定偏移）
+func legacyTimeOffset() time.Duration {
+	return time.Duration(config.Cfg.LegacyTimeOffsetMin) * time.Minute
+}
+
+// legacyTime 带utc标记的模型
+type legacyTime interface {
+	// legacyTimeColumns 全部时间列
+	legacyTimeColumns() []string
+	shiftLegacyTimes()
+}
+
+func shiftLegacyTimes(utc bool, times ...*time.Time) {
+	if utc {
+		return
+	}
+	for _, t := range times {
+		if !t.IsZero() {
+			*t = t.Add(-legacyTimeOffset())
+		}
+	}
+}
+
+func (t *TopicDetail) legacyTimeColumns() []string {
+	return []string{"created_at", "updated_at", "deleted_at", "start_at", "end_at"}
+}
+
+func (t *TopicDetail) shiftLegacyTimes() {
+	shiftLegacyTimes(t.UTC, &t.CreatedAt, &t.UpdatedAt, &t.DeletedAt.Time, &t.StartAt, &t.EndAt)
+	t.UTC = true
+}
+
+func (t *TopicStatistic) legacyTimeColumns() []string {
+	return []string{"created_at", "updated_at", "deleted_at"}
+}
+
+func (t *TopicStatistic) shiftLegacyTimes() {
+	shiftLegacyTimes(t.UTC, &t.CreatedAt, &t.UpdatedAt, &t.DeletedAt.Time)
+	t.UTC = true
+}
+
+func (t *TopicUserBehavior) legacyTimeColumns() []string {
+	return []string{"created_at", "updated_at", "deleted_at"}
+}
+
+func (t *TopicUserBehavior) shiftLegacyTimes() {
+	shiftLegacyTimes(t.UTC, &t.CreatedAt, &t.UpdatedAt, &t.DeletedAt.Time)
+	t.UTC = true
+}
+
+// LegacyTimeBackfill 转换utc=0行的赋值，时间列只引用自身，与赋值顺序无关，只能用于限定utc=0的更新
+func LegacyTimeBackfill(columns ...string) map[string]interface{} {
+	updates := make(map[string]interface{}, len(columns)+1)
+	for _, assignment := range legacyTimeBackfillSet(columns...) {
+		updates[assignment.Column.Name] = assignment.Value
+	}
+	return updates
+}
+
+func legacyTimeBackfillSet(columns ...string) clause.Set {
+	set := make(clause.Set, 0, len(columns)+1)
+	for _, column := range columns {
+		set = append(set, clause.Assignment{
+			Column: clause.Column{Name: column},
+			Value:  gorm.Expr(fmt.Sprintf("DATE_SUB(`%s`, INTERVAL %d MINUTE)", column, config.Cfg.LegacyTimeOffsetMin)),
+		})
+	}
+	return append(set, clause.Assignment{Column: clause.Column{Name: columnUTC}, Value: true})
+}
+
+// LegacyTimeAssignments upsert更新已有行时转换未更新的时间列
+// 时间列引用更新前的utc，utc显式放在最后赋值（MySQL按SET顺序依次赋值）
+func LegacyTimeAssignments(columns ...string) []clause.Assignment {
+	assignments := make([]clause.Assignment, 0, len(columns)+1)
+	for _, column := range columns {
+		assignments = append(assignments, clause.Assignment{
+			Column: clause.Column{Name: column},
+			Value: gorm.Expr(fmt.Sprintf("IF(`utc`, `%s`, DATE_SUB(`%s`, INTERVAL %d MINUTE))",
+				column, column, config.Cfg.LegacyTimeOffsetMin)),
+		})
+	}
+	return append(assignments, clause.Assignment{Column: clause.Column{Name: columnUTC}, Value: true})
+}
+
+func registerLegacyTimeCallbacks(db *gorm.DB) {
+	_ = db.Callback().Query().Before("gorm:query").Register("topic:legacy_time_select", selectLegacyTime)
+	_ = db.Callback().Query().After("gorm:query").Register("topic:legacy_time_read", readLegacyTime)
+	_ = db.Callback().Update().Before("gorm:update").Register("topic:legacy_time_update", updateLegacyTime)
+}
+
+// queryingModel 查询结果为带utc标记的模型，Pluck、Count、Scan到其它结构体时不处理
+func queryingModel(db *gorm.DB) bool {
+	stmt := db.Statement
+	if stmt.Schema == nil || stmt.Schema.LookUpField(columnUTC) == nil || !stmt.ReflectValue.IsValid() {
+		return false
+	}
+	t := stmt.ReflectValue.Type()
+	for t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t == stmt.Schema.ModelType
+}
+
+// selectLegacyTime 指定了查询列时补充utc，否则无法判断存储格式
+func selectLegacyTime(db *gorm.DB) {
+	if db.Error != nil || len(db.Statement.Selects) == 0 || !queryingModel(db) {
+		return
+	}
+	for _, s := range db.Statement.Selects {
+		if s == columnUTC || s == "*" {
+			return
+		}
+	}
+	db.Statement.Selects = append(db.Statement.Selects, columnUTC)
+}
+
+func readLegacyTime(db *gorm.DB) {
+	if db.Error != nil || !queryingModel(db) {
+		return
+	}
+
+	shift := func(v reflect.Value) {
+		if v.Kind() != reflect.Ptr {
+			v = v.Addr()
+		}
+		if m, ok := v.Interface().(legacyTime); ok {
+			m.shiftLegacyTimes()
+		}
+	}
+	switch v := db.Statement.ReflectValue; v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			shift(reflect.Indirect(v.Index(i)))
+		}
+	case reflect.Struct:
+		shift(v)
+	}
+}
+
+// updateLegacyTime 按模型更新前先将命中的utc=0行整行转换，本次更新再显式写入utc=1，不依赖SET的列顺序
+func updateLegacyTime(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || stmt.Model == nil {
+		return
+	}
+	m, ok := stmt.Model.(legacyTime)
+	if !ok {
+		return
+	}
+	updates, ok := stmt.Dest.(map[string]interface{})
+	if !ok {
+		return
+	}
+	where, ok := legacyTimeWhere(stmt)
+	if !ok {
+		// 没有条件的更新由gorm拒绝
+		return
+	}
+
+	convert := &gorm.Statement{
+		DB:       db,
+		ConnPool: stmt.ConnPool,
+		Context:  stmt.Context,
+		Table:    stmt.Table,
+		Clauses:  map[string]clause.Clause{},
+	}
+	convert.AddClause(clause.Update{})
+	convert.AddClause(legacyTimeBackfillSet(m.legacyTimeColumns()...))
+	convert.AddClause(where)
+	convert.AddClause(clause.Where{Exprs: []clause.Expression{clause.Eq{Column: clause.Column{Name: columnUTC}, Value: false}}})
+	convert.Build("UPDATE", "SET", "WHERE")
+	if _, err := stmt.ConnPool.ExecContext(stmt.Context, convert.SQL.String(), convert.Vars...); err != nil {
+		_ = db.AddError(fmt.Errorf("convert legacy time err: %v", err))
+		return
+	}
+
+	updates[columnUTC] = true
+}
+
+// legacyTimeWhere 本次更新的条件，含模型上的主键
+func legacyTimeWhere(stmt *gorm.Statement) (clause.Where, bool) {
+	var where clause.Where
+	if c, ok := stmt.Clauses["WHERE"]; ok {
+		if w, ok := c.Expression.(clause.Where); ok {
+			where.Exprs = append(where.Exprs, w.Exprs...)
+		}
+	}
+	if stmt.Schema != nil && stmt.ReflectValue.Kind() == reflect.Struct {
+		for _, field := range stmt.Schema.PrimaryFields {
+			if value := stmt.ReflectValue.FieldByIndex(field.StructField.Index); !value.IsZero() {
+				where.Exprs = append(where.Exprs, clause.Eq{Column: clause.Column{Name: field.DBName}, Value: value.Interface()})
+			}
+		}
+	}
+	return where, len(where.Exprs) != 0
+}
+
+// LegacyTimeTable 带utc标记的表及其全部时间列
+type LegacyTimeTable struct {
+	Table   string
+	Columns []string
+}
+
+var LegacyTimeTables = []LegacyTimeTable{
+	{"topic_details", []string{"created_at", "updated_at", "deleted_at", "start_at", "end_at"}},
+	{"topic_statistics", []string{"created_at", "updated_at", "deleted_at"}},
+	{"topic_user_behaviors", []string{"created_at", "updated_at", "deleted_at"}},
+}
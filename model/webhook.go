@@ -0,0 +1,102 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// webhook事件类型，由话题领域事件转换
+const (
+	WebhookEventTopicStarted = "TopicStarted"
+	WebhookEventTopicEnded   = "TopicEnded"
+	WebhookEventTopicUpdated = "TopicUpdated"
+)
+
+var WebhookEvents = []string{
+	WebhookEventTopicStarted,
+	WebhookEventTopicEnded,
+	WebhookEventTopicUpdated,
+}
+
+const (
+	WebhookDeliveryStatusPending   = "pending"
+	WebhookDeliveryStatusSucceeded = "succeeded"
+	WebhookDeliveryStatusFailed    = "failed" // 重试次数用尽
+)
+
+// WebhookSubscription webhook订阅
+type WebhookSubscription struct {
+	Base
+
+	URL        string `gorm:"size:1024;not null"`
+	EventTypes string `gorm:"size:255;not null"` // 逗号分隔，取值见WebhookEvents
+	Secret     string `gorm:"size:255;not null"` // HMAC-SHA256签名密钥，以WebhookSecretKey加密保存
+	Enabled    bool   `gorm:"not null"`
+}
+
+func (*WebhookSubscription) Description() string {
+	return "webhook订阅表"
+}
+
+// WebhookSubscriptionUpdatableFields UpdateWebhookSubscription可按FieldMask更新的字段
+var WebhookSubscriptionUpdatableFields = []string{"url", "event_types", "secret", "enabled"}
+
+// ValidateWebhookSubscriptionUpdateMask 校验FieldMask的path
+func ValidateWebhookSubscriptionUpdateMask(paths []string) error {
+	return validateUpdateMask(paths, WebhookSubscriptionUpdatableFields)
+}
+
+// WithFields 以s为基础，取src中fields指定的字段，fields为空时取全部可更新字段
+func (s *WebhookSubscription) WithFields(src *WebhookSubscription, fields []string) *WebhookSubscription {
+	if len(fields) == 0 {
+		fields = WebhookSubscriptionUpdatableFields
+	}
+
+	merged := *s
+	for _, field := range fields {
+		switch field {
+		case "url":
+			merged.URL = src.URL
+		case "event_types":
+			merged.EventTypes = src.EventTypes
+		case "secret":
+			merged.Secret = src.Secret
+		case "enabled":
+			merged.Enabled = src.Enabled
+		}
+	}
+	return &merged
+}
+
+// Subscribes 是否订阅了eventType
+func (s *WebhookSubscription) Subscribes(eventType string) bool {
+	for _, v := range strings.Split(s.EventTypes, ",") {
+		if v == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery webhook投递记录，同一订阅同一事件只投递一次
+type WebhookDelivery struct {
+	ID        int64 `gorm:"primarykey;<-:false"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	SubscriptionID int64      `gorm:"not null;uniqueIndex:idx_webhook_deliveries_subscription_id_event_id"`
+	EventID        string     `gorm:"size:64;not null;uniqueIndex:idx_webhook_deliveries_subscription_id_event_id"`
+	EventType      string     `gorm:"size:64;not null"`
+	TopicID        int64      `gorm:"not null"`
+	Payload        string     `gorm:"type:text;not null"`
+	Status         string     `gorm:"size:16;not null;index:idx_webhook_deliveries_status_next_attempt_at"` // pending、succeeded、failed
+	Attempts       int        `gorm:"not null"`
+	ResponseCode   int        `gorm:"not null"` // 最近一次响应码，0-未收到响应
+	Err            string     `gorm:"type:text;not null"`
+	NextAttemptAt  time.Time  `gorm:"not null;index:idx_webhook_deliveries_status_next_attempt_at"`
+	DeliveredAt    *time.Time // 投递成功时间
+}
+
+func (*WebhookDelivery) Description() string {
+	return "webhook投递记录表"
+}
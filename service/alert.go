@@ -0,0 +1,300 @@
+package service
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/events"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validateAlertRule 校验并规范化规则，阈值去重后升序保存
+func validateAlertRule(ctx context.Context, rule *model.AlertRule, thresholds []int64, invalidCode int32) error {
+	invalid := func(msg string) error {
+		return &common.InternalError{ErrCode: invalidCode, ErrMsg: msg}
+	}
+
+	known := false
+	for _, v := range model.AlertMetrics {
+		if v == rule.Metric {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return invalid(fmt.Sprintf("未知的指标：%v", rule.Metric))
+	}
+	if len(thresholds) == 0 {
+		return invalid("thresholds不能为空")
+	}
+
+	sort.Slice(thresholds, func(i, j int) bool { return thresholds[i] < thresholds[j] })
+	thresholdArr := make([]string, 0, len(thresholds))
+	for i, threshold := range thresholds {
+		if threshold <= 0 {
+			return invalid("threshold须大于0")
+		}
+		if i > 0 && threshold == thresholds[i-1] {
+			continue
+		}
+		thresholdArr = append(thresholdArr, strconv.FormatInt(threshold, 10))
+	}
+	rule.Thresholds = strings.Join(thresholdArr, ",")
+	if len(rule.Thresholds) > 255 {
+		return invalid("thresholds过多")
+	}
+
+	if rule.TopicID != 0 {
+		existing, err := dao.TiDBInstance.ExistingTopicIds(ctx, []int64{rule.TopicID})
+		if err != nil {
+			return err
+		}
+		if !existing[rule.TopicID] {
+			return invalid("话题不存在")
+		}
+	}
+
+	return nil
+}
+
+func (service *Service) CreateAlertRule(ctx context.Context, rule *model.AlertRule, thresholds []int64) error {
+	if err := validateAlertRule(ctx, rule, thresholds, int32(pb.CreateAlertRuleResp_INVALID_ARGUMENT)); err != nil {
+		return err
+	}
+
+	return dao.TiDBInstance.CreateAlertRule(ctx, rule)
+}
+
+// UpdateAlertRule 修改阈值不影响已记录的告警，修改后重新记录基线
+func (service *Service) UpdateAlertRule(ctx context.Context, rule *model.AlertRule, thresholds []int64) error {
+	if err := validateAlertRule(ctx, rule, thresholds, int32(pb.UpdateAlertRuleResp_INVALID_ARGUMENT)); err != nil {
+		return err
+	}
+
+	rowsAffected, err := dao.TiDBInstance.UpdateAlertRule(ctx, rule)
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		if _, err := dao.TiDBInstance.GetAlertRule(ctx, rule.ID); dao.IsNotFound(err) {
+			return &common.InternalError{
+				ErrCode: int32(pb.UpdateAlertRuleResp_NOT_FOUND),
+				ErrMsg:  "规则不存在",
+			}
+		}
+	}
+
+	return nil
+}
+
+func (service *Service) DelAlertRule(ctx context.Context, id int64) error {
+	rowsAffected, err := dao.TiDBInstance.DelAlertRule(ctx, id)
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return &common.InternalError{
+			ErrCode: int32(pb.DelAlertRuleResp_NOT_FOUND),
+			ErrMsg:  "规则不存在",
+		}
+	}
+
+	return nil
+}
+
+func (service *Service) ListAlertRules(ctx context.Context) ([]*model.AlertRule, error) {
+	return dao.TiDBInstance.AlertRuleList(ctx, false)
+}
+
+func (service *Service) ListTopicAlerts(ctx context.Context, topicID int64, offset, limit int64) ([]*model.TopicAlert, int64, error) {
+	if limit <= 0 {
+		limit = 20
+	}
+	return dao.TiDBInstance.TopicAlertList(ctx, topicID, offset, limit)
+}
+
+// EvaluateTopicAlerts 定时按已落库的统计及内容检查进行中话题的阈值，检查完成后未记录基线的规则标记为已记录
+func (service *Service) EvaluateTopicAlerts(ctx context.Context) error {
+	ruleArr, err := dao.TiDBInstance.AlertRuleList(ctx, true)
+	if err != nil || len(ruleArr) == 0 {
+		return err
+	}
+
+	job := newBatchJob(model.JobEvaluateTopicAlerts, MaintenanceOptions{}, func(ctx context.Context, ids []int64) map[int64]error {
+		storedMap, err := dao.TiDBInstance.TopicStatisticsByTopicIds(ctx, ids)
+		if err == nil {
+			current := make(map[int64]*model.TopicStatistic, len(ids))
+			for _, id := range ids {
+				if current[id] = storedMap[id]; current[id] == nil {
+					current[id] = &model.TopicStatistic{TopicID: id}
+				}
+			}
+			err = service.evaluateAlerts(ctx, ruleArr, current)
+		}
+		if err == nil {
+			return nil
+		}
+		failed := make(map[int64]error, len(ids))
+		for _, id := range ids {
+			failed[id] = err
+		}
+		return failed
+	})
+	job.Filter.Statuses = []pb.TopicDetail_TopicStatus{pb.TopicDetail_TopicStatus_InProcess}
+	if err := service.runBatchJob(ctx, job); err != nil {
+		return err
+	}
+
+	for _, rule := range ruleArr {
+		if rule.BaselinedAt != nil {
+			continue
+		}
+		if err := dao.TiDBInstance.MarkAlertRuleBaselined(ctx, rule); err != nil {
+			return err
+		}
+		service.Log.Infof("[task] EvaluateTopicAlerts rule baselined: %v", rule.ID)
+	}
+	return nil
+}
+
+// evaluateAlerts 检查阈值，同一规则、话题、阈值越过后只告警一次，回落到阈值以下时解除，再次越过时重新告警
+// 未记录基线的规则越过时只记录基线不告警
+func (service *Service) evaluateAlerts(ctx context.Context,
+	ruleArr []*model.AlertRule, topicStatisticMap map[int64]*model.TopicStatistic) error {
+	if len(ruleArr) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(topicStatisticMap))
+	values := map[string]map[int64]int64{
+		model.AlertMetricContentNum:         {},
+		model.AlertMetricMpNum:              {},
+		model.AlertMetricContentExposureNum: {},
+		model.AlertMetricIdleHours:          {},
+	}
+	for id, topicStatistic := range topicStatisticMap {
+		ids = append(ids, id)
+		values[model.AlertMetricContentNum][id] = topicStatistic.ContentNum
+		values[model.AlertMetricMpNum][id] = topicStatistic.MpNum
+		values[model.AlertMetricContentExposureNum][id] = topicStatistic.ContentExposureNum
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, rule := range ruleArr {
+		if rule.Metric == model.AlertMetricIdleHours {
+			if err := service.fillIdleHours(ctx, ids, values[model.AlertMetricIdleHours]); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	states, err := dao.TiDBInstance.TopicAlertStates(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	clearIds := make([]int64, 0)
+	for _, rule := range ruleArr {
+		thresholds := rule.ThresholdList()
+		for _, id := range ids {
+			// 没有指标值的话题不检查也不解除，如没有内容的话题的idle_hours
+			value, ok := values[rule.Metric][id]
+			if !ok || !rule.AppliesTo(id) {
+				continue
+			}
+			for _, threshold := range thresholds {
+				state := states[dao.TopicAlertKey{RuleID: rule.ID, TopicID: id, Threshold: threshold}]
+				if value < threshold {
+					if state != nil && state.Active {
+						clearIds = append(clearIds, state.ID)
+					}
+					continue
+				}
+				if state != nil && state.Active {
+					continue
+				}
+
+				alert := &model.TopicAlert{
+					RuleID:    rule.ID,
+					TopicID:   id,
+					Threshold: threshold,
+					Round:     1,
+					Metric:    rule.Metric,
+					Value:     value,
+					Baseline:  rule.BaselinedAt == nil,
+				}
+				if state != nil {
+					alert.Round = state.Round + 1
+				}
+				if err := service.createTopicAlert(ctx, alert); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return dao.TiDBInstance.ClearTopicAlerts(ctx, clearIds)
+}
+
+// fillIdleHours 进行中话题距最近一条内容（早于开始时间时按开始时间）的小时数，没有内容的话题不计算
+func (service *Service) fillIdleHours(ctx context.Context, ids []int64, idleHours map[int64]int64) error {
+	topicDetailArr, err := dao.TiDBInstance.InProcessTopics(ctx, ids)
+	if err != nil {
+		return err
+	}
+	inProcessIds := make([]int64, 0, len(topicDetailArr))
+	for _, topicDetail := range topicDetailArr {
+		inProcessIds = append(inProcessIds, topicDetail.ID)
+	}
+	latestMap, err := dao.TiDBInstance.LatestTopicContentAt(ctx, inProcessIds)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, topicDetail := range topicDetailArr {
+		latest, ok := latestMap[topicDetail.ID]
+		if !ok {
+			continue
+		}
+		since := topicDetail.StartAt
+		if latest.After(since) {
+			since = latest
+		}
+		idleHours[topicDetail.ID] = int64(now.Sub(since) / time.Hour)
+	}
+
+	return nil
+}
+
+// createTopicAlert 告警与事件同一事务写入，并发重复写入时只有一个生效；基线记录不登记事件
+func (service *Service) createTopicAlert(ctx context.Context, alert *model.TopicAlert) error {
+	var outboxEvent *model.OutboxEvent
+	if !alert.Baseline {
+		ev := events.TopicThresholdCrossed(alert)
+		alert.EventID = ev.EventID
+		outboxEvents, err := newDomainOutboxEvents(ev)
+		if err != nil {
+			return err
+		}
+		outboxEvent = outboxEvents[0]
+	}
+
+	created, err := dao.TiDBInstance.CreateTopicAlert(ctx, alert, outboxEvent)
+	if err != nil {
+		return err
+	}
+	if created {
+		service.Log.Infof("[service] createTopicAlert topic: %v, rule: %v, %v >= %v, round: %v, baseline: %v",
+			alert.TopicID, alert.RuleID, alert.Metric, alert.Threshold, alert.Round, alert.Baseline)
+	}
+
+	return nil
+}
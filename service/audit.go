@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/metrics"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"math/rand"
+	"strings"
+)
+
+const (
+	CacheAuditRepairNone    = "none"
+	CacheAuditRepairEvict   = "evict"
+	CacheAuditRepairRewrite = "rewrite"
+)
+
+// AuditTopicCache 巡检redis话题缓存，逐字段与TiDB比对，不一致时上报并按配置修复
+func (service *Service) AuditTopicCache(ctx context.Context) error {
+	if !dao.RedisInstance.Healthy() {
+		service.Log.Warnf("[task] AuditTopicCache skip, redis unavailable")
+		return dao.RedisUnavailableErr
+	}
+
+	var checked, mismatched int
+	fieldCount := make(map[string]int)
+	sampleIds := make([]int64, 0) // 上报的不一致话题，最多20个
+	err := dao.RedisInstance.ScanTopicIds(ctx, func(scanIds []int64) error {
+		metrics.CacheAuditScanned.Add(int64(len(scanIds)))
+
+		// 抽样
+		ids := scanIds
+		if !config.Cfg.CacheAuditFull {
+			ids = make([]int64, 0)
+			for _, id := range scanIds {
+				if rand.Float64() < config.Cfg.CacheAuditSampleRate {
+					ids = append(ids, id)
+				}
+			}
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		mismatches, err := service.auditTopicCache(ctx, ids)
+		if err != nil {
+			return err
+		}
+		checked += len(ids)
+		dao.AddJobProcessed(ctx, len(ids))
+		for id, fields := range mismatches {
+			mismatched++
+			if len(sampleIds) < 20 {
+				sampleIds = append(sampleIds, id)
+			}
+			for _, field := range fields {
+				fieldCount[field]++
+			}
+		}
+
+		return nil
+	})
+
+	// 每次巡检汇总上报一次
+	if mismatched > 0 {
+		currErr := fmt.Errorf("[task] AuditTopicCache mismatch, checked: %v, mismatched: %v, fields: %v, sampleIds: %v, repair: %v",
+			checked, mismatched, fieldCount, sampleIds, config.Cfg.CacheAuditRepair)
+		service.Log.Warn(currErr)
+		sentry.CaptureException(currErr)
+	}
+
+	if err != nil {
+		service.Log.Errorf("[task] AuditTopicCache err: %v, checked: %v, mismatched: %v", err, checked, mismatched)
+		return err
+	}
+
+	service.Log.Infof("[task] AuditTopicCache success, checked: %v, mismatched: %v", checked, mismatched)
+
+	return nil
+}
+
+// auditTopicCache 批量比对，不一致的话题持话题锁复查，排除与并发编辑的竞争后再计数和修复
+func (service *Service) auditTopicCache(ctx context.Context, ids []int64) (map[int64][]string, error) {
+	candidates, err := diffTopicCache(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	metrics.CacheAuditChecked.Add(int64(len(ids)))
+
+	mismatches := make(map[int64][]string)
+	for id := range candidates {
+		var fields []string
+		f := func(ctx context.Context) error {
+			rechecked, err := diffTopicCache(ctx, []int64{id})
+			if err != nil {
+				return err
+			}
+			fields = rechecked[id]
+			if len(fields) == 0 {
+				return nil
+			}
+			return service.repairTopicCache(ctx, id)
+		}
+		if err := dao.LockerInstance.LockWrap(ctx, model.GetKeyForLockTopic(id), f); err != nil {
+			service.Log.Errorf("[task] AuditTopicCache recheck err: %v, id: %v", err, id)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		mismatches[id] = fields
+		for _, field := range fields {
+			metrics.CacheAuditMismatch.Add(field, 1)
+		}
+		service.Log.Warnf("[task] AuditTopicCache mismatch, id: %v, fields: %v, repair: %v",
+			id, strings.Join(fields, ","), config.Cfg.CacheAuditRepair)
+	}
+
+	return mismatches, nil
+}
+
+// diffTopicCache 返回缓存与TiDB不一致的话题及字段
+func diffTopicCache(ctx context.Context, ids []int64) (map[int64][]string, error) {
+	topicInfosRedis, err := dao.RedisInstance.GetTopics(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	topicInfosTiDB, err := dao.TiDBInstance.GetTopicByIds(ctx, ids, false, "")
+	if err != nil {
+		if !isNotFound(err) {
+			return nil, err
+		}
+	}
+
+	diffs := make(map[int64][]string)
+	for id, cached := range topicInfosRedis {
+		var fields []string
+		if fresh, ok := topicInfosTiDB[id]; !ok {
+			// TiDB中已删除
+			fields = []string{"deleted"}
+		} else {
+			fields = cached.TopicDetail.Diff(fresh.TopicDetail)
+		}
+		if len(fields) != 0 {
+			diffs[id] = fields
+		}
+	}
+
+	return diffs, nil
+}
+
+// repairTopicCache 调用方需持有话题锁
+func (service *Service) repairTopicCache(ctx context.Context, id int64) error {
+	switch config.Cfg.CacheAuditRepair {
+	case CacheAuditRepairEvict:
+		if err := dao.RedisInstance.Del(ctx, []string{model.GetKeyForTopic(id)}); err != nil {
+			return err
+		}
+	case CacheAuditRepairRewrite:
+		if err := dao.RedisInstance.Del(ctx, []string{model.GetKeyForTopic(id)}); err != nil {
+			return err
+		}
+		if _, err := service.refreshTopicCache(ctx, id); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	metrics.CacheAuditRepaired.Add(1)
+	return nil
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"time"
+)
+
+// BatchJob 按话题id游标分批处理，每批处理完记录断点
+type BatchJob struct {
+	Name       string
+	BatchSize  int
+	RatePerSec int             // 每秒最多处理的条目数，0-不限速
+	MaxRetries int             // 单条目失败后的重试次数，仍失败时记入job_failures
+	Resume     bool            // true-从上次未完成的断点续跑
+	Scope      string          // 断点范围，与上次断点的范围一致才续跑
+	DryRun     bool            // true-只统计待处理条目，不处理也不记录断点
+	Filter     dao.TopicFilter // 处理的话题范围
+
+	// Process 处理一批话题，返回失败的条目
+	Process func(ctx context.Context, ids []int64) map[int64]error
+}
+
+func newBatchJob(name string, opts MaintenanceOptions, process func(ctx context.Context, ids []int64) map[int64]error) *BatchJob {
+	job := &BatchJob{
+		Name:       name,
+		BatchSize:  config.Cfg.BatchJobSize,
+		RatePerSec: config.Cfg.BatchJobRatePerSec,
+		MaxRetries: config.Cfg.BatchJobMaxRetries,
+		Resume:     config.Cfg.BatchJobResume,
+		DryRun:     opts.DryRun,
+		Process:    process,
+	}
+	if opts.BatchSize > 0 {
+		job.BatchSize = opts.BatchSize
+	}
+	if opts.RatePerSec > 0 {
+		job.RatePerSec = opts.RatePerSec
+	}
+	return job
+}
+
+// runBatchJob 执行批处理任务，有条目最终失败时返回错误
+func (service *Service) runBatchJob(ctx context.Context, job *BatchJob) error {
+	var lastID int64
+	if job.Resume && !job.DryRun {
+		checkpoint, err := dao.TiDBInstance.GetJobCheckpoint(ctx, job.Name)
+		if err != nil {
+			return err
+		}
+		if !checkpoint.Finished && checkpoint.Scope == job.Scope {
+			lastID = checkpoint.LastID
+			service.Log.Infof("[task] %v resume from checkpoint, lastID: %v", job.Name, lastID)
+		}
+	}
+
+	total, err := dao.TiDBInstance.CountTopics(ctx, lastID, job.Filter)
+	if err != nil {
+		return err
+	}
+	dao.SetJobTotal(ctx, total)
+	service.Log.Infof("[task] %v start, total: %v", job.Name, total)
+
+	var interval time.Duration
+	if job.RatePerSec > 0 {
+		interval = time.Duration(job.BatchSize) * time.Second / time.Duration(job.RatePerSec)
+	}
+
+	var processed, failed int
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		ids, err := dao.TiDBInstance.TopicIdsAfter(ctx, lastID, job.BatchSize, job.Filter)
+		if err != nil {
+			currErr := fmt.Errorf("[task] %v dao.TiDBInstance.TopicIdsAfter err: %v, lastID: %v", job.Name, err, lastID)
+			service.Log.Error(currErr)
+			sentry.CaptureException(currErr)
+			return err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		if job.DryRun {
+			lastID = ids[len(ids)-1]
+			processed += len(ids)
+			continue
+		}
+
+		batchStart := time.Now()
+		if batchFailed := service.retryBatchItems(ctx, job, job.Process(ctx, ids)); len(batchFailed) != 0 {
+			failed += len(batchFailed)
+			service.Log.Errorf("[task] %v items failed, count: %v, sample: %v", job.Name, len(batchFailed), sampleErr(batchFailed))
+			_ = dao.TiDBInstance.RecordJobFailures(ctx, job.Name, batchFailed, job.MaxRetries+1)
+		}
+
+		lastID = ids[len(ids)-1]
+		if err := dao.TiDBInstance.SaveJobCheckpoint(ctx, job.Name, job.Scope, lastID, false); err != nil {
+			return err
+		}
+		processed += len(ids)
+		dao.AddJobProcessed(ctx, len(ids))
+		service.Log.Infof("[task] %v current batch success, lastID: %v, progress: %v/%v, failed: %v",
+			job.Name, lastID, processed, total, failed)
+
+		// 限速
+		if wait := interval - time.Since(batchStart); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+	}
+
+	if job.DryRun {
+		service.Log.Infof("[task] %v dry run, would process: %v", job.Name, processed)
+		return nil
+	}
+	if err := dao.TiDBInstance.SaveJobCheckpoint(ctx, job.Name, job.Scope, lastID, true); err != nil {
+		return err
+	}
+	if failed != 0 {
+		currErr := fmt.Errorf("[task] %v finished with %v failed items, see job_failures", job.Name, failed)
+		service.Log.Error(currErr)
+		sentry.CaptureException(currErr)
+		return currErr
+	}
+	service.Log.Infof("[task] %v success, processed: %v", job.Name, processed)
+
+	return nil
+}
+
+// retryBatchItems 仅对失败的条目按指数退避重试，每轮一起重试仍失败的条目，返回最终失败的条目
+func (service *Service) retryBatchItems(ctx context.Context, job *BatchJob, failed map[int64]error) map[int64]error {
+	for tries := 0; tries < job.MaxRetries && len(failed) != 0; tries++ {
+		select {
+		case <-ctx.Done():
+			return failed
+		case <-time.After(100 * time.Millisecond << uint(tries)):
+		}
+
+		ids := make([]int64, 0, len(failed))
+		for id := range failed {
+			ids = append(ids, id)
+		}
+		retryFailed := job.Process(ctx, ids)
+		for id := range failed {
+			if err, ok := retryFailed[id]; ok {
+				failed[id] = err
+			} else {
+				delete(failed, id)
+			}
+		}
+	}
+	return failed
+}
+
+// sampleErr 任取一个失败条目用于日志
+func sampleErr(failed map[int64]error) string {
+	for id, err := range failed {
+		return fmt.Sprintf("id: %v, err: %v", id, err)
+	}
+	return ""
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	maxIngestTopicContents   = 500
+	defaultTopicContentLimit = 20
+	maxTopicContentLimit     = 100
+)
+
+// TopicContentItem 内容服务推送的关联变更，Removed为true时解除关联
+type TopicContentItem struct {
+	TopicID     int64
+	ContentID   string
+	PublishedAt time.Time
+	Removed     bool
+}
+
+// IngestTopicContents 写入话题内容关联，话题不存在的条目跳过并返回其话题id
+func (service *Service) IngestTopicContents(ctx context.Context,
+	items []*TopicContentItem) (accepted int, unknownTopicIds []int64, err error) {
+	invalid := func(msg string) error {
+		return &common.InternalError{
+			ErrCode: int32(pb.IngestTopicContentsResp_INVALID_ARGUMENT),
+			ErrMsg:  msg,
+		}
+	}
+	if len(items) > maxIngestTopicContents {
+		return 0, nil, invalid(fmt.Sprintf("单次最多写入%v条", maxIngestTopicContents))
+	}
+
+	topicIds := make([]int64, 0, len(items))
+	seen := make(map[int64]bool)
+	for i, item := range items {
+		if item.TopicID == 0 || item.ContentID == "" || len(item.ContentID) > 64 {
+			return 0, nil, invalid(fmt.Sprintf("第%v条topicId或contentId无效", i+1))
+		}
+		if !item.Removed && item.PublishedAt.IsZero() {
+			return 0, nil, invalid(fmt.Sprintf("第%v条缺少publishedAt", i+1))
+		}
+		if !seen[item.TopicID] {
+			seen[item.TopicID] = true
+			topicIds = append(topicIds, item.TopicID)
+		}
+	}
+
+	existing, err := dao.TiDBInstance.ExistingTopicIds(ctx, topicIds)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, id := range topicIds {
+		if !existing[id] {
+			unknownTopicIds = append(unknownTopicIds, id)
+		}
+	}
+
+	contentArr := make([]*model.TopicContent, 0, len(items))
+	for _, item := range items {
+		if !existing[item.TopicID] {
+			continue
+		}
+		if item.Removed {
+			if _, err := dao.TiDBInstance.DelTopicContent(ctx, item.TopicID, item.ContentID); err != nil {
+				return accepted, unknownTopicIds, err
+			}
+			accepted++
+			continue
+		}
+		contentArr = append(contentArr, &model.TopicContent{
+			TopicID:     item.TopicID,
+			ContentID:   item.ContentID,
+			PublishedAt: item.PublishedAt,
+		})
+	}
+	if err := dao.TiDBInstance.UpsertTopicContents(ctx, contentArr); err != nil {
+		return accepted, unknownTopicIds, err
+	}
+	accepted += len(contentArr)
+
+	return accepted, unknownTopicIds, nil
+}
+
+// UpdateTopicContent 运营设置置顶、精选、隐藏及排序，只更新fields指定的字段，fields为空时更新全部
+func (service *Service) UpdateTopicContent(ctx context.Context, content *model.TopicContent, fields []string) error {
+	rowsAffected, err := dao.TiDBInstance.UpdateTopicContent(ctx, content, fields)
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		if _, err := dao.TiDBInstance.GetTopicContent(ctx, content.TopicID, content.ContentID); dao.IsNotFound(err) {
+			return &common.InternalError{
+				ErrCode: int32(pb.UpdateTopicContentResp_NOT_FOUND),
+				ErrMsg:  "话题内容不存在",
+			}
+		}
+	}
+	service.Log.Infof("[service] UpdateTopicContent success, topic: %v, content: %v", content.TopicID, content.ContentID)
+
+	return nil
+}
+
+// ListTopicContents 游标分页，nextCursor为空表示没有更多
+func (service *Service) ListTopicContents(ctx context.Context, topicID int64, cursor string, limit int,
+	featuredOnly, includeHidden bool) (contentArr []*model.TopicContent, nextCursor string, err error) {
+	invalid := func(msg string) error {
+		return &common.InternalError{
+			ErrCode: int32(pb.ListTopicContentsResp_INVALID_ARGUMENT),
+			ErrMsg:  msg,
+		}
+	}
+	if topicID == 0 {
+		return nil, "", invalid("topicId不能为空")
+	}
+	if limit <= 0 {
+		limit = defaultTopicContentLimit
+	}
+	if limit > maxTopicContentLimit {
+		limit = maxTopicContentLimit
+	}
+
+	var after *dao.TopicContentCursor
+	if cursor != "" {
+		after, err = decodeTopicContentCursor(cursor)
+		if err != nil {
+			return nil, "", invalid("cursor无效")
+		}
+	}
+
+	// 多取一条判断是否还有下一页
+	contentArr, err = dao.TiDBInstance.TopicContentList(ctx, topicID, after, limit+1, featuredOnly, includeHidden)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(contentArr) > limit {
+		contentArr = contentArr[:limit]
+		last := contentArr[limit-1]
+		nextCursor, err = encodeTopicContentCursor(&dao.TopicContentCursor{
+			Pinned:      last.Pinned,
+			Sort:        last.Sort,
+			PublishedAt: last.PublishedAt,
+			ID:          last.ID,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	return contentArr, nextCursor, nil
+}
+
+func encodeTopicContentCursor(cursor *dao.TopicContentCursor) (string, error) {
+	b, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeTopicContentCursor(s string) (*dao.TopicContentCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &dao.TopicContentCursor{}
+	if err := json.Unmarshal(b, cursor); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+)
+
+func (service *Service) ListDeadLetters(ctx context.Context,
+	topicID int64, kind string, offset, limit int64) ([]*model.DeadLetter, int64, error) {
+	if limit <= 0 {
+		limit = 20
+	}
+	return dao.TiDBInstance.DeadLetterList(ctx, topicID, kind, offset, limit)
+}
+
+// ReplayDeadLetter 重新登记到发件箱末尾，排在该话题已登记的事件之后
+func (service *Service) ReplayDeadLetter(ctx context.Context, id int64) error {
+	found, err := dao.TiDBInstance.ReplayDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return &common.InternalError{
+			ErrCode: int32(pb.ReplayDeadLetterResp_NOT_FOUND),
+			ErrMsg:  "死信不存在",
+		}
+	}
+	service.Log.Infof("[service] ReplayDeadLetter success, deadLetter: %v", id)
+
+	return nil
+}
+
+func (service *Service) DiscardDeadLetter(ctx context.Context, id int64) error {
+	rowsAffected, err := dao.TiDBInstance.DelDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return &common.InternalError{
+			ErrCode: int32(pb.DiscardDeadLetterResp_NOT_FOUND),
+			ErrMsg:  "死信不存在",
+		}
+	}
+	service.Log.Infof("[service] DiscardDeadLetter success, deadLetter: %v", id)
+
+	return nil
+}
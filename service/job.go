@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+)
+
+func (service *Service) ListJobRuns(ctx context.Context, job, status string, offset, limit int64) ([]*model.JobRun, int64, error) {
+	if limit <= 0 {
+		limit = 20
+	}
+	return dao.TiDBInstance.JobRunList(ctx, job, status, offset, limit)
+}
+
+// TriggerJob 手动触发任务，记录为pending后由leader副本持任务锁执行，params为任务参数JSON
+func (service *Service) TriggerJob(ctx context.Context, job, params string) (int64, error) {
+	if !model.IsJob(job) {
+		return 0, &common.InternalError{
+			ErrCode: int32(pb.TriggerJobResp_JOB_NOT_FOUND),
+			ErrMsg:  "任务不存在",
+		}
+	}
+
+	// 没有leader时pending记录无人执行，直接拒绝
+	leading, err := dao.SingleBackendLocker(dao.LockerInstance).Held(ctx, model.CronLeader)
+	if err != nil {
+		return 0, err
+	}
+	if !leading {
+		return 0, &common.InternalError{
+			ErrCode: int32(pb.TriggerJobResp_NO_LEADER),
+			ErrMsg:  "没有可执行任务的leader副本，检查是否开启定时任务",
+		}
+	}
+
+	jobRun := &model.JobRun{
+		Job:     job,
+		Trigger: model.JobTriggerManual,
+		Status:  model.JobRunStatusPending,
+		Params:  params,
+	}
+	if err := dao.TiDBInstance.CreateJobRun(ctx, jobRun); err != nil {
+		return 0, err
+	}
+	service.Log.Infof("[service] TriggerJob success, job: %v, run: %v", job, jobRun.ID)
+
+	return jobRun.ID, nil
+}
+
+// CancelJobRun 取消待执行或执行中的任务，执行中的任务通过ctx中断
+func (service *Service) CancelJobRun(ctx context.Context, id int64) error {
+	rowsAffected, err := dao.TiDBInstance.CancelJobRun(ctx, id)
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return &common.InternalError{
+			ErrCode: int32(pb.CancelJobRunResp_NOT_FOUND),
+			ErrMsg:  "任务不存在或已结束",
+		}
+	}
+	service.Log.Infof("[service] CancelJobRun success, run: %v", id)
+
+	return nil
+}
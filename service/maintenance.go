@@ -0,0 +1,226 @@
+package service
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/events"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"encoding/json"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"time"
+)
+
+// MaintenanceOptions 运维命令参数
+type MaintenanceOptions struct {
+	BatchSize  int  `json:"batchSize,omitempty"`  // 0-使用配置BatchJobSize
+	RatePerSec int  `json:"ratePerSec,omitempty"` // 每秒最多处理的话题数，0-使用配置
+	DryRun     bool `json:"dryRun,omitempty"`     // true-只统计不写入
+}
+
+// ReindexOptions 重建es索引的范围及速率
+type ReindexOptions struct {
+	MaintenanceOptions
+	Filter dao.TopicFilter `json:"filter"`
+}
+
+// RebuildTopicBitMap 重建缓存穿透过滤器
+func (service *Service) RebuildTopicBitMap(ctx context.Context, opts MaintenanceOptions) error {
+	job := newBatchJob("RebuildTopicBitMap", opts, func(ctx context.Context, ids []int64) map[int64]error {
+		if err := dao.RedisInstance.SetBitTopics(ctx, ids); err != nil {
+			failed := make(map[int64]error, len(ids))
+			for _, id := range ids {
+				failed[id] = err
+			}
+			return failed
+		}
+		return nil
+	})
+
+	return service.runBatchJob(ctx, job)
+}
+
+// ReindexTopics 按范围发布话题事件，下游据此重建es索引；范围不固定，不续跑断点
+func (service *Service) ReindexTopics(ctx context.Context, opts ReindexOptions) error {
+	if opts.RatePerSec == 0 {
+		opts.RatePerSec = config.Cfg.ReindexRatePerSec
+	}
+	job := newBatchJob(model.JobReindexTopics, opts.MaintenanceOptions, func(ctx context.Context, ids []int64) map[int64]error {
+		// 与话题写入一样经发件箱发布，由relay保证送达及顺序
+		reindexCtx := topicOutbox(ctx, outboxIndexNew, func(_, _ *model.TopicDetail) []*events.TopicEvent {
+			return nil
+		})
+		if err := dao.TiDBInstance.EnqueueTopicEvents(reindexCtx, ids); err != nil {
+			failed := make(map[int64]error, len(ids))
+			for _, id := range ids {
+				failed[id] = err
+			}
+			return failed
+		}
+		return nil
+	})
+	job.Resume = false
+	job.Filter = opts.Filter
+
+	return service.runBatchJob(ctx, job)
+}
+
+// ReindexTopicsJob 手动任务入口，参数为TriggerReindex登记的ReindexOptions
+func (service *Service) ReindexTopicsJob(ctx context.Context) error {
+	opts := ReindexOptions{}
+	if params := dao.JobParams(ctx); params != "" {
+		if err := json.Unmarshal([]byte(params), &opts); err != nil {
+			return fmt.Errorf("invalid params: %v", err)
+		}
+	}
+
+	return service.ReindexTopics(ctx, opts)
+}
+
+// TriggerReindex 登记重建es索引的手动任务，由leader副本执行，进度见ListJobRuns
+func (service *Service) TriggerReindex(ctx context.Context, opts ReindexOptions) (int64, error) {
+	invalid := func(msg string) error {
+		return &common.InternalError{
+			ErrCode: int32(pb.ReindexTopicsResp_INVALID_ARGUMENT),
+			ErrMsg:  msg,
+		}
+	}
+	filter := opts.Filter
+	if !filter.CreatedFrom.IsZero() && !filter.CreatedTo.IsZero() && !filter.CreatedFrom.Before(filter.CreatedTo) {
+		return 0, invalid("createdFrom须早于createdTo")
+	}
+	if !filter.UpdatedFrom.IsZero() && !filter.UpdatedTo.IsZero() && !filter.UpdatedFrom.Before(filter.UpdatedTo) {
+		return 0, invalid("updatedFrom须早于updatedTo")
+	}
+	if opts.RatePerSec < 0 || opts.BatchSize < 0 {
+		return 0, invalid("ratePerSec、batchSize不能为负数")
+	}
+
+	params, err := json.Marshal(opts)
+	if err != nil {
+		return 0, err
+	}
+	// TriggerJobResp_NO_LEADER与ReindexTopicsResp_NO_LEADER取值一致，handler按错误码透传
+	return service.TriggerJob(ctx, model.JobReindexTopics, string(params))
+}
+
+// RefreshTopicStatus 分批修正状态与开始、结束时间不一致的话题，并为未结束的话题登记状态切换
+// 每批按目标状态条件更新，缓存删除与事件登记按批进行
+func (service *Service) RefreshTopicStatus(ctx context.Context, opts MaintenanceOptions) error {
+	job := newBatchJob(model.JobUpdateTopicStatus, opts, func(ctx context.Context, ids []int64) map[int64]error {
+		refreshCtx := topicOutbox(ctx, outboxIndexNew, func(before, after *model.TopicDetail) []*events.TopicEvent {
+			// before只含id和status，其余字段与变更后一致
+			full := *after
+			full.Status = before.Status
+			return []*events.TopicEvent{events.TopicStatusChanged(&full, after)}
+		})
+		changed, err := dao.TiDBInstance.RefreshTopicStatus(refreshCtx, ids, time.Now())
+		if len(changed) != 0 {
+			service.afterTopicStatusChanged(changed)
+		}
+		if err == nil {
+			return nil
+		}
+
+		currErr := fmt.Errorf("[task] RefreshTopicStatus dao.TiDBInstance.RefreshTopicStatus err: %v", err)
+		service.Log.Error(currErr)
+		sentry.CaptureException(currErr)
+		failed := make(map[int64]error, len(ids))
+		for _, id := range ids {
+			failed[id] = err
+		}
+		return failed
+	})
+	// 每次按当前时间重新筛选，不续跑断点
+	job.Resume = false
+	job.Filter.StatusStaleAt = time.Now()
+	if err := service.runBatchJob(ctx, job); err != nil || opts.DryRun {
+		return err
+	}
+
+	if _, err := service.scheduleNotEndedTopics(ctx); err != nil {
+		currErr := fmt.Errorf("[task] RefreshTopicStatus scheduleNotEndedTopics err: %v", err)
+		service.Log.Error(currErr)
+		sentry.CaptureException(currErr)
+		return err
+	}
+
+	return nil
+}
+
+// BackfillUTC 将存量行的时间由旧版本偏移转换为UTC，已转换的行按utc标记跳过，可重复执行
+// 须在全部副本升级后执行，滚动发布期间旧版本写入的行同样为utc=0
+func (service *Service) BackfillUTC(ctx context.Context, opts MaintenanceOptions) error {
+	batchSize := config.Cfg.BatchJobSize
+	if opts.BatchSize > 0 {
+		batchSize = opts.BatchSize
+	}
+	var interval time.Duration
+	if opts.RatePerSec > 0 {
+		interval = time.Duration(batchSize) * time.Second / time.Duration(opts.RatePerSec)
+	}
+
+	for _, table := range model.LegacyTimeTables {
+		var afterID, converted int64
+		for {
+			batchStart := time.Now()
+			lastID, n, err := dao.TiDBInstance.BackfillUTC(ctx, table, afterID, batchSize, opts.DryRun)
+			if err != nil {
+				currErr := fmt.Errorf("[task] BackfillUTC err: %v, table: %v, afterID: %v", err, table.Table, afterID)
+				service.Log.Error(currErr)
+				sentry.CaptureException(currErr)
+				return err
+			}
+			if lastID == 0 {
+				break
+			}
+			afterID = lastID
+			converted += n
+
+			if wait := interval - time.Since(batchStart); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(wait):
+				}
+			}
+		}
+		service.Log.Infof("[task] BackfillUTC success, table: %v, converted: %v, dryRun: %v", table.Table, converted, opts.DryRun)
+	}
+
+	return nil
+}
+
+// EvictTopicCache 删除指定话题缓存，ids为空时删除全部话题缓存
+func (service *Service) EvictTopicCache(ctx context.Context, ids []int64, opts MaintenanceOptions) error {
+	var evicted int
+	evict := func(ids []int64) error {
+		evicted += len(ids)
+		if opts.DryRun {
+			return nil
+		}
+
+		keys := make([]string, 0, len(ids))
+		for _, id := range ids {
+			keys = append(keys, model.GetKeyForTopic(id))
+		}
+		return dao.RedisInstance.Del(ctx, keys)
+	}
+
+	var err error
+	if len(ids) != 0 {
+		err = evict(ids)
+	} else {
+		err = dao.RedisInstance.ScanTopicIds(ctx, evict)
+	}
+	if err != nil {
+		service.Log.Errorf("[task] EvictTopicCache err: %v, evicted: %v", err, evicted)
+		return err
+	}
+	service.Log.Infof("[task] EvictTopicCache success, evicted: %v, dryRun: %v", evicted, opts.DryRun)
+
+	return nil
+}
@@ -0,0 +1,259 @@
+package service
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/events"
+	"dm-gitlab.bolo.me/hubpd/topic/metrics"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	uuid "github.com/satori/go.uuid"
+	"time"
+)
+
+// es索引事件类型
+const (
+	outboxIndexNew    = "new"
+	outboxIndexDelete = "delete"
+)
+
+// 发布失败后的重试退避
+const (
+	outboxRetryBase = time.Second
+	outboxRetryMax  = 5 * time.Minute
+)
+
+// undeliverableErr 重试也无法发布的事件，直接转入死信
+var undeliverableErr = errors.New("undeliverable")
+
+func newIndexOutboxEvent(id int64, typ string) *model.OutboxEvent {
+	return &model.OutboxEvent{
+		EventID: uuid.NewV4().String(),
+		Kind:    model.OutboxKindIndex,
+		TopicID: id,
+		Payload: typ,
+	}
+}
+
+func newDomainOutboxEvents(evs ...*events.TopicEvent) ([]*model.OutboxEvent, error) {
+	outboxEvents := make([]*model.OutboxEvent, 0, len(evs))
+	for _, ev := range evs {
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			return nil, err
+		}
+		outboxEvents = append(outboxEvents, &model.OutboxEvent{
+			EventID: ev.EventID,
+			Kind:    model.OutboxKindDomain,
+			TopicID: ev.TopicID,
+			Payload: string(payload),
+		})
+	}
+	return outboxEvents, nil
+}
+
+// topicOutbox 话题写入时为每个话题登记es索引事件及build生成的领域事件，并同时登记webhook投递
+func topicOutbox(ctx context.Context, indexTyp string,
+	build func(before, after *model.TopicDetail) []*events.TopicEvent) context.Context {
+	ctx = dao.WithWebhooks(ctx, webhookDeliveries)
+	return dao.WithOutbox(ctx, func(befores map[int64]*model.TopicDetail, afters []*model.TopicDetail) ([]*model.OutboxEvent, error) {
+		outboxEvents := make([]*model.OutboxEvent, 0)
+		for _, after := range afters {
+			domainEvents, err := newDomainOutboxEvents(build(befores[after.ID], after)...)
+			if err != nil {
+				return nil, err
+			}
+			outboxEvents = append(outboxEvents, newIndexOutboxEvent(after.ID, indexTyp))
+			outboxEvents = append(outboxEvents, domainEvents...)
+		}
+		return outboxEvents, nil
+	})
+}
+
+// followingOutbox 关注、取消关注只登记领域事件
+func followingOutbox(ctx context.Context, ev *events.TopicEvent) context.Context {
+	return dao.WithOutbox(ctx, func(map[int64]*model.TopicDetail, []*model.TopicDetail) ([]*model.OutboxEvent, error) {
+		return newDomainOutboxEvents(ev)
+	})
+}
+
+// RunOutboxRelay 持有relay租约时按登记顺序发布发件箱事件，各副本竞争租约
+func (service *Service) RunOutboxRelay(ctx context.Context) {
+	// 死信积压与是否持有租约无关，各副本均上报
+	go service.reportDeadLetterBacklog(ctx)
+
+	ttl := time.Duration(config.Cfg.OutboxRelayLeaseSec) * time.Second
+	retry := time.NewTicker(ttl / 3)
+	defer retry.Stop()
+
+	for {
+		h, err := dao.SingleBackendLocker(dao.LockerInstance).Acquire(ctx, model.OutboxRelay, dao.LockOptions{TTL: ttl})
+		if err != nil && err != dao.LockNotAcquiredErr {
+			service.Log.Warnf("[service] RunOutboxRelay acquire err: %v", err)
+		}
+		if h != nil {
+			service.relayOutbox(ctx, h)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-retry.C:
+		}
+	}
+}
+
+// relayOutbox 持续发布直到租约丢失或ctx取消
+func (service *Service) relayOutbox(ctx context.Context, h *dao.LockHandle) {
+	relayCtx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		if err := dao.SingleBackendLocker(dao.LockerInstance).Release(context.Background(), h); err != nil {
+			service.Log.Warnf("[service] relayOutbox release err: %v", err)
+		}
+	}()
+	service.Log.Infof("[service] relayOutbox start, fence: %v", h.Fence)
+
+	poll := time.NewTicker(time.Duration(config.Cfg.OutboxPollMs) * time.Millisecond)
+	defer poll.Stop()
+	purge := time.NewTicker(time.Hour)
+	defer purge.Stop()
+
+	// 按话题id轮转，避免事件多的话题占满每批
+	var cursor int64
+	for {
+		select {
+		case <-relayCtx.Done():
+			return
+		case <-h.Lost():
+			service.Log.Warnf("[service] relayOutbox lease lost, fence: %v", h.Fence)
+			return
+		case <-purge.C:
+			before := time.Now().Add(-time.Duration(config.Cfg.OutboxRetentionHours) * time.Hour)
+			if purged, err := dao.TiDBInstance.PurgeOutboxEvents(relayCtx, before); err == nil && purged != 0 {
+				service.Log.Infof("[service] relayOutbox purged: %v", purged)
+			}
+			// 顺带清理一天前已过期的锁租约
+			if purged, err := dao.TiDBInstance.PurgeLockLeases(relayCtx, time.Now().Add(-24*time.Hour)); err == nil && purged != 0 {
+				service.Log.Infof("[service] relayOutbox purged lock leases: %v", purged)
+			}
+		case <-poll.C:
+			cursor = service.relayOutboxBatch(relayCtx, cursor)
+		}
+	}
+}
+
+// relayOutboxBatch 同一话题的事件严格按seq发布，前一条未发布成功时跳过该话题的后续事件，返回下一批的游标
+func (service *Service) relayOutboxBatch(ctx context.Context, cursor int64) int64 {
+	outboxEvents, err := dao.TiDBInstance.PendingOutboxEvents(ctx, cursor, config.Cfg.OutboxBatchSize)
+	if err != nil {
+		return cursor
+	}
+	if len(outboxEvents) < config.Cfg.OutboxBatchSize {
+		cursor = 0
+	} else if last := outboxEvents[len(outboxEvents)-1].TopicID; last > 0 {
+		// 最后一个话题的事件可能未取全，下一批从该话题重新开始
+		cursor = last - 1
+	}
+
+	now := time.Now()
+	blocked := make(map[int64]bool)
+	for _, outboxEvent := range outboxEvents {
+		if ctx.Err() != nil {
+			return cursor
+		}
+		if blocked[outboxEvent.TopicID] {
+			continue
+		}
+
+		if err := service.publishOutboxEvent(ctx, outboxEvent); err != nil {
+			outboxEvent.Attempts++
+			currErr := fmt.Errorf("[service] relayOutboxBatch publish err: %v, eventId: %v, attempts: %v",
+				err, outboxEvent.EventID, outboxEvent.Attempts)
+			service.Log.Error(currErr)
+			sentry.CaptureException(currErr)
+
+			// 转入死信后该话题的后续事件仍不发布，直到死信重放或丢弃
+			blocked[outboxEvent.TopicID] = true
+			if errors.Is(err, undeliverableErr) || outboxRetryExpired(outboxEvent, now) {
+				if dlErr := dao.TiDBInstance.DeadLetterOutboxEvent(ctx, outboxEvent, err.Error()); dlErr == nil {
+					metrics.DeadLetters.Add(1)
+					continue
+				}
+			}
+			_ = dao.TiDBInstance.OutboxEventFailed(ctx, outboxEvent.ID, err.Error(), now.Add(outboxBackoff(outboxEvent.Attempts)))
+			continue
+		}
+
+		// 已发布但未标记时下次会重复发布，消费方按eventId去重
+		if _, err := dao.TiDBInstance.MarkOutboxEventSent(ctx, outboxEvent.ID); err != nil {
+			blocked[outboxEvent.TopicID] = true
+		}
+	}
+	return cursor
+}
+
+// publishOutboxEvent webhook投递已在写入事务内登记，这里只发布到kafka
+func (service *Service) publishOutboxEvent(ctx context.Context, outboxEvent *model.OutboxEvent) error {
+	switch outboxEvent.Kind {
+	case model.OutboxKindIndex:
+		return service.pubIndexEvent(outboxEvent)
+	case model.OutboxKindDomain:
+		if events.Instance == nil {
+			return errors.New("events publisher not initialized")
+		}
+		ev := &events.TopicEvent{}
+		if err := json.Unmarshal([]byte(outboxEvent.Payload), ev); err != nil {
+			return fmt.Errorf("%w: %v", undeliverableErr, err)
+		}
+		return events.Instance.Publish(ev)
+	default:
+		return fmt.Errorf("%w: unknown outbox kind %q", undeliverableErr, outboxEvent.Kind)
+	}
+}
+
+// pubIndexEvent 同步发送，得到kafka确认后才返回，之后才标记为已发布
+func (service *Service) pubIndexEvent(outboxEvent *model.OutboxEvent) error {
+	if events.Index == nil {
+		return errors.New("index publisher not initialized")
+	}
+	return events.Index.PublishIndex(outboxEvent.TopicID, outboxEvent.Payload == outboxIndexDelete)
+}
+
+// reportDeadLetterBacklog 每分钟从TiDB读取死信数上报，各副本的值一致
+func (service *Service) reportDeadLetterBacklog(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		if total, err := dao.TiDBInstance.CountDeadLetters(ctx); err == nil {
+			metrics.DeadLetterBacklog.Set(total)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// outboxRetryExpired 首次发布失败后已重试超过OutboxMaxRetryMin，首次失败时firstFailedAt尚未记录
+func outboxRetryExpired(outboxEvent *model.OutboxEvent, now time.Time) bool {
+	return outboxEvent.FirstFailedAt != nil &&
+		now.Sub(*outboxEvent.FirstFailedAt) >= time.Duration(config.Cfg.OutboxMaxRetryMin)*time.Minute
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 16 {
+		return outboxRetryMax
+	}
+	if d := outboxRetryBase << uint(attempts-1); d < outboxRetryMax {
+		return d
+	}
+	return outboxRetryMax
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"time"
+)
+
+const (
+	topicStatusRetryDelay    = 5 * time.Second  // 状态切换失败时重新入队的延迟
+	topicStatusClaimTimeout  = 30 * time.Second // 认领后未确认的话题在此之后可被重新认领
+	topicStatusBackfillBatch = 500
+	topicStatusBackfillCheck = time.Minute // 检查延时队列是否需要补登记的间隔
+)
+
+// scheduleTopicStatus 按开始、结束时间登记下一次状态切换，失败时由每日状态任务兜底
+func (service *Service) scheduleTopicStatus(ctx context.Context, topicDetail *model.TopicDetail) {
+	at, ok := topicDetail.NextStatusTransitionAt(time.Now())
+	if !ok {
+		if err := dao.RedisInstance.UnscheduleTopicStatus(ctx, []int64{topicDetail.ID}); err != nil {
+			service.Log.Warnf("[service] scheduleTopicStatus UnscheduleTopicStatus err: %v, id: %v", err, topicDetail.ID)
+		}
+		return
+	}
+
+	if err := dao.RedisInstance.ScheduleTopicStatus(ctx, topicDetail.ID, at); err != nil {
+		service.Log.Warnf("[service] scheduleTopicStatus ScheduleTopicStatus err: %v, id: %v", err, topicDetail.ID)
+	}
+}
+
+// RunTopicStatusQueue 消费状态切换延时队列，到点切换话题状态，各副本均可消费
+// 认领后处理，切换成功才确认，处理中副本退出的话题在认领超时后由其它副本重新处理
+func (service *Service) RunTopicStatusQueue(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(config.Cfg.StatusQueuePollMs) * time.Millisecond)
+	defer ticker.Stop()
+	backfillTicker := time.NewTicker(topicStatusBackfillCheck)
+	defer backfillTicker.Stop()
+
+	service.backfillTopicStatusQueue(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-backfillTicker.C:
+			service.backfillTopicStatusQueue(ctx)
+			continue
+		case <-ticker.C:
+		}
+
+		if !dao.RedisInstance.Healthy() {
+			continue
+		}
+
+		ids, deadline, err := dao.RedisInstance.ClaimDueTopicStatus(ctx, time.Now(), topicStatusClaimTimeout, config.Cfg.StatusQueueBatchSize)
+		if err != nil {
+			continue
+		}
+		acks := make([]int64, 0, len(ids))
+		for _, id := range ids {
+			if err := service.transitTopicStatus(ctx, id); err != nil {
+				service.Log.Errorf("[service] RunTopicStatusQueue transitTopicStatus err: %v, id: %v", err, id)
+				// 不确认，提前到重试时间再次到期
+				_ = dao.RedisInstance.ScheduleTopicStatus(ctx, id, time.Now().Add(topicStatusRetryDelay))
+				continue
+			}
+			acks = append(acks, id)
+		}
+		_ = dao.RedisInstance.AckTopicStatus(ctx, acks, deadline)
+	}
+}
+
+// backfillTopicStatusQueue 延时队列上线前创建的话题、redis数据丢失后的队列，由一个副本分批补登记，完成后写入标记
+func (service *Service) backfillTopicStatusQueue(ctx context.Context) {
+	if !dao.RedisInstance.Healthy() {
+		return
+	}
+	if done, err := dao.RedisInstance.TopicStatusBackfilled(ctx); err != nil || done {
+		return
+	}
+
+	err := dao.LockerInstance.LockWrap(ctx, model.KeyLockStatusBackfill, func(ctx context.Context) error {
+		if done, err := dao.RedisInstance.TopicStatusBackfilled(ctx); err != nil || done {
+			return err
+		}
+		scheduled, err := service.scheduleNotEndedTopics(ctx)
+		if err != nil {
+			return err
+		}
+		service.Log.Infof("[service] backfillTopicStatusQueue success, scheduled: %v", scheduled)
+		return dao.RedisInstance.MarkTopicStatusBackfilled(ctx)
+	})
+	if err != nil && !errors.Is(err, dao.LockNotAcquiredErr) {
+		currErr := fmt.Errorf("[service] backfillTopicStatusQueue err: %v", err)
+		service.Log.Error(currErr)
+		sentry.CaptureException(currErr)
+	}
+}
+
+// scheduleNotEndedTopics 分批为未结束的话题登记下一次状态切换
+func (service *Service) scheduleNotEndedTopics(ctx context.Context) (int, error) {
+	var afterID int64
+	var scheduled int
+	for {
+		topicDetailArr, err := dao.TiDBInstance.TopicDetailListNotEnded(ctx, afterID, topicStatusBackfillBatch)
+		if err != nil {
+			return scheduled, err
+		}
+
+		now := time.Now()
+		schedule := make(map[int64]time.Time, len(topicDetailArr))
+		for _, topicDetail := range topicDetailArr {
+			if at, ok := topicDetail.NextStatusTransitionAt(now); ok {
+				schedule[topicDetail.ID] = at
+			}
+		}
+		if err := dao.RedisInstance.ScheduleTopicsStatus(ctx, schedule); err != nil {
+			return scheduled, err
+		}
+		scheduled += len(schedule)
+
+		if len(topicDetailArr) < topicStatusBackfillBatch {
+			return scheduled, nil
+		}
+		afterID = topicDetailArr[len(topicDetailArr)-1].ID
+	}
+}
+
+// transitTopicStatus 持锁切换单个话题状态，并登记下一次切换
+func (service *Service) transitTopicStatus(ctx context.Context, id int64) error {
+	f := func(ctx context.Context) error {
+		topicDetail, err := dao.TiDBInstance.GetTopicDetail(ctx, id)
+		if err != nil {
+			if dao.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+
+		before := topicDetail.Status
+		topicDetail.Status = topicDetail.StatusAt(time.Now())
+		if topicDetail.Status != before {
+			// 更新TiDB并删除缓存，只重新计算status
+			if _, err := service.UpdateTopicWithoutLock(ctx, topicDetail, []string{"status"}); err != nil {
+				currErr := fmt.Errorf("[service] transitTopicStatus UpdateTopicWithoutLock err: %v, id: %v", err, id)
+				service.Log.Error(currErr)
+				sentry.CaptureException(currErr)
+				return err
+			}
+
+			service.Log.Infof("[service] transitTopicStatus success, id: %v, status: %v -> %v", id, before, topicDetail.Status)
+			return nil
+		}
+
+		service.scheduleTopicStatus(ctx, topicDetail)
+		return nil
+	}
+
+	return dao.LockerInstance.LockWrap(ctx, model.GetKeyForLockTopic(id), f)
+}
@@ -2,15 +2,14 @@ package service
 
 import (
 	"context"
-	core "dm-gitlab.bolo.me/hubpd/basic/grpc"
-	basicUtil "dm-gitlab.bolo.me/hubpd/basic/util"
 	"dm-gitlab.bolo.me/hubpd/proto/bi"
-	"dm-gitlab.bolo.me/hubpd/proto/event"
-	"dm-gitlab.bolo.me/hubpd/proto/topic"
 	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
 	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
 	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/events"
 	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"dm-gitlab.bolo.me/hubpd/topic/webhook"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,118 +25,158 @@ import (
 type Service struct {
 	Log               *logrus.Entry
 	BIChartDataClient bi.ChartDataClient
-	Pub               *core.Publisher
+	Webhook           *webhook.Client
 }
 
 var Instance *Service
 
+var (
+	tiDBFallbackLimiter     chan struct{}
+	tiDBFallbackLimiterOnce sync.Once
+)
+
+// fallbackLimiter 配置加载后再按TiDBFallbackConcurrent创建，<=0时按1处理
+func fallbackLimiter() chan struct{} {
+	tiDBFallbackLimiterOnce.Do(func() {
+		n := config.Cfg.TiDBFallbackConcurrent
+		if n <= 0 {
+			n = 1
+		}
+		tiDBFallbackLimiter = make(chan struct{}, n)
+	})
+	return tiDBFallbackLimiter
+}
+
 func (service *Service) CreateTopic(ctx context.Context, topicDetail *model.TopicDetail) error {
-	if err := dao.TiDBInstance.CreateTopic(ctx, topicDetail); err != nil {
+	if err := topicDetail.ValidateTimeRange(); err != nil {
+		return &common.InternalError{
+			ErrCode: int32(pb.CreateTopicResp_INVALID_ARGUMENT),
+			ErrMsg:  err.Error(),
+		}
+	}
+
+	createCtx := topicOutbox(ctx, outboxIndexNew, func(_, after *model.TopicDetail) []*events.TopicEvent {
+		return []*events.TopicEvent{events.TopicCreated(after)}
+	})
+	if err := dao.TiDBInstance.CreateTopic(createCtx, topicDetail); err != nil {
 		currErr := fmt.Errorf("[service] CreateTopic dao.TiDBInstance.CreateTopic err: %v", err)
 		service.Log.Error(currErr)
 		sentry.CaptureException(currErr)
 		return err
 	}
 
-	f := func() error {
+	// id由TiDB生成，只能插入后加锁；加锁或写bloom filter失败时删除新插入的行，避免留下不可见的话题
+	f := func(ctx context.Context) error {
 		// 添加到bloom filter
-		if err := dao.RedisInstance.SetBitTopics(ctx, []int64{topicDetail.ID}); err != nil {
-			currErr := fmt.Errorf("[service] CreateTopic BloomFilter dao.RedisInstance.SetBitTopics err: %v", err)
+		if err := dao.RedisInstance.SetBitTopicsOrDefer(ctx, []int64{topicDetail.ID}); err != nil {
+			currErr := fmt.Errorf("[service] CreateTopic BloomFilter dao.RedisInstance.SetBitTopicsOrDefer err: %v", err)
 			service.Log.Error(currErr)
 			sentry.CaptureException(currErr)
-
-			// TiDB 补偿
-			rowsAffected, delErr := dao.TiDBInstance.DelTopicByIdsWithoutUserBehavior(ctx, []int64{topicDetail.ID})
-			if delErr != nil {
-				currDelErr := fmt.Errorf("[service] CreateTopic 补偿 dao.TiDBInstance.DelTopicByIds err: %v ", delErr)
-				service.Log.Error(currDelErr)
-				sentry.CaptureException(currDelErr)
-				return currDelErr
-			}
-			if rowsAffected != 1 {
-				rowsAffectedErr := fmt.Errorf(
-					"[service] CreateTopic 补偿 dao.TiDBInstance.DelTopicByIds rowsAffected: %v != 1", rowsAffected)
-				service.Log.Error(rowsAffectedErr)
-				sentry.CaptureException(rowsAffectedErr)
-				return rowsAffectedErr
-			}
-
 			return err
 		}
 
-		// Index to es
-		basicUtil.PubEvent(service.Pub, topic.EV_DM_TOPIC, event.DataEventUint64_NEW, topicDetail.ID)
+		// 登记状态切换
+		service.scheduleTopicStatus(ctx, topicDetail)
 
 		return nil
 	}
 
 	// lock
-	return dao.RedisInstance.LockWrap(ctx, model.GetKeyForLockTopic(topicDetail.ID), f)
+	err := dao.LockerInstance.LockWrap(ctx, model.GetKeyForLockTopic(topicDetail.ID), f)
+	if err == nil {
+		return nil
+	}
+
+	// TiDB 补偿
+	delCtx := topicOutbox(ctx, outboxIndexDelete, func(_, after *model.TopicDetail) []*events.TopicEvent {
+		return []*events.TopicEvent{events.TopicDeleted(after)}
+	})
+	rowsAffected, delErr := dao.TiDBInstance.DelTopicByIdsWithoutUserBehavior(delCtx, []int64{topicDetail.ID})
+	if delErr != nil {
+		currDelErr := fmt.Errorf("[service] CreateTopic 补偿 dao.TiDBInstance.DelTopicByIds err: %v ", delErr)
+		service.Log.Error(currDelErr)
+		sentry.CaptureException(currDelErr)
+		return currDelErr
+	}
+	if rowsAffected != 1 {
+		rowsAffectedErr := fmt.Errorf(
+			"[service] CreateTopic 补偿 dao.TiDBInstance.DelTopicByIds rowsAffected: %v != 1", rowsAffected)
+		service.Log.Error(rowsAffectedErr)
+		sentry.CaptureException(rowsAffectedErr)
+		return rowsAffectedErr
+	}
+
+	return err
 }
 
-func (service *Service) UpdateTopic(ctx context.Context, topicDetail *model.TopicDetail) (int64, error) {
+// UpdateTopic fields为FieldMask的path，为空时更新全部字段
+func (service *Service) UpdateTopic(ctx context.Context, topicDetail *model.TopicDetail, fields []string) (int64, error) {
 	var rowsAffected int64
 
-	f := func() error {
-		// Redis
-		if err := dao.RedisInstance.Del(ctx, []string{model.GetKeyForTopic(topicDetail.ID)}); err != nil {
-			currErr := fmt.Errorf("[service] UpdateTopic dao.RedisInstance.Del err: %v, key: %v",
-				err, model.GetKeyForTopic(topicDetail.ID))
-			service.Log.Error(currErr)
-			sentry.CaptureException(currErr)
-			return err
-		}
+	f := func(ctx context.Context) error {
+		var err error
+		rowsAffected, err = service.UpdateTopicWithoutLock(ctx, topicDetail, fields)
+		return err
+	}
 
-		// TiDB
-		var updateErr error
-		rowsAffected, updateErr = dao.TiDBInstance.UpdateTopicWithoutUserBehavior(ctx, topicDetail)
-		if updateErr != nil {
-			currErr := fmt.Errorf("[service] UpdateTopic dao.TiDBInstance.UpdateTopicWithoutUserBehavior err: %v id: %v",
-				updateErr, topicDetail.ID)
-			service.Log.Error(currErr)
-			sentry.CaptureException(currErr)
-			return updateErr
-		}
-		if rowsAffected != 1 {
-			service.Log.Infof("[service] UpdateTopic dao.TiDBInstance.UpdateTopic rowsAffected: %v != 1", rowsAffected)
-			return nil
-		} else {
-			// Index to es
-			basicUtil.PubEvent(service.Pub, topic.EV_DM_TOPIC, event.DataEventUint64_NEW, topicDetail.ID)
+	// lock
+	return rowsAffected, dao.LockerInstance.LockWrap(ctx, model.GetKeyForLockTopic(topicDetail.ID), f)
+}
+
+// UpdateTopicWithoutLock 调用方需持有话题锁
+// 未指定的字段保留原值，uniq、status仅在title、开始结束时间被指定时重新计算
+// fields为内部字段status时只按当前时间重新计算status
+// topicDetail.Version非0时作为期望版本，与当前版本不一致返回VersionConflictError，话题不存在时返回NOT_FOUND
+func (service *Service) UpdateTopicWithoutLock(ctx context.Context, topicDetail *model.TopicDetail, fields []string) (int64, error) {
+	var rowsAffected int64
+
+	// 变更前数据，用于合并未指定的字段及领域事件
+	before, err := dao.TiDBInstance.GetTopicDetail(ctx, topicDetail.ID)
+	if err != nil {
+		if dao.IsNotFound(err) {
+			return rowsAffected, topicNotFoundErr()
 		}
+		currErr := fmt.Errorf("[service] UpdateTopic dao.TiDBInstance.GetTopicDetail err: %v id: %v", err, topicDetail.ID)
+		service.Log.Error(currErr)
+		sentry.CaptureException(currErr)
+		return rowsAffected, err
+	}
 
-		// 延时双删
-		go func() {
-			time.Sleep(200 * time.Millisecond)
+	expectedVersion := topicDetail.Version
+	if expectedVersion != 0 && expectedVersion != before.Version {
+		return rowsAffected, &common.VersionConflictError{
+			InternalError: common.InternalError{
+				ErrCode: int32(pb.UpdateTopicResp_VERSION_CONFLICT),
+				ErrMsg:  fmt.Sprintf("version conflict, current version: %v", before.Version),
+			},
+			Current: before.Version,
+		}
+	}
 
-			ddl := time.Now().Add(time.Duration(60) * time.Second)
-			for tries := 0; time.Now().Before(ddl); tries++ {
-				if err := dao.RedisInstance.Del(context.Background(), []string{model.GetKeyForTopic(topicDetail.ID)}); err != nil {
-					currErr := fmt.Errorf("[service] UpdateTopic 延时双删 dao.RedisInstance.Del err: %v, key: %v",
-						err, model.GetKeyForTopic(topicDetail.ID))
-					service.Log.Error(currErr)
-					sentry.CaptureException(currErr)
-				} else {
-					return
+	topicDetail = before.WithFields(topicDetail, fields)
+	columns := updateColumns(fields)
+	// 与dao层version + 1保持一致，事件快照中为更新后的版本
+	if dao.BumpsVersion(columns) {
+		topicDetail.Version = before.Version + 1
+	}
+	for _, column := range columns {
+		switch column {
+		case "start_at", "end_at":
+			// 合并后校验，只指定开始或结束时间时与原值比较
+			if err := topicDetail.ValidateTimeRange(); err != nil {
+				return rowsAffected, &common.InternalError{
+					ErrCode: int32(pb.UpdateTopicResp_INVALID_ARGUMENT),
+					ErrMsg:  err.Error(),
 				}
-
-				time.Sleep(time.Second << uint(tries))
 			}
-		}()
-
-		return nil
+		case "status":
+			topicDetail.Status = topicDetail.StatusAt(time.Now())
+		}
 	}
 
-	// lock
-	return rowsAffected, dao.RedisInstance.LockWrap(ctx, model.GetKeyForLockTopic(topicDetail.ID), f)
-}
-
-func (service *Service) UpdateTopicWithoutLock(ctx context.Context, topicDetail *model.TopicDetail) (int64, error) {
-	var rowsAffected int64
-
 	// Redis
-	if err := dao.RedisInstance.Del(ctx, []string{model.GetKeyForTopic(topicDetail.ID)}); err != nil {
-		currErr := fmt.Errorf("[service] UpdateTopic dao.RedisInstance.Del err: %v, key: %v",
+	if err := dao.RedisInstance.DelOrDefer(ctx, []string{model.GetKeyForTopic(topicDetail.ID)}); err != nil {
+		currErr := fmt.Errorf("[service] UpdateTopic dao.RedisInstance.DelOrDefer err: %v, key: %v",
 			err, model.GetKeyForTopic(topicDetail.ID))
 		service.Log.Error(currErr)
 		sentry.CaptureException(currErr)
@@ -146,8 +185,23 @@ func (service *Service) UpdateTopicWithoutLock(ctx context.Context, topicDetail
 
 	// TiDB
 	var updateErr error
-	rowsAffected, updateErr = dao.TiDBInstance.UpdateTopicWithoutUserBehavior(ctx, topicDetail)
+	updateCtx := topicOutbox(ctx, outboxIndexNew, func(txBefore, after *model.TopicDetail) []*events.TopicEvent {
+		// before、after均为事务内读取，与实际写入一致
+		evs := []*events.TopicEvent{events.TopicUpdated(txBefore, after)}
+		if txBefore.Status != after.Status {
+			evs = append(evs, events.TopicStatusChanged(txBefore, after))
+		}
+		return evs
+	})
+	rowsAffected, updateErr = dao.TiDBInstance.UpdateTopicWithoutUserBehavior(updateCtx, topicDetail, columns, expectedVersion)
 	if updateErr != nil {
+		if _, ok := updateErr.(*common.VersionConflictError); ok {
+			return rowsAffected, updateErr
+		}
+		// 读取变更前数据后被删除
+		if dao.IsNotFound(updateErr) {
+			return rowsAffected, topicNotFoundErr()
+		}
 		currErr := fmt.Errorf("[service] UpdateTopic dao.TiDBInstance.UpdateTopicWithoutUserBehavior err: %v id: %v",
 			updateErr, topicDetail.ID)
 		service.Log.Error(currErr)
@@ -155,21 +209,24 @@ func (service *Service) UpdateTopicWithoutLock(ctx context.Context, topicDetail
 		return rowsAffected, updateErr
 	}
 	if rowsAffected != 1 {
-		service.Log.Infof("[service] UpdateTopic dao.TiDBInstance.UpdateTopic rowsAffected: %v != 1", rowsAffected)
-		return rowsAffected, nil
-	} else {
-		// Index to es
-		basicUtil.PubEvent(service.Pub, topic.EV_DM_TOPIC, event.DataEventUint64_NEW, topicDetail.ID)
+		currErr := fmt.Errorf("[service] UpdateTopic dao.TiDBInstance.UpdateTopicWithoutUserBehavior rowsAffected: %v != 1, id: %v",
+			rowsAffected, topicDetail.ID)
+		service.Log.Error(currErr)
+		sentry.CaptureException(currErr)
+		return rowsAffected, currErr
 	}
 
+	// 开始、结束时间可能变更，重新登记状态切换
+	service.scheduleTopicStatus(ctx, topicDetail)
+
 	// 延时双删
 	go func() {
 		time.Sleep(200 * time.Millisecond)
 
 		ddl := time.Now().Add(time.Duration(60) * time.Second)
 		for tries := 0; time.Now().Before(ddl); tries++ {
-			if err := dao.RedisInstance.Del(context.Background(), []string{model.GetKeyForTopic(topicDetail.ID)}); err != nil {
-				currErr := fmt.Errorf("[service] UpdateTopic 延时双删 dao.RedisInstance.Del err: %v, key: %v",
+			if err := dao.RedisInstance.DelOrDefer(context.Background(), []string{model.GetKeyForTopic(topicDetail.ID)}); err != nil {
+				currErr := fmt.Errorf("[service] UpdateTopic 延时双删 dao.RedisInstance.DelOrDefer err: %v, key: %v",
 					err, model.GetKeyForTopic(topicDetail.ID))
 				service.Log.Error(currErr)
 				sentry.CaptureException(currErr)
@@ -184,13 +241,47 @@ func (service *Service) UpdateTopicWithoutLock(ctx context.Context, topicDetail
 	return rowsAffected, nil
 }
 
+func topicNotFoundErr() error {
+	return &common.InternalError{
+		ErrCode: int32(pb.UpdateTopicResp_NOT_FOUND),
+		ErrMsg:  pb.UpdateTopicResp_ErrCode_name[int32(pb.UpdateTopicResp_NOT_FOUND)],
+	}
+}
+
+// updateColumns fields对应的列，含需重新计算的uniq、status，fields为空时为全部列
+// status不在TopicUpdatableFields中，仅供内部按时间切换状态时指定
+func updateColumns(fields []string) []string {
+	if len(fields) == 0 {
+		fields = model.TopicUpdatableFields
+	}
+
+	columns := make([]string, 0, len(fields)+2)
+	seen := make(map[string]bool, len(fields)+2)
+	add := func(column string) {
+		if !seen[column] {
+			seen[column] = true
+			columns = append(columns, column)
+		}
+	}
+	for _, field := range fields {
+		add(field)
+		switch field {
+		case "title":
+			add("uniq")
+		case "start_at", "end_at":
+			add("status")
+		}
+	}
+	return columns
+}
+
 func (service *Service) DelTopicById(ctx context.Context, id int64) (int64, error) {
 	var rowsAffected int64
 
-	f := func() error {
+	f := func(ctx context.Context) error {
 		// Redis
-		if err := dao.RedisInstance.Del(ctx, []string{model.GetKeyForTopic(id)}); err != nil {
-			currErr := fmt.Errorf("[service] DelTopicById dao.RedisInstance.Del err: %v key: %v", err, model.GetKeyForTopic(id))
+		if err := dao.RedisInstance.DelOrDefer(ctx, []string{model.GetKeyForTopic(id)}); err != nil {
+			currErr := fmt.Errorf("[service] DelTopicById dao.RedisInstance.DelOrDefer err: %v key: %v", err, model.GetKeyForTopic(id))
 			service.Log.Error(currErr)
 			sentry.CaptureException(currErr)
 			return err
@@ -198,7 +289,10 @@ func (service *Service) DelTopicById(ctx context.Context, id int64) (int64, erro
 
 		// TiDB
 		var delErr error
-		rowsAffected, delErr = dao.TiDBInstance.DelTopicByIdsWithoutUserBehavior(ctx, []int64{id})
+		delCtx := topicOutbox(ctx, outboxIndexDelete, func(_, after *model.TopicDetail) []*events.TopicEvent {
+			return []*events.TopicEvent{events.TopicDeleted(after)}
+		})
+		rowsAffected, delErr = dao.TiDBInstance.DelTopicByIdsWithoutUserBehavior(delCtx, []int64{id})
 		if delErr != nil {
 			currErr := fmt.Errorf("[service] DelTopicById dao.TiDBInstance.Del err: %v id: %v", delErr, id)
 			service.Log.Error(currErr)
@@ -210,8 +304,10 @@ func (service *Service) DelTopicById(ctx context.Context, id int64) (int64, erro
 				"[service] DelTopicByIds dao.TiDBInstance.DelTopicByIds rowsAffected: %v != 1", rowsAffected)
 			service.Log.Info(rowsAffectedErr)
 			return rowsAffectedErr
-		} else {
-			basicUtil.PubEvent(service.Pub, topic.EV_DM_TOPIC, event.DataEventUint64_DELETE, id)
+		}
+
+		if err := dao.RedisInstance.UnscheduleTopicStatus(ctx, []int64{id}); err != nil {
+			service.Log.Warnf("[service] DelTopicById UnscheduleTopicStatus err: %v, id: %v", err, id)
 		}
 
 		// 延时双删
@@ -220,8 +316,8 @@ func (service *Service) DelTopicById(ctx context.Context, id int64) (int64, erro
 
 			ddl := time.Now().Add(time.Duration(60) * time.Second)
 			for tries := 0; time.Now().Before(ddl); tries++ {
-				if err := dao.RedisInstance.Del(context.Background(), []string{model.GetKeyForTopic(id)}); err != nil {
-					currErr := fmt.Errorf("[service] DelTopicById 延时双删 dao.RedisInstance.Del err: %v, key: %v",
+				if err := dao.RedisInstance.DelOrDefer(context.Background(), []string{model.GetKeyForTopic(id)}); err != nil {
+					currErr := fmt.Errorf("[service] DelTopicById 延时双删 dao.RedisInstance.DelOrDefer err: %v, key: %v",
 						err, model.GetKeyForTopic(id))
 					service.Log.Error(currErr)
 					sentry.CaptureException(currErr)
@@ -237,7 +333,7 @@ func (service *Service) DelTopicById(ctx context.Context, id int64) (int64, erro
 	}
 
 	// lock
-	return rowsAffected, dao.RedisInstance.LockWrap(ctx, model.GetKeyForLockTopic(id), f)
+	return rowsAffected, dao.LockerInstance.LockWrap(ctx, model.GetKeyForLockTopic(id), f)
 }
 
 func (service *Service) DelTopicByIds(ctx context.Context, ids []int64) (int64, error) {
@@ -268,13 +364,18 @@ func (service *Service) GetTopicByIds(ctx context.Context, preIds []int64, withS
 		return topicInfos, topicStatistics, currErr
 	}
 
+	// redis降级，直接读TiDB
+	if !dao.RedisInstance.Healthy() {
+		return service.getTopicByIdsFallback(ctx, preIds, withStatistics, withUserBehavior, userID)
+	}
+
 	// 缓存穿透
 	ids, err := dao.RedisInstance.GetBitTopics(ctx, preIds)
 	if err != nil {
 		currErr := fmt.Errorf("[service] GetTopicByIds BitMap dao.RedisInstance.GetBitTopics err: %v", err)
 		service.Log.Error(currErr)
 		sentry.CaptureException(currErr)
-		return topicInfos, topicStatistics, currErr
+		return service.getTopicByIdsFallback(ctx, preIds, withStatistics, withUserBehavior, userID)
 	}
 	if len(ids) == 0 {
 		return topicInfos, topicStatistics, &common.InternalError{
@@ -289,7 +390,8 @@ func (service *Service) GetTopicByIds(ctx context.Context, preIds []int64, withS
 	if withStatistics {
 		sw.Add(1)
 		go func() {
-			biCtx, _ := context.WithTimeout(ctx, 3*time.Second)
+			biCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			defer cancel()
 			service.Log.Infof("[service] GetTopicByIds bi-svc.TopicStatisticsFromBI ids: %v", ids)
 			topicStatistics, biErr = service.TopicStatisticsFromBI(biCtx, ids)
 
@@ -303,7 +405,13 @@ func (service *Service) GetTopicByIds(ctx context.Context, preIds []int64, withS
 		currErr := fmt.Errorf("[service] GetTopicByIds dao.RedisInstance.GetTopics err: %v", redisGetErr)
 		service.Log.Error(currErr)
 		sentry.CaptureException(currErr)
-		return topicInfos, topicStatistics, redisGetErr
+		// 统计数据已在请求中，降级时只补topicInfo
+		sw.Wait()
+		topicInfos, _, err = service.getTopicByIdsFallback(ctx, ids, false, withUserBehavior, userID)
+		if err == nil {
+			err = biErr
+		}
+		return topicInfos, topicStatistics, err
 	}
 
 	lackArr := make([]int64, 0)        // redis缺失 首次
@@ -321,11 +429,27 @@ func (service *Service) GetTopicByIds(ctx context.Context, preIds []int64, withS
 
 	// 从TiDB获取
 	if len(lackArr) != 0 {
+		lockHandles := make([]*dao.LockHandle, 0) // 本次请求持有的击穿锁
+		defer func() {
+			for _, h := range lockHandles {
+				if unLockErr := dao.RedisInstance.Release(ctx, h); unLockErr != nil {
+					currErr := fmt.Errorf("[redis] GetTopicByIds Redis Release return unLockErr: %v", unLockErr)
+					service.Log.Error(currErr)
+					sentry.CaptureException(currErr)
+				}
+			}
+		}()
+
 		for _, lackID := range lackArr {
 			// 缓存击穿
 			lockedIDs := make([]int64, 0) // 锁被抢占
-			if err := dao.RedisInstance.Lock(ctx, model.GetKeyForLockTopicForGetsByTiDB(lackID)); err != nil {
+			h, err := dao.RedisInstance.Acquire(ctx, model.GetKeyForLockTopicForGetsByTiDB(lackID), dao.LockOptions{
+				TTL: time.Duration(config.Cfg.RedisLockExpirationSec) * time.Second,
+			})
+			if err != nil {
 				lockedIDs = append(lockedIDs, lackID)
+			} else {
+				lockHandles = append(lockHandles, h)
 			}
 
 			// 锁被抢占 延时再次从redis获取
@@ -363,17 +487,6 @@ func (service *Service) GetTopicByIds(ctx context.Context, preIds []int64, withS
 
 		// 到TiDB
 		if len(lastLackArr) != 0 {
-			// 仅对lastLackArr解锁
-			defer func() {
-				for _, lackID := range lastLackArr {
-					if unLockErr := dao.RedisInstance.UnLock(ctx, model.GetKeyForLockTopicForGetsByTiDB(lackID)); unLockErr != nil {
-						currErr := fmt.Errorf("[redis] GetTopicByIds Redis UnLock return unLockErr: %v", unLockErr)
-						service.Log.Error(currErr)
-						sentry.CaptureException(currErr)
-					}
-				}
-			}()
-
 			topicInfosTiDB, err := dao.TiDBInstance.GetTopicByIds(ctx, lastLackArr, withUserBehavior, userID)
 			if err != nil {
 				var internalError *common.InternalError
@@ -443,7 +556,8 @@ func (service *Service) GetTopicByIdsWithoutRedis(ctx context.Context,
 	if withStatistics {
 		sw.Add(1)
 		go func() {
-			biCtx, _ := context.WithTimeout(ctx, 3*time.Second)
+			biCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			defer cancel()
 			topicStatistics, topicStatisticErr = service.TopicStatisticsFromBI(biCtx, ids)
 			sw.Done()
 		}()
@@ -460,6 +574,25 @@ func (service *Service) GetTopicByIdsWithoutRedis(ctx context.Context,
 	return topicInfos, topicStatistics, nil
 }
 
+// redis降级时读TiDB，限制并发防止打垮TiDB
+func (service *Service) getTopicByIdsFallback(ctx context.Context,
+	ids []int64, withStatistics, withUserBehavior bool, userID string) (map[int64]*model.TopicInfo, map[int64]*model.TopicStatistic, error) {
+
+	limiter := fallbackLimiter()
+	select {
+	case limiter <- struct{}{}:
+		defer func() { <-limiter }()
+	case <-time.After(3 * time.Second):
+		service.Log.Warnf("[service] GetTopicByIds fallback wait tiDBFallbackLimiter timeout, ids: %v", ids)
+		return map[int64]*model.TopicInfo{}, map[int64]*model.TopicStatistic{}, dao.RedisUnavailableErr
+	case <-ctx.Done():
+		return map[int64]*model.TopicInfo{}, map[int64]*model.TopicStatistic{}, ctx.Err()
+	}
+
+	service.Log.Warnf("[service] GetTopicByIds redis unavailable, fallback to TiDB, ids: %v", ids)
+	return service.GetTopicByIdsWithoutRedis(ctx, ids, withStatistics, withUserBehavior, userID)
+}
+
 func (service *Service) TopicList(ctx context.Context,
 	keyword string, keywordsWithExactlyEqual []string, sortBy pb.TopicListReq_SortByType, orderBy pb.TopicListReq_OrderByType,
 	offset, limit int64, startAt, endAt *timestamp.Timestamp, effectStatus pb.TopicListReq_EffectStatus,
@@ -484,7 +617,8 @@ func (service *Service) TopicList(ctx context.Context,
 			topicInfoIDs = append(topicInfoIDs, topicInfoArrItem.TopicDetail.ID)
 		}
 
-		biCtx, _ := context.WithTimeout(ctx, 3*time.Second)
+		biCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
 		topicStatisticMap, err = service.TopicStatisticsFromBI(biCtx, topicInfoIDs)
 		if err != nil {
 			return topicInfoArr, total, topicStatisticMap, err
@@ -496,9 +630,9 @@ func (service *Service) TopicList(ctx context.Context,
 
 func (service *Service) TopicFollowing(ctx context.Context, action bool, topicID int64, userID string) error {
 	if action {
-		return dao.TiDBInstance.CreateTopicFollowing(ctx, topicID, userID)
+		return dao.TiDBInstance.CreateTopicFollowing(followingOutbox(ctx, events.TopicFollowed(topicID, userID)), topicID, userID)
 	} else {
-		return dao.TiDBInstance.DelTopicFollowing(ctx, topicID, userID)
+		return dao.TiDBInstance.DelTopicFollowing(followingOutbox(ctx, events.TopicUnfollowed(topicID, userID)), topicID, userID)
 	}
 }
 
@@ -567,169 +701,122 @@ func (service *Service) TopicStatisticsFromBI(ctx context.Context, topicIDs []in
 	return topicStatisticMap, nil
 }
 
+// UpdateTopicStatistic 从BI拉取统计数据落库，仅对统计有变化的话题发布事件刷新es，并检查阈值规则
 func (service *Service) UpdateTopicStatistic(ctx context.Context) error {
-	var offset, limit int64 = 0, 500
-	for {
-		topicInfoArr, total, err := dao.TiDBInstance.TopicList(ctx, "", []string{}, pb.TopicListReq_CREATED_AT, pb.TopicListReq_ASC,
-			offset, limit, nil, nil, pb.TopicListReq_NONE, false, "", true,
-			pb.TopicListReq_ManualAudit_None, false)
-		if err != nil {
-			service.Log.Errorf("[service] UpdateTopicStatistic dao.TiDBInstance.TopicList err: %v", err)
-			sentry.CaptureException(fmt.Errorf(
-				"[task] updateTopicStatistic fail, offset: %v, limit: %v, total: %v, err: %v", offset, limit, total, err))
-			break
-		}
+	// 与EvaluateTopicAlerts相同的规则口径，这里不记录基线完成
+	ruleArr, err := dao.TiDBInstance.AlertRuleList(ctx, true)
+	if err != nil {
+		return err
+	}
 
-		// refresh es
-		for _, topicInfo := range topicInfoArr {
-			basicUtil.PubEvent(service.Pub, topic.EV_DM_TOPIC, event.DataEventUint64_NEW, topicInfo.TopicDetail.ID)
-			service.Log.Debugf("[task] updateTopicStatistic pub kafka, id: %v", topicInfo.TopicDetail.ID)
+	job := newBatchJob(model.JobUpdateTopicStatistic, MaintenanceOptions{}, func(ctx context.Context, ids []int64) map[int64]error {
+		failAll := func(err error) map[int64]error {
+			failed := make(map[int64]error, len(ids))
+			for _, id := range ids {
+				failed[id] = err
+			}
+			return failed
 		}
 
-		service.Log.Infof("[task] updateTopicStatistic current batch success, offset: %v, limit: %v, total: %v", offset, limit, total)
-
-		if total < limit {
-			service.Log.Infof("[task] updateTopicStatistic success")
-			break
+		latestMap, err := service.TopicStatisticsFromBI(ctx, ids)
+		if err != nil {
+			return failAll(err)
 		}
-
-		offset += limit
-	}
-
-	return nil
-}
-
-func (service *Service) InitTopicBitMap(ctx context.Context) error {
-	var offset, limit int64 = 0, 500
-	for {
-		topicInfoArr, total, err := dao.TiDBInstance.TopicList(ctx, "", []string{}, pb.TopicListReq_CREATED_AT, pb.TopicListReq_ASC,
-			offset, limit, nil, nil, pb.TopicListReq_NONE, false, "", true, pb.TopicListReq_ManualAudit_None, false)
+		storedMap, err := dao.TiDBInstance.TopicStatisticsByTopicIds(ctx, ids)
 		if err != nil {
-			service.Log.Errorf("[service] InitTopicBitMap dao.TiDBInstance.TopicList err: %v", err)
-			sentry.CaptureException(fmt.Errorf(
-				"[task] updateTopicStatistic fail, offset: %v, limit: %v, total: %v, err: %v", offset, limit, total, err))
-			break
+			return failAll(err)
 		}
 
-		// init bitmap
-		ids := make([]int64, 0)
-		for _, topicInfo := range topicInfoArr {
-			if topicInfo.TopicDetail != nil {
-				ids = append(ids, topicInfo.TopicDetail.ID)
+		changed := make([]*model.TopicStatistic, 0)
+		current := make(map[int64]*model.TopicStatistic, len(ids))
+		for _, id := range ids {
+			latest, ok := latestMap[id]
+			if !ok {
+				latest = &model.TopicStatistic{TopicID: id}
+			}
+			current[id] = latest
+			stored, ok := storedMap[id]
+			if !ok {
+				stored = &model.TopicStatistic{TopicID: id}
+			}
+			if latest.ContentNum != stored.ContentNum || latest.MpNum != stored.MpNum ||
+				latest.ContentExposureNum != stored.ContentExposureNum {
+				changed = append(changed, latest)
 			}
-		}
-		if err := dao.RedisInstance.SetBitTopics(ctx, ids); err != nil {
-			currErr := fmt.Errorf("[service] InitTopicBitMap dao.RedisInstance.SetBitTopics err: %v", err)
-			service.Log.Error(currErr)
-			sentry.CaptureException(currErr)
-			break
 		}
 
-		service.Log.Infof("[task] InitTopicBitMap current batch success, offset: %v, limit: %v, total: %v", offset, limit, total)
+		// refresh es
+		saveCtx := topicOutbox(ctx, outboxIndexNew, func(_, _ *model.TopicDetail) []*events.TopicEvent {
+			return nil
+		})
+		if err := dao.TiDBInstance.SaveTopicStatistics(saveCtx, changed); err != nil {
+			// 只有需要写入的话题失败，未变化的不重试
+			failed := make(map[int64]error, len(changed))
+			for _, topicStatistic := range changed {
+				failed[topicStatistic.TopicID] = err
+			}
+			return failed
+		}
+		service.Log.Debugf("[task] updateTopicStatistic changed: %v/%v", len(changed), len(ids))
 
-		if total < limit {
-			service.Log.Infof("[task] InitTopicBitMap success")
-			break
+		// 按当前值判断阈值，失败时下次刷新会重新检查，不计入失败条目
+		if err := service.evaluateAlerts(ctx, ruleArr, current); err != nil {
+			currErr := fmt.Errorf("[task] updateTopicStatistic evaluateAlerts err: %v", err)
+			service.Log.Error(currErr)
+			sentry.CaptureException(currErr)
 		}
+		return nil
+	})
+	// 断点限定在同一统计日，前一天未完成的断点不续跑
+	job.Filter.CreatedTo = todayZeroTime()
+	job.Scope = job.Filter.CreatedTo.Format("2006-01-02")
 
-		offset += limit
-	}
+	return service.runBatchJob(ctx, job)
+}
 
-	return nil
+// todayZeroTime 与原TopicList(withLatest)口径一致
+func todayZeroTime() time.Time {
+	t, _ := time.Parse("2006-01-02", time.Now().Format("2006-01-02"))
+	return t
 }
 
 func (service *Service) MustManualAudit(ctx context.Context, topics []string) ([]string, error) {
 	return dao.TiDBInstance.MustManualAudit(ctx, topics)
 }
 
+// UpdateTopicStatus 批量修正状态，仅对有变化的话题删缓存、发事件，并登记状态切换
 func (service *Service) UpdateTopicStatus(ctx context.Context) error {
-	topicDetailArr, err := dao.TiDBInstance.TopicDetailListForUpdateStatus(ctx)
-	if err != nil {
-		service.Log.Errorf("[service] UpdateTopicStatus dao.TiDBInstance.TopicDetailListForUpdateStatus err: %v", err)
-		sentry.CaptureException(fmt.Errorf("[task] UpdateTopicStatus fail, err: %v", err))
-		return err
-	}
-
-	for _, topicDetail := range topicDetailArr {
-		f := func() error {
-			// 获取详情
-			getTopicDetail, err := dao.TiDBInstance.GetTopicDetail(ctx, topicDetail.ID)
-			if err != nil {
-				service.Log.Errorf("[service] UpdateTopicStatus dao.TiDBInstance.GetTopicDetail err: %v", err)
-				sentry.CaptureException(fmt.Errorf("[task] UpdateTopicStatus fail, err: %v", err))
-				return err
-			}
-
-			// 更新状态
-			getTopicDetail.Status = func() pb.TopicDetail_TopicStatus {
-				if time.Now().Unix() < getTopicDetail.StartAt.Unix() {
-					return pb.TopicDetail_TopicStatus_NotStarted
-				} else if time.Now().Unix() > getTopicDetail.EndAt.Unix() {
-					return pb.TopicDetail_TopicStatus_Ended
-				} else {
-					return pb.TopicDetail_TopicStatus_InProcess
-				}
-			}()
-			if _, err := service.UpdateTopicWithoutLock(ctx, getTopicDetail); err != nil {
-				service.Log.Errorf("[service] UpdateTopicStatus service.UpdateTopicWithoutLock err: %v", err)
-				sentry.CaptureException(fmt.Errorf("[task] UpdateTopicStatus fail, err: %v", err))
-				return err
-			}
+	return service.RefreshTopicStatus(ctx, MaintenanceOptions{})
+}
 
-			return nil
-		}
+// afterTopicStatusChanged 批量删除缓存（含延时双删），事件已随状态更新登记到发件箱
+func (service *Service) afterTopicStatusChanged(changed []*model.TopicDetail) {
+	ctx := context.Background()
 
-		// lock
-		if err := dao.RedisInstance.LockWrap(ctx, model.GetKeyForLockTopic(topicDetail.ID), f); err != nil {
-			return err
-		}
+	keys := make([]string, 0, len(changed))
+	for _, topicDetail := range changed {
+		keys = append(keys, model.GetKeyForTopic(topicDetail.ID))
 	}
-
-	return nil
-}
-
-func (service *Service) FullUpdateTopicStatus(ctx context.Context) error {
-	topicDetailArr, err := dao.TiDBInstance.TopicDetailListForFullUpdateStatus(ctx)
-	if err != nil {
-		service.Log.Errorf("[service] FullUpdateTopicStatus dao.TiDBInstance.TopicDetailListForFullUpdateStatus err: %v", err)
-		sentry.CaptureException(fmt.Errorf("[task] FullUpdateTopicStatus fail, err: %v", err))
-		return err
+	if err := dao.RedisInstance.DelOrDefer(ctx, keys); err != nil {
+		service.Log.Errorf("[service] afterTopicStatusChanged dao.RedisInstance.DelOrDefer err: %v, count: %v", err, len(keys))
 	}
 
-	for _, topicDetail := range topicDetailArr {
-		f := func() error {
-			// 获取详情
-			getTopicDetail, err := dao.TiDBInstance.GetTopicDetail(ctx, topicDetail.ID)
-			if err != nil {
-				service.Log.Errorf("[service] FullUpdateTopicStatus dao.TiDBInstance.GetTopicDetail err: %v", err)
-				sentry.CaptureException(fmt.Errorf("[task] FullUpdateTopicStatus fail, err: %v", err))
-				return err
-			}
+	// 延时双删
+	go func() {
+		time.Sleep(200 * time.Millisecond)
 
-			// 更新状态
-			getTopicDetail.Status = func() pb.TopicDetail_TopicStatus {
-				if time.Now().Unix() < getTopicDetail.StartAt.Unix() {
-					return pb.TopicDetail_TopicStatus_NotStarted
-				} else if time.Now().Unix() > getTopicDetail.EndAt.Unix() {
-					return pb.TopicDetail_TopicStatus_Ended
-				} else {
-					return pb.TopicDetail_TopicStatus_InProcess
-				}
-			}()
-			if _, err := service.UpdateTopicWithoutLock(ctx, getTopicDetail); err != nil {
-				service.Log.Errorf("[service] FullUpdateTopicStatus service.UpdateTopicWithoutLock err: %v", err)
-				sentry.CaptureException(fmt.Errorf("[task] FullUpdateTopicStatus fail, err: %v", err))
-				return err
+		ddl := time.Now().Add(time.Duration(60) * time.Second)
+		for tries := 0; time.Now().Before(ddl); tries++ {
+			if err := dao.RedisInstance.DelOrDefer(ctx, keys); err != nil {
+				currErr := fmt.Errorf("[service] afterTopicStatusChanged 延时双删 dao.RedisInstance.DelOrDefer err: %v, count: %v",
+					err, len(keys))
+				service.Log.Error(currErr)
+				sentry.CaptureException(currErr)
+			} else {
+				return
 			}
 
-			return nil
-		}
-
-		// lock
-		if err := dao.RedisInstance.LockWrap(ctx, model.GetKeyForLockTopic(topicDetail.ID), f); err != nil {
-			return err
+			time.Sleep(time.Second << uint(tries))
 		}
-	}
-
-	return nil
+	}()
 }
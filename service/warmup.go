@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"time"
+)
+
+// WarmUpTopicCache 将进行中、即将开始的话题预热到redis，并主动刷新即将过期的缓存，避免大活动缓存过期时回源TiDB
+func (service *Service) WarmUpTopicCache(ctx context.Context) error {
+	if !dao.RedisInstance.Healthy() {
+		service.Log.Warnf("[task] WarmUpTopicCache skip, redis unavailable")
+		return dao.RedisUnavailableErr
+	}
+
+	soonStartAt := time.Now().Add(time.Duration(config.Cfg.WarmUpSoonStartHours) * time.Hour)
+	topicDetailArr, err := dao.TiDBInstance.TopicDetailListForWarmUp(ctx, soonStartAt, config.Cfg.WarmUpMaxTopics)
+	if err != nil {
+		currErr := fmt.Errorf("[task] WarmUpTopicCache dao.TiDBInstance.TopicDetailListForWarmUp err: %v", err)
+		service.Log.Error(currErr)
+		sentry.CaptureException(currErr)
+		return err
+	}
+
+	total := len(topicDetailArr)
+	batchSize := config.Cfg.WarmUpBatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	ratePerSec := config.Cfg.WarmUpRatePerSec
+	if ratePerSec <= 0 {
+		ratePerSec = 200
+	}
+	refreshAhead := time.Duration(config.Cfg.WarmUpRefreshAheadMin) * time.Minute
+	// 按每秒回源话题数限速，每个话题回源前取一个tick
+	ticker := time.NewTicker(time.Second / time.Duration(ratePerSec))
+	defer ticker.Stop()
+
+	var scanned, refreshed int
+	for start := 0; start < total; start += batchSize {
+		end := start + batchSize
+		if end > total {
+			end = total
+		}
+		ids := make([]int64, 0, end-start)
+		for _, topicDetail := range topicDetailArr[start:end] {
+			ids = append(ids, topicDetail.ID)
+		}
+
+		ttlMap, err := dao.RedisInstance.TTLTopics(ctx, ids)
+		if err != nil {
+			service.Log.Errorf("[task] WarmUpTopicCache dao.RedisInstance.TTLTopics err: %v", err)
+			return err
+		}
+		scanned += len(ids)
+
+		for _, id := range ids {
+			if ttlMap[id] >= refreshAhead {
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+
+			ok, err := service.refreshTopicCache(ctx, id)
+			if err != nil {
+				service.Log.Errorf("[task] WarmUpTopicCache refreshTopicCache err: %v, id: %v", err, id)
+				return err
+			}
+			if ok {
+				refreshed++
+				dao.AddJobProcessed(ctx, 1)
+			}
+		}
+
+		service.Log.Infof("[task] WarmUpTopicCache progress: %v/%v, refreshed: %v", scanned, total, refreshed)
+	}
+
+	service.Log.Infof("[task] WarmUpTopicCache success, total: %v, refreshed: %v", total, refreshed)
+
+	return nil
+}
+
+// refreshTopicCache 持有缓存击穿锁时从TiDB回源并覆盖写入redis，与读请求回源互斥
+// 锁被占用说明已有请求在回源，跳过并返回false
+func (service *Service) refreshTopicCache(ctx context.Context, id int64) (bool, error) {
+	h, err := dao.RedisInstance.Acquire(ctx, model.GetKeyForLockTopicForGetsByTiDB(id), dao.LockOptions{
+		TTL: time.Duration(config.Cfg.RedisLockExpirationSec) * time.Second,
+	})
+	if err != nil {
+		if errors.Is(err, dao.LockNotAcquiredErr) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer func() {
+		if unLockErr := dao.RedisInstance.Release(ctx, h); unLockErr != nil {
+			service.Log.Errorf("[task] refreshTopicCache Release err: %v, id: %v", unLockErr, id)
+		}
+	}()
+
+	topicInfosTiDB, err := dao.TiDBInstance.GetTopicByIds(ctx, []int64{id}, false, "")
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	topicInfosTiDBArr := make([]*model.TopicInfo, 0, len(topicInfosTiDB))
+	for _, v := range topicInfosTiDB {
+		topicInfosTiDBArr = append(topicInfosTiDBArr, v)
+	}
+
+	return true, dao.RedisInstance.SetTopics(ctx, topicInfosTiDBArr)
+}
+
+func isNotFound(err error) bool {
+	var internalError *common.InternalError
+	return errors.As(err, &internalError) && internalError.ErrCode == int32(pb.GetTopicByIdsResp_NOT_FOUND)
+}
@@ -0,0 +1,399 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	pb "dm-gitlab.bolo.me/hubpd/proto/topic_grpc"
+	"dm-gitlab.bolo.me/hubpd/topic/common"
+	"dm-gitlab.bolo.me/hubpd/topic/config"
+	"dm-gitlab.bolo.me/hubpd/topic/dao"
+	"dm-gitlab.bolo.me/hubpd/topic/events"
+	"dm-gitlab.bolo.me/hubpd/topic/model"
+	"dm-gitlab.bolo.me/hubpd/topic/webhook"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webhookPayload 投递内容，EventID与话题领域事件一致
+type webhookPayload struct {
+	EventID       string                `json:"eventId"`
+	Type          string                `json:"type"`
+	OccurredAt    time.Time             `json:"occurredAt"`
+	TopicID       int64                 `json:"topicId"`
+	Topic         *events.TopicSnapshot `json:"topic"`
+	ChangedFields []string              `json:"changedFields,omitempty"`
+}
+
+// webhookEventType 话题领域事件对应的webhook事件，不需要通知时返回空
+// 定时切换状态时只有status变化，只通知TopicStarted、TopicEnded，不再通知TopicUpdated
+func webhookEventType(ev *events.TopicEvent) string {
+	switch ev.Type {
+	case events.TypeTopicUpdated:
+		for _, field := range ev.ChangedFields {
+			if field != "status" {
+				return model.WebhookEventTopicUpdated
+			}
+		}
+	case events.TypeTopicStatusChanged:
+		if ev.After == nil {
+			return ""
+		}
+		switch pb.TopicDetail_TopicStatus(ev.After.Status) {
+		case pb.TopicDetail_TopicStatus_InProcess:
+			return model.WebhookEventTopicStarted
+		case pb.TopicDetail_TopicStatus_Ended:
+			return model.WebhookEventTopicEnded
+		}
+	}
+	return ""
+}
+
+// validateWebhookSubscription 校验订阅，url须在WebhookAllowedHosts内
+func validateWebhookSubscription(subscription *model.WebhookSubscription, invalidCode int32) error {
+	invalid := func(msg string) error {
+		return &common.InternalError{ErrCode: invalidCode, ErrMsg: msg}
+	}
+
+	u, err := url.Parse(subscription.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return invalid("url须为http或https地址")
+	}
+	if !webhook.HostAllowed(subscription.URL, config.Cfg.WebhookAllowedHosts) {
+		return invalid(fmt.Sprintf("url域名不在允许范围内：%v", u.Hostname()))
+	}
+	if subscription.EventTypes == "" {
+		return invalid("eventTypes不能为空")
+	}
+	for _, eventType := range strings.Split(subscription.EventTypes, ",") {
+		known := false
+		for _, v := range model.WebhookEvents {
+			if v == eventType {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return invalid(fmt.Sprintf("未知的事件类型：%v", eventType))
+		}
+	}
+
+	return nil
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// webhookSecretKey 签名密钥的加密密钥，未配置时不能创建、修改订阅，也不能投递
+func webhookSecretKey() ([]byte, error) {
+	key, err := hex.DecodeString(config.Cfg.WebhookSecretKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("WebhookSecretKey未配置或不是hex编码的32字节密钥")
+	}
+	return key, nil
+}
+
+// sealWebhookSecret 加密后保存
+func sealWebhookSecret(secret string) (string, error) {
+	key, err := webhookSecretKey()
+	if err != nil {
+		return "", err
+	}
+	return webhook.SealSecret(key, secret)
+}
+
+// CreateWebhookSubscription 未指定secret时生成，返回明文secret，仅在创建时返回
+func (service *Service) CreateWebhookSubscription(ctx context.Context, subscription *model.WebhookSubscription) (string, error) {
+	if err := validateWebhookSubscription(subscription,
+		int32(pb.CreateWebhookSubscriptionResp_INVALID_ARGUMENT)); err != nil {
+		return "", err
+	}
+	secret := subscription.Secret
+	if secret == "" {
+		var err error
+		if secret, err = newWebhookSecret(); err != nil {
+			return "", err
+		}
+	}
+	sealed, err := sealWebhookSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	subscription.Secret = sealed
+
+	if err := dao.TiDBInstance.CreateWebhookSubscription(ctx, subscription); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// UpdateWebhookSubscription 只更新fields指定的字段，fields为空时更新全部字段；secret为空时保留原值
+func (service *Service) UpdateWebhookSubscription(ctx context.Context,
+	subscription *model.WebhookSubscription, fields []string) error {
+	notFound := &common.InternalError{
+		ErrCode: int32(pb.UpdateWebhookSubscriptionResp_NOT_FOUND),
+		ErrMsg:  "订阅不存在",
+	}
+	current, err := dao.TiDBInstance.GetWebhookSubscription(ctx, subscription.ID)
+	if err != nil {
+		if dao.IsNotFound(err) {
+			return notFound
+		}
+		return err
+	}
+
+	merged := current.WithFields(subscription, fields)
+	if err := validateWebhookSubscription(merged,
+		int32(pb.UpdateWebhookSubscriptionResp_INVALID_ARGUMENT)); err != nil {
+		return err
+	}
+	if merged.Secret == "" {
+		merged.Secret = current.Secret
+	} else if merged.Secret != current.Secret {
+		if merged.Secret, err = sealWebhookSecret(merged.Secret); err != nil {
+			return err
+		}
+	}
+
+	rowsAffected, err := dao.TiDBInstance.UpdateWebhookSubscription(ctx, merged)
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		if _, err := dao.TiDBInstance.GetWebhookSubscription(ctx, subscription.ID); dao.IsNotFound(err) {
+			return notFound
+		}
+	}
+
+	return nil
+}
+
+func (service *Service) DelWebhookSubscription(ctx context.Context, id int64) error {
+	rowsAffected, err := dao.TiDBInstance.DelWebhookSubscription(ctx, id)
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return &common.InternalError{
+			ErrCode: int32(pb.DelWebhookSubscriptionResp_NOT_FOUND),
+			ErrMsg:  "订阅不存在",
+		}
+	}
+
+	return nil
+}
+
+func (service *Service) ListWebhookSubscriptions(ctx context.Context) ([]*model.WebhookSubscription, error) {
+	return dao.TiDBInstance.WebhookSubscriptionList(ctx, false)
+}
+
+func (service *Service) ListWebhookDeliveries(ctx context.Context,
+	subscriptionID int64, status string, offset, limit int64) ([]*model.WebhookDelivery, int64, error) {
+	if limit <= 0 {
+		limit = 20
+	}
+	return dao.TiDBInstance.WebhookDeliveryList(ctx, subscriptionID, status, offset, limit)
+}
+
+// RedeliverWebhook 重新投递，含已成功的记录
+func (service *Service) RedeliverWebhook(ctx context.Context, id int64) error {
+	rowsAffected, err := dao.TiDBInstance.RedeliverWebhookDelivery(ctx, id)
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return &common.InternalError{
+			ErrCode: int32(pb.RedeliverWebhookResp_NOT_FOUND),
+			ErrMsg:  "投递记录不存在",
+		}
+	}
+	service.Log.Infof("[service] RedeliverWebhook success, delivery: %v", id)
+
+	return nil
+}
+
+// webhookDeliveries 为订阅了领域事件的订阅生成投递记录，在发件箱事务内调用
+func webhookDeliveries(outboxEvents []*model.OutboxEvent,
+	subscriptionArr []*model.WebhookSubscription) ([]*model.WebhookDelivery, error) {
+	now := time.Now()
+	deliveryArr := make([]*model.WebhookDelivery, 0)
+	for _, outboxEvent := range outboxEvents {
+		if outboxEvent.Kind != model.OutboxKindDomain {
+			continue
+		}
+		ev := &events.TopicEvent{}
+		if err := json.Unmarshal([]byte(outboxEvent.Payload), ev); err != nil {
+			return nil, err
+		}
+		eventType := webhookEventType(ev)
+		if eventType == "" {
+			continue
+		}
+
+		payload, err := json.Marshal(&webhookPayload{
+			EventID:       ev.EventID,
+			Type:          eventType,
+			OccurredAt:    ev.OccurredAt,
+			TopicID:       ev.TopicID,
+			Topic:         ev.After,
+			ChangedFields: ev.ChangedFields,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, subscription := range subscriptionArr {
+			if !subscription.Subscribes(eventType) {
+				continue
+			}
+			deliveryArr = append(deliveryArr, &model.WebhookDelivery{
+				SubscriptionID: subscription.ID,
+				EventID:        ev.EventID,
+				EventType:      eventType,
+				TopicID:        ev.TopicID,
+				Payload:        string(payload),
+				Status:         model.WebhookDeliveryStatusPending,
+				NextAttemptAt:  now,
+			})
+		}
+	}
+	return deliveryArr, nil
+}
+
+// RunWebhookDelivery 投递到期的webhook，各副本均可投递，通过占用记录避免重复
+// 每批最多WebhookWorkers个并发投递，整批完成后再取下一批
+func (service *Service) RunWebhookDelivery(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(config.Cfg.WebhookPollMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	workers := config.Cfg.WebhookWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deliveryArr, err := dao.TiDBInstance.DueWebhookDeliveries(ctx, time.Now(), config.Cfg.WebhookBatchSize)
+		if err != nil || len(deliveryArr) == 0 {
+			continue
+		}
+		// 含已停用的订阅，投递时据此标记失败；各协程只读
+		subscriptionArr, err := dao.TiDBInstance.WebhookSubscriptionList(ctx, false)
+		if err != nil {
+			continue
+		}
+		subscriptionMap := make(map[int64]*model.WebhookSubscription, len(subscriptionArr))
+		for _, subscription := range subscriptionArr {
+			subscriptionMap[subscription.ID] = subscription
+		}
+
+		sem := make(chan struct{}, workers)
+		sw := sync.WaitGroup{}
+		for _, delivery := range deliveryArr {
+			if ctx.Err() != nil {
+				break
+			}
+			sem <- struct{}{}
+			sw.Add(1)
+			go func(delivery *model.WebhookDelivery) {
+				defer func() {
+					<-sem
+					sw.Done()
+				}()
+				service.deliverWebhook(ctx, delivery, subscriptionMap[delivery.SubscriptionID])
+			}(delivery)
+		}
+		sw.Wait()
+	}
+}
+
+// deliverWebhook subscription为nil表示订阅已删除
+func (service *Service) deliverWebhook(ctx context.Context,
+	delivery *model.WebhookDelivery, subscription *model.WebhookSubscription) {
+	timeout := time.Duration(config.Cfg.WebhookTimeoutSec) * time.Second
+	// 占用期间其他副本不会投递，超过占用时间未完成时可被重新投递
+	claimed, err := dao.TiDBInstance.ClaimWebhookDelivery(ctx, delivery, time.Now().Add(2*timeout))
+	if err != nil || !claimed {
+		return
+	}
+
+	delivery.Attempts++
+	if subscription == nil || !subscription.Enabled {
+		delivery.Status, delivery.Err = model.WebhookDeliveryStatusFailed, "subscription deleted or disabled"
+	} else if !webhook.HostAllowed(subscription.URL, config.Cfg.WebhookAllowedHosts) {
+		// 订阅创建后收紧了白名单
+		delivery.Status, delivery.Err = model.WebhookDeliveryStatusFailed, "url host not allowed"
+	} else if secret, openErr := service.openWebhookSecret(subscription); openErr != nil {
+		delivery.Status, delivery.Err = model.WebhookDeliveryStatusFailed, openErr.Error()
+	} else {
+		deliverCtx, cancel := context.WithTimeout(ctx, timeout)
+		delivery.ResponseCode, err = service.Webhook.Deliver(deliverCtx, &webhook.Request{
+			URL:        subscription.URL,
+			Secret:     secret,
+			DeliveryID: delivery.ID,
+			EventID:    delivery.EventID,
+			EventType:  delivery.EventType,
+			Payload:    []byte(delivery.Payload),
+		})
+		cancel()
+
+		switch {
+		case err == nil:
+			now := time.Now()
+			delivery.Status, delivery.Err, delivery.DeliveredAt = model.WebhookDeliveryStatusSucceeded, "", &now
+		case delivery.Attempts >= config.Cfg.WebhookMaxAttempts:
+			delivery.Status, delivery.Err = model.WebhookDeliveryStatusFailed, err.Error()
+			currErr := fmt.Errorf("[service] deliverWebhook give up, delivery: %v, url: %v, attempts: %v, err: %v",
+				delivery.ID, subscription.URL, delivery.Attempts, err)
+			service.Log.Error(currErr)
+			sentry.CaptureException(currErr)
+		default:
+			delivery.Err, delivery.NextAttemptAt = err.Error(), time.Now().Add(webhookBackoff(delivery.Attempts))
+			service.Log.Warnf("[service] deliverWebhook err: %v, delivery: %v, attempts: %v, next: %v",
+				err, delivery.ID, delivery.Attempts, delivery.NextAttemptAt)
+		}
+	}
+
+	_ = dao.TiDBInstance.FinishWebhookDeliveryAttempt(context.Background(), delivery)
+}
+
+func (service *Service) openWebhookSecret(subscription *model.WebhookSubscription) (string, error) {
+	key, err := webhookSecretKey()
+	if err == nil {
+		var secret string
+		if secret, err = webhook.OpenSecret(key, subscription.Secret); err == nil {
+			return secret, nil
+		}
+	}
+	currErr := fmt.Errorf("[service] openWebhookSecret err: %v, subscription: %v", err, subscription.ID)
+	service.Log.Error(currErr)
+	sentry.CaptureException(currErr)
+	return "", err
+}
+
+// webhookBackoff 按失败次数指数退避，不超过WebhookRetryMaxSec
+func webhookBackoff(attempts int) time.Duration {
+	base := time.Duration(config.Cfg.WebhookRetryBaseSec) * time.Second
+	max := time.Duration(config.Cfg.WebhookRetryMaxSec) * time.Second
+	if attempts > 30 {
+		return max
+	}
+	if d := base << uint(attempts-1); d > 0 && d < max {
+		return d
+	}
+	return max
+}
@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// sealedPrefix 加密后的签名密钥前缀，便于日后更换算法
+const sealedPrefix = "v1:"
+
+var InvalidSealedSecretErr = errors.New("invalid sealed secret")
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealSecret AES-GCM加密签名密钥，key为16、24或32字节
+func SealSecret(key []byte, secret string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenSecret 解密SealSecret的结果
+func OpenSecret(key []byte, sealed string) (string, error) {
+	if !strings.HasPrefix(sealed, sealedPrefix) {
+		return "", InvalidSealedSecretErr
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	if err != nil {
+		return "", InvalidSealedSecretErr
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < gcm.NonceSize() {
+		return "", InvalidSealedSecretErr
+	}
+	secret, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", InvalidSealedSecretErr
+	}
+	return string(secret), nil
+}
+
+// HostAllowed rawURL的域名与allowed中的某项相同或为其子域名，allowed为空时均不允许
+func HostAllowed(rawURL string, allowed []string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return false
+	}
+	for _, v := range allowed {
+		v = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(v), "."))
+		if v == "" {
+			continue
+		}
+		if host == v || strings.HasSuffix(host, "."+v) {
+			return true
+		}
+	}
+	return false
+}
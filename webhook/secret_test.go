@@ -0,0 +1,54 @@
+package webhook
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealSecret(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	sealed, err := SealSecret(key, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed == "s3cret" {
+		t.Fatalf("secret not sealed")
+	}
+
+	got, err := OpenSecret(key, sealed)
+	if err != nil || got != "s3cret" {
+		t.Errorf("OpenSecret() = %v, %v", got, err)
+	}
+	if _, err := OpenSecret(bytes.Repeat([]byte{2}, 32), sealed); err == nil {
+		t.Errorf("OpenSecret() with other key succeeded")
+	}
+	if _, err := OpenSecret(key, "s3cret"); err != InvalidSealedSecretErr {
+		t.Errorf("OpenSecret() plaintext err = %v", err)
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	allowed := []string{"hooks.example.com", ".partner.com"}
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://hooks.example.com/topic", true},
+		{"https://HOOKS.example.com:8443/topic", true},
+		{"https://a.partner.com/topic", true},
+		{"https://partner.com/topic", true},
+		{"https://evilpartner.com/topic", false},
+		{"https://example.com/topic", false},
+		{"http://127.0.0.1/topic", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"https://hooks.example.com.evil.com/topic", false},
+	}
+	for _, tt := range tests {
+		if got := HostAllowed(tt.url, allowed); got != tt.want {
+			t.Errorf("HostAllowed(%v) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+	if HostAllowed("https://hooks.example.com/topic", nil) {
+		t.Errorf("HostAllowed() with empty allow-list = true")
+	}
+}
@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	HeaderSignature = "X-Topic-Signature" // sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+	HeaderTimestamp = "X-Topic-Timestamp" // unix秒，接收方可据此拒绝过旧的请求
+	HeaderEvent     = "X-Topic-Event"
+	HeaderEventID   = "X-Topic-Event-Id" // 重投时不变，接收方据此去重
+	HeaderDelivery  = "X-Topic-Delivery"
+)
+
+// Request 一次投递的内容
+type Request struct {
+	URL        string
+	Secret     string
+	DeliveryID int64
+	EventID    string
+	EventType  string
+	Payload    []byte
+}
+
+// Sign 签名内容为timestamp + "." + body
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify 接收方校验签名
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+type Client struct {
+	HTTP *http.Client
+}
+
+// NewClient 不跟随重定向，避免绕过域名白名单
+func NewClient(timeout time.Duration) *Client {
+	return &Client{HTTP: &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// Deliver 响应2xx为成功，返回响应码，未收到响应时为0
+func (c *Client) Deliver(ctx context.Context, req *Request) (int, error) {
+	httpReq, err := http.NewRequest(http.MethodPost, req.URL, bytes.NewReader(req.Payload))
+	if err != nil {
+		return 0, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+
+	timestamp := time.Now().Unix()
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(HeaderSignature, Sign(req.Secret, timestamp, req.Payload))
+	httpReq.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	httpReq.Header.Set(HeaderEvent, req.EventType)
+	httpReq.Header.Set(HeaderEventID, req.EventID)
+	httpReq.Header.Set(HeaderDelivery, strconv.FormatInt(req.DeliveryID, 10))
+
+	resp, err := c.HTTP.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// 读完响应体以复用连接
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %v", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
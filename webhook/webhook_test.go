@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClient_Deliver(t *testing.T) {
+	const secret = "s3cret"
+	payload := []byte(`{"type":"TopicStarted","topicId":1}`)
+
+	tests := []struct {
+		name     string
+		status   int
+		wantCode int
+		wantErr  bool
+	}{
+		{"ok", http.StatusNoContent, http.StatusNoContent, false},
+		{"server error", http.StatusInternalServerError, http.StatusInternalServerError, true},
+		{"client error", http.StatusBadRequest, http.StatusBadRequest, true},
+		{"redirect", http.StatusFound, http.StatusFound, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+				if err != nil {
+					t.Errorf("invalid timestamp header: %v", r.Header.Get(HeaderTimestamp))
+				}
+				if !Verify(secret, timestamp, body, r.Header.Get(HeaderSignature)) {
+					t.Errorf("signature mismatch")
+				}
+				if got := r.Header.Get(HeaderEvent); got != "TopicStarted" {
+					t.Errorf("event header = %v", got)
+				}
+				if got := r.Header.Get(HeaderEventID); got != "ev-1" {
+					t.Errorf("event id header = %v", got)
+				}
+				if got := r.Header.Get(HeaderDelivery); got != "7" {
+					t.Errorf("delivery header = %v", got)
+				}
+				if string(body) != string(payload) {
+					t.Errorf("body = %s", body)
+				}
+				// 跟随重定向时会以GET再次请求，签名校验失败
+				w.Header().Set("Location", "/redirected")
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			code, err := NewClient(time.Second).Deliver(context.Background(), &Request{
+				URL:        server.URL,
+				Secret:     secret,
+				DeliveryID: 7,
+				EventID:    "ev-1",
+				EventType:  "TopicStarted",
+				Payload:    payload,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Deliver() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if code != tt.wantCode {
+				t.Errorf("Deliver() code = %v, want %v", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte("{}")
+	signature := Sign("a", 100, body)
+	if !Verify("a", 100, body, signature) {
+		t.Errorf("Verify() = false, want true")
+	}
+	if Verify("b", 100, body, signature) {
+		t.Errorf("Verify() with other secret = true, want false")
+	}
+	if Verify("a", 101, body, signature) {
+		t.Errorf("Verify() with other timestamp = true, want false")
+	}
+}